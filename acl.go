@@ -0,0 +1,282 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACL is an access control list for the proxy requests. Each rule is a line of
+// 'allow|deny actions clients hosts [ports]', such as 'deny tcp 10.0.0.0/8 .example.com 80,443',
+// the actions are the comma separated request types (tcp, udp, rtcp, rudp),
+// the clients are the IP addresses or CIDRs of the clients, or the identities of the client certificates
+// verified by the TLS based transports with the prefix 'id:', such as 'id:node1' or 'id:*.mesh.local',
+// the hosts are the destination patterns (IP, CIDR, domain, '.example.com' or '*.example.com'),
+// '*' matches any of them. The first matched rule decides, the request matching no rule
+// is allowed unless the line 'default deny' is present.
+type ACL struct {
+	rules   []aclRule
+	deny    bool
+	period  time.Duration
+	stopped chan struct{}
+	mux     sync.RWMutex
+}
+
+type aclRule struct {
+	allow   bool
+	actions map[string]bool
+	clients []Matcher
+	ids     []Matcher // the client identities
+	hosts   []Matcher
+	ipHosts bool // the hosts have IP or CIDR patterns
+	ports   *PortSet
+}
+
+func (r *aclRule) match(action, client string, ids []string, host string, port int, resolve func() []net.IP) bool {
+	if r.actions != nil && !r.actions[action] {
+		return false
+	}
+	if (r.clients != nil || r.ids != nil) && !r.matchClient(client, ids) {
+		return false
+	}
+	if r.ports != nil && !r.ports.Contains(port) {
+		return false
+	}
+	return r.hosts == nil || r.matchHost(host, resolve)
+}
+
+// matchHost matches the host, the IP and CIDR patterns are also matched against the resolved addresses of the domain name.
+func (r *aclRule) matchHost(host string, resolve func() []net.IP) bool {
+	if matchAny(r.hosts, host) {
+		return true
+	}
+	if !r.ipHosts || resolve == nil || net.ParseIP(host) != nil {
+		return false
+	}
+	for _, ip := range resolve() {
+		if matchAny(r.hosts, ip.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *aclRule) matchClient(client string, ids []string) bool {
+	if matchAny(r.clients, client) {
+		return true
+	}
+	for _, id := range ids {
+		if matchAny(r.ids, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(matchers []Matcher, v string) bool {
+	for _, m := range matchers {
+		if m != nil && m.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewACL creates an empty ACL which allows all requests.
+func NewACL() *ACL {
+	return &ACL{
+		stopped: make(chan struct{}),
+	}
+}
+
+// Allow reports whether the request of action from the client address to the target addr is allowed,
+// ids are the identities of the client, see PeerIdentities.
+// The domain name of addr is not resolved, use AllowResolve to match it by the IP and CIDR rules.
+func (acl *ACL) Allow(action, client, addr string, ids ...string) bool {
+	return acl.AllowResolve(action, client, addr, nil, ids...)
+}
+
+// AllowResolve is like Allow, but the IP and CIDR hosts of the rules are also matched against
+// the addresses of the domain name of addr returned by resolve, it is only called when such a rule is checked.
+func (acl *ACL) AllowResolve(action, client, addr string, resolve func() []net.IP, ids ...string) bool {
+	if acl == nil {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(sport)
+
+	// the rules are replaced as a whole on reload, so they are matched without holding the lock while resolving.
+	acl.mux.RLock()
+	rules, deny := acl.rules, acl.deny
+	acl.mux.RUnlock()
+
+	for i := range rules {
+		if rules[i].match(action, client, ids, host, port, resolve) {
+			return rules[i].allow
+		}
+	}
+	return !deny
+}
+
+func parseACLRule(ss []string) (rule aclRule, err error) {
+	switch ss[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("invalid rule %s", ss[0])
+	}
+	if len(ss) < 4 {
+		return rule, fmt.Errorf("invalid rule %s", strings.Join(ss, " "))
+	}
+
+	if ss[1] != "*" {
+		rule.actions = make(map[string]bool)
+		for _, s := range strings.Split(ss[1], ",") {
+			rule.actions[strings.ToLower(strings.TrimSpace(s))] = true
+		}
+	}
+	if ss[2] != "*" {
+		for _, pattern := range strings.Split(ss[2], ",") {
+			pattern = strings.TrimSpace(pattern)
+			if strings.HasPrefix(pattern, "id:") {
+				if m := NewMatcher(pattern[3:]); m != nil {
+					rule.ids = append(rule.ids, m)
+				}
+			} else if m := NewMatcher(pattern); m != nil {
+				rule.clients = append(rule.clients, m)
+			}
+		}
+	}
+	rule.hosts = parseACLMatchers(ss[3])
+	for _, m := range rule.hosts {
+		switch m.(type) {
+		case *ipMatcher, *cidrMatcher:
+			rule.ipHosts = true
+		}
+	}
+	if len(ss) > 4 && ss[4] != "*" {
+		if rule.ports, err = ParsePortSet(ss[4]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func parseACLMatchers(s string) (matchers []Matcher) {
+	if s == "*" {
+		return nil
+	}
+	for _, pattern := range strings.Split(s, ",") {
+		if m := NewMatcher(strings.TrimSpace(pattern)); m != nil {
+			matchers = append(matchers, m)
+		}
+	}
+	return
+}
+
+// Reload parses config from r, then live reloads the ACL.
+func (acl *ACL) Reload(r io.Reader) error {
+	var rules []aclRule
+	var deny bool
+	var period time.Duration
+
+	if r == nil || acl.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ss := splitLine(scanner.Text())
+		if len(ss) == 0 {
+			continue
+		}
+		switch ss[0] {
+		case "reload": // reload option
+			if len(ss) > 1 {
+				period, _ = time.ParseDuration(ss[1])
+			}
+		case "default": // default policy
+			if len(ss) > 1 {
+				deny = ss[1] == "deny"
+			}
+		default:
+			rule, err := parseACLRule(ss)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	acl.mux.Lock()
+	defer acl.mux.Unlock()
+
+	acl.rules = rules
+	acl.deny = deny
+	acl.period = period
+
+	return nil
+}
+
+// Period returns the reload period.
+func (acl *ACL) Period() time.Duration {
+	if acl.Stopped() {
+		return -1
+	}
+
+	acl.mux.RLock()
+	defer acl.mux.RUnlock()
+
+	return acl.period
+}
+
+// Stop stops reloading.
+func (acl *ACL) Stop() {
+	select {
+	case <-acl.stopped:
+	default:
+		close(acl.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (acl *ACL) Stopped() bool {
+	select {
+	case <-acl.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (acl *ACL) String() string {
+	acl.mux.RLock()
+	n, policy := len(acl.rules), "allow"
+	if acl.deny {
+		policy = "deny"
+	}
+	acl.mux.RUnlock()
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "reload: %v\n", acl.Period())
+	fmt.Fprintf(b, "default: %s\n", policy)
+	fmt.Fprintf(b, "rules: %d\n", n)
+	return b.String()
+}
@@ -0,0 +1,229 @@
+package gost
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+var aclData = `
+reload 10s
+default deny
+
+deny  *       192.168.1.100  *                      # banned client
+allow tcp     *              example.com            80,443
+allow tcp     *              .example.org           *
+deny  tcp     *              *.example.net
+allow tcp,udp 192.168.1.0/24 *                      53
+allow rtcp    10.0.0.0/8     *                      8000-9000
+allow *       127.0.0.1      10.0.0.0/8
+`
+
+var aclTests = []struct {
+	action string
+	client string
+	addr   string
+	allow  bool
+}{
+	{"tcp", "1.2.3.4:1000", "example.com:80", true},
+	{"tcp", "1.2.3.4:1000", "example.com:8080", false},
+	{"tcp", "1.2.3.4:1000", "www.example.com:80", false},
+	{"udp", "1.2.3.4:1000", "example.com:80", false},
+	{"tcp", "192.168.1.100:1000", "example.com:80", false},
+	{"tcp", "1.2.3.4:1000", "example.org:22", true},
+	{"tcp", "1.2.3.4:1000", "a.b.example.org:22", true},
+	{"tcp", "192.168.1.1:1000", "www.example.net:53", false},
+	{"tcp", "192.168.1.1:1000", "example.net:53", true},
+	{"udp", "192.168.1.1:1000", "8.8.8.8:53", true},
+	{"udp", "192.168.2.1:1000", "8.8.8.8:53", false},
+	{"rtcp", "10.1.2.3:1000", ":8080", true},
+	{"rtcp", "10.1.2.3:1000", ":80", false},
+	{"rudp", "127.0.0.1:1000", "10.1.1.1:80", true},
+	{"rudp", "127.0.0.1:1000", "11.1.1.1:80", false},
+	{"tcp", "1.2.3.4", "example.com:443", true},
+}
+
+func TestACLAllow(t *testing.T) {
+	var acl *ACL
+	if !acl.Allow("tcp", "1.2.3.4:1000", "example.com:80") {
+		t.Error("nil ACL should allow all requests")
+	}
+
+	acl = NewACL()
+	if !acl.Allow("tcp", "1.2.3.4:1000", "example.com:80") {
+		t.Error("empty ACL should allow all requests")
+	}
+	if err := acl.Reload(strings.NewReader(aclData)); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Period() != 10*time.Second {
+		t.Errorf("reload period should be 10s, got %v", acl.Period())
+	}
+	for i, tc := range aclTests {
+		if allow := acl.Allow(tc.action, tc.client, tc.addr); allow != tc.allow {
+			t.Errorf("#%d %s %s -> %s: should be %v, got %v", i, tc.action, tc.client, tc.addr, tc.allow, allow)
+		}
+	}
+
+	if err := acl.Reload(bytes.NewBufferString("permit * * *")); err == nil {
+		t.Error("invalid rule should fail")
+	}
+	if acl.Allow("tcp", "1.2.3.4:1000", "example.com:8080") {
+		t.Error("failed reload should keep the rules")
+	}
+
+	acl.Stop()
+	if acl.Period() >= 0 {
+		t.Error("period of the stopped ACL should be negative")
+	}
+}
+
+func TestSOCKS5ACL(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	acl := NewACL()
+	if err := acl.Reload(strings.NewReader("deny tcp * * " + port)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+	sln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Handler:  SOCKS5Handler(ACLHandlerOption(acl)),
+		Listener: sln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := proxyConn(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	_, err = client.Connect(conn, ln.Addr().String())
+	if re, ok := err.(*ReplyError); !ok || re.Code != int(gosocks5.NotAllowed) {
+		t.Errorf("should be not allowed, got %v", err)
+	}
+}
+
+func TestACLIdentity(t *testing.T) {
+	acl := NewACL()
+	if err := acl.Reload(strings.NewReader("default deny\nallow tcp 10.0.0.1,id:*.mesh *\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allow("tcp", "10.0.0.1:1000", "example.com:80") {
+		t.Error("the client address should be matched")
+	}
+	if !acl.Allow("tcp", "1.2.3.4:1000", "example.com:80", "node1", "node1.mesh") {
+		t.Error("any identity of the client should be matched")
+	}
+	if acl.Allow("tcp", "1.2.3.4:1000", "example.com:80", "node1", "10.0.0.1") {
+		t.Error("the identities should not match the client addresses")
+	}
+	if acl.Allow("tcp", "1.2.3.4:1000", "example.com:80") {
+		t.Error("the client without identities should be denied")
+	}
+}
+
+func TestACLAllowResolve(t *testing.T) {
+	acl := NewACL()
+	if err := acl.Reload(strings.NewReader("deny tcp * 10.0.0.0/8,::1 80\ndeny tcp * .example.org *\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	resolve := func(ips ...string) func() []net.IP {
+		return func() []net.IP {
+			n++
+			var v []net.IP
+			for _, ip := range ips {
+				v = append(v, net.ParseIP(ip))
+			}
+			return v
+		}
+	}
+	for i, tc := range []struct {
+		addr    string
+		resolve func() []net.IP
+		allow   bool
+	}{
+		{"internal.example.com:80", nil, true},
+		{"internal.example.com:80", resolve("10.1.2.3"), false},
+		{"internal.example.com:80", resolve("192.168.1.1", "::1"), false},
+		{"internal.example.com:80", resolve("192.168.1.1"), true},
+		{"internal.example.com:443", resolve("10.1.2.3"), true},
+		{"10.1.2.3:80", resolve("192.168.1.1"), false},
+		{"www.example.org:80", resolve("192.168.1.1"), false},
+	} {
+		if allow := acl.AllowResolve("tcp", "1.2.3.4:1000", tc.addr, tc.resolve); allow != tc.allow {
+			t.Errorf("#%d %s: should be %v, got %v", i, tc.addr, tc.allow, allow)
+		}
+	}
+	// the addresses are resolved only for the domain names checked by the CIDR rule of the port.
+	if n != 4 {
+		t.Errorf("the domain name should be resolved 4 times, got %d", n)
+	}
+}
+
+func TestSOCKS5ACLResolve(t *testing.T) {
+	ln := mustTCPListener(t)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	acl := NewACL()
+	if err := acl.Reload(strings.NewReader("deny tcp * 127.0.0.0/8 *")); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+	server := &Server{
+		Handler: SOCKS5Handler(
+			ACLHandlerOption(acl),
+			HostsHandlerOption(NewHosts(NewHost(net.ParseIP("127.0.0.1"), "internal.test"))),
+		),
+		Listener: mustTCPListener(t),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := proxyConn(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	_, err = client.Connect(conn, net.JoinHostPort("internal.test", port))
+	if re, ok := err.(*ReplyError); !ok || re.Code != int(gosocks5.NotAllowed) {
+		t.Errorf("the domain name resolved to the denied address should be not allowed, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AdminNode is the health status of a node of the chain used by a service.
+type AdminNode struct {
+	Service   string    `json:"service"`
+	Hop       int       `json:"hop"` // the index of the node group in the chain
+	ID        int       `json:"id"`
+	Addr      string    `json:"addr"`
+	Alive     bool      `json:"alive"`
+	Conns     int64     `json:"conns"`
+	Fails     uint64    `json:"fails"`
+	FailCount uint32    `json:"fail_count"`
+	FailTime  time.Time `json:"fail_time"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+}
+
+func adminNodes(metrics *Metrics) []AdminNode {
+	chains := metrics.Chains()
+	names := make([]string, 0, len(chains))
+	for name := range chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodes := []AdminNode{}
+	for _, name := range names {
+		for hop, group := range chains[name].NodeGroups() {
+			for _, st := range group.Stats() {
+				nodes = append(nodes, AdminNode{
+					Service:   name,
+					Hop:       hop,
+					ID:        st.ID,
+					Addr:      st.Addr,
+					Alive:     st.Alive,
+					Conns:     st.Conns,
+					Fails:     st.Fails,
+					FailCount: st.FailCount,
+					FailTime:  st.FailTime,
+					BytesIn:   st.BytesIn,
+					BytesOut:  st.BytesOut,
+				})
+			}
+		}
+	}
+	return nodes
+}
+
+type adminHandler struct {
+	options *HandlerOptions
+}
+
+// AdminHandler creates a server Handler for the admin API of the runtime inspection and control over HTTP:
+// GET /sessions lists the active sessions in JSON format, DELETE /sessions?id=<id> kills the session,
+// GET /nodes shows the health of the nodes of the chains reported by the metrics,
+// GET /debug shows whether the debug log is enabled, and PUT /debug?enabled=<bool> toggles it.
+// The requests are authenticated by HTTP basic auth if the authenticator is set,
+// otherwise only the requests from the loopback addresses are served.
+func AdminHandler(opts ...HandlerOption) Handler {
+	h := &adminHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *adminHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *adminHandler) Handle(conn net.Conn) {
+	serveAPI("admin", h.options, conn, func(req *http.Request, resp *http.Response) {
+		// the admin API without the users is only served to the local clients.
+		if h.options.Authenticator == nil && !isLoopback(conn.RemoteAddr()) {
+			h.options.Logger.Logf("[admin] %s - %s : forbidden without users", conn.RemoteAddr(), conn.LocalAddr())
+			resp.StatusCode = http.StatusForbidden
+			return
+		}
+
+		var v interface{}
+		switch {
+		case req.URL.Path == "/sessions" && req.Method == http.MethodGet:
+			v = h.options.Sessions.List()
+		case req.URL.Path == "/sessions" && req.Method == http.MethodDelete:
+			id := req.URL.Query().Get("id")
+			if id == "" {
+				resp.StatusCode = http.StatusBadRequest
+				return
+			}
+			if !h.options.Sessions.Kill(id) {
+				resp.StatusCode = http.StatusNotFound
+				return
+			}
+			h.options.Logger.Logf("[admin] %s - %s : session %s killed", conn.RemoteAddr(), conn.LocalAddr(), id)
+			resp.StatusCode = http.StatusNoContent
+		case req.URL.Path == "/nodes" && req.Method == http.MethodGet:
+			v = adminNodes(h.options.Metrics)
+		case req.URL.Path == "/debug" && req.Method == http.MethodGet:
+			v = map[string]bool{"enabled": DebugEnabled()}
+		case req.URL.Path == "/debug" && req.Method == http.MethodPut:
+			enabled, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+			if err != nil {
+				resp.StatusCode = http.StatusBadRequest
+				return
+			}
+			SetDebug(enabled)
+			h.options.Logger.Logf("[admin] %s - %s : debug log enabled %v", conn.RemoteAddr(), conn.LocalAddr(), enabled)
+			v = map[string]bool{"enabled": DebugEnabled()}
+		case req.URL.Path == "/sessions" || req.URL.Path == "/nodes" || req.URL.Path == "/debug":
+			resp.StatusCode = http.StatusMethodNotAllowed
+		default:
+			resp.StatusCode = http.StatusNotFound
+		}
+		if v == nil {
+			return
+		}
+
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(v); err != nil {
+			h.options.Logger.Logf("[admin] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			resp.StatusCode = http.StatusInternalServerError
+			return
+		}
+		setResponseBody(resp, "application/json", buf)
+	})
+}
+
+func isLoopback(addr net.Addr) bool {
+	host, _, _ := net.SplitHostPort(addr.String())
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,207 @@
+package gost
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, addr, method, path string, v interface{}) int {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest(method, "http://gost"+path, nil)
+	req.SetBasicAuth("admin", "123456")
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Errorf("%s %s : %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminHandler(t *testing.T) {
+	echo := mustTCPListener(t)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	sessions := NewSessions()
+	server := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  SOCKS5Handler(SessionsHandlerOption(sessions), NameHandlerOption("socks")),
+	}
+	go server.Run()
+	defer server.Close()
+
+	chain := NewChain(Node{
+		ID:     1,
+		Addr:   server.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+		marker: &failMarker{},
+	})
+	metrics := NewMetrics()
+	metrics.SetChain("client", chain)
+
+	admin := &Server{
+		Listener: mustTCPListener(t),
+		Handler: AdminHandler(
+			UsersHandlerOption(url.UserPassword("admin", "123456")),
+			SessionsHandlerOption(sessions),
+			MetricsHandlerOption(metrics),
+		),
+	}
+	go admin.Run()
+	defer admin.Close()
+	addr := admin.Addr().String()
+
+	conn, err := chain.Dial(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []Session
+	if code := adminRequest(t, addr, http.MethodGet, "/sessions", &list); code != http.StatusOK {
+		t.Fatalf("list sessions: %d", code)
+	}
+	if len(list) != 1 || list[0].Service != "socks" || list[0].Target != echo.Addr().String() ||
+		list[0].BytesIn != 5 || list[0].BytesOut != 5 || list[0].Duration <= 0 {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+
+	var nodes []AdminNode
+	if code := adminRequest(t, addr, http.MethodGet, "/nodes", &nodes); code != http.StatusOK {
+		t.Fatalf("list nodes: %d", code)
+	}
+	if len(nodes) != 1 || nodes[0].Service != "client" || nodes[0].Addr != server.Addr().String() ||
+		!nodes[0].Alive || nodes[0].Conns != 1 {
+		t.Errorf("unexpected nodes: %+v", nodes)
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodDelete, "/sessions", http.StatusBadRequest},
+		{http.MethodDelete, "/sessions?id=unknown", http.StatusNotFound},
+		{http.MethodDelete, "/sessions?id=" + list[0].ID, http.StatusNoContent},
+		{http.MethodPost, "/nodes", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/unknown", http.StatusNotFound},
+		{http.MethodPut, "/debug?enabled=maybe", http.StatusBadRequest},
+	} {
+		if code := adminRequest(t, addr, tc.method, tc.path, nil); code != tc.code {
+			t.Errorf("%s %s : status code should be %d, got %d", tc.method, tc.path, tc.code, code)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the killed session should be closed, got %v", err)
+	}
+	for i := 0; i < 10 && len(sessions.List()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(sessions.List()); n != 0 {
+		t.Errorf("the closed session should be removed, got %d", n)
+	}
+
+	defer atomic.StoreInt32(&debugOverride, 0)
+	var state map[string]bool
+	if code := adminRequest(t, addr, http.MethodPut, "/debug?enabled=false", &state); code != http.StatusOK ||
+		state["enabled"] || DebugEnabled() || (*ServiceLogger)(nil).Debug() {
+		t.Errorf("debug log should be disabled: %d %v", code, state)
+	}
+	if code := adminRequest(t, addr, http.MethodGet, "/debug", &state); code != http.StatusOK || state["enabled"] {
+		t.Errorf("debug log should be reported disabled: %d %v", code, state)
+	}
+}
+
+func TestAdminHandlerAuth(t *testing.T) {
+	admin := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  AdminHandler(UsersHandlerOption(url.UserPassword("admin", "secret"))),
+	}
+	go admin.Run()
+	defer admin.Close()
+
+	if code := adminRequest(t, admin.Addr().String(), http.MethodGet, "/sessions", nil); code != http.StatusUnauthorized {
+		t.Errorf("status code should be %d, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestAdminHandlerLoopback(t *testing.T) {
+	for _, tc := range []struct {
+		users  bool
+		client string
+		code   int
+	}{
+		{false, "127.0.0.1:1000", http.StatusOK},
+		{false, "[::1]:1000", http.StatusOK},
+		{false, "10.0.0.1:1000", http.StatusForbidden},
+		{true, "10.0.0.1:1000", http.StatusOK},
+	} {
+		var opts []HandlerOption
+		if tc.users {
+			opts = append(opts, UsersHandlerOption(url.UserPassword("admin", "123456")))
+		}
+		h := AdminHandler(opts...)
+
+		client, server := net.Pipe()
+		addr, _ := net.ResolveTCPAddr("tcp", tc.client)
+		go h.Handle(&remoteAddrConn{Conn: server, addr: addr})
+
+		req, _ := http.NewRequest(http.MethodGet, "http://gost/sessions", nil)
+		req.SetBasicAuth("admin", "123456")
+		req.Write(client)
+		resp, err := http.ReadResponse(bufio.NewReader(client), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("users %v, client %s: status code should be %d, got %d", tc.users, tc.client, tc.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// serveAPI serves the single HTTP request on conn for the API handler of the tag, such as the metrics and the admin endpoints.
+// The request is authenticated by HTTP basic auth if the authenticator is set, the failure is counted by the banner,
+// otherwise the response is filled by handle. The request and the response are dumped if the debug log is enabled.
+func serveAPI(tag string, opts *HandlerOptions, conn net.Conn, handle func(req *http.Request, resp *http.Response)) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		opts.Logger.Logf("[%s] %s - %s : %s", tag, conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	defer req.Body.Close()
+
+	if opts.Logger.Debug() {
+		dump, _ := httputil.DumpRequest(req, false)
+		opts.Logger.Logf("[%s] %s -> %s\n%s", tag, conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	resp.Header.Set("Server", "gost/"+Version)
+	resp.Header.Set("Connection", "close")
+
+	if u, p, _ := req.BasicAuth(); opts.Authenticator != nil && !opts.Authenticator.Authenticate(u, p) {
+		opts.Logger.Logf("[%s] %s - %s : authentication required", tag, conn.RemoteAddr(), conn.LocalAddr())
+		opts.Banner.Fail(conn.RemoteAddr().String())
+		resp.StatusCode = http.StatusUnauthorized
+		resp.Header.Set("WWW-Authenticate", `Basic realm="gost"`)
+	} else {
+		handle(req, resp)
+	}
+
+	if opts.Logger.Debug() {
+		dump, _ := httputil.DumpResponse(resp, false)
+		opts.Logger.Logf("[%s] %s <- %s\n%s", tag, conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+	}
+	resp.Write(conn)
+}
+
+// setResponseBody sets the body of the API response to b of the content type.
+func setResponseBody(resp *http.Response, contentType string, b *bytes.Buffer) {
+	resp.Header.Set("Content-Type", contentType)
+	resp.ContentLength = int64(b.Len())
+	resp.Body = ioutil.NopCloser(b)
+}
@@ -0,0 +1,253 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// Banner bans the clients temporarily when they fail the authentication repeatedly, like a built-in fail2ban.
+// A client (by source IP) is banned for a duration once it exceeds the threshold of failures within a time window.
+type Banner struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	clients   map[string]*banEntry
+	swept     time.Time
+	mux       sync.Mutex
+}
+
+type banEntry struct {
+	failures []time.Time
+	until    time.Time
+}
+
+// Ban is a banned client.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// NewBanner creates a Banner which bans the client for the duration when it fails more than threshold times within the window.
+func NewBanner(threshold int, window, duration time.Duration) *Banner {
+	if window <= 0 {
+		window = time.Minute
+	}
+	if duration <= 0 {
+		duration = 10 * time.Minute
+	}
+	return &Banner{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		clients:   make(map[string]*banEntry),
+	}
+}
+
+// Fail records an authentication failure of the client address, it reports whether the client is banned.
+func (b *Banner) Fail(addr string) bool {
+	if b == nil || b.threshold <= 0 {
+		return false
+	}
+	ip := banIP(addr)
+	now := time.Now()
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	// the expired clients are swept at most once per window, not on every failure.
+	if now.Sub(b.swept) > b.window {
+		b.sweep(now)
+		b.swept = now
+	}
+	e := b.clients[ip]
+	if e == nil || b.expired(e, now) {
+		e = &banEntry{}
+		b.clients[ip] = e
+	}
+	if now.Before(e.until) {
+		return true
+	}
+
+	e.failures = append(e.failures, now)
+	for len(e.failures) > 0 && now.Sub(e.failures[0]) > b.window {
+		e.failures = e.failures[1:]
+	}
+	if len(e.failures) <= b.threshold {
+		return false
+	}
+
+	e.until = now.Add(b.duration)
+	log.Logf("[ban] %s : %d authentication failures in %v, banned for %v", ip, len(e.failures), b.window, b.duration)
+	return true
+}
+
+// Banned reports whether the client address is banned.
+func (b *Banner) Banned(addr string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	ip := banIP(addr)
+	now := time.Now()
+	e := b.clients[ip]
+	if e != nil && b.expired(e, now) {
+		delete(b.clients, ip)
+	}
+	return e != nil && now.Before(e.until)
+}
+
+// Bans returns the banned clients, sorted by IP.
+func (b *Banner) Bans() []Ban {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	bans := []Ban{}
+	for ip, e := range b.clients {
+		if now.Before(e.until) {
+			bans = append(bans, Ban{IP: ip, Failures: len(e.failures), Until: e.until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Unban lifts the ban of the client IP, it reports whether the client was banned.
+func (b *Banner) Unban(ip string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	e := b.clients[banIP(ip)]
+	if e == nil {
+		return false
+	}
+	delete(b.clients, banIP(ip))
+	if time.Now().After(e.until) {
+		return false
+	}
+	log.Logf("[ban] %s : unbanned", banIP(ip))
+	return true
+}
+
+// sweep removes the expired clients, it must be called with the lock held.
+func (b *Banner) sweep(now time.Time) {
+	for ip, e := range b.clients {
+		if b.expired(e, now) {
+			delete(b.clients, ip)
+		}
+	}
+}
+
+// expired reports whether the client is neither banned nor has any failure within the window.
+func (b *Banner) expired(e *banEntry, now time.Time) bool {
+	return now.After(e.until) &&
+		(len(e.failures) == 0 || now.Sub(e.failures[len(e.failures)-1]) > b.window)
+}
+
+func banIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+type banListener struct {
+	Listener
+	banner *Banner
+}
+
+// BanListener wraps the listener ln, the connections from the clients banned by the banner are closed once accepted.
+func BanListener(ln Listener, banner *Banner) Listener {
+	if banner == nil {
+		return ln
+	}
+	return &banListener{Listener: ln, banner: banner}
+}
+
+func (l *banListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.banner.Banned(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		if Debug {
+			log.Logf("[ban] %s - %s : banned", conn.RemoteAddr(), conn.LocalAddr())
+		}
+		conn.Close()
+	}
+}
+
+type banHandler struct {
+	options *HandlerOptions
+}
+
+// BanHandler creates a server Handler for the admin endpoint of the banner,
+// it responds to the HTTP GET requests with the banned clients in JSON format,
+// and lifts the ban of the client by the HTTP DELETE requests with query 'ip=<ip>'.
+// The requests are authenticated by HTTP basic auth if the authenticator is set.
+func BanHandler(opts ...HandlerOption) Handler {
+	h := &banHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *banHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *banHandler) Handle(conn net.Conn) {
+	serveAPI("ban", h.options, conn, func(req *http.Request, resp *http.Response) {
+		switch req.Method {
+		case http.MethodGet:
+			buf := &bytes.Buffer{}
+			if err := json.NewEncoder(buf).Encode(h.options.Banner.Bans()); err != nil {
+				h.options.Logger.Logf("[ban] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+				resp.StatusCode = http.StatusInternalServerError
+				return
+			}
+			setResponseBody(resp, "application/json", buf)
+		case http.MethodDelete:
+			ip := req.URL.Query().Get("ip")
+			if ip == "" {
+				resp.StatusCode = http.StatusBadRequest
+				return
+			}
+			if !h.options.Banner.Unban(ip) {
+				resp.StatusCode = http.StatusNotFound
+				return
+			}
+			resp.StatusCode = http.StatusNoContent
+		default:
+			resp.StatusCode = http.StatusMethodNotAllowed
+		}
+	})
+}
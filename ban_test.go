@@ -0,0 +1,254 @@
+package gost
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	var banner *Banner
+	if banner.Fail("1.2.3.4:1000") || banner.Banned("1.2.3.4:1000") {
+		t.Error("nil banner should not ban")
+	}
+
+	banner = NewBanner(2, time.Minute, time.Minute)
+	for i := 0; i < 2; i++ {
+		if banner.Fail("1.2.3.4:1000") {
+			t.Fatalf("#%d failure should not ban the client", i)
+		}
+	}
+	if !banner.Fail("1.2.3.4:2000") || !banner.Banned("1.2.3.4:3000") {
+		t.Fatal("the client exceeding the threshold should be banned")
+	}
+	if banner.Banned("5.6.7.8:1000") {
+		t.Error("the other clients should not be banned")
+	}
+
+	bans := banner.Bans()
+	if len(bans) != 1 || bans[0].IP != "1.2.3.4" || bans[0].Failures != 3 {
+		t.Errorf("unexpected bans: %+v", bans)
+	}
+
+	if !banner.Unban("1.2.3.4") || banner.Banned("1.2.3.4:1000") {
+		t.Error("the client should be unbanned")
+	}
+	if banner.Unban("1.2.3.4") {
+		t.Error("the unbanned client should not be unbanned again")
+	}
+}
+
+func TestBannerExpire(t *testing.T) {
+	banner := NewBanner(1, 100*time.Millisecond, 100*time.Millisecond)
+	banner.Fail("1.2.3.4:1000")
+	time.Sleep(150 * time.Millisecond)
+	if banner.Fail("1.2.3.4:1000") {
+		t.Fatal("the failures out of the window should not count")
+	}
+
+	if !banner.Fail("1.2.3.4:1000") {
+		t.Fatal("the client exceeding the threshold should be banned")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if banner.Banned("1.2.3.4:1000") {
+		t.Error("the ban should expire after the duration")
+	}
+}
+
+func TestBanProxy(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	banner := NewBanner(1, time.Minute, time.Minute)
+	server := &Server{
+		Handler: SOCKS5Handler(
+			UsersHandlerOption(url.UserPassword("admin", "123456")),
+			BannerHandlerOption(banner),
+		),
+		Listener: BanListener(ln, banner),
+	}
+	go server.Run()
+	defer server.Close()
+
+	newClient := func(user *url.Userinfo) *Client {
+		return &Client{
+			Connector:   SOCKS5Connector(user),
+			Transporter: TCPTransporter(),
+		}
+	}
+
+	if err := proxyRoundtrip(newClient(url.UserPassword("admin", "123456")), server, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := proxyRoundtrip(newClient(url.UserPassword("admin", "654321")), server, httpSrv.URL, sendData); err == nil {
+			t.Fatalf("#%d authentication should fail", i)
+		}
+	}
+	if err := proxyRoundtrip(newClient(url.UserPassword("admin", "123456")), server, httpSrv.URL, sendData); err == nil {
+		t.Error("the banned client should be rejected")
+	}
+
+	banner.Unban("127.0.0.1")
+	banner.Unban("::1")
+	if err := proxyRoundtrip(newClient(url.UserPassword("admin", "123456")), server, httpSrv.URL, sendData); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBanHandler(t *testing.T) {
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner := NewBanner(1, time.Minute, time.Minute)
+	banner.Fail("1.2.3.4:1000")
+	banner.Fail("1.2.3.4:1000")
+
+	server := &Server{
+		Listener: ln,
+		Handler: BanHandler(
+			UsersHandlerOption(url.UserPassword("admin", "123456")),
+			BannerHandlerOption(banner),
+		),
+	}
+	go server.Run()
+	defer server.Close()
+
+	for i, tc := range []struct {
+		method string
+		url    string
+		user   *url.Userinfo
+		code   int
+		bans   int
+	}{
+		{http.MethodGet, "http://gost/bans", nil, http.StatusUnauthorized, -1},
+		{http.MethodGet, "http://gost/bans", url.UserPassword("admin", "123456"), http.StatusOK, 1},
+		{http.MethodDelete, "http://gost/bans", url.UserPassword("admin", "123456"), http.StatusBadRequest, -1},
+		{http.MethodDelete, "http://gost/bans?ip=5.6.7.8", url.UserPassword("admin", "123456"), http.StatusNotFound, -1},
+		{http.MethodDelete, "http://gost/bans?ip=1.2.3.4", url.UserPassword("admin", "123456"), http.StatusNoContent, -1},
+		{http.MethodGet, "http://gost/bans", url.UserPassword("admin", "123456"), http.StatusOK, 0},
+		{http.MethodPost, "http://gost/bans", url.UserPassword("admin", "123456"), http.StatusMethodNotAllowed, -1},
+	} {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		if tc.user != nil {
+			p, _ := tc.user.Password()
+			req.SetBasicAuth(tc.user.Username(), p)
+		}
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != tc.code {
+			t.Errorf("#%d status code should be %d, got %d", i, tc.code, resp.StatusCode)
+		}
+		if tc.bans >= 0 {
+			var bans []Ban
+			if err := json.NewDecoder(resp.Body).Decode(&bans); err != nil {
+				t.Errorf("#%d %s", i, err)
+			}
+			if len(bans) != tc.bans {
+				t.Errorf("#%d should have %d bans, got %d", i, tc.bans, len(bans))
+			}
+		}
+		resp.Body.Close()
+		conn.Close()
+	}
+}
+
+func TestBannerSweep(t *testing.T) {
+	banner := NewBanner(1, 50*time.Millisecond, 50*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		banner.Fail(net.JoinHostPort(net.IPv4(10, 0, 0, byte(i)).String(), "1000"))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	banner.Fail("1.2.3.4:1000")
+	banner.mux.Lock()
+	n := len(banner.clients)
+	banner.mux.Unlock()
+	if n != 1 {
+		t.Errorf("the expired clients should be swept, got %d clients", n)
+	}
+	if !banner.Fail("1.2.3.4:1000") {
+		t.Error("the client exceeding the threshold should be banned")
+	}
+}
+
+func TestSSHTunnelBan(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	banner := NewBanner(1, time.Minute, time.Minute)
+	ln, err := SSHTunnelListener("", &SSHConfig{
+		Authenticator: NewLocalAuthenticator(map[string]string{"admin": "123456"}),
+		Banner:        banner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: BanListener(ln, banner),
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	roundtrip := func(user *url.Userinfo) error {
+		client := &Client{
+			Connector:   HTTPConnector(nil),
+			Transporter: SSHTunnelTransporter(),
+		}
+		conn, err := client.Dial(server.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn, err = client.Handshake(conn, AddrHandshakeOption(server.Addr().String()), UserHandshakeOption(user))
+		if err != nil {
+			return err
+		}
+		u, _ := url.Parse(httpSrv.URL)
+		if conn, err = client.Connect(conn, u.Host); err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		return httpRoundtrip(conn, httpSrv.URL, sendData)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := roundtrip(url.UserPassword("admin", "654321")); err == nil {
+			t.Fatalf("#%d authentication should fail", i)
+		}
+	}
+	if len(banner.Bans()) != 1 {
+		t.Fatal("the client failing the SSH authentication should be banned")
+	}
+	if err := roundtrip(url.UserPassword("admin", "123456")); err == nil {
+		t.Error("the banned client should be rejected")
+	}
+}
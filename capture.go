@@ -0,0 +1,281 @@
+package gost
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 0xFFFF
+	pcapLinkTypeIP = 101 // LINKTYPE_RAW, the packet begins with an IPv4 or IPv6 header.
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	// the max TCP payload size of the synthetic packet, it leaves space for the IPv6 and TCP headers.
+	captureMaxPayload = pcapSnapLen - 60
+)
+
+var packetCapture atomic.Value
+
+// SetPacketCapture sets the packet capture for the relayed connections, nil disables the capture.
+func SetPacketCapture(c *PacketCapture) {
+	packetCapture.Store(&c)
+}
+
+func getPacketCapture() *PacketCapture {
+	if c, ok := packetCapture.Load().(**PacketCapture); ok {
+		return *c
+	}
+	return nil
+}
+
+// PacketCapture writes the byte streams of the relayed connections to a pcap file for debugging.
+// The streams are the decrypted data after the handshake of the proxy protocol,
+// each direction of the stream is framed into synthetic TCP/IP packets,
+// so they can be analyzed by the tools such as Wireshark.
+type PacketCapture struct {
+	w      io.Writer
+	filter []Matcher
+	mux    sync.Mutex
+}
+
+// NewPacketCapture creates a PacketCapture writing to w, the pcap file header is written immediately.
+// The filter is a list of matchers for the IP addresses of the connections,
+// a connection is captured if the address of either end of it matches the filter.
+// All connections are captured if the filter is empty.
+func NewPacketCapture(w io.Writer, filter ...Matcher) (*PacketCapture, error) {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(b[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(b[20:], pcapLinkTypeIP)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	c := &PacketCapture{w: w}
+	for _, m := range filter {
+		if m != nil {
+			c.filter = append(c.filter, m)
+		}
+	}
+	return c, nil
+}
+
+func (c *PacketCapture) match(addrs ...string) bool {
+	if len(c.filter) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		for _, m := range c.filter {
+			if m.Match(host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *PacketCapture) writePacket(b []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	now := time.Now()
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(b)))
+	if _, err := c.w.Write(hdr); err == nil {
+		c.w.Write(b)
+	}
+}
+
+// capture wraps the relayed streams rw1 and rw2 if they are connections matching the filter.
+func (c *PacketCapture) capture(rw1, rw2 io.ReadWriter) (io.ReadWriter, io.ReadWriter) {
+	c1, ok1 := rw1.(net.Conn)
+	c2, ok2 := rw2.(net.Conn)
+	if !ok1 || !ok2 {
+		return rw1, rw2
+	}
+	src, dst := c1.RemoteAddr(), c2.RemoteAddr()
+	if src == nil || dst == nil || !c.match(src.String(), dst.String()) {
+		return rw1, rw2
+	}
+
+	f := newCaptureFlow(c, src.String(), dst.String())
+	return &captureWriter{ReadWriter: rw1, flow: f, dir: 1},
+		&captureWriter{ReadWriter: rw2, flow: f, dir: 0}
+}
+
+type captureEndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+func parseCaptureEndpoint(addr string) captureEndpoint {
+	ep := captureEndpoint{ip: net.IPv4zero}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ep
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		ep.ip = ip
+	}
+	n, _ := strconv.ParseUint(port, 10, 16)
+	ep.port = uint16(n)
+	return ep
+}
+
+// captureFlow is the synthetic TCP connection of a relay,
+// the direction 0 is from the client to the server, and 1 is the reverse.
+type captureFlow struct {
+	capture *PacketCapture
+	ends    [2]captureEndpoint
+	ipv6    bool
+	seq     [2]uint32
+	fin     [2]bool
+	mux     sync.Mutex
+}
+
+func newCaptureFlow(c *PacketCapture, src, dst string) *captureFlow {
+	f := &captureFlow{
+		capture: c,
+		ends:    [2]captureEndpoint{parseCaptureEndpoint(src), parseCaptureEndpoint(dst)},
+	}
+	f.ipv6 = f.ends[0].ip.To4() == nil || f.ends[1].ip.To4() == nil
+
+	// three-way handshake
+	f.packet(0, tcpFlagSYN, nil)
+	f.packet(1, tcpFlagSYN|tcpFlagACK, nil)
+	f.packet(0, tcpFlagACK, nil)
+
+	return f
+}
+
+func (f *captureFlow) write(dir int, b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > captureMaxPayload {
+			n = captureMaxPayload
+		}
+		f.packet(dir, tcpFlagPSH|tcpFlagACK, b[:n])
+		b = b[n:]
+	}
+}
+
+// close closes the direction dir of the flow.
+func (f *captureFlow) close(dir int) {
+	f.mux.Lock()
+	fin := f.fin[dir]
+	f.fin[dir] = true
+	f.mux.Unlock()
+
+	if !fin {
+		f.packet(dir, tcpFlagFIN|tcpFlagACK, nil)
+	}
+}
+
+func (f *captureFlow) packet(dir int, flags byte, payload []byte) {
+	f.mux.Lock()
+	seq, ack := f.seq[dir], f.seq[1-dir]
+	f.seq[dir] += uint32(len(payload))
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		f.seq[dir]++
+	}
+	f.mux.Unlock()
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	src, dst := f.ends[dir], f.ends[1-dir]
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF) // window
+	copy(tcp[20:], payload)
+
+	var b []byte
+	if !f.ipv6 {
+		b = make([]byte, 20, 20+len(tcp))
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(20+len(tcp)))
+		b[6] = 0x40 // don't fragment
+		b[8] = 64   // TTL
+		b[9] = 6    // TCP
+		copy(b[12:16], src.ip.To4())
+		copy(b[16:20], dst.ip.To4())
+		binary.BigEndian.PutUint16(b[10:], ^ipChecksum(0, b))
+	} else {
+		b = make([]byte, 40, 40+len(tcp))
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:], uint16(len(tcp)))
+		b[6] = 6  // TCP
+		b[7] = 64 // hop limit
+		copy(b[8:24], src.ip.To16())
+		copy(b[24:40], dst.ip.To16())
+	}
+
+	// the pseudo header checksum
+	var sum uint16
+	if f.ipv6 {
+		sum = ipChecksum(0, b[8:40])
+	} else {
+		sum = ipChecksum(0, b[12:20])
+	}
+	sum = ipChecksum(uint32(sum)+6+uint32(len(tcp)), nil)
+	binary.BigEndian.PutUint16(tcp[16:], ^ipChecksum(uint32(sum), tcp))
+
+	f.capture.writePacket(append(b, tcp...))
+}
+
+// ipChecksum computes the internet checksum of b on the initial sum, without the final complement.
+func ipChecksum(sum uint32, b []byte) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return uint16(sum)
+}
+
+type captureWriter struct {
+	io.ReadWriter
+	flow *captureFlow
+	dir  int
+}
+
+func (w *captureWriter) Write(b []byte) (n int, err error) {
+	n, err = w.ReadWriter.Write(b)
+	if n > 0 {
+		w.flow.write(w.dir, b[:n])
+	}
+	return
+}
+
+// captureClose closes the direction of the flow written by w, if w is a captured stream.
+func captureClose(w io.Writer) {
+	if cw, ok := w.(*captureWriter); ok {
+		cw.flow.close(cw.dir)
+	}
+}
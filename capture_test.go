@@ -0,0 +1,134 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type capturePacket struct {
+	src, dst net.IP
+	flags    byte
+	payload  []byte
+}
+
+func parseCapture(t *testing.T, b []byte) (packets []capturePacket) {
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != pcapMagic ||
+		binary.LittleEndian.Uint32(b[20:]) != pcapLinkTypeIP {
+		t.Fatal("invalid pcap file header")
+	}
+	b = b[24:]
+	for len(b) > 0 {
+		if len(b) < 16 {
+			t.Fatal("invalid pcap record header")
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		p := b[16 : 16+n]
+		b = b[16+n:]
+
+		var src, dst net.IP
+		var tcp []byte
+		var sum uint32
+		switch p[0] >> 4 {
+		case 4:
+			if ipChecksum(0, p[:20]) != 0xFFFF {
+				t.Fatal("invalid IPv4 header checksum")
+			}
+			src, dst, tcp = net.IP(p[12:16]), net.IP(p[16:20]), p[20:]
+			sum = uint32(ipChecksum(0, p[12:20]))
+		case 6:
+			src, dst, tcp = net.IP(p[8:24]), net.IP(p[24:40]), p[40:]
+			sum = uint32(ipChecksum(0, p[8:40]))
+		default:
+			t.Fatalf("invalid IP version %d", p[0]>>4)
+		}
+		if ipChecksum(sum+6+uint32(len(tcp)), tcp) != 0xFFFF {
+			t.Fatal("invalid TCP checksum")
+		}
+		packets = append(packets, capturePacket{
+			src:     src,
+			dst:     dst,
+			flags:   tcp[13],
+			payload: tcp[20:],
+		})
+	}
+	return
+}
+
+func TestPacketCapture(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	buf := &bytes.Buffer{}
+	c, err := NewPacketCapture(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPacketCapture(c)
+	defer SetPacketCapture(nil)
+
+	if err := socks5ProxyRoundtrip(httpSrv.URL, sendData, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []capturePacket
+	for i := 0; i < 10; i++ {
+		c.mux.Lock()
+		packets = parseCapture(t, buf.Bytes())
+		c.mux.Unlock()
+		if len(packets) > 0 && packets[len(packets)-1].flags&tcpFlagFIN != 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(packets) < 5 {
+		t.Fatalf("too few packets: %d", len(packets))
+	}
+	for i, flags := range []byte{tcpFlagSYN, tcpFlagSYN | tcpFlagACK, tcpFlagACK} {
+		if packets[i].flags != flags {
+			t.Errorf("#%d packet should be the handshake with flags %x, got %x", i, flags, packets[i].flags)
+		}
+	}
+
+	var upstream, downstream []byte
+	for _, p := range packets[3:] {
+		if p.src.Equal(packets[0].src) {
+			upstream = append(upstream, p.payload...)
+		} else {
+			downstream = append(downstream, p.payload...)
+		}
+	}
+	if !bytes.Contains(upstream, sendData) {
+		t.Error("request data should be captured")
+	}
+	if !bytes.Contains(downstream, sendData) {
+		t.Error("response data should be captured")
+	}
+}
+
+func TestPacketCaptureFilter(t *testing.T) {
+	c, err := NewPacketCapture(&bytes.Buffer{}, NewMatcher("192.168.1.0/24"), NewMatcher(""), NewMatcher("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		addrs []string
+		match bool
+	}{
+		{[]string{"192.168.1.1:1080", "8.8.8.8:53"}, true},
+		{[]string{"127.0.0.1:1080", "10.0.0.1:80"}, true},
+		{[]string{"127.0.0.1:1080", "10.0.0.2:80"}, false},
+		{[]string{"", "example.com:80"}, false},
+	} {
+		if c.match(tc.addrs...) != tc.match {
+			t.Errorf("#%d match %v should be %v", i, tc.addrs, tc.match)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package gost
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+// GenerateCA generates a self-signed CA certificate of the common name name, valid for validFor,
+// for signing the certificates of the gost nodes. The certificate and the private key are PEM encoded.
+func GenerateCA(name string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	template, err := certTemplate(name, validFor)
+	if err != nil {
+		return
+	}
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	template.BasicConstraintsValid = true
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	return createCertificate(template, template, priv, priv)
+}
+
+// IssueCertificate issues a certificate of the common name name signed by the CA certificate and key (PEM encoded),
+// valid for validFor. The hosts are the subject alternative names, the IP addresses, the DNS names
+// or the URIs, the name is also a DNS name if hosts is empty.
+// The certificate is for both the server and the client authentication,
+// so the node can serve the other nodes and connect to them with it.
+func IssueCertificate(caCertPEM, caKeyPEM []byte, name string, hosts []string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return
+	}
+	if !caCert.IsCA {
+		return nil, nil, errors.New("not a CA certificate")
+	}
+
+	template, err := certTemplate(name, validFor)
+	if err != nil {
+		return
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if len(hosts) == 0 && name != "" {
+		hosts = []string{name}
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if u, er := url.Parse(h); er == nil && u.Scheme != "" && u.Host != "" {
+			template.URIs = append(template.URIs, u)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	return createCertificate(template, caCert, priv, ca.PrivateKey)
+}
+
+func certTemplate(name string, validFor time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"gost"},
+			CommonName:   name,
+		},
+		NotBefore: now.Add(-time.Hour), // tolerate the clock skew of the nodes
+		NotAfter:  now.Add(validFor),
+	}, nil
+}
+
+func createCertificate(template, parent *x509.Certificate, priv *ecdsa.PrivateKey, signer crypto.PrivateKey) (certPEM, keyPEM []byte, err error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, signer)
+	if err != nil {
+		return
+	}
+	rawKey, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey})
+	return
+}
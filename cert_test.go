@@ -0,0 +1,150 @@
+package gost
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustIssueCertificate(t *testing.T, caCert, caKey []byte, name string, hosts ...string) tls.Certificate {
+	certPEM, keyPEM, err := IssueCertificate(caCert, caKey, name, hosts, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIssueCertificate(t *testing.T) {
+	caCert, caKey, err := GenerateCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := mustIssueCertificate(t, caCert, caKey, "node1", "node1.mesh", "127.0.0.1", "spiffe://mesh/node1")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCert)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:   "node1.mesh",
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{usage},
+		}); err != nil {
+			t.Errorf("certificate should be verified for %v: %v", usage, err)
+		}
+	}
+	if len(leaf.IPAddresses) != 1 || len(leaf.URIs) != 1 || !reflect.DeepEqual(leaf.DNSNames, []string{"node1.mesh"}) {
+		t.Errorf("unexpected subject alternative names: %v %v %v", leaf.DNSNames, leaf.IPAddresses, leaf.URIs)
+	}
+
+	leaf, _ = x509.ParseCertificate(mustIssueCertificate(t, caCert, caKey, "node2").Certificate[0])
+	if !reflect.DeepEqual(leaf.DNSNames, []string{"node2"}) {
+		t.Errorf("name should be the DNS name without hosts, got %v", leaf.DNSNames)
+	}
+
+	certPEM, keyPEM, _ := IssueCertificate(caCert, caKey, "node3", nil, time.Hour)
+	if _, _, err := IssueCertificate(certPEM, keyPEM, "node4", nil, time.Hour); err == nil {
+		t.Error("certificate should not be issued by a non-CA certificate")
+	}
+}
+
+func TestMutualTLSIdentityACL(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	caCert, caKey, err := GenerateCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, otherKey, _ := GenerateCA("other CA", time.Hour)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+
+	acl := NewACL()
+	acl.Reload(strings.NewReader("default deny\nallow tcp id:*.mesh,id:spiffe://mesh/admin *"))
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for _, mux := range []bool{false, true} {
+		serverCfg := &tls.Config{
+			Certificates: []tls.Certificate{mustIssueCertificate(t, caCert, caKey, "server")},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		ln, err := TLSListener("", serverCfg)
+		tr := TLSTransporter()
+		if mux {
+			ln, err = MTLSListener("", serverCfg)
+			tr = MTLSTransporter()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Listener: ln,
+			Handler:  SOCKS5Handler(ACLHandlerOption(acl)),
+		}
+		go server.Run()
+		defer server.Close()
+
+		for i, tc := range []struct {
+			cert  tls.Certificate
+			allow bool
+		}{
+			{mustIssueCertificate(t, caCert, caKey, "node1", "node1.mesh"), true},
+			{mustIssueCertificate(t, caCert, caKey, "admin", "spiffe://mesh/admin"), true},
+			{mustIssueCertificate(t, caCert, caKey, "node2", "node2.example.com"), false},
+			// the identity of the certificate of the untrusted CA is not accepted.
+			{mustIssueCertificate(t, otherCert, otherKey, "node3", "node3.mesh"), false},
+		} {
+			client := &Client{
+				Connector:   SOCKS5Connector(nil),
+				Transporter: tr,
+			}
+			err := func() error {
+				conn, err := client.Dial(server.Addr().String())
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				conn, err = client.Handshake(conn,
+					AddrHandshakeOption(server.Addr().String()),
+					TLSConfigHandshakeOption(&tls.Config{
+						RootCAs:      pool,
+						ServerName:   "server",
+						Certificates: []tls.Certificate{tc.cert},
+					}),
+				)
+				if err != nil {
+					return err
+				}
+				u, _ := url.Parse(httpSrv.URL)
+				if conn, err = client.Connect(conn, u.Host); err != nil {
+					return err
+				}
+				conn.SetDeadline(time.Now().Add(time.Second))
+				return httpRoundtrip(conn, httpSrv.URL, sendData)
+			}()
+			if tc.allow && err != nil {
+				t.Errorf("mux %v #%d should be allowed: %v", mux, i, err)
+			}
+			if !tc.allow && err == nil {
+				t.Errorf("mux %v #%d should be denied", mux, i)
+			}
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package gost
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/go-log/log"
@@ -17,10 +19,18 @@ var (
 type Chain struct {
 	isRoute    bool
 	Retries    int
+	Rules      []RouteRule
 	nodeGroups []*NodeGroup
 	route      []Node // nodes in the selected route
 }
 
+// RouteRule routes the targets matched by the patterns through the chain instead,
+// such as the onion addresses through Tor.
+type RouteRule struct {
+	Patterns *Bypass
+	Chain    *Chain
+}
+
 // NewChain creates a proxy chain with a list of proxy nodes.
 // It creates the node groups automatically, one group per node.
 func NewChain(nodes ...Node) *Chain {
@@ -103,6 +113,10 @@ func (c *Chain) IsEmpty() bool {
 // Dial connects to the target address addr through the chain.
 // If the chain is empty, it will use the net.Dial directly.
 func (c *Chain) Dial(addr string, opts ...ChainOption) (conn net.Conn, err error) {
+	return c.dial(context.Background(), addr, opts...)
+}
+
+func (c *Chain) dial(ctx context.Context, addr string, opts ...ChainOption) (conn net.Conn, err error) {
 	options := &ChainOptions{}
 	for _, opt := range opts {
 		opt(options)
@@ -117,7 +131,10 @@ func (c *Chain) Dial(addr string, opts ...ChainOption) (conn net.Conn, err error
 	}
 
 	for i := 0; i < retries; i++ {
-		conn, err = c.dialWithOptions(addr, options)
+		if e := ctx.Err(); e != nil {
+			return nil, e
+		}
+		conn, err = c.dialWithOptions(ctx, addr, options)
 		if err == nil {
 			break
 		}
@@ -125,38 +142,119 @@ func (c *Chain) Dial(addr string, opts ...ChainOption) (conn net.Conn, err error
 	return
 }
 
-func (c *Chain) dialWithOptions(addr string, options *ChainOptions) (net.Conn, error) {
+func (c *Chain) dialWithOptions(ctx context.Context, addr string, options *ChainOptions) (net.Conn, error) {
 	if options == nil {
 		options = &ChainOptions{}
 	}
+	addr, err := toASCIIAddr(addr)
+	if err != nil {
+		return nil, err
+	}
 	route, err := c.selectRouteFor(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	ipAddr := c.resolve(addr, options.Resolver, options.Hosts)
-
 	timeout := options.Timeout
 	if timeout <= 0 {
 		timeout = DialTimeout
 	}
 
+	policy := route.dnsPolicy(addr)
+	if policy == "" {
+		policy = options.DNSPolicy
+	}
+
 	if route.IsEmpty() {
-		return net.DialTimeout("tcp", ipAddr, timeout)
+		if policy == DNSLocal {
+			if addr, err = c.resolveLocal(ctx, addr, options.Resolver, options.Hosts, timeout); err != nil {
+				return nil, err
+			}
+		}
+		d := net.Dialer{Timeout: timeout}
+		return d.DialContext(ctx, "tcp", c.resolve(addr, options.Resolver, options.Hosts))
 	}
 
-	conn, err := route.getConn()
+	ipAddr := addr
+	switch policy {
+	case DNSRemote:
+	case DNSLocal:
+		if ipAddr, err = c.resolveLocal(ctx, addr, options.Resolver, options.Hosts, timeout); err != nil {
+			return nil, err
+		}
+	default:
+		ipAddr = c.resolve(addr, options.Resolver, options.Hosts)
+	}
+
+	start := time.Now()
+	conn, err := route.getConn(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	cOpts := append([]ConnectOption{AddrConnectOption(addr)}, route.LastNode().ConnectOptions...)
+	stop := closeOnDone(ctx, conn)
 	cc, err := route.LastNode().Client.Connect(conn, ipAddr, cOpts...)
-	if err != nil {
+	if cc, err = stopConn(stop, cc, err); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	return cc, nil
+	nodes := route.route // all nodes of the route, including the ones before the multiplex node.
+	if nodes == nil {
+		nodes = route.Nodes()
+	}
+	d := time.Since(start)
+	for i := range nodes {
+		nodes[i].marker.observeDial(d)
+	}
+	return newNodeConn(cc, nodes), nil
+}
+
+// The DNS resolution policies of the chain, set by the dns option of the last node of the chain.
+const (
+	// DNSLocal always resolves the target locally, the IP address is sent to the proxy server.
+	DNSLocal = "local"
+	// DNSRemote never resolves the target locally, the domain is sent to the proxy server.
+	DNSRemote = "remote"
+)
+
+// DNSRule specifies the DNS resolution policy of the targets matched by the patterns.
+type DNSRule struct {
+	Policy   string
+	Patterns *Bypass
+}
+
+// dnsPolicy returns the DNS resolution policy of the target addr through the route,
+// which is the policy of the first DNS rule of the last node matching the target, or the dns option of the last node.
+// The target is resolved only by the resolver or hosts of the service if it is not set.
+func (c *Chain) dnsPolicy(addr string) string {
+	node := c.LastNode()
+	for _, rule := range node.DNSRules {
+		if rule.Patterns.Contains(addr) {
+			return rule.Policy
+		}
+	}
+	return node.Get("dns")
+}
+
+// resolveLocal resolves the address addr by the resolver or hosts, or the system resolver if they not resolve it.
+func (c *Chain) resolveLocal(ctx context.Context, addr string, resolver Resolver, hosts *Hosts, timeout time.Duration) (string, error) {
+	addr = c.resolve(addr, resolver, hosts)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip, _ := splitHostZone(host); net.ParseIP(ip) != nil {
+		return addr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
 }
 
 func (*Chain) resolve(addr string, resolver Resolver, hosts *Hosts) string {
@@ -168,6 +266,9 @@ func (*Chain) resolve(addr string, resolver Resolver, hosts *Hosts) string {
 	if ip := hosts.Lookup(host); ip != nil {
 		return net.JoinHostPort(ip.String(), port)
 	}
+	if _, zone := splitHostZone(host); zone != "" { // the IPv6 literal with zone is dialed as is.
+		return addr
+	}
 	if resolver != nil {
 		ips, err := resolver.Resolve(host)
 		if err != nil {
@@ -180,8 +281,27 @@ func (*Chain) resolve(addr string, resolver Resolver, hosts *Hosts) string {
 	return addr
 }
 
+// DialContext is like Dial, but the in-flight dial, the handshakes and the connect requests through the chain
+// are aborted once ctx is done, the connection established late is closed.
+// The deadline of ctx is the default timeout of the connection to the target, unless it is set by opts.
+func (c *Chain) DialContext(ctx context.Context, addr string, opts ...ChainOption) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append([]ChainOption{TimeoutChainOption(time.Until(deadline))}, opts...)
+	}
+	return c.dial(ctx, addr, opts...)
+}
+
+// ConnContext is like Conn, but the in-flight dial and handshakes are aborted once ctx is done.
+func (c *Chain) ConnContext(ctx context.Context, opts ...ChainOption) (net.Conn, error) {
+	return c.conn(ctx, opts...)
+}
+
 // Conn obtains a handshaked connection to the last node of the chain.
 func (c *Chain) Conn(opts ...ChainOption) (conn net.Conn, err error) {
+	return c.conn(context.Background(), opts...)
+}
+
+func (c *Chain) conn(ctx context.Context, opts ...ChainOption) (conn net.Conn, err error) {
 	options := &ChainOptions{}
 	for _, opt := range opts {
 		opt(options)
@@ -196,12 +316,15 @@ func (c *Chain) Conn(opts ...ChainOption) (conn net.Conn, err error) {
 	}
 
 	for i := 0; i < retries; i++ {
+		if e := ctx.Err(); e != nil {
+			return nil, e
+		}
 		var route *Chain
 		route, err = c.selectRoute()
 		if err != nil {
 			continue
 		}
-		conn, err = route.getConn()
+		conn, err = route.getConn(ctx)
 		if err == nil {
 			break
 		}
@@ -210,26 +333,51 @@ func (c *Chain) Conn(opts ...ChainOption) (conn net.Conn, err error) {
 }
 
 // getConn obtains a connection to the last node of the chain.
-func (c *Chain) getConn() (conn net.Conn, err error) {
+// The in-flight dial and handshakes are aborted by closing the connection once ctx is done,
+// the nodes are not marked dead by the abort.
+func (c *Chain) getConn(ctx context.Context) (conn net.Conn, err error) {
 	if c.IsEmpty() {
 		err = ErrEmptyChain
 		return
 	}
 	nodes := c.Nodes()
 	node := nodes[0]
+	markDead := func(node Node) {
+		if ctx.Err() == nil {
+			node.MarkDead()
+		}
+	}
 
-	cn, err := node.Client.Dial(node.Addr, node.DialOptions...)
+	cn, err := node.Client.Dial(node.Addr, append([]DialOption{ContextDialOption(ctx)}, node.DialOptions...)...)
 	if err != nil {
-		node.MarkDead()
+		markDead(node)
 		return
 	}
 
+	// the connection dialed by the multiplexed transporter is shared by the streams of the session,
+	// so only the stream is closed by ctx.
+	stop := func() error { return nil }
+	if !node.Client.Transporter.Multiplex() {
+		stop = closeOnDone(ctx, cn)
+	}
+	// fail stops closing the connection by ctx, the error of ctx is reported if the connection is closed by it.
+	fail := func(e error) error {
+		if er := stop(); er != nil {
+			return er
+		}
+		return e
+	}
+
 	cn, err = node.Client.Handshake(cn, node.HandshakeOptions...)
 	if err != nil {
-		node.MarkDead()
+		markDead(node)
+		err = fail(err)
 		return
 	}
 	node.ResetDead()
+	if node.Client.Transporter.Multiplex() {
+		stop = closeOnDone(ctx, cn)
+	}
 
 	preNode := node
 	for _, node := range nodes[1:] {
@@ -237,13 +385,15 @@ func (c *Chain) getConn() (conn net.Conn, err error) {
 		cc, err = preNode.Client.Connect(cn, node.Addr, preNode.ConnectOptions...)
 		if err != nil {
 			cn.Close()
-			node.MarkDead()
+			markDead(node)
+			err = fail(err)
 			return
 		}
 		cc, err = node.Client.Handshake(cc, node.HandshakeOptions...)
 		if err != nil {
 			cn.Close()
-			node.MarkDead()
+			markDead(node)
+			err = fail(err)
 			return
 		}
 		node.ResetDead()
@@ -252,7 +402,163 @@ func (c *Chain) getConn() (conn net.Conn, err error) {
 		preNode = node
 	}
 
-	conn = cn
+	return stopConn(stop, cn, nil)
+}
+
+var errCloseWriteUnsupported = errors.New("close write not supported")
+
+// nodeConn is the connection to the target through the nodes, it is counted as an active connection of the nodes until closed.
+type nodeConn struct {
+	net.Conn
+	nodes []Node
+	once  sync.Once
+}
+
+func newNodeConn(conn net.Conn, nodes []Node) net.Conn {
+	for i := range nodes {
+		nodes[i].marker.addConns(1)
+	}
+	return &nodeConn{Conn: conn, nodes: nodes}
+}
+
+func (c *nodeConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	for i := range c.nodes {
+		c.nodes[i].marker.addBytes(int64(n), 0)
+	}
+	return
+}
+
+func (c *nodeConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	for i := range c.nodes {
+		c.nodes[i].marker.addBytes(0, int64(n))
+	}
+	return
+}
+
+func (c *nodeConn) addSpliced(read, written int64) {
+	for i := range c.nodes {
+		c.nodes[i].marker.addBytes(read, written)
+	}
+}
+
+func (c *nodeConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *nodeConn) Close() error {
+	c.once.Do(func() {
+		for i := range c.nodes {
+			c.nodes[i].marker.addConns(-1)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the connection if it supports half-close.
+func (c *nodeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+// TraceHop is the result of a hop traced by Chain.Trace.
+type TraceHop struct {
+	// Hop is the index of the node in the chain starting from 1, it is 0 for the target.
+	Hop int
+	// Node is the node of the hop, it is empty for the target.
+	Node Node
+	// Addr is the address of the hop.
+	Addr string
+	// Stage is the stage of the hop: dial, handshake or connect.
+	Stage string
+	// Code is the reply code of the failure reply from the proxy server, if any.
+	Code int
+	// Duration is the elapsed time since the hop started.
+	Duration time.Duration
+	Err      error
+}
+
+// Trace walks the chain hop by hop to the target address addr,
+// by dialing and handshaking with each node in turn, then connecting to addr via the last node.
+// It returns the traced hops until the first failure, to localize the broken hop of the chain.
+// If addr is empty, the trace stops at the last node.
+func (c *Chain) Trace(addr string) (hops []TraceHop, err error) {
+	route, err := c.selectRouteFor(addr)
+	if err != nil {
+		return
+	}
+	nodes := route.Nodes()
+
+	trace := func(n int, node Node, addr, stage string, start time.Time, e error) bool {
+		hop := TraceHop{
+			Hop:      n,
+			Node:     node,
+			Addr:     addr,
+			Stage:    stage,
+			Duration: time.Since(start),
+			Err:      e,
+		}
+		if re, ok := e.(*ReplyError); ok {
+			hop.Code = re.Code
+		}
+		hops = append(hops, hop)
+		return e == nil
+	}
+
+	if len(nodes) == 0 {
+		if addr == "" {
+			return
+		}
+		start := time.Now()
+		conn, e := net.DialTimeout("tcp", addr, DialTimeout)
+		if conn != nil {
+			conn.Close()
+		}
+		trace(0, Node{}, addr, "connect", start, e)
+		return
+	}
+
+	start := time.Now()
+	node := nodes[0]
+	cn, e := node.Client.Dial(node.Addr, node.DialOptions...)
+	if !trace(1, node, node.Addr, "dial", start, e) {
+		return
+	}
+	defer func() {
+		cn.Close()
+	}()
+	cc, e := node.Client.Handshake(cn, node.HandshakeOptions...)
+	if !trace(1, node, node.Addr, "handshake", start, e) {
+		return
+	}
+	cn = cc
+
+	preNode := node
+	for i, node := range nodes[1:] {
+		start := time.Now()
+		cc, e := preNode.Client.Connect(cn, node.Addr, preNode.ConnectOptions...)
+		if !trace(i+2, node, node.Addr, "connect", start, e) {
+			return
+		}
+		cn = cc
+		if cc, e = node.Client.Handshake(cn, node.HandshakeOptions...); !trace(i+2, node, node.Addr, "handshake", start, e) {
+			return
+		}
+		cn = cc
+		preNode = node
+	}
+
+	if addr == "" {
+		return
+	}
+	start = time.Now()
+	cOpts := append([]ConnectOption{AddrConnectOption(addr)}, preNode.ConnectOptions...)
+	if cc, e = preNode.Client.Connect(cn, addr, cOpts...); trace(0, Node{}, addr, "connect", start, e) {
+		cn = cc
+	}
 	return
 }
 
@@ -262,6 +568,14 @@ func (c *Chain) selectRoute() (route *Chain, err error) {
 
 // selectRouteFor selects route with bypass testing.
 func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
+	if c != nil {
+		for _, rule := range c.Rules {
+			if rule.Patterns.Contains(addr) {
+				return rule.Chain.selectRouteFor(addr)
+			}
+		}
+	}
+
 	if c.IsEmpty() {
 		return newRoute(), nil
 	}
@@ -301,10 +615,11 @@ func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
 
 // ChainOptions holds options for Chain.
 type ChainOptions struct {
-	Retries  int
-	Timeout  time.Duration
-	Hosts    *Hosts
-	Resolver Resolver
+	Retries   int
+	Timeout   time.Duration
+	Hosts     *Hosts
+	Resolver  Resolver
+	DNSPolicy string
 }
 
 // ChainOption allows a common way to set chain options.
@@ -337,3 +652,10 @@ func ResolverChainOption(resolver Resolver) ChainOption {
 		opts.Resolver = resolver
 	}
 }
+
+// DNSPolicyChainOption specifies the DNS resolution policy used by Chain.Dial if the route does not set it.
+func DNSPolicyChainOption(policy string) ChainOption {
+	return func(opts *ChainOptions) {
+		opts.DNSPolicy = policy
+	}
+}
@@ -0,0 +1,292 @@
+package gost
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestChainTrace(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	ln1, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server1 := &Server{Listener: ln1, Handler: SOCKS5Handler()}
+	go server1.Run()
+	defer server1.Close()
+
+	ln2, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server2 := &Server{Listener: ln2, Handler: HTTPHandler(UsersHandlerOption(url.UserPassword("admin", "123456")))}
+	go server2.Run()
+	defer server2.Close()
+
+	socksNode := Node{
+		Addr:   server1.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+	}
+	httpNode := Node{
+		Addr:   server2.Addr().String(),
+		Client: &Client{Connector: HTTPConnector(nil), Transporter: TCPTransporter()},
+	}
+	targetURL, _ := url.Parse(httpSrv.URL)
+	target := targetURL.Host
+
+	// the chain is fine.
+	hops, err := NewChain(socksNode).Trace(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 3 || hops[2].Hop != 0 || hops[2].Err != nil {
+		t.Fatalf("unexpected hops: %+v", hops)
+	}
+
+	// the trace stops at the last node without the target.
+	hops, err = NewChain(socksNode).Trace("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 2 || hops[1].Hop != 1 || hops[1].Err != nil {
+		t.Fatalf("unexpected hops: %+v", hops)
+	}
+
+	// the second hop rejects the connection.
+	hops, err = NewChain(socksNode, httpNode).Trace(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := hops[len(hops)-1]
+	if len(hops) != 5 || last.Hop != 0 || last.Stage != "connect" || last.Code != 407 {
+		t.Errorf("unexpected hops: %+v", hops)
+	}
+
+	// the first hop is unreachable.
+	server1.Close()
+	hops, err = NewChain(socksNode, httpNode).Trace(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 1 || hops[0].Hop != 1 || hops[0].Stage != "dial" || hops[0].Err == nil {
+		t.Errorf("unexpected hops: %+v", hops)
+	}
+}
+
+func TestChainDialContext(t *testing.T) {
+	// the server accepts the connections, but never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	node := Node{
+		Addr:   ln.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+	}
+	chain := NewChain(node)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := chain.DialContext(ctx, "example.com:80"); err != context.DeadlineExceeded {
+		t.Errorf("should be aborted by the deadline, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the dial should return within the deadline, took %v", d)
+	}
+
+	// the in-flight handshake is aborted by closing the connection.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := node.Client.ConnectContext(ctx, conn, "example.com:80")
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("should be canceled, got %v", err)
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Error("the connection should be closed")
+	}
+}
+
+func TestChainDialContextClose(t *testing.T) {
+	// the server never replies, and reports the connections closed by the client.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	node := Node{
+		Addr:   ln.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+		marker: &failMarker{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewChain(node).DialContext(ctx, "example.com:80")
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("should be canceled, got %v", err)
+	}
+
+	// the in-flight connection is closed rather than abandoned until the connect timeout.
+	select {
+	case <-closed:
+	case <-time.After(ConnectTimeout / 2):
+		t.Error("the connection to the node should be closed")
+	}
+	if n := node.marker.FailCount(); n != 0 {
+		t.Errorf("the node should not be marked dead by the abort, got %d fails", n)
+	}
+}
+
+func TestChainDNSPolicy(t *testing.T) {
+	// the server records the address of the request.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addrs := make(chan *gosocks5.Addr, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			gosocks5.ReadMethods(conn)
+			gosocks5.WriteMethod(gosocks5.MethodNoAuth, conn)
+			if req, err := gosocks5.ReadRequest(conn); err == nil {
+				addrs <- req.Addr
+			}
+			gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+			conn.Close()
+		}
+	}()
+
+	hosts := NewHosts(NewHost(net.ParseIP("10.0.0.1"), "example.test"))
+	remoteRules := []DNSRule{{Policy: DNSRemote, Patterns: NewBypassPatterns(false, "*.test")}}
+	for i, tc := range []struct {
+		policy  string
+		service string // the policy of the service
+		rules   []DNSRule
+		addr    string
+		atyp    uint8
+		host    string
+	}{
+		{"", "", nil, "example.test:80", gosocks5.AddrIPv4, "10.0.0.1"},
+		{"", "", nil, "example.com:80", gosocks5.AddrDomain, "example.com"},
+		{DNSRemote, "", nil, "example.test:80", gosocks5.AddrDomain, "example.test"},
+		{DNSLocal, "", nil, "example.test:80", gosocks5.AddrIPv4, "10.0.0.1"},
+		{DNSLocal, "", nil, "127.0.0.1:80", gosocks5.AddrIPv4, "127.0.0.1"},
+		{DNSLocal, "", remoteRules, "example.test:80", gosocks5.AddrDomain, "example.test"},
+		{"", "", remoteRules, "127.0.0.1:80", gosocks5.AddrIPv4, "127.0.0.1"},
+		{"", DNSRemote, nil, "example.test:80", gosocks5.AddrDomain, "example.test"},
+		{DNSLocal, DNSRemote, nil, "example.test:80", gosocks5.AddrIPv4, "10.0.0.1"},
+		{"", DNSLocal, remoteRules, "example.test:80", gosocks5.AddrDomain, "example.test"},
+	} {
+		node := Node{
+			Addr:     ln.Addr().String(),
+			Client:   &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+			Values:   url.Values{"dns": []string{tc.policy}},
+			DNSRules: tc.rules,
+		}
+		NewChain(node).Dial(tc.addr, HostsChainOption(hosts), DNSPolicyChainOption(tc.service))
+		addr := <-addrs
+		if addr.Type != tc.atyp || addr.Host != tc.host {
+			t.Errorf("#%d unexpected address: %d %s", i, addr.Type, addr.Host)
+		}
+	}
+}
+
+func TestChainBypass(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	// the proxy is down, only the bypassed targets are reachable.
+	bypass := NewBypass(false)
+	if err := bypass.Reload(strings.NewReader("127.0.0.0/8\n.lan\n*.local.test\n")); err != nil {
+		t.Fatal(err)
+	}
+	node := healthTestNode(1, closedAddr(t))
+	node.Bypass = bypass
+	chain := NewChain(node)
+
+	for _, addr := range []string{httpSrv.Listener.Addr().String(), "nas.lan:80", "lan:80", "a.local.test:80"} {
+		route, err := chain.selectRouteFor(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !route.IsEmpty() {
+			t.Errorf("%s should be connected directly", addr)
+		}
+	}
+	if route, _ := chain.selectRouteFor("example.com:80"); route.IsEmpty() {
+		t.Error("example.com should be connected through the chain")
+	}
+
+	conn, err := chain.Dial(httpSrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// the whitelist mode: only the listed targets go through the chain.
+	if err := bypass.Reload(strings.NewReader("reverse true\n*.proxied.test\n")); err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := chain.selectRouteFor("www.proxied.test:80"); route.IsEmpty() {
+		t.Error("www.proxied.test should be connected through the chain")
+	}
+	if _, err := chain.Dial(httpSrv.Listener.Addr().String()); err != nil {
+		t.Errorf("the target not listed should be connected directly: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package gost
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/url"
@@ -33,6 +34,73 @@ func (c *Client) Connect(conn net.Conn, addr string, options ...ConnectOption) (
 	return c.Connector.Connect(conn, addr, options...)
 }
 
+// DialContext is like Dial, but the in-flight dial is aborted once ctx is done, the connection established late is closed.
+func (c *Client) DialContext(ctx context.Context, addr string, options ...DialOption) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := c.Dial(addr, append([]DialOption{ContextDialOption(ctx)}, options...)...)
+	if err == nil && ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return conn, err
+}
+
+// HandshakeContext is like Handshake, but the in-flight handshake is aborted by closing the connection conn once ctx is done.
+func (c *Client) HandshakeContext(ctx context.Context, conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
+	stop := closeOnDone(ctx, conn)
+	cc, err := c.Handshake(conn, options...)
+	return stopConn(stop, cc, err)
+}
+
+// ConnectContext is like Connect, but the in-flight request is aborted by closing the connection conn once ctx is done.
+func (c *Client) ConnectContext(ctx context.Context, conn net.Conn, addr string, options ...ConnectOption) (net.Conn, error) {
+	stop := closeOnDone(ctx, conn)
+	cc, err := c.Connect(conn, addr, options...)
+	return stopConn(stop, cc, err)
+}
+
+// closeOnDone closes the connection conn once ctx is done to abort the in-flight I/O on it, until stop is called.
+// The stop reports the error of ctx if conn is closed.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return func() error { return err }
+	}
+
+	done := make(chan struct{})
+	closed := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- ctx.Err()
+		case <-done:
+			closed <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-closed
+	}
+}
+
+// stopConn calls stop of closeOnDone once the connection cc is obtained,
+// cc is closed and the error of the context is returned if the connection is closed by the context.
+func stopConn(stop func() error, cc net.Conn, err error) (net.Conn, error) {
+	if e := stop(); e != nil {
+		if err == nil {
+			cc.Close()
+		}
+		return nil, e
+	}
+	return cc, err
+}
+
 // DefaultClient is a standard HTTP proxy client.
 var DefaultClient = &Client{Connector: HTTPConnector(nil), Transporter: TCPTransporter()}
 
@@ -56,6 +124,23 @@ type Connector interface {
 	Connect(conn net.Conn, addr string, options ...ConnectOption) (net.Conn, error)
 }
 
+// ReplyError is the error of the failure reply from the proxy server, with the reply code of the protocol,
+// such as the status code of HTTP or the reply field of SOCKS.
+type ReplyError struct {
+	Protocol string
+	Code     int
+	Msg      string
+	// Detail is the reason of the failure reported by the server, see ErrorDetailHandlerOption.
+	Detail string
+}
+
+func (e *ReplyError) Error() string {
+	if e.Detail != "" {
+		return e.Msg + ": " + e.Detail
+	}
+	return e.Msg
+}
+
 // Transporter is responsible for handshaking with the proxy server.
 type Transporter interface {
 	Dial(addr string, options ...DialOption) (net.Conn, error)
@@ -82,10 +167,7 @@ func (tr *tcpTransporter) Dial(addr string, options ...DialOption) (net.Conn, er
 	if timeout <= 0 {
 		timeout = DialTimeout
 	}
-	if opts.Chain == nil {
-		return net.DialTimeout("tcp", addr, timeout)
-	}
-	return opts.Chain.Dial(addr)
+	return opts.dial(addr, timeout)
 }
 
 func (tr *tcpTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
@@ -128,8 +210,11 @@ func (tr *udpTransporter) Multiplex() bool {
 
 // DialOptions describes the options for Transporter.Dial.
 type DialOptions struct {
-	Timeout time.Duration
-	Chain   *Chain
+	Timeout    time.Duration
+	Chain      *Chain
+	MaxStreams int
+	KeepAlive  time.Duration
+	Context    context.Context
 }
 
 // DialOption allows a common way to set DialOptions.
@@ -149,6 +234,50 @@ func ChainDialOption(chain *Chain) DialOption {
 	}
 }
 
+// MaxStreamsDialOption specifies the maximum number of the streams of a multiplexed session,
+// a new session is established once it is reached.
+func MaxStreamsDialOption(n int) DialOption {
+	return func(opts *DialOptions) {
+		opts.MaxStreams = n
+	}
+}
+
+// KeepAliveDialOption specifies the keep-alive period of the TCP connection dialed by Transporter.Dial,
+// the default period of net.Dialer is used if it is zero, and the keep-alive is disabled if it is negative.
+func KeepAliveDialOption(period time.Duration) DialOption {
+	return func(opts *DialOptions) {
+		opts.KeepAlive = period
+	}
+}
+
+// ContextDialOption specifies the context of Transporter.Dial, the in-flight dial is aborted once it is done.
+func ContextDialOption(ctx context.Context) DialOption {
+	return func(opts *DialOptions) {
+		opts.Context = ctx
+	}
+}
+
+func (opts *DialOptions) context() context.Context {
+	if opts.Context == nil {
+		return context.Background()
+	}
+	return opts.Context
+}
+
+// dial connects to the TCP address addr directly or through the chain of the options.
+func (opts *DialOptions) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if opts.Chain == nil {
+		return opts.dialTCP(addr, timeout)
+	}
+	return opts.Chain.DialContext(opts.context(), addr)
+}
+
+// dialTCP connects to the TCP address addr directly.
+func (opts *DialOptions) dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout, KeepAlive: opts.KeepAlive}
+	return d.DialContext(opts.context(), "tcp", addr)
+}
+
 // HandshakeOptions describes the options for handshake.
 type HandshakeOptions struct {
 	Addr       string
@@ -161,6 +290,7 @@ type HandshakeOptions struct {
 	WSOptions  *WSOptions
 	KCPConfig  *KCPConfig
 	QUICConfig *QUICConfig
+	SSHConfig  *SSHClientConfig
 }
 
 // HandshakeOption allows a common way to set HandshakeOptions.
@@ -236,6 +366,13 @@ func QUICConfigHandshakeOption(config *QUICConfig) HandshakeOption {
 	}
 }
 
+// SSHConfigHandshakeOption specifies the SSH client config used by SSH handshake
+func SSHConfigHandshakeOption(config *SSHClientConfig) HandshakeOption {
+	return func(opts *HandshakeOptions) {
+		opts.SSHConfig = config
+	}
+}
+
 // ConnectOptions describes the options for Connector.Connect.
 type ConnectOptions struct {
 	Addr      string
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ginuerzh/gost"
+)
+
+// certCmd generates the CA and the node certificates for the mutual TLS between the gost nodes, such as
+// 'gost cert ca -o ca' writes ca.crt and ca.key, then 'gost cert issue -hosts node1.example.com node1'
+// writes node1.crt and node1.key signed by the CA. The nodes trust each other by the 'ca' option,
+// and present their own certificates by the 'cert' and 'key' options.
+func certCmd(args []string) error {
+	fs := flag.NewFlagSet("cert", flag.ExitOnError)
+	caFile := fs.String("ca", "ca.crt", "CA certificate file signing the node certificate")
+	caKeyFile := fs.String("cakey", "ca.key", "private key file of the CA")
+	hosts := fs.String("hosts", "", "comma separated IP addresses, DNS names or URIs of the node certificate, default is the name")
+	days := fs.Int("days", 0, "days the certificate is valid for (default 3650 for CA, 365 for node)")
+	out := fs.String("o", "", "output file name without the extension, default is the name")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gost cert ca [-days days] [-o file] [name]")
+		fmt.Fprintln(os.Stderr, "       gost cert issue [-ca ca.crt] [-cakey ca.key] [-hosts hosts] [-days days] [-o file] name")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	var certPEM, keyPEM []byte
+	var err error
+	name := fs.Arg(0)
+	validFor := time.Duration(*days) * 24 * time.Hour
+
+	switch action {
+	case "ca":
+		if name == "" {
+			name = "gost CA"
+		}
+		if validFor <= 0 {
+			validFor = 3650 * 24 * time.Hour
+		}
+		if *out == "" {
+			*out = "ca"
+		}
+		certPEM, keyPEM, err = gost.GenerateCA(name, validFor)
+	case "issue":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if validFor <= 0 {
+			validFor = 365 * 24 * time.Hour
+		}
+		if *out == "" {
+			*out = name
+		}
+		caCert, er := ioutil.ReadFile(*caFile)
+		if er != nil {
+			return er
+		}
+		caKey, er := ioutil.ReadFile(*caKeyFile)
+		if er != nil {
+			return er
+		}
+		var sans []string
+		for _, s := range strings.Split(*hosts, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				sans = append(sans, s)
+			}
+		}
+		certPEM, keyPEM, err = gost.IssueCertificate(caCert, caKey, name, sans, validFor)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		return err
+	}
+
+	certOut, keyOut := *out+".crt", *out+".key"
+	for _, fname := range []string{certOut, keyOut} {
+		if _, err := os.Stat(fname); err == nil {
+			return errors.New(fname + " already exists")
+		}
+	}
+	if err := ioutil.WriteFile(certOut, certPEM, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyOut, keyPEM, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s and %s are written\n", certOut, keyOut)
+	return nil
+}
@@ -2,16 +2,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ginuerzh/gost"
+	"github.com/go-log/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
@@ -20,24 +31,285 @@ var (
 
 type baseConfig struct {
 	route
-	Routes []route
-	Debug  bool
+	Routes   []route
+	Debug    bool
+	Interval string // the period for live reloading, such as 30s
+	Grace    string // the period for draining the connections on shutdown, such as 30s
+	Include  []string
+	// Capture is the pcap file that the relayed traffic is captured to, for debugging.
+	Capture string
+	// CaptureFilter is the comma separated IP/CIDR list of the connections to capture.
+	CaptureFilter string
+	// CheckOnStart enables the connectivity self-check of the listeners and chains before serving.
+	CheckOnStart bool
+	// CheckTarget is the target address the chains are checked to, the chains are checked to the last node if it is empty.
+	CheckTarget string
+	Vars        map[string]string
+	Chains      map[string]stringList
+
+	// named resources, which can be shared between services by referencing the name.
+	Secrets   map[string]string
+	Resolvers map[string]string
+	Hosts     map[string]string
+	Bypasses  map[string]string
 }
 
+// parseBaseConfig loads the config from the file or the remote HTTP(S) URL s.
 func parseBaseConfig(s string) (*baseConfig, error) {
-	file, err := os.Open(s)
+	data, err := loadConfig(s)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	if err := json.NewDecoder(file).Decode(baseCfg); err != nil {
+	if err := json.Unmarshal(data, baseCfg); err != nil {
+		return nil, configError(s, data, err)
+	}
+	if err := baseCfg.prepare(s); err != nil {
 		return nil, err
 	}
+	if err := baseCfg.validate(); err != nil {
+		return nil, err
+	}
+	configData = data
 
 	return baseCfg, nil
 }
 
+// loadConfig reads the raw config data from the file or the remote HTTP(S) URL s.
+// The encrypted config will be decrypted automatically.
+func loadConfig(s string) (data []byte, err error) {
+	if isRemoteConfig(s) {
+		data, err = fetchConfig(s)
+	} else {
+		data, err = ioutil.ReadFile(s)
+	}
+	if err != nil {
+		return
+	}
+	return decryptConfigData(data)
+}
+
+// configError annotates the decoding error err of the config data loaded from s with the line and column of the error.
+func configError(s string, data []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return fmt.Errorf("%s: %v", s, err)
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Errorf("%s:%d:%d: %v", s, line, col, err)
+}
+
+func isRemoteConfig(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+var (
+	// configClient is the HTTP client used for fetching the remote config.
+	configClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// fetchConfig fetches the config from the remote URL s.
+// The credentials in URL are sent by HTTP Basic Authentication,
+// and the environment variable GOST_CONFIG_TOKEN is sent as a bearer token if it is set.
+func fetchConfig(s string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, s, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GOST_CONFIG_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", "gost/"+gost.Version)
+
+	resp, err := configClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", s, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Period returns the reload period of the config.
+func (cfg *baseConfig) Period() time.Duration {
+	d, _ := time.ParseDuration(cfg.Interval)
+	return d
+}
+
+// Reload parses the config from r, validates it, then restarts the routers.
+// The command line routes are always kept.
+func (cfg *baseConfig) Reload(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if data, err = decryptConfigData(data); err != nil {
+		return err
+	}
+
+	c := &baseConfig{route: cliRoute.clone(), Grace: cliGrace}
+	if err := json.Unmarshal(data, c); err != nil {
+		return configError(configureFile, data, err)
+	}
+	if err := c.prepare(configureFile); err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	if err := restart(c); err != nil {
+		return err
+	}
+	cfg.Interval = c.Interval
+	return nil
+}
+
+// validate checks the grace period and the nodes of the config without listening on them,
+// the error points to the offending node, such as 'route 2: ChainNodes[1]: ...'.
+func (cfg *baseConfig) validate() error {
+	if _, err := parseGracePeriod(cfg.Grace); err != nil {
+		return err
+	}
+	for i, r := range cfg.routes() {
+		for n, ns := range r.ServeNodes {
+			if _, err := gost.ParseNode(ns); err != nil {
+				return fmt.Errorf("route %d: %v", i+1, nodeError("ServeNodes", n, err))
+			}
+		}
+		for n, ns := range r.ChainNodes {
+			if _, err := gost.ParseNode(ns); err != nil {
+				return fmt.Errorf("route %d: %v", i+1, nodeError("ChainNodes", n, err))
+			}
+		}
+	}
+	return nil
+}
+
+// genRouters creates the routers for all routes in the config.
+func (cfg *baseConfig) genRouters() ([]router, error) {
+	defaultRegistry.Stop()
+	defaultRegistry = newRegistry(cfg)
+	defaultMetrics.ClearChains()
+
+	rts, err := cfg.genRoutes(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(rts) == 0 {
+		return nil, errors.New("invalid config")
+	}
+	return rts, nil
+}
+
+// genRoutes creates the routers for the routes of the config selected by the filter, or all routes if filter is nil,
+// with the resources of the running registry.
+func (cfg *baseConfig) genRoutes(filter func(r *route) bool) ([]router, error) {
+	var rts []router
+	for i, r := range cfg.routes() {
+		if filter != nil && !filter(r) {
+			continue
+		}
+		rs, err := r.GenRouters()
+		if err != nil {
+			closeRouters(rts)
+			return nil, fmt.Errorf("route %d: %v", i+1, err)
+		}
+		rts = append(rts, rs...)
+	}
+	return rts, nil
+}
+
+// sameResources reports whether the configs share the same named resources and global settings,
+// then the running resources can be kept for the unchanged routes on reload.
+func (cfg *baseConfig) sameResources(c *baseConfig) bool {
+	return cfg.Debug == c.Debug &&
+		cfg.Capture == c.Capture &&
+		cfg.CaptureFilter == c.CaptureFilter &&
+		reflect.DeepEqual(cfg.Secrets, c.Secrets) &&
+		reflect.DeepEqual(cfg.Resolvers, c.Resolvers) &&
+		reflect.DeepEqual(cfg.Hosts, c.Hosts) &&
+		reflect.DeepEqual(cfg.Bypasses, c.Bypasses) &&
+		reflect.DeepEqual(cfg.Chains, c.Chains)
+}
+
+const defaultGracePeriod = 30 * time.Second
+
+// GracePeriod returns the period for draining the connections on shutdown.
+func (cfg *baseConfig) GracePeriod() time.Duration {
+	d, err := parseGracePeriod(cfg.Grace)
+	if err != nil {
+		return defaultGracePeriod
+	}
+	return d
+}
+
+// parseGracePeriod parses the grace period s, such as 30s, the default period is used if it is empty.
+func parseGracePeriod(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultGracePeriod, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = errors.New("negative duration")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid grace period %q: %v", s, err)
+	}
+	return d, nil
+}
+
+// periodFetch polls the remote config URL s periodically according to the period of the Reloader r,
+// the config is reloaded when the fetched content changes.
+func periodFetch(r gost.Reloader, s string, last []byte) error {
+	for {
+		period := r.Period()
+		if period < 0 {
+			log.Log("[reload] stopped:", s)
+			return nil
+		}
+		if period == 0 {
+			log.Log("[reload] disabled:", s)
+			return nil
+		}
+		if period < time.Second {
+			period = time.Second
+		}
+		<-time.After(period)
+
+		data, err := fetchConfig(s)
+		if err == nil {
+			data, err = decryptConfigData(data)
+		}
+		if err != nil {
+			log.Logf("[reload] %s: %s", s, err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+
+		last = data
+
+		log.Log("[reload]", s)
+		if err := r.Reload(bytes.NewReader(data)); err != nil {
+			log.Logf("[reload] %s: %s", s, err)
+		}
+	}
+}
+
 var (
 	defaultCertFile = "cert.pem"
 	defaultKeyFile  = "key.pem"
@@ -71,19 +343,71 @@ func loadCA(caFile string) (cp *x509.CertPool, err error) {
 	return
 }
 
-func parseKCPConfig(configFile string) (*gost.KCPConfig, error) {
-	if configFile == "" {
-		return nil, nil
-	}
-	file, err := os.Open(configFile)
-	if err != nil {
-		return nil, err
+// parseKCPConfig parses the KCP config of the node from the config file of the 'c' option,
+// or the default config if not specified, then the parameters are overridden by the node options,
+// such as 'kcp://:8388?mode=fast2&sndwnd=2048&datashard=10&parityshard=3&cipher=secret'.
+func parseKCPConfig(node gost.Node) (*gost.KCPConfig, error) {
+	config := &gost.KCPConfig{}
+	*config = gost.DefaultKCPConfig
+
+	if configFile := node.Get("c"); configFile != "" {
+		file, err := os.Open(configFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		config = &gost.KCPConfig{}
+		if err = json.NewDecoder(file).Decode(config); err != nil {
+			return nil, err
+		}
 	}
-	defer file.Close()
 
-	config := &gost.KCPConfig{}
-	if err = json.NewDecoder(file).Decode(config); err != nil {
-		return nil, err
+	// the 'key' option is the key file of the TLS certificate, so the 'cipher' option is used as the key like the QUIC.
+	for k, v := range map[string]*string{
+		"cipher": &config.Key,
+		"crypt":  &config.Crypt,
+		"mode":   &config.Mode,
+	} {
+		if s := node.Get(k); s != "" {
+			*v = s
+		}
+	}
+	// the mode presets the nodelay, interval, resend and nc options, the manual mode keeps the options set explicitly.
+	config.Init()
+	for _, k := range []string{"nodelay", "interval", "resend", "nc"} {
+		if node.Get(k) != "" {
+			config.Mode = "manual"
+		}
+	}
+	for k, v := range map[string]*int{
+		"mtu":         &config.MTU,
+		"sndwnd":      &config.SndWnd,
+		"rcvwnd":      &config.RcvWnd,
+		"datashard":   &config.DataShard,
+		"parityshard": &config.ParityShard,
+		"dscp":        &config.DSCP,
+		"nodelay":     &config.NoDelay,
+		"interval":    &config.Interval,
+		"resend":      &config.Resend,
+		"nc":          &config.NoCongestion,
+		"sockbuf":     &config.SockBuf,
+		"keepalive":   &config.KeepAlive,
+	} {
+		if node.Get(k) != "" {
+			*v = node.GetInt(k)
+		}
+	}
+	for k, v := range map[string]*bool{
+		"nocomp":     &config.NoComp,
+		"acknodelay": &config.AckNodelay,
+	} {
+		if node.Get(k) != "" {
+			*v = node.GetBool(k)
+		}
+	}
+	if keepAlive := time.Duration(config.KeepAlive) * time.Second; keepAlive >= gost.MuxKeepAliveTimeout {
+		return nil, fmt.Errorf("keepalive %s: should be less than the mux keepalive timeout %s", keepAlive, gost.MuxKeepAliveTimeout)
 	}
 	return config, nil
 }
@@ -204,6 +528,158 @@ func parseBypass(s string) *gost.Bypass {
 	return bp
 }
 
+// parseReputation loads the reputation lists configured by the file s, and refreshes them periodically.
+func parseReputation(s string) *gost.Reputation {
+	f, err := os.Open(s)
+	if err != nil {
+		log.Log("[reputation]", err)
+		return nil
+	}
+	defer f.Close()
+
+	rep := gost.NewReputation()
+	rep.Reload(f)
+	go gost.PeriodReload(rep, s)
+	go gost.PeriodRefresh(rep)
+
+	return rep
+}
+
+// parseGeoIP loads the GeoIP database from the file s.
+func parseGeoIP(s string) *gost.GeoIP {
+	f, err := os.Open(s)
+	if err != nil {
+		log.Log("[geo]", err)
+		return nil
+	}
+	defer f.Close()
+
+	geo := gost.NewGeoIP()
+	geo.Reload(f)
+	go gost.PeriodReload(geo, s)
+
+	return geo
+}
+
+// parseACL loads the access control list from the file s, and live reloads it.
+func parseACL(s string) *gost.ACL {
+	f, err := os.Open(s)
+	if err != nil {
+		log.Log("[acl]", err)
+		return nil
+	}
+	defer f.Close()
+
+	acl := gost.NewACL()
+	if err := acl.Reload(f); err != nil {
+		log.Log("[acl]", err)
+	}
+	go gost.PeriodReload(acl, s)
+
+	return acl
+}
+
+// parseGeoFilter creates the filter of the comma separated countries or AS numbers s with the GeoIP database geo,
+// the rules are reversed to block the matched clients if s starts with '~'.
+func parseGeoFilter(geo *gost.GeoIP, s string) *gost.GeoFilter {
+	if s == "" {
+		return nil
+	}
+	if geo == nil {
+		log.Log("[geo] the geoip database is required by", s)
+		return nil
+	}
+	var reversed bool
+	if strings.HasPrefix(s, "~") {
+		reversed = true
+		s = strings.TrimLeft(s, "~")
+	}
+	return gost.NewGeoFilter(geo, reversed, strings.Split(s, ",")...)
+}
+
+// parseValidator creates the protocol validator of the node by the strict option,
+// the protocol deviations are tolerated without counting if the option is not set.
+func parseValidator(node gost.Node) *gost.Validator {
+	if node.Get("strict") == "" {
+		return nil
+	}
+	return gost.NewValidator(node.GetBool("strict"))
+}
+
+// parseSSHClientConfig creates the SSH client config of the node by the options 'ssh_agent', 'ssh_key' and 'known_hosts'.
+// The ssh_agent is the socket path of the SSH agent, or true for $SSH_AUTH_SOCK,
+// the ssh_key is the private key file, decrypted by the option 'ssh_passphrase' if it is encrypted,
+// the host key of the server is verified against the known_hosts file if set.
+func parseSSHClientConfig(node gost.Node) (*gost.SSHClientConfig, error) {
+	config := &gost.SSHClientConfig{}
+	switch s := node.Get("ssh_agent"); s {
+	case "", "false":
+	case "true":
+		if config.AgentSocket = os.Getenv("SSH_AUTH_SOCK"); config.AgentSocket == "" {
+			return nil, errors.New("ssh agent: SSH_AUTH_SOCK is not set")
+		}
+	default:
+		config.AgentSocket = s
+	}
+	if s := node.Get("ssh_key"); s != "" {
+		signer, err := loadSSHKey(s, node.Get("ssh_passphrase"))
+		if err != nil {
+			return nil, err
+		}
+		config.Signers = []ssh.Signer{signer}
+	}
+	if s := node.Get("known_hosts"); s != "" {
+		callback, err := knownhosts.New(s)
+		if err != nil {
+			return nil, err
+		}
+		config.HostKeyCallback = callback
+	}
+
+	if config.AgentSocket == "" && len(config.Signers) == 0 && config.HostKeyCallback == nil {
+		return nil, nil
+	}
+	return config, nil
+}
+
+// loadSSHKey loads the private key from the identity file, which is decrypted by the passphrase if it is encrypted.
+func loadSSHKey(file, passphrase string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh key %s: %v", file, err)
+	}
+	return signer, nil
+}
+
+// parseErrorPages loads the error page templates of the HTTP proxy from the file s.
+func parseErrorPages(s string) *gost.ErrorPages {
+	if s == "" {
+		return nil
+	}
+	f, err := os.Open(s)
+	if err != nil {
+		log.Log("[http]", err)
+		return nil
+	}
+	defer f.Close()
+
+	pages, err := gost.ParseErrorPages(f)
+	if err != nil {
+		log.Log("[http]", err)
+		return nil
+	}
+	return pages
+}
+
 func parseResolver(cfg string) gost.Resolver {
 	if cfg == "" {
 		return nil
@@ -212,39 +688,9 @@ func parseResolver(cfg string) gost.Resolver {
 
 	f, err := os.Open(cfg)
 	if err != nil {
-		for _, s := range strings.Split(cfg, ",") {
-			s = strings.TrimSpace(s)
-			if s == "" {
-				continue
-			}
-			if strings.HasPrefix(s, "https") {
-				ns := gost.NameServer{
-					Addr:     s,
-					Protocol: "https",
-				}
-				if err := ns.Init(); err == nil {
-					nss = append(nss, ns)
-				}
-				continue
-			}
-
-			ss := strings.Split(s, "/")
-			if len(ss) == 1 {
-				ns := gost.NameServer{
-					Addr: ss[0],
-				}
-				if err := ns.Init(); err == nil {
-					nss = append(nss, ns)
-				}
-			}
-			if len(ss) == 2 {
-				ns := gost.NameServer{
-					Addr:     ss[0],
-					Protocol: ss[1],
-				}
-				if err := ns.Init(); err == nil {
-					nss = append(nss, ns)
-				}
+		for _, ns := range gost.ParseNameServers(cfg) {
+			if err := ns.Init(); err == nil {
+				nss = append(nss, ns)
 			}
 		}
 		return gost.NewResolver(0, nss...)
@@ -259,6 +705,243 @@ func parseResolver(cfg string) gost.Resolver {
 	return resolver
 }
 
+func parseVirtualHosts(s string) (*gost.VirtualHosts, error) {
+	if s == "" {
+		return nil, nil
+	}
+	chains, err := defaultRegistry.Chains()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vhosts := gost.NewVirtualHosts(chains)
+	if err := vhosts.Reload(f); err != nil {
+		return nil, err
+	}
+
+	go gost.PeriodReload(vhosts, s)
+
+	return vhosts, nil
+}
+
+func parseTunnels(s string) *gost.Tunnels {
+	f, err := os.Open(s)
+	if err != nil {
+		return gost.NewTunnels(s)
+	}
+	defer f.Close()
+
+	tunnels := gost.NewTunnels("")
+	tunnels.Reload(f)
+
+	go gost.PeriodReload(tunnels, s)
+
+	return tunnels
+}
+
+// defaultMetrics collects the metrics of all services, which are kept across the live reloading.
+var defaultMetrics = gost.NewMetrics()
+
+// defaultSessions tracks the active sessions of all services for the admin API.
+var defaultSessions = gost.NewSessions()
+
+var (
+	traffics   = make(map[string]*gost.Traffic)
+	trafficMux sync.Mutex
+)
+
+// parseTraffic returns the traffic statistics reported to the file s every period,
+// the services with the same report file share the statistics, which are kept across the live reloading.
+func parseTraffic(s string, period time.Duration) *gost.Traffic {
+	if s == "" {
+		return nil
+	}
+
+	trafficMux.Lock()
+	defer trafficMux.Unlock()
+
+	if traffic := traffics[s]; traffic != nil {
+		return traffic
+	}
+	if period <= 0 {
+		period = time.Minute
+	}
+	traffic := gost.NewTraffic()
+	traffics[s] = traffic
+
+	go gost.PeriodTrafficReport(traffic, s, period)
+
+	return traffic
+}
+
+var (
+	logFiles   = make(map[string]io.Writer)
+	logFileMux sync.Mutex
+)
+
+// parseLogger creates the logger of the service by the node options 'name', 'log', 'log_level' and 'log_format'.
+// The logs are written to the file 'log', or stdout and stderr by the name, otherwise the default log output,
+// the services with the same log file share the file, which is kept open across the live reloading.
+// The log file is rotated once it exceeds 'log_max_size' megabytes, keeping 'log_backups' (default 3) rotated files.
+func parseLogger(node gost.Node) (*gost.ServiceLogger, error) {
+	name, sink, level, format := node.Get("name"), node.Get("log"), node.Get("log_level"), node.Get("log_format")
+	if name == "" && sink == "" && level == "" && format == "" {
+		return nil, nil
+	}
+
+	var w io.Writer
+	switch sink {
+	case "":
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		logFileMux.Lock()
+		defer logFileMux.Unlock()
+
+		w = logFiles[sink]
+		if w == nil {
+			var err error
+			if maxSize := node.GetInt("log_max_size"); maxSize > 0 {
+				backups := 3
+				if node.Get("log_backups") != "" {
+					backups = node.GetInt("log_backups")
+				}
+				w, err = gost.NewRotateWriter(sink, int64(maxSize)<<20, backups)
+			} else {
+				w, err = os.OpenFile(sink, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			}
+			if err != nil {
+				return nil, err
+			}
+			logFiles[sink] = w
+		}
+	}
+	return gost.NewServiceLogger(name, w, level, format)
+}
+
+// parseMirror creates the mirror to the endpoint addr for the targets matching the comma separated patterns.
+func parseMirror(addr, patterns string) *gost.Mirror {
+	if addr == "" {
+		return nil
+	}
+	return gost.NewMirrorPatterns(addr, strings.Split(patterns, ",")...)
+}
+
+// parseScanDetector creates the port scan detector of the node,
+// which allows at most 'scan' distinct targets per client within 'scan_window' (default 1m),
+// the client exceeding it is blocked or throttled ('scan_action') for 'scan_duration' (default scan_window).
+func parseScanDetector(node gost.Node) *gost.ScanDetector {
+	threshold := node.GetInt("scan")
+	if threshold <= 0 {
+		return nil
+	}
+	return gost.NewScanDetector(threshold, node.GetDuration("scan_window"),
+		node.Get("scan_action"), node.GetDuration("scan_duration"))
+}
+
+var (
+	banners   = make(map[string]*gost.Banner)
+	bannerMux sync.Mutex
+)
+
+// parseBanner returns the banner of the node, which bans the client for 'ban_duration' (default 10m)
+// when it fails the authentication more than 'ban' times within 'ban_window' (default 1m).
+// The services with the same settings share the banner, including the 'ban' admin service,
+// and the bans are kept across the live reloading.
+func parseBanner(node gost.Node) *gost.Banner {
+	threshold := node.GetInt("ban")
+	if threshold <= 0 {
+		return nil
+	}
+	window, duration := node.GetDuration("ban_window"), node.GetDuration("ban_duration")
+	key := fmt.Sprintf("%d/%v/%v", threshold, window, duration)
+
+	bannerMux.Lock()
+	defer bannerMux.Unlock()
+
+	banner := banners[key]
+	if banner == nil {
+		banner = gost.NewBanner(threshold, window, duration)
+		banners[key] = banner
+	}
+	return banner
+}
+
+var (
+	inspectors   = make(map[string]gost.Inspector)
+	inspectorMux sync.Mutex
+)
+
+// parseInspector returns the inspector streaming the sampled chunks to the external detector at addr,
+// the connection to the detector is shared by the services and kept across the live reloading.
+func parseInspector(addr string, rate, size int) gost.Inspector {
+	if addr == "" {
+		return nil
+	}
+
+	inspectorMux.Lock()
+	defer inspectorMux.Unlock()
+
+	inspector := inspectors[addr]
+	if inspector == nil {
+		inspector = gost.RemoteInspector(addr)
+		inspectors[addr] = inspector
+	}
+	if rate <= 1 && size <= 0 {
+		return inspector
+	}
+	return gost.SampledInspector(inspector, rate, size)
+}
+
+var (
+	captureFile string
+	captureOut  *os.File
+)
+
+// setCapture applies the packet capture option of the config cfg.
+func setCapture(cfg *baseConfig) error {
+	file, filter := cfg.Capture, cfg.CaptureFilter
+	if file+"?"+filter == captureFile {
+		return nil
+	}
+
+	gost.SetPacketCapture(nil)
+	if captureOut != nil {
+		captureOut.Close()
+		captureOut = nil
+	}
+	captureFile = file + "?" + filter
+	if file == "" {
+		return nil
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	var matchers []gost.Matcher
+	for _, s := range strings.Split(filter, ",") {
+		matchers = append(matchers, gost.NewMatcher(strings.TrimSpace(s)))
+	}
+	c, err := gost.NewPacketCapture(f, matchers...)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	captureOut = f
+	gost.SetPacketCapture(c)
+	log.Log("[capture]", file)
+	return nil
+}
+
 func parseHosts(s string) *gost.Hosts {
 	f, err := os.Open(s)
 	if err != nil {
@@ -273,3 +956,108 @@ func parseHosts(s string) *gost.Hosts {
 
 	return hosts
 }
+
+// parseRate parses the bandwidth s into bytes per second. The rate with the suffix 'bps', 'kbps', 'mbps' or 'gbps'
+// is in bits per second, such as '10mbps', otherwise it is in bytes per second with the optional suffix 'k', 'm' or 'g',
+// such as '512k'.
+func parseRate(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	if v == "" {
+		return 0, nil
+	}
+
+	bits := strings.HasSuffix(v, "bps")
+	v = strings.TrimSuffix(v, "bps")
+	v = strings.TrimSuffix(v, "b")
+
+	unit := 1.0
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'k':
+			unit = 1e3
+		case 'm':
+			unit = 1e6
+		case 'g':
+			unit = 1e9
+		}
+		if unit > 1 {
+			v = v[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if bits {
+		f /= 8
+	}
+	return int64(f * unit), nil
+}
+
+var (
+	globalBandwidths = make(map[int64]*gost.Bandwidth)
+	bandwidthMux     sync.Mutex
+)
+
+// parseRateLimits creates the bandwidth limits of the service by the node options 'rlimit' (each connection),
+// 'rlimit_user' (each authenticated user), 'rlimit_total' (the service) and 'rlimit_global'.
+// The services with the same 'rlimit_global' share the limit, which is kept across the live reloading.
+func parseRateLimits(node gost.Node) (*gost.RateLimits, error) {
+	var rates [4]int64
+	for i, key := range []string{"rlimit", "rlimit_user", "rlimit_total", "rlimit_global"} {
+		rate, err := parseRate(node.Get(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		rates[i] = rate
+	}
+	if rates == [4]int64{} {
+		return nil, nil
+	}
+
+	limits := &gost.RateLimits{
+		ConnRate: rates[0],
+		UserRate: rates[1],
+		Service:  gost.NewBandwidth(rates[2]),
+	}
+	if rate := rates[3]; rate > 0 {
+		bandwidthMux.Lock()
+		defer bandwidthMux.Unlock()
+
+		if limits.Global = globalBandwidths[rate]; limits.Global == nil {
+			limits.Global = gost.NewBandwidth(rate)
+			globalBandwidths[rate] = limits.Global
+		}
+	}
+	return limits, nil
+}
+
+// parseObfs selects the obfuscating transport of the node by the node option 'obfs',
+// 'http' for obfs-http and 'tls' for obfs-tls, it can only be used by the plain TCP transport.
+func parseObfs(node *gost.Node) error {
+	obfs := node.Get("obfs")
+	if obfs == "" {
+		return nil
+	}
+	if node.Transport != "tcp" {
+		return fmt.Errorf("obfs %s: not supported by the %s transport", obfs, node.Transport)
+	}
+	switch obfs {
+	case "http":
+		node.Transport = "ohttp"
+	case "tls":
+		node.Transport = "otls"
+	default:
+		return fmt.Errorf("obfs %s: unknown obfuscation", obfs)
+	}
+	return nil
+}
+
+// parseTimeout returns the duration of the node option key, such as 'dial_timeout=3s',
+// or the node option 'timeout' in seconds if it is not set.
+func parseTimeout(node gost.Node, key string) time.Duration {
+	if d := node.GetDuration(key); d > 0 {
+		return d
+	}
+	return time.Duration(node.GetInt("timeout")) * time.Second
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ginuerzh/gost"
+)
+
+func TestParseKCPConfig(t *testing.T) {
+	for _, tc := range []struct {
+		s                                       string
+		mode                                    string
+		noDelay, interval, resend, noCongestion int
+	}{
+		{"kcp://:8388", "fast", 0, 30, 2, 1},
+		{"kcp://:8388?mode=fast3", "fast3", 1, 10, 2, 1},
+		// the explicit options are kept, the others are preset by the mode.
+		{"kcp://:8388?mode=fast3&interval=15&nc=0", "manual", 1, 15, 2, 0},
+		{"kcp://:8388?nodelay=1", "manual", 1, 30, 2, 1},
+	} {
+		node, err := gost.ParseNode(tc.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := parseKCPConfig(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the config is initialized again by the transporter and the listener.
+		config.Init()
+		if config.Mode != tc.mode || config.NoDelay != tc.noDelay || config.Interval != tc.interval ||
+			config.Resend != tc.resend || config.NoCongestion != tc.noCongestion {
+			t.Errorf("%s: unexpected config mode %s, nodelay %d, interval %d, resend %d, nc %d", tc.s,
+				config.Mode, config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+		}
+	}
+
+	node, _ := gost.ParseNode("kcp://:8388?keepalive=30")
+	if _, err := parseKCPConfig(node); err == nil {
+		t.Error("the keepalive should be less than the mux keepalive timeout")
+	}
+}
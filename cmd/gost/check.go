@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"text/tabwriter"
+
+	"github.com/ginuerzh/gost"
+)
+
+// errCheckSkipped indicates that the check is not applicable.
+var errCheckSkipped = errors.New("skipped")
+
+// checkConfig validates the config cfg before serving: each listener is bound and released,
+// and each chain is traced end to end (to the target if it is not empty, otherwise to the last node).
+// It prints the pass/fail table of the checks to out, and reports whether all checks passed.
+func checkConfig(out io.Writer, cfg *baseConfig, target string) bool {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	ok := true
+	report := func(kind, name string, err error) {
+		result := "PASS"
+		if err == errCheckSkipped {
+			result = "SKIP"
+		} else if err != nil {
+			ok = false
+			result = fmt.Sprintf("FAIL: %s", err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", kind, name, result)
+	}
+
+	fmt.Fprintln(w, "CHECK\tNAME\tRESULT")
+	for i, r := range cfg.routes() {
+		for _, ns := range r.ServeNodes {
+			report("listen", ns, checkListen(ns))
+		}
+
+		if len(r.ChainNodes) == 0 {
+			continue
+		}
+		name := fmt.Sprintf("route %d (%d hops)", i+1, len(r.ChainNodes))
+		if r.chainName != "" {
+			name = fmt.Sprintf("chain %s (%d hops)", r.chainName, len(r.ChainNodes))
+		}
+		report("chain", name, checkChain(r, target))
+	}
+	return ok
+}
+
+// checkListen binds the listen address of the serve node ns, then releases it.
+func checkListen(ns string) error {
+	node, err := gost.ParseNode(ns)
+	if err != nil {
+		return err
+	}
+
+	switch node.Transport {
+	case "rtcp", "rudp": // the remote port forwarding listens on the remote side.
+		return errCheckSkipped
+	}
+
+	addr, err := gost.InterfaceAddr(node.Addr)
+	if err != nil {
+		return err
+	}
+	if listenNetwork(node) == "udp" {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		return pc.Close()
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// listenNetwork returns the network of the listener of the serve node. It is UDP for the packet transports,
+// which include the DNS proxy without a stream transport ('dns://' is served over UDP, 'dns+tcp://' over TCP),
+// and for the handlers that relay the datagrams only.
+func listenNetwork(node gost.Node) string {
+	switch node.Transport {
+	case "kcp", "quic", "udp", "ssu":
+		return "udp"
+	}
+	switch node.Protocol {
+	case "udp", "ssu":
+		return "udp"
+	}
+	return "tcp"
+}
+
+// checkChain traces the chain of the route r, it returns the error of the failed hop.
+func checkChain(r *route, target string) error {
+	chain, err := r.parseChain()
+	if err != nil {
+		return err
+	}
+	hops, err := chain.Trace(target)
+	if err != nil {
+		return err
+	}
+	for _, hop := range hops {
+		if hop.Err == nil {
+			continue
+		}
+		name := hop.Addr
+		if hop.Hop > 0 {
+			name = fmt.Sprintf("hop %d %s", hop.Hop, hop.Node.String())
+		}
+		return fmt.Errorf("%s %s: %s", name, hop.Stage, hop.Err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckListen(t *testing.T) {
+	busyTCP, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busyTCP.Close()
+	busyUDP, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busyUDP.Close()
+
+	for _, tc := range []struct {
+		ns string
+		ok bool
+	}{
+		{"socks5://" + freeAddr(t), true},
+		{"socks5://" + busyTCP.Addr().String(), false},
+		{"dns://" + busyTCP.Addr().String(), true},
+		{"dns://" + busyUDP.LocalAddr().String(), false},
+		{"dns+tcp://" + busyUDP.LocalAddr().String(), true},
+		{"ssu://" + busyUDP.LocalAddr().String(), false},
+		{"udp://" + busyTCP.Addr().String() + "/127.0.0.1:53", true},
+		{"udp://" + busyUDP.LocalAddr().String() + "/127.0.0.1:53", false},
+	} {
+		err := checkListen(tc.ns)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: listen check should pass %v, got %v", tc.ns, tc.ok, err)
+		}
+	}
+	if err := checkListen("rtcp://" + busyTCP.Addr().String() + "/127.0.0.1:80"); err != errCheckSkipped {
+		t.Errorf("the remote port forwarding should be skipped, got %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	addr := freeAddr(t)
+	rts, err := (&route{ServeNodes: stringList{"socks5://" + addr}}).GenRouters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rts[0].Serve()
+	defer rts[0].Close()
+
+	cfg := &baseConfig{
+		Chains: map[string]stringList{"upstream": {"socks5://" + addr}},
+	}
+	cfg.ServeNodes = stringList{"http://" + freeAddr(t)}
+	cfg.Chain = "upstream"
+	if err := cfg.resolveChains(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if !checkConfig(&out, cfg, "") {
+		t.Fatalf("all checks should pass:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "chain upstream (1 hops)") {
+		t.Errorf("the chain row should be reported by the chain name:\n%s", out.String())
+	}
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	cfg = &baseConfig{}
+	cfg.ServeNodes = stringList{"http://" + busy.Addr().String()}
+	cfg.ChainNodes = stringList{"socks5://" + freeAddr(t)}
+	out.Reset()
+	if checkConfig(&out, cfg, "") {
+		t.Fatalf("the checks of the address in use and the unreachable chain should fail:\n%s", out.String())
+	}
+	rows := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(rows) != 3 {
+		t.Fatalf("unexpected check rows:\n%s", out.String())
+	}
+	for _, row := range rows[1:] {
+		if !strings.Contains(row, "FAIL") {
+			t.Errorf("the check should fail: %s", row)
+		}
+	}
+	if !strings.Contains(rows[2], "route 1 (1 hops)") {
+		t.Errorf("the chain row should be reported by the route: %s", rows[2])
+	}
+}
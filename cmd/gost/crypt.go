@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	encryptedConfigPrefix = "gost-encrypted:v1:"
+	encryptSaltSize       = 16
+	encryptKeyIter        = 100000
+)
+
+var (
+	errNoPassphrase = errors.New("no passphrase, please set GOST_CONFIG_PASSPHRASE or GOST_CONFIG_KEYFILE")
+	errDecrypt      = errors.New("decrypt config: invalid passphrase or corrupted data")
+)
+
+// configPassphrase reads the passphrase for the encrypted config,
+// from the environment variable GOST_CONFIG_PASSPHRASE, or the key file specified by GOST_CONFIG_KEYFILE.
+func configPassphrase() ([]byte, error) {
+	if s := os.Getenv("GOST_CONFIG_PASSPHRASE"); s != "" {
+		return []byte(s), nil
+	}
+	if fname := os.Getenv("GOST_CONFIG_KEYFILE"); fname != "" {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			return data, nil
+		}
+	}
+	return nil, errNoPassphrase
+}
+
+func isEncryptedConfig(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedConfigPrefix))
+}
+
+func configCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2.Key(passphrase, salt, encryptKeyIter, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptConfig encrypts the config data with AES-256-GCM,
+// the key is derived from the passphrase by PBKDF2.
+// The output is: prefix + base64(salt + nonce + ciphertext).
+func encryptConfig(data, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, encryptSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := configCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	b := append(salt, nonce...)
+	b = aead.Seal(b, nonce, data, []byte(encryptedConfigPrefix))
+
+	buf := bytes.Buffer{}
+	buf.WriteString(encryptedConfigPrefix)
+	buf.WriteString(base64.StdEncoding.EncodeToString(b))
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// decryptConfig decrypts the config data encrypted by encryptConfig.
+func decryptConfig(data, passphrase []byte) ([]byte, error) {
+	s := strings.TrimSpace(strings.TrimPrefix(string(data), encryptedConfigPrefix))
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < encryptSaltSize {
+		return nil, errDecrypt
+	}
+
+	aead, err := configCipher(passphrase, b[:encryptSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	b = b[encryptSaltSize:]
+	if len(b) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(encryptedConfigPrefix))
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
+
+// decryptConfigData decrypts the data if it is an encrypted config.
+func decryptConfigData(data []byte) ([]byte, error) {
+	if !isEncryptedConfig(data) {
+		return data, nil
+	}
+	passphrase, err := configPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return decryptConfig(data, passphrase)
+}
+
+// encryptCmd implements the 'gost encrypt [-o output] file' command.
+func encryptCmd(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	output := fs.String("o", "", "output file, default is stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gost encrypt [-o output] file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if isEncryptedConfig(data) {
+		return fmt.Errorf("%s: already encrypted", fs.Arg(0))
+	}
+	passphrase, err := configPassphrase()
+	if err != nil {
+		return err
+	}
+	b, err := encryptConfig(data, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(*output, b, 0600)
+}
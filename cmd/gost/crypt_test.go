@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testConfigData = []byte(`{"ServeNodes": ["socks5://:1080"]}`)
+
+func TestEncryptConfig(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	data, err := encryptConfig(testConfigData, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedConfig(data) {
+		t.Fatalf("the encrypted config should have the prefix: %q", data)
+	}
+	if bytes.Contains(data, testConfigData) {
+		t.Error("the encrypted config should not contain the plain data")
+	}
+
+	plain, err := decryptConfig(data, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, testConfigData) {
+		t.Errorf("decrypted config should be %q, got %q", testConfigData, plain)
+	}
+
+	other, err := encryptConfig(testConfigData, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, other) {
+		t.Error("each encryption should use a new salt and nonce")
+	}
+}
+
+func TestDecryptConfigWrongPassphrase(t *testing.T) {
+	data, err := encryptConfig(testConfigData, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := decryptConfig(data, []byte("Passphrase"))
+	if err != errDecrypt {
+		t.Errorf("the wrong passphrase should fail with %v, got %v", errDecrypt, err)
+	}
+	if plain != nil {
+		t.Errorf("no data should be returned with the wrong passphrase, got %q", plain)
+	}
+}
+
+func TestDecryptConfigCorrupted(t *testing.T) {
+	passphrase := []byte("passphrase")
+	data, err := encryptConfig(testConfigData, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(string(data), encryptedConfigPrefix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) []byte {
+		return []byte(encryptedConfigPrefix + base64.StdEncoding.EncodeToString(b))
+	}
+
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1] ^= 0x01
+	salted := append([]byte(nil), raw...)
+	salted[0] ^= 0x01
+
+	for name, b := range map[string][]byte{
+		"empty":            encode(nil),
+		"truncated salt":   encode(raw[:encryptSaltSize-1]),
+		"truncated nonce":  encode(raw[:encryptSaltSize+4]),
+		"truncated data":   encode(raw[:len(raw)-1]),
+		"tampered data":    encode(tampered),
+		"tampered salt":    encode(salted),
+		"invalid encoding": []byte(encryptedConfigPrefix + "!not base64!"),
+	} {
+		plain, err := decryptConfig(b, passphrase)
+		if err == nil {
+			t.Errorf("%s: the corrupted config should be rejected", name)
+		}
+		if plain != nil {
+			t.Errorf("%s: no data should be returned, got %q", name, plain)
+		}
+	}
+}
+
+func TestDecryptConfigData(t *testing.T) {
+	if data, err := decryptConfigData(testConfigData); err != nil || !bytes.Equal(data, testConfigData) {
+		t.Errorf("the plain config should be returned as is, got %q (%v)", data, err)
+	}
+
+	data, err := encryptConfig(testConfigData, []byte("key file passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GOST_CONFIG_PASSPHRASE", "")
+	t.Setenv("GOST_CONFIG_KEYFILE", "")
+	if _, err := decryptConfigData(data); err != errNoPassphrase {
+		t.Errorf("the encrypted config without passphrase should fail with %v, got %v", errNoPassphrase, err)
+	}
+
+	keyfile := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(keyfile, []byte("key file passphrase\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOST_CONFIG_KEYFILE", keyfile)
+	if plain, err := decryptConfigData(data); err != nil || !bytes.Equal(plain, testConfigData) {
+		t.Errorf("the config should be decrypted by the key file, got %q (%v)", plain, err)
+	}
+
+	t.Setenv("GOST_CONFIG_PASSPHRASE", "wrong")
+	if _, err := decryptConfigData(data); err != errDecrypt {
+		t.Errorf("the passphrase should take precedence over the key file, got %v", err)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
 	_ "net/http/pprof"
 
@@ -17,20 +23,53 @@ import (
 
 var (
 	configureFile string
+	configData    []byte
 	baseCfg       = &baseConfig{}
+	cliRoute      route  // the route specified by command line flags
+	cliGrace      string // the grace period specified by command line flags
 )
 
+// commands are the sub-commands, such as 'gost encrypt config.json'.
+var commands = map[string]func(args []string) error{
+	"cert":       certCmd,
+	"encrypt":    encryptCmd,
+	"ping":       pingCmd,
+	"speedtest":  speedTestCmd,
+	"traceroute": tracerouteCmd,
+}
+
 func init() {
 	gost.SetLogger(&gost.LogLogger{})
+}
+
+// parseFlags runs the subcommand or parses the command line flags and the config file.
+// It is not run by init, so the package can be tested.
+func parseFlags() {
+	if len(os.Args) > 1 {
+		if cmd := commands[os.Args[1]]; cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Log(err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
 
 	var (
 		printVersion bool
+		check        bool
 	)
 
 	flag.Var(&baseCfg.route.ChainNodes, "F", "forward address, can make a forward chain")
 	flag.Var(&baseCfg.route.ServeNodes, "L", "listen address, can listen on multiple ports")
-	flag.StringVar(&configureFile, "C", "", "configure file")
+	flag.StringVar(&configureFile, "C", "", "configure file or HTTP(S) URL")
 	flag.BoolVar(&baseCfg.Debug, "D", false, "enable debug log")
+	flag.StringVar(&baseCfg.Capture, "capture", "", "capture the relayed traffic to pcap file for debugging")
+	flag.StringVar(&baseCfg.CaptureFilter, "capture_filter", "", "comma separated IP/CIDR list of the connections to capture")
+	flag.BoolVar(&check, "check", false, "check the listeners and chains of the config, then exit")
+	flag.BoolVar(&baseCfg.CheckOnStart, "check_on_start", false, "check the listeners and chains of the config before serving")
+	flag.StringVar(&baseCfg.CheckTarget, "check_target", "", "target address the chains are checked to, default is the last node of the chain")
+	flag.StringVar(&baseCfg.Grace, "grace", "", "period for draining the connections on shutdown, such as 30s (default 30s)")
 	flag.BoolVar(&printVersion, "V", false, "print version")
 	flag.Parse()
 
@@ -40,6 +79,13 @@ func init() {
 		os.Exit(0)
 	}
 
+	if _, err := parseGracePeriod(baseCfg.Grace); err != nil {
+		log.Log(err)
+		os.Exit(1)
+	}
+	cliRoute = baseCfg.route.clone()
+	cliGrace = baseCfg.Grace
+
 	if configureFile != "" {
 		_, err := parseBaseConfig(configureFile)
 		if err != nil {
@@ -47,6 +93,12 @@ func init() {
 			os.Exit(1)
 		}
 	}
+	if check {
+		if !checkConfig(os.Stdout, baseCfg, baseCfg.CheckTarget) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if flag.NFlag() == 0 {
 		flag.PrintDefaults()
 		os.Exit(0)
@@ -54,6 +106,8 @@ func init() {
 }
 
 func main() {
+	parseFlags()
+
 	if os.Getenv("PROFILING") != "" {
 		go func() {
 			log.Log(http.ListenAndServe("127.0.0.1:16060", nil))
@@ -75,38 +129,216 @@ func main() {
 	}
 	gost.DefaultTLSConfig = tlsConfig
 
+	if baseCfg.CheckOnStart {
+		checkConfig(os.Stdout, baseCfg, baseCfg.CheckTarget)
+	}
+
 	if err := start(); err != nil {
 		log.Log(err)
 		os.Exit(1)
 	}
 
-	select {}
+	handleSignals()
+}
+
+// handleSignals reloads the config file on SIGHUP, and shuts down gracefully on SIGTERM or SIGINT.
+// The second SIGTERM or SIGINT during the shutdown exits immediately.
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+
+	for sig := range ch {
+		if sig == syscall.SIGHUP {
+			if configureFile == "" {
+				log.Log("[reload] no config file to reload")
+				continue
+			}
+			if err := reloadConfig(configureFile); err != nil {
+				log.Log("[reload]", err)
+			}
+			continue
+		}
+
+		go func() {
+			<-ch
+			os.Exit(1)
+		}()
+		shutdown(baseCfg.GracePeriod())
+		os.Exit(0)
+	}
+}
+
+// reloadConfig reloads the config from the file or the remote HTTP(S) URL s.
+func reloadConfig(s string) error {
+	data, err := loadConfig(s)
+	if err != nil {
+		return err
+	}
+	if err := baseCfg.Reload(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	configData = data
+	log.Log("[reload] config reloaded")
+	return nil
+}
+
+// shutdown stops accepting the connections, then waits for the connections being handled to finish,
+// until the grace period is exceeded.
+func shutdown(grace time.Duration) {
+	routersMux.Lock()
+	rts := routers
+	routers = nil
+	routersMux.Unlock()
+
+	var conns int64
+	for i := range rts {
+		conns += rts[i].server.Conns()
+	}
+	log.Logf("[shutdown] draining %d connections in %v", conns, grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range rts {
+		wg.Add(1)
+		go func(r *router) {
+			defer wg.Done()
+			r.Shutdown(ctx)
+		}(&rts[i])
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		conns = 0
+		for i := range rts {
+			conns += rts[i].server.Conns()
+		}
+		log.Logf("[shutdown] grace period exceeded, %d connections dropped", conns)
+	}
 }
 
 func start() error {
 	gost.Debug = baseCfg.Debug
+	if err := setCapture(baseCfg); err != nil {
+		return err
+	}
 
-	var routers []router
-	rts, err := baseCfg.route.GenRouters()
+	rts, err := baseCfg.genRouters()
 	if err != nil {
 		return err
 	}
-	routers = append(routers, rts...)
+	serveRouters(rts)
 
-	for _, route := range baseCfg.Routes {
-		rts, err := route.GenRouters()
-		if err != nil {
-			return err
+	if configureFile != "" && baseCfg.Period() > 0 {
+		if isRemoteConfig(configureFile) {
+			go periodFetch(baseCfg, configureFile, configData)
+		} else {
+			go gost.PeriodReload(baseCfg, configureFile)
 		}
-		routers = append(routers, rts...)
 	}
 
-	if len(routers) == 0 {
-		return errors.New("invalid config")
-	}
+	return nil
+}
+
+var routersMux sync.Mutex
+
+func serveRouters(rts []router) {
+	routersMux.Lock()
+	defer routersMux.Unlock()
+
+	routers = rts
 	for i := range routers {
 		go routers[i].Serve()
 	}
+}
+
+// restart stops the running routers and starts the routers of the new config cfg.
+// If the new config can not be applied, the previous config is restored.
+// The unchanged routes are kept running if the configs share the same resources.
+func restart(cfg *baseConfig) error {
+	if baseCfg.sameResources(cfg) {
+		return reload(cfg)
+	}
 
+	routersMux.Lock()
+	closeRouters(routers)
+	routers = nil
+	routersMux.Unlock()
+
+	rts, err := cfg.genRouters()
+	if err != nil {
+		log.Log("[reload] restore the previous config:", err)
+		if rts, er := baseCfg.genRouters(); er == nil {
+			serveRouters(rts)
+		}
+		return err
+	}
+
+	gost.Debug = cfg.Debug
+	if err := setCapture(cfg); err != nil {
+		log.Log("[capture]", err)
+	}
+	baseCfg = cfg
+	serveRouters(rts)
+	return nil
+}
+
+// reload applies the new config cfg sharing the same resources with the running one,
+// only the routers of the removed and the changed routes are stopped, and the ones of the new routes are started.
+// If the new routes can not be started, the removed ones are restored.
+func reload(cfg *baseConfig) error {
+	routersMux.Lock()
+	defer routersMux.Unlock()
+
+	running := make(map[string][]router)
+	for _, rt := range routers {
+		running[rt.route] = append(running[rt.route], rt)
+	}
+	var kept []router
+	for _, r := range cfg.routes() {
+		key := r.key()
+		kept = append(kept, running[key]...)
+		delete(running, key)
+	}
+	for _, rts := range running {
+		closeRouters(rts)
+	}
+
+	added, err := cfg.genRoutes(func(r *route) bool {
+		for _, rt := range kept {
+			if rt.route == r.key() {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil && len(kept)+len(added) == 0 {
+		err = errors.New("invalid config")
+	}
+	if err != nil {
+		log.Log("[reload] restore the previous config:", err)
+		restored, er := baseCfg.genRoutes(func(r *route) bool {
+			_, ok := running[r.key()]
+			return ok
+		})
+		if er == nil {
+			added = restored
+		} else {
+			added = nil
+		}
+		routers = append(kept, added...)
+		for i := range added {
+			go added[i].Serve()
+		}
+		return err
+	}
+
+	log.Logf("[reload] %d routers kept, %d stopped, %d started", len(kept), len(routers)-len(kept), len(added))
+	baseCfg = cfg
+	routers = append(kept, added...)
+	for i := len(kept); i < len(routers); i++ {
+		go routers[i].Serve()
+	}
 	return nil
 }
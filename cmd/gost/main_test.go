@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config of the routes of the serve nodes to the file.
+func writeConfig(t *testing.T, file string, routes ...[]string) {
+	var cfg baseConfig
+	for _, nodes := range routes {
+		cfg.Routes = append(cfg.Routes, route{ServeNodes: nodes})
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startConfig serves the routers of the config file like start, the routers are closed when the test finishes.
+func startConfig(t *testing.T, file string) {
+	oldCfg, oldFile := baseCfg, configureFile
+	t.Cleanup(func() {
+		routersMux.Lock()
+		closeRouters(routers)
+		routers = nil
+		routersMux.Unlock()
+		baseCfg, configureFile = oldCfg, oldFile
+	})
+
+	baseCfg, configureFile = &baseConfig{}, file
+	if _, err := parseBaseConfig(file); err != nil {
+		t.Fatal(err)
+	}
+	rts, err := baseCfg.genRouters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRouters(rts)
+}
+
+// runningServers returns the servers of the running routers by the addresses of the nodes.
+func runningServers() map[string]interface{} {
+	routersMux.Lock()
+	defer routersMux.Unlock()
+
+	servers := make(map[string]interface{})
+	for _, rt := range routers {
+		servers[rt.node.Addr] = rt.server
+	}
+	return servers
+}
+
+func listening(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gost.json")
+	addr1, addr2, addr3 := freeAddr(t), freeAddr(t), freeAddr(t)
+	writeConfig(t, file, []string{"socks5://" + addr1}, []string{"http://" + addr2})
+	startConfig(t, file)
+	before := runningServers()
+
+	// the route of addr2 is removed and the route of addr3 is added.
+	writeConfig(t, file, []string{"socks5://" + addr1}, []string{"http://" + addr3})
+	if err := reloadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+	after := runningServers()
+	if len(after) != 2 || after[addr1] == nil || after[addr3] == nil {
+		t.Fatalf("unexpected routers after reload: %v", after)
+	}
+	if after[addr1] != before[addr1] {
+		t.Error("the router of the unchanged route should be kept")
+	}
+	if listening(addr2) {
+		t.Errorf("the router of the removed route on %s should be stopped", addr2)
+	}
+	if !listening(addr1) || !listening(addr3) {
+		t.Error("the routers of the kept and the added routes should be serving")
+	}
+
+	// the router of the route changed by the node options is restarted.
+	writeConfig(t, file, []string{"socks5://" + addr1 + "?retry=1"}, []string{"http://" + addr3})
+	if err := reloadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+	if servers := runningServers(); servers[addr1] == after[addr1] || servers[addr3] != after[addr3] {
+		t.Error("only the router of the changed route should be restarted")
+	}
+	if !listening(addr1) {
+		t.Errorf("the restarted router on %s should be serving", addr1)
+	}
+}
+
+func TestReloadConfigRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gost.json")
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	writeConfig(t, file, []string{"socks5://" + addr1}, []string{"http://" + addr2})
+	startConfig(t, file)
+	before := runningServers()
+
+	// the new route can not be started as the address is in use.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	writeConfig(t, file, []string{"socks5://" + addr1}, []string{"http://" + busy.Addr().String()})
+	if err := reloadConfig(file); err == nil {
+		t.Fatal("the route on the address in use should fail")
+	}
+
+	after := runningServers()
+	if len(after) != 2 || after[addr1] != before[addr1] || after[addr2] == nil {
+		t.Fatalf("the previous routers should be restored: %v", after)
+	}
+	if !listening(addr2) {
+		t.Errorf("the restored router on %s should be serving", addr2)
+	}
+	if len(baseCfg.Routes) != 2 || baseCfg.Routes[1].ServeNodes[0] != "http://"+addr2 {
+		t.Errorf("the previous config should be kept: %v", baseCfg.Routes)
+	}
+
+	writeConfig(t, file, []string{"socks5://" + addr1}, []string{"http://" + addr2})
+	if err := reloadConfig(file); err != nil {
+		t.Fatalf("the previous config should be reloaded after the failure: %v", err)
+	}
+}
+
+func TestReloadConfigGrace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gost.json")
+	addr := freeAddr(t)
+	writeConfig(t, file, []string{"socks5://" + addr})
+	startConfig(t, file)
+
+	if err := baseCfg.Reload(strings.NewReader(`{"Grace": "soon", "ServeNodes": ["socks5://` + addr + `"]}`)); err == nil {
+		t.Error("the invalid grace period should fail")
+	}
+	if d := baseCfg.GracePeriod(); d != defaultGracePeriod {
+		t.Errorf("grace period should be %v, got %v", defaultGracePeriod, d)
+	}
+	for _, tc := range []struct {
+		s  string
+		d  time.Duration
+		ok bool
+	}{
+		{"", defaultGracePeriod, true},
+		{"5s", 5 * time.Second, true},
+		{"0", 0, true},
+		{"-1s", 0, false},
+		{"30", 0, false},
+	} {
+		d, err := parseGracePeriod(tc.s)
+		if (err == nil) != tc.ok || d != tc.d {
+			t.Errorf("%q: grace period should be %v (ok %v), got %v (%v)", tc.s, tc.d, tc.ok, d, err)
+		}
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	r := route{
+		ServeNodes: stringList{"socks5://:1080"},
+		ChainNodes: stringList{"http://127.0.0.1:8080"},
+	}
+	c := r.clone()
+	if r.key() != c.key() {
+		t.Error("the cloned route should have the same key")
+	}
+	for _, changed := range []route{
+		{ServeNodes: stringList{"socks5://:1080?retry=1"}, ChainNodes: r.ChainNodes},
+		{ServeNodes: r.ServeNodes},
+		{ServeNodes: r.ServeNodes, ChainNodes: r.ChainNodes, Retries: 1},
+		{ServeNodes: r.ServeNodes, Chain: "upstream"},
+	} {
+		if changed.key() == r.key() {
+			t.Errorf("the changed route %+v should have a different key", changed)
+		}
+	}
+	c.ServeNodes[0] = "http://:8080"
+	if r.ServeNodes[0] != "socks5://:1080" {
+		t.Error("the cloned route should not share the nodes")
+	}
+}
+
+func TestRouterShutdownKCP(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.LocalAddr().String()
+	ln.Close()
+
+	rts, err := (&route{ServeNodes: stringList{"socks5+kcp://" + addr}}).GenRouters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rts[0].Serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rts[0].Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	// closing the router again does not panic.
+	rts[0].Close()
+}
@@ -14,14 +14,15 @@ import (
 )
 
 type peerConfig struct {
-	Strategy    string `json:"strategy"`
-	MaxFails    int    `json:"max_fails"`
-	FailTimeout time.Duration
-	period      time.Duration // the period for live reloading
-	Nodes       []string      `json:"nodes"`
-	group       *gost.NodeGroup
-	baseNodes   []gost.Node
-	stopped     chan struct{}
+	Strategy       string `json:"strategy"`
+	MaxFails       int    `json:"max_fails"`
+	FailTimeout    time.Duration
+	MaxFailTimeout time.Duration
+	period         time.Duration // the period for live reloading
+	Nodes          []string      `json:"nodes"`
+	group          *gost.NodeGroup
+	baseNodes      []gost.Node
+	stopped        chan struct{}
 }
 
 func newPeerConfig() *peerConfig {
@@ -48,8 +49,9 @@ func (cfg *peerConfig) Reload(r io.Reader) error {
 		nil,
 		gost.WithFilter(
 			&gost.FailFilter{
-				MaxFails:    cfg.MaxFails,
-				FailTimeout: cfg.FailTimeout,
+				MaxFails:       cfg.MaxFails,
+				FailTimeout:    cfg.FailTimeout,
+				MaxFailTimeout: cfg.MaxFailTimeout,
 			},
 			&gost.InvalidFilter{},
 		),
@@ -128,6 +130,8 @@ func (cfg *peerConfig) parse(r io.Reader) error {
 			cfg.MaxFails, _ = strconv.Atoi(ss[1])
 		case "fail_timeout":
 			cfg.FailTimeout, _ = time.ParseDuration(ss[1])
+		case "max_fail_timeout":
+			cfg.MaxFailTimeout, _ = time.ParseDuration(ss[1])
 		case "reload":
 			cfg.period, _ = time.ParseDuration(ss[1])
 		case "peer":
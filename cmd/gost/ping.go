@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ginuerzh/gost"
+)
+
+// pingStats is the latency statistics of a hop.
+type pingStats struct {
+	name     string
+	sent     int
+	received int
+	min, max time.Duration
+	total    time.Duration
+}
+
+func (s *pingStats) add(d time.Duration, err error) {
+	s.sent++
+	if err != nil {
+		return
+	}
+	s.received++
+	s.total += d
+	if s.min == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+}
+
+func (s *pingStats) String() string {
+	loss := 100 * float64(s.sent-s.received) / float64(s.sent)
+	if s.received == 0 {
+		return fmt.Sprintf("%s\t%.0f%%\t-\t-\t-", s.name, loss)
+	}
+	avg := s.total / time.Duration(s.received)
+	return fmt.Sprintf("%s\t%.0f%%\t%v\t%v\t%v", s.name, loss,
+		s.min.Round(10*time.Microsecond), avg.Round(10*time.Microsecond), s.max.Round(10*time.Microsecond))
+}
+
+// pingCmd measures the latency to the target through the chain, like mtr for the proxy chains.
+// Each probe connects to each hop of the chain in turn, then to the target,
+// and waits for the first byte of the response to the data sent.
+func pingCmd(args []string) error {
+	var rt route
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	fs.Var(&rt.ChainNodes, "F", "forward address, can make a forward chain")
+	configFile := fs.String("C", "", "configure file or HTTP(S) URL, its chain is used if -F is not set")
+	chainName := fs.String("chain", "", "the name of the chain defined in the configure file")
+	count := fs.Int("c", 3, "number of probes")
+	interval := fs.Duration("i", time.Second, "interval between the probes")
+	timeout := fs.Duration("t", 5*time.Second, "timeout of each step of the probe")
+	data := fs.String("d", "", "data sent to the target after connected, default is an HTTP HEAD request, '-' sends nothing")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gost ping [-F node]... [-C config] [-c count] target")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *count <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	target := fs.Arg(0)
+	if _, port, _ := net.SplitHostPort(target); port == "" {
+		target = net.JoinHostPort(target, "80")
+	}
+	host, _, _ := net.SplitHostPort(target)
+
+	switch *data {
+	case "":
+		*data = fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %s\r\nUser-Agent: gost/%s\r\nConnection: close\r\n\r\n", host, gost.Version)
+	case "-":
+		*data = ""
+	}
+
+	chain, err := parseCmdChain(&rt, *configFile, *chainName)
+	if err != nil {
+		return err
+	}
+
+	groups := chain.NodeGroups()
+	var hops []*pingStats
+	var prefixes []*gost.Chain // the chains to each hop
+	for i, group := range groups {
+		prefix := gost.NewChain()
+		prefix.AddNodeGroup(groups[:i+1]...)
+		prefixes = append(prefixes, prefix)
+
+		var names []string
+		for _, node := range group.Nodes() {
+			names = append(names, node.String())
+		}
+		hops = append(hops, &pingStats{name: strings.Join(names, ",")})
+	}
+	connect := &pingStats{name: target + " (connect)"}
+	firstByte := &pingStats{name: target + " (first byte)"}
+
+	fmt.Printf("PING %s via %d hop(s)\n", target, len(groups))
+	for i := 0; i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+
+		// the time to establish the chain to each hop.
+		for n, prefix := range prefixes {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			start := time.Now()
+			conn, err := prefix.ConnContext(ctx)
+			d := time.Since(start)
+			cancel()
+			if conn != nil {
+				conn.Close()
+			}
+			hops[n].add(d, err)
+			if err != nil {
+				fmt.Printf("hop %d %s: %s\n", n+1, hops[n].name, err)
+			}
+		}
+
+		d1, d2, err := pingTarget(chain, target, *data, *timeout)
+		connect.add(d1, err)
+		if err != nil {
+			fmt.Printf("%s: %s\n", target, err)
+			firstByte.add(0, err)
+			continue
+		}
+		firstByte.add(d2, nil)
+		fmt.Printf("%s: connect=%v first-byte=%v\n", target,
+			d1.Round(10*time.Microsecond), d2.Round(10*time.Microsecond))
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tNODE\tLOSS\tMIN\tAVG\tMAX")
+	for i, hop := range hops {
+		fmt.Fprintf(w, "%d\t%s\n", i+1, hop)
+	}
+	fmt.Fprintf(w, "-\t%s\n", connect)
+	fmt.Fprintf(w, "-\t%s\n", firstByte)
+	return w.Flush()
+}
+
+// parseCmdChain parses the chain of the diagnostic commands,
+// the chain of the config file (or the named chain in it) is used if the chain nodes of rt are not set.
+func parseCmdChain(rt *route, configFile, chainName string) (*gost.Chain, error) {
+	if len(rt.ChainNodes) == 0 && configFile != "" {
+		cfg, err := parseBaseConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		name := chainName
+		if name == "" {
+			name = cfg.route.Chain
+		}
+		if name != "" {
+			nodes, ok := cfg.Chains[name]
+			if !ok {
+				return nil, fmt.Errorf("chain %s: not found", name)
+			}
+			rt.ChainNodes = nodes
+		} else {
+			rt.ChainNodes = cfg.route.ChainNodes
+		}
+	}
+	return rt.parseChain()
+}
+
+// pingTarget connects to the target through the chain and sends the data,
+// it returns the durations of the connection and the first byte of the response from the start.
+func pingTarget(chain *gost.Chain, target, data string, timeout time.Duration) (connect, firstByte time.Duration, err error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := chain.DialContext(ctx, target)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	connect = time.Since(start)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if data != "" {
+		if _, err = io.WriteString(conn, data); err != nil {
+			return
+		}
+	}
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		return
+	}
+	firstByte = time.Since(start)
+	return
+}
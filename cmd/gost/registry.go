@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ginuerzh/gost"
+)
+
+// registry holds the named resources defined in config, they can be shared by services referencing them by name.
+// The resources that are not referenced by name are private to the service.
+type registry struct {
+	secrets   map[string]string
+	resolvers map[string]string
+	hosts     map[string]string
+	bypasses  map[string]string
+	chains    map[string]stringList
+
+	authenticators map[string]gost.Authenticator
+	resolverCache  map[string]gost.Resolver
+	hostsCache     map[string]*gost.Hosts
+	bypassCache    map[string]*gost.Bypass
+	chainCache     map[string]*gost.Chain
+	tunnels        map[string]*gost.Tunnels
+	reputations    map[string]*gost.Reputation
+	geoips         map[string]*gost.GeoIP
+	acls           map[string]*gost.ACL
+	shared         map[interface{}]bool
+	mux            sync.Mutex
+
+	// the health checkers of the chains, they have their own lock as the chains are parsed with the registry locked.
+	checkers   map[*gost.Chain][]*gost.HealthChecker
+	checkerMux sync.Mutex
+}
+
+func newRegistry(cfg *baseConfig) *registry {
+	return &registry{
+		secrets:        cfg.Secrets,
+		resolvers:      cfg.Resolvers,
+		hosts:          cfg.Hosts,
+		bypasses:       cfg.Bypasses,
+		chains:         cfg.Chains,
+		authenticators: make(map[string]gost.Authenticator),
+		resolverCache:  make(map[string]gost.Resolver),
+		hostsCache:     make(map[string]*gost.Hosts),
+		bypassCache:    make(map[string]*gost.Bypass),
+		chainCache:     make(map[string]*gost.Chain),
+		tunnels:        make(map[string]*gost.Tunnels),
+		reputations:    make(map[string]*gost.Reputation),
+		geoips:         make(map[string]*gost.GeoIP),
+		acls:           make(map[string]*gost.ACL),
+		shared:         make(map[interface{}]bool),
+		checkers:       make(map[*gost.Chain][]*gost.HealthChecker),
+	}
+}
+
+// defaultRegistry is the registry of the running config.
+var defaultRegistry = newRegistry(&baseConfig{})
+
+// Authenticator returns the named authenticator s, or a private one if s is not a name.
+func (r *registry) Authenticator(s string) (gost.Authenticator, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, ok := r.secrets[s]
+	if !ok {
+		return parseAuthenticator(s)
+	}
+	if au := r.authenticators[s]; au != nil {
+		return au, nil
+	}
+	au, err := parseAuthenticator(v)
+	if err != nil || au == nil {
+		return au, err
+	}
+	r.authenticators[s] = au
+	r.shared[au] = true
+	return au, nil
+}
+
+// Resolver returns the named resolver s, or a private one if s is not a name.
+func (r *registry) Resolver(s string) gost.Resolver {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, ok := r.resolvers[s]
+	if !ok {
+		return parseResolver(s)
+	}
+	if resolver := r.resolverCache[s]; resolver != nil {
+		return resolver
+	}
+	resolver := parseResolver(v)
+	if resolver != nil {
+		r.resolverCache[s] = resolver
+		r.shared[resolver] = true
+	}
+	return resolver
+}
+
+// Hosts returns the named hosts s, or a private one if s is not a name.
+func (r *registry) Hosts(s string) *gost.Hosts {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, ok := r.hosts[s]
+	if !ok {
+		return parseHosts(s)
+	}
+	if hosts := r.hostsCache[s]; hosts != nil {
+		return hosts
+	}
+	hosts := parseHosts(v)
+	if hosts != nil {
+		r.hostsCache[s] = hosts
+		r.shared[hosts] = true
+	}
+	return hosts
+}
+
+// Bypass returns the named bypass s, or a private one if s is not a name.
+func (r *registry) Bypass(s string) *gost.Bypass {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	v, ok := r.bypasses[s]
+	if !ok {
+		return parseBypass(s)
+	}
+	if bp := r.bypassCache[s]; bp != nil {
+		return bp
+	}
+	bp := parseBypass(v)
+	if bp != nil {
+		r.bypassCache[s] = bp
+		r.shared[bp] = true
+	}
+	return bp
+}
+
+// Chains returns all the named chains.
+func (r *registry) Chains() (map[string]*gost.Chain, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for name, nodes := range r.chains {
+		if r.chainCache[name] != nil {
+			continue
+		}
+		rt := route{ChainNodes: nodes}
+		chain, err := rt.parseChain()
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %v", name, err)
+		}
+		r.chainCache[name] = chain
+		r.shared[chain] = true
+	}
+
+	chains := make(map[string]*gost.Chain, len(r.chainCache))
+	for name, chain := range r.chainCache {
+		chains[name] = chain
+	}
+	return chains, nil
+}
+
+// Tunnels returns the reverse tunnels s, the services referencing the same tunnels share them.
+// The s is either the domain of the tunnels, or a file containing the tunnel services.
+func (r *registry) Tunnels(s string) *gost.Tunnels {
+	if s == "" {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if tunnels := r.tunnels[s]; tunnels != nil {
+		return tunnels
+	}
+	tunnels := parseTunnels(s)
+	r.tunnels[s] = tunnels
+	r.shared[tunnels] = true
+	return tunnels
+}
+
+// Reputation returns the reputation lists configured by the file s, the services referencing the same file share them.
+func (r *registry) Reputation(s string) *gost.Reputation {
+	if s == "" {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if rep := r.reputations[s]; rep != nil {
+		return rep
+	}
+	rep := parseReputation(s)
+	if rep != nil {
+		r.reputations[s] = rep
+		r.shared[rep] = true
+		defaultMetrics.SetReputation(s, rep)
+	}
+	return rep
+}
+
+// GeoIP returns the GeoIP database loaded from the file s, the services referencing the same file share it.
+func (r *registry) GeoIP(s string) *gost.GeoIP {
+	if s == "" {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if geo := r.geoips[s]; geo != nil {
+		return geo
+	}
+	geo := parseGeoIP(s)
+	if geo != nil {
+		r.geoips[s] = geo
+		r.shared[geo] = true
+	}
+	return geo
+}
+
+// ACL returns the access control list loaded from the file s, the services referencing the same file share it.
+func (r *registry) ACL(s string) *gost.ACL {
+	if s == "" {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if acl := r.acls[s]; acl != nil {
+		return acl
+	}
+	acl := parseACL(s)
+	if acl != nil {
+		r.acls[s] = acl
+		r.shared[acl] = true
+	}
+	return acl
+}
+
+// IsShared reports whether the resource v is owned by the registry.
+func (r *registry) IsShared(v interface{}) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.shared[v]
+}
+
+// HealthCheck runs the health checker hc of the chain, it is stopped along with the chain or the registry.
+func (r *registry) HealthCheck(chain *gost.Chain, hc *gost.HealthChecker) {
+	r.checkerMux.Lock()
+	defer r.checkerMux.Unlock()
+
+	r.checkers[chain] = append(r.checkers[chain], hc)
+	go hc.Run()
+}
+
+// StopHealthChecks stops the health checkers of the chain, such as the chain of the removed route.
+func (r *registry) StopHealthChecks(chain *gost.Chain) {
+	r.checkerMux.Lock()
+	defer r.checkerMux.Unlock()
+
+	for _, hc := range r.checkers[chain] {
+		hc.Stop()
+	}
+	delete(r.checkers, chain)
+}
+
+// Stop stops the live reloading of all shared resources, and the health checkers.
+func (r *registry) Stop() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for v := range r.shared {
+		if s, ok := v.(gost.Stoppable); ok {
+			s.Stop()
+		}
+	}
+	for s := range r.reputations {
+		defaultMetrics.SetReputation(s, nil)
+	}
+
+	r.checkerMux.Lock()
+	defer r.checkerMux.Unlock()
+
+	for _, checkers := range r.checkers {
+		for _, hc := range checkers {
+			hc.Stop()
+		}
+	}
+}
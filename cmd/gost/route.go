@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ginuerzh/gost"
@@ -25,7 +30,31 @@ func (l *stringList) Set(value string) error {
 type route struct {
 	ServeNodes stringList
 	ChainNodes stringList
+	Chain      string // the name of the shared chain defined in config
 	Retries    int
+
+	chainName string // the name of the resolved shared chain, reported by the check mode
+}
+
+// nodeError annotates the error err of the n-th node in the field of the route, such as 'ServeNodes[0]'.
+func nodeError(field string, n int, err error) error {
+	return fmt.Errorf("%s[%d]: %v", field, n, err)
+}
+
+// key identifies the route by its nodes, the unchanged routes are kept running on reload.
+func (r *route) key() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func (r *route) clone() route {
+	return route{
+		ServeNodes: append(stringList(nil), r.ServeNodes...),
+		ChainNodes: append(stringList(nil), r.ChainNodes...),
+		Chain:      r.Chain,
+		Retries:    r.Retries,
+		chainName:  r.chainName,
+	}
 }
 
 func (r *route) parseChain() (*gost.Chain, error) {
@@ -33,7 +62,7 @@ func (r *route) parseChain() (*gost.Chain, error) {
 	chain.Retries = r.Retries
 	gid := 1 // group ID
 
-	for _, ns := range r.ChainNodes {
+	for n, ns := range r.ChainNodes {
 		ngroup := gost.NewNodeGroup()
 		ngroup.ID = gid
 		gid++
@@ -41,7 +70,7 @@ func (r *route) parseChain() (*gost.Chain, error) {
 		// parse the base nodes
 		nodes, err := parseChainNode(ns)
 		if err != nil {
-			return nil, err
+			return nil, nodeError("ChainNodes", n, err)
 		}
 
 		nid := 1 // node ID
@@ -54,8 +83,9 @@ func (r *route) parseChain() (*gost.Chain, error) {
 		ngroup.SetSelector(nil,
 			gost.WithFilter(
 				&gost.FailFilter{
-					MaxFails:    nodes[0].GetInt("max_fails"),
-					FailTimeout: nodes[0].GetDuration("fail_timeout"),
+					MaxFails:       nodes[0].GetInt("max_fails"),
+					FailTimeout:    nodes[0].GetDuration("fail_timeout"),
+					MaxFailTimeout: nodes[0].GetDuration("max_fail_timeout"),
 				},
 				&gost.InvalidFilter{},
 			),
@@ -65,7 +95,7 @@ func (r *route) parseChain() (*gost.Chain, error) {
 		if cfg := nodes[0].Get("peer"); cfg != "" {
 			f, err := os.Open(cfg)
 			if err != nil {
-				return nil, err
+				return nil, nodeError("ChainNodes", n, err)
 			}
 
 			peerCfg := newPeerConfig()
@@ -77,17 +107,65 @@ func (r *route) parseChain() (*gost.Chain, error) {
 			go gost.PeriodReload(peerCfg, cfg)
 		}
 
+		// the Tor nodes are not chained, the targets matched by the route option (the onion addresses by default) are routed to them.
+		if nodes[0].Protocol == "tor" {
+			patterns := nodes[0].Get("route")
+			if patterns == "" {
+				patterns = gost.TorOnionPattern
+			}
+			tor := gost.NewChain()
+			tor.AddNodeGroup(ngroup)
+			chain.Rules = append(chain.Rules, gost.RouteRule{
+				Patterns: defaultRegistry.Bypass(patterns),
+				Chain:    tor,
+			})
+			continue
+		}
+
+		// the nodes of the group are probed through the preceding hops.
+		if period := nodes[0].GetDuration("check"); period > 0 {
+			prev := gost.NewChain()
+			for _, group := range chain.NodeGroups() {
+				prev.AddNodeGroup(group)
+			}
+			defaultRegistry.HealthCheck(chain, gost.NewHealthChecker(prev, ngroup, period))
+		}
+
 		chain.AddNodeGroup(ngroup)
 	}
 
 	return chain, nil
 }
 
+// parseDNSRules parses the DNS rules of the dns_local and dns_remote options of the node string ns,
+// the rules are in the order of the options, as the first rule matching the target is applied.
+func parseDNSRules(ns string) (rules []gost.DNSRule) {
+	i := strings.IndexByte(ns, '?')
+	if i < 0 {
+		return
+	}
+	for _, param := range strings.Split(ns[i+1:], "&") {
+		values, err := url.ParseQuery(param)
+		if err != nil {
+			continue
+		}
+		for _, policy := range []string{gost.DNSLocal, gost.DNSRemote} {
+			if patterns := defaultRegistry.Bypass(values.Get("dns_" + policy)); patterns != nil {
+				rules = append(rules, gost.DNSRule{Policy: policy, Patterns: patterns})
+			}
+		}
+	}
+	return
+}
+
 func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	node, err := gost.ParseNode(ns)
 	if err != nil {
 		return
 	}
+	if err = parseObfs(&node); err != nil {
+		return
+	}
 
 	users, err := parseUsers(node.Get("secrets"))
 	if err != nil {
@@ -100,6 +178,9 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	if serverName == "" {
 		serverName = "localhost" // default server name
 	}
+	if sni := node.Get("servername"); sni != "" {
+		serverName = sni
+	}
 
 	rootCAs, err := loadCA(node.Get("ca"))
 	if err != nil {
@@ -110,6 +191,14 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		InsecureSkipVerify: !node.GetBool("secure"),
 		RootCAs:            rootCAs,
 	}
+	// the client certificate is presented if the server verifies the clients.
+	if certFile, keyFile := node.Get("cert"), node.Get("key"); certFile != "" && keyFile != "" {
+		cert, er := tls.LoadX509KeyPair(certFile, keyFile)
+		if er != nil {
+			return nil, er
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
 	wsOpts := &gost.WSOptions{}
 	wsOpts.EnableCompression = node.GetBool("compression")
 	wsOpts.ReadBufferSize = node.GetInt("rbuf")
@@ -118,6 +207,7 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	wsOpts.Path = node.Get("path")
 
 	var host string
+	var sshConfig *gost.SSHClientConfig
 
 	var tr gost.Transporter
 	switch node.Transport {
@@ -126,30 +216,38 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	case "mtls":
 		tr = gost.MTLSTransporter()
 	case "ws":
+		host = node.Get("host") // the Host header of the WebSocket request, such as the domain name behind a CDN.
 		tr = gost.WSTransporter(wsOpts)
 	case "mws":
+		host = node.Get("host")
 		tr = gost.MWSTransporter(wsOpts)
 	case "wss":
+		host = node.Get("host")
 		tr = gost.WSSTransporter(wsOpts)
 	case "mwss":
+		host = node.Get("host")
 		tr = gost.MWSSTransporter(wsOpts)
 	case "kcp":
-		config, err := parseKCPConfig(node.Get("c"))
+		config, err := parseKCPConfig(node)
 		if err != nil {
 			return nil, err
 		}
 		tr = gost.KCPTransporter(config)
 	case "ssh":
-		if node.Protocol == "direct" || node.Protocol == "remote" {
+		// the forward+ssh nodes are the SSH port forwarding servers, they can be nested like ProxyJump.
+		if node.Protocol == "direct" || node.Protocol == "remote" || node.Protocol == "forward" {
 			tr = gost.SSHForwardTransporter()
 		} else {
 			tr = gost.SSHTunnelTransporter()
 		}
+		if sshConfig, err = parseSSHClientConfig(node); err != nil {
+			return
+		}
 	case "quic":
 		config := &gost.QUICConfig{
 			TLSConfig:   tlsCfg,
 			KeepAlive:   node.GetBool("keepalive"),
-			Timeout:     time.Duration(node.GetInt("timeout")) * time.Second,
+			Timeout:     parseTimeout(node, "handshake_timeout"),
 			IdleTimeout: time.Duration(node.GetInt("idle")) * time.Second,
 		}
 
@@ -168,13 +266,27 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 
 	case "obfs4":
 		tr = gost.Obfs4Transporter()
-	case "ohttp":
-		host = node.Get("host")
+	case "ohttp", "otls":
+		// the Host header of obfs-http, or the server name of obfs-tls.
+		if host = node.Get("obfs-host"); host == "" {
+			host = node.Get("host")
+		}
 		tr = gost.ObfsHTTPTransporter()
+		if node.Transport == "otls" {
+			tr = gost.ObfsTLSTransporter()
+		}
 	default:
 		tr = gost.TCPTransporter()
 	}
 
+	switch node.Transport {
+	case "mtls", "mws", "mwss":
+		// the server closes the session if no keepalive is received within the timeout.
+		if ping := time.Duration(node.GetInt("ping")) * time.Second; ping >= gost.MuxKeepAliveTimeout {
+			return nil, fmt.Errorf("ping %s: should be less than the mux keepalive timeout %s", ping, gost.MuxKeepAliveTimeout)
+		}
+	}
+
 	var connector gost.Connector
 	switch node.Protocol {
 	case "http2":
@@ -195,22 +307,32 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		connector = gost.SSHRemoteForwardConnector()
 	case "forward":
 		connector = gost.ForwardConnector()
+		if node.Transport == "ssh" {
+			connector = gost.SSHDirectForwardConnector()
+		}
 	case "sni":
 		connector = gost.SNIConnector(node.Get("host"))
+	case "tor":
+		connector = gost.TorConnector(node.Get("isolation"))
+		if node.Get("dns") == "" {
+			node.Values.Set("dns", gost.DNSRemote) // the onion addresses can only be resolved by Tor.
+		}
 	case "http":
 		fallthrough
 	default:
 		node.Protocol = "http" // default protocol is HTTP
-		connector = gost.HTTPConnector(node.User)
+		connector = gost.HTTPAuthConnector(node.User, node.Get("auth"))
 	}
 
-	timeout := node.GetInt("timeout")
 	node.DialOptions = append(node.DialOptions,
-		gost.TimeoutDialOption(time.Duration(timeout)*time.Second),
+		gost.TimeoutDialOption(parseTimeout(node, "dial_timeout")),
+		gost.MaxStreamsDialOption(node.GetInt("max_streams")),
+		gost.KeepAliveDialOption(node.GetDuration("keepalive_period")),
 	)
 
 	node.ConnectOptions = []gost.ConnectOption{
 		gost.UserAgentConnectOption(node.Get("agent")),
+		gost.UserConnectOption(node.User), // the user ID of the SOCKS4(A) request.
 	}
 
 	if host == "" {
@@ -222,15 +344,17 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		gost.UserHandshakeOption(node.User),
 		gost.TLSConfigHandshakeOption(tlsCfg),
 		gost.IntervalHandshakeOption(time.Duration(node.GetInt("ping")) * time.Second),
-		gost.TimeoutHandshakeOption(time.Duration(timeout) * time.Second),
+		gost.TimeoutHandshakeOption(parseTimeout(node, "handshake_timeout")),
 		gost.RetryHandshakeOption(node.GetInt("retry")),
+		gost.SSHConfigHandshakeOption(sshConfig),
 	}
 	node.Client = &gost.Client{
 		Connector:   connector,
 		Transporter: tr,
 	}
 
-	node.Bypass = parseBypass(node.Get("bypass"))
+	node.Bypass = defaultRegistry.Bypass(node.Get("bypass"))
+	node.DNSRules = parseDNSRules(ns)
 
 	ips := parseIP(node.Get("ip"), sport)
 	for _, ip := range ips {
@@ -257,22 +381,33 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	return
 }
 
-func (r *route) GenRouters() ([]router, error) {
+func (r *route) GenRouters() (rts []router, err error) {
 	chain, err := r.parseChain()
 	if err != nil {
 		return nil, err
 	}
+	var listeners []gost.Listener // the listeners are closed if any of the nodes fails.
+	defer func() {
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			defaultRegistry.StopHealthChecks(chain)
+		}
+	}()
+	key := r.key()
 
-	var rts []router
-
-	for _, ns := range r.ServeNodes {
+	for n, ns := range r.ServeNodes {
 		node, err := gost.ParseNode(ns)
 		if err != nil {
-			return nil, err
+			return nil, nodeError("ServeNodes", n, err)
 		}
-		authenticator, err := parseAuthenticator(node.Get("secrets"))
+		if err := parseObfs(&node); err != nil {
+			return nil, nodeError("ServeNodes", n, err)
+		}
+		authenticator, err := defaultRegistry.Authenticator(node.Get("secrets"))
 		if err != nil {
-			return nil, err
+			return nil, nodeError("ServeNodes", n, err)
 		}
 		if authenticator == nil && node.User != nil {
 			kvs := make(map[string]string)
@@ -282,7 +417,22 @@ func (r *route) GenRouters() ([]router, error) {
 		certFile, keyFile := node.Get("cert"), node.Get("key")
 		tlsCfg, err := tlsConfig(certFile, keyFile)
 		if err != nil && certFile != "" && keyFile != "" {
-			return nil, err
+			return nil, nodeError("ServeNodes", n, err)
+		}
+		// the clients of the TLS based transports must present the certificates signed by the CA.
+		lnTLSCfg := tlsCfg
+		if caFile := node.Get("ca"); caFile != "" {
+			clientCAs, err := loadCA(caFile)
+			if err != nil {
+				return nil, nodeError("ServeNodes", n, err)
+			}
+			if tlsCfg != nil {
+				lnTLSCfg = tlsCfg.Clone()
+			} else {
+				lnTLSCfg = gost.DefaultTLSConfig.Clone()
+			}
+			lnTLSCfg.ClientCAs = clientCAs
+			lnTLSCfg.ClientAuth = tls.RequireAndVerifyClientCert
 		}
 
 		wsOpts := &gost.WSOptions{}
@@ -291,88 +441,156 @@ func (r *route) GenRouters() ([]router, error) {
 		wsOpts.WriteBufferSize = node.GetInt("wbuf")
 		wsOpts.Path = node.Get("path")
 
-		var ln gost.Listener
-		switch node.Transport {
-		case "tls":
-			ln, err = gost.TLSListener(node.Addr, tlsCfg)
-		case "mtls":
-			ln, err = gost.MTLSListener(node.Addr, tlsCfg)
-		case "ws":
-			ln, err = gost.WSListener(node.Addr, wsOpts)
-		case "mws":
-			ln, err = gost.MWSListener(node.Addr, wsOpts)
-		case "wss":
-			ln, err = gost.WSSListener(node.Addr, tlsCfg, wsOpts)
-		case "mwss":
-			ln, err = gost.MWSSListener(node.Addr, tlsCfg, wsOpts)
-		case "kcp":
-			config, er := parseKCPConfig(node.Get("c"))
-			if er != nil {
-				return nil, er
-			}
-			ln, err = gost.KCPListener(node.Addr, config)
-		case "ssh":
-			config := &gost.SSHConfig{
-				Authenticator: authenticator,
-				TLSConfig:     tlsCfg,
-			}
-			if node.Protocol == "forward" {
-				ln, err = gost.TCPListener(node.Addr)
-			} else {
-				ln, err = gost.SSHTunnelListener(node.Addr, config)
+		geoFilter := parseGeoFilter(defaultRegistry.GeoIP(node.Get("geoip")), node.Get("geo"))
+		reputation := defaultRegistry.Reputation(node.Get("reputation"))
+		banner := parseBanner(node)
+		limits, err := parseRateLimits(node)
+		if err != nil {
+			return nil, nodeError("ServeNodes", n, err)
+		}
+		service := node.Get("name") // the label of the metrics of the service.
+		if service == "" {
+			service = node.String()
+		}
+
+		// listen creates the listener of the node, it is also used to rebind the listener by the watchdog.
+		// the interface name as the host, such as 'eth1:1080', is resolved to the current address of the interface on each bind.
+		// the address of the remote port forwarding is bound on the remote side, so it is not resolved locally.
+		listen := func() (ln gost.Listener, err error) {
+			addr := node.Addr
+			if node.Transport != "rtcp" && node.Transport != "rudp" {
+				if addr, err = gost.InterfaceAddr(node.Addr); err != nil {
+					return
+				}
 			}
-		case "quic":
-			config := &gost.QUICConfig{
-				TLSConfig:   tlsCfg,
-				KeepAlive:   node.GetBool("keepalive"),
-				Timeout:     time.Duration(node.GetInt("timeout")) * time.Second,
-				IdleTimeout: time.Duration(node.GetInt("idle")) * time.Second,
+
+			switch node.Transport {
+			case "tls":
+				ln, err = gost.TLSListener(addr, lnTLSCfg)
+			case "mtls":
+				ln, err = gost.MTLSListener(addr, lnTLSCfg)
+			case "ws":
+				ln, err = gost.WSListener(addr, wsOpts)
+			case "mws":
+				ln, err = gost.MWSListener(addr, wsOpts)
+			case "wss":
+				ln, err = gost.WSSListener(addr, lnTLSCfg, wsOpts)
+			case "mwss":
+				ln, err = gost.MWSSListener(addr, lnTLSCfg, wsOpts)
+			case "kcp":
+				config, er := parseKCPConfig(node)
+				if er != nil {
+					return nil, er
+				}
+				ln, err = gost.KCPListener(addr, config)
+			case "ssh":
+				config := &gost.SSHConfig{
+					Authenticator: authenticator,
+					TLSConfig:     tlsCfg,
+					Banner:        banner,
+				}
+				if node.Protocol == "forward" {
+					ln, err = gost.TCPListener(addr)
+				} else {
+					ln, err = gost.SSHTunnelListener(addr, config)
+				}
+			case "quic":
+				config := &gost.QUICConfig{
+					TLSConfig:   tlsCfg,
+					KeepAlive:   node.GetBool("keepalive"),
+					Timeout:     parseTimeout(node, "handshake_timeout"),
+					IdleTimeout: time.Duration(node.GetInt("idle")) * time.Second,
+				}
+				if cipher := node.Get("cipher"); cipher != "" {
+					sum := sha256.Sum256([]byte(cipher))
+					config.Key = sum[:]
+				}
+
+				ln, err = gost.QUICListener(addr, config)
+			case "http2":
+				ln, err = gost.HTTP2Listener(addr, lnTLSCfg)
+			case "h2":
+				ln, err = gost.H2Listener(addr, lnTLSCfg)
+			case "h2c":
+				ln, err = gost.H2CListener(addr)
+			case "tcp":
+				// Directly use SSH port forwarding if the last chain node is forward+ssh
+				if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
+					chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHDirectForwardConnector()
+					chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
+				}
+				ln, err = gost.TCPListener(addr)
+			case "rtcp":
+				// Directly use SSH port forwarding if the last chain node is forward+ssh
+				if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
+					chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHRemoteForwardConnector()
+					chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
+				}
+				if name := node.Get("tunnel"); name != "" {
+					if secret := node.Get("secret"); secret != "" {
+						config := &gost.SecretTunnelConfig{
+							Secret: secret,
+							P2P:    node.Get("p2p"),
+						}
+						ln, err = gost.TCPRemoteSecretListener(name, node.Get("token"), config, chain)
+						break
+					}
+					ln, err = gost.TCPRemoteTunnelListener(name, node.Get("token"), chain)
+					break
+				}
+				ln, err = gost.TCPRemoteForwardListener(addr, chain)
+			case "udp":
+				if node.Protocol == "tproxy" {
+					ln, err = gost.UDPTProxyListener(addr, time.Duration(node.GetInt("ttl"))*time.Second)
+					break
+				}
+				ln, err = gost.UDPDirectForwardListener(addr, time.Duration(node.GetInt("ttl"))*time.Second)
+			case "rudp":
+				ln, err = gost.UDPRemoteForwardListener(addr, chain, time.Duration(node.GetInt("ttl"))*time.Second)
+			case "ssu":
+				ln, err = gost.ShadowUDPListener(addr, node.User, time.Duration(node.GetInt("ttl"))*time.Second)
+			case "obfs4":
+				if err = gost.Obfs4Init(node, true); err != nil {
+					return nil, err
+				}
+				ln, err = gost.Obfs4Listener(addr)
+			case "ohttp":
+				ln, err = gost.ObfsHTTPListener(addr)
+			case "otls":
+				ln, err = gost.ObfsTLSListener(addr)
+			case "tproxy":
+				ln, err = gost.TCPTProxyListener(addr)
+			default:
+				ln, err = gost.TCPListener(addr)
 			}
-			if cipher := node.Get("cipher"); cipher != "" {
-				sum := sha256.Sum256([]byte(cipher))
-				config.Key = sum[:]
+			if err != nil {
+				return
 			}
 
-			ln, err = gost.QUICListener(node.Addr, config)
-		case "http2":
-			ln, err = gost.HTTP2Listener(node.Addr, tlsCfg)
-		case "h2":
-			ln, err = gost.H2Listener(node.Addr, tlsCfg)
-		case "h2c":
-			ln, err = gost.H2CListener(node.Addr)
-		case "tcp":
-			// Directly use SSH port forwarding if the last chain node is forward+ssh
-			if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
-				chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHDirectForwardConnector()
-				chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
+			if addr != node.Addr {
+				host, _, _ := net.SplitHostPort(node.Addr)
+				ln = gost.InterfaceListener(ln, host)
 			}
-			ln, err = gost.TCPListener(node.Addr)
-		case "rtcp":
-			// Directly use SSH port forwarding if the last chain node is forward+ssh
-			if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
-				chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHRemoteForwardConnector()
-				chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
+			ln = gost.KeepAliveListener(ln, node.GetDuration("keepalive_period"))
+			if node.Transport != "http2" {
+				ln = gost.IdleTimeoutListener(ln, node.GetDuration("idle_timeout"))
 			}
-			ln, err = gost.TCPRemoteForwardListener(node.Addr, chain)
-		case "udp":
-			ln, err = gost.UDPDirectForwardListener(node.Addr, time.Duration(node.GetInt("ttl"))*time.Second)
-		case "rudp":
-			ln, err = gost.UDPRemoteForwardListener(node.Addr, chain, time.Duration(node.GetInt("ttl"))*time.Second)
-		case "ssu":
-			ln, err = gost.ShadowUDPListener(node.Addr, node.User, time.Duration(node.GetInt("ttl"))*time.Second)
-		case "obfs4":
-			if err = gost.Obfs4Init(node, true); err != nil {
-				return nil, err
+			ln = gost.GeoListener(ln, geoFilter)
+			ln = gost.ReputationListener(ln, reputation)
+			if node.Protocol != "ban" { // the admin service must be reachable to lift the bans.
+				ln = gost.BanListener(ln, banner)
 			}
-			ln, err = gost.Obfs4Listener(node.Addr)
-		case "ohttp":
-			ln, err = gost.ObfsHTTPListener(node.Addr)
-		default:
-			ln, err = gost.TCPListener(node.Addr)
+			ln = gost.MetricsListener(ln, defaultMetrics, service)
+			if node.Transport != "http2" { // the connections of the http2 transport are not streams.
+				ln = gost.RateLimitListener(ln, limits)
+			}
+			return
 		}
+		ln, err := listen()
 		if err != nil {
-			return nil, err
+			return nil, nodeError("ServeNodes", n, err)
 		}
+		listeners = append(listeners, ln)
 
 		var handler gost.Handler
 		switch node.Protocol {
@@ -400,10 +618,33 @@ func (r *route) GenRouters() ([]router, error) {
 			handler = gost.SSHForwardHandler()
 		case "redirect":
 			handler = gost.TCPRedirectHandler()
+		case "tproxy":
+			handler = gost.TProxyHandler()
 		case "ssu":
 			handler = gost.ShadowUDPdHandler()
 		case "sni":
 			handler = gost.SNIHandler()
+		case "vhost":
+			handler = gost.VHostHandler()
+		case "stcp":
+			handler = gost.SecretTunnelHandler(node.Remote, &gost.SecretTunnelConfig{
+				Secret: node.Get("secret"),
+				P2P:    node.Get("p2p"),
+			})
+		case "rendezvous":
+			handler = gost.RendezvousHandler()
+		case "traffic":
+			handler = gost.TrafficHandler()
+		case "metrics":
+			handler = gost.MetricsHandler()
+		case "ban":
+			handler = gost.BanHandler()
+		case "admin":
+			handler = gost.AdminHandler()
+		case "speedtest":
+			handler = gost.SpeedTestHandler()
+		case "dns":
+			handler = gost.DNSHandler(node.Remote)
 		default:
 			// start from 2.5, if remote is not empty, then we assume that it is a forward tunnel.
 			if node.Remote != "" {
@@ -416,19 +657,30 @@ func (r *route) GenRouters() ([]router, error) {
 		var whitelist, blacklist *gost.Permissions
 		if node.Values.Get("whitelist") != "" {
 			if whitelist, err = gost.ParsePermissions(node.Get("whitelist")); err != nil {
-				return nil, err
+				return nil, nodeError("ServeNodes", n, err)
 			}
 		}
 		if node.Values.Get("blacklist") != "" {
 			if blacklist, err = gost.ParsePermissions(node.Get("blacklist")); err != nil {
-				return nil, err
+				return nil, nodeError("ServeNodes", n, err)
 			}
 		}
 
-		node.Bypass = parseBypass(node.Get("bypass"))
-		resolver := parseResolver(node.Get("dns"))
-		hosts := parseHosts(node.Get("hosts"))
+		node.Bypass = defaultRegistry.Bypass(node.Get("bypass"))
+		resolver := defaultRegistry.Resolver(node.Get("dns"))
+		hosts := defaultRegistry.Hosts(node.Get("hosts"))
 		ips := parseIP(node.Get("ip"), "")
+		vhosts, err := parseVirtualHosts(node.Get("vhosts"))
+		if err != nil {
+			return nil, nodeError("ServeNodes", n, err)
+		}
+
+		logger, err := parseLogger(node)
+		if err != nil {
+			return nil, nodeError("ServeNodes", n, err)
+		}
+		// the query log mode of the DNS handler and the key of the hash mode, such as 'hash:secret'.
+		queryLog := strings.SplitN(node.Get("querylog"), ":", 2)
 
 		handler.Init(
 			gost.AddrHandlerOption(ln.Addr().String()),
@@ -444,21 +696,49 @@ func (r *route) GenRouters() ([]router, error) {
 			gost.BypassHandlerOption(node.Bypass),
 			gost.ResolverHandlerOption(resolver),
 			gost.HostsHandlerOption(hosts),
+			gost.DNSPolicyHandlerOption(node.Get("dns_policy")),
 			gost.RetryHandlerOption(node.GetInt("retry")), // override the global retry option.
-			gost.TimeoutHandlerOption(time.Duration(node.GetInt("timeout"))*time.Second),
+			gost.TimeoutHandlerOption(parseTimeout(node, "dial_timeout")),
+			gost.HandshakeTimeoutHandlerOption(node.GetDuration("handshake_timeout")),
+			gost.TTLHandlerOption(time.Duration(node.GetInt("ttl"))*time.Second),
 			gost.ProbeResistHandlerOption(node.Get("probe_resist")),
 			gost.KnockingHandlerOption(node.Get("knock")),
 			gost.NodeHandlerOption(node),
 			gost.IPsHandlerOption(ips),
+			gost.VirtualHostsHandlerOption(vhosts),
+			gost.TunnelsHandlerOption(defaultRegistry.Tunnels(node.Get("tunnels"))),
+			gost.TrafficHandlerOption(parseTraffic(node.Get("traffic"), node.GetDuration("traffic_period"))),
+			gost.MetricsHandlerOption(defaultMetrics),
+			gost.SessionsHandlerOption(defaultSessions),
+			gost.MirrorHandlerOption(parseMirror(node.Get("mirror"), node.Get("mirror_filter"))),
+			gost.InspectorHandlerOption(parseInspector(node.Get("inspect"), node.GetInt("inspect_sample"), node.GetInt("inspect_size"))),
+			gost.ScanDetectorHandlerOption(parseScanDetector(node)),
+			gost.BannerHandlerOption(banner),
+			gost.ReputationHandlerOption(reputation),
+			gost.ACLHandlerOption(defaultRegistry.ACL(node.Get("acl"))),
+			gost.ErrorPagesHandlerOption(parseErrorPages(node.Get("errpage"))),
+			gost.ErrorDetailHandlerOption(node.GetBool("errdetail")),
+			gost.BindPeerHandlerOption(node.GetBool("bind_peer")),
+			gost.ValidatorHandlerOption(parseValidator(node)),
+			gost.QueryLogHandlerOption(queryLog[0], queryLog[1:]...),
+			gost.NameHandlerOption(node.Get("name")),
+			gost.LoggerHandlerOption(logger),
 		)
+		defaultMetrics.SetChain(service, chain)
 
 		rt := router{
-			node:     node,
-			server:   &gost.Server{Listener: ln},
-			handler:  handler,
-			chain:    chain,
-			resolver: resolver,
-			hosts:    hosts,
+			route:         key,
+			service:       service,
+			node:          node,
+			server:        &gost.Server{Listener: ln},
+			handler:       handler,
+			chain:         chain,
+			authenticator: authenticator,
+			resolver:      resolver,
+			hosts:         hosts,
+			vhosts:        vhosts,
+			listen:        listen,
+			watchdog:      &watchdog{events: logListenerEvent},
 		}
 		rts = append(rts, rt)
 	}
@@ -467,22 +747,183 @@ func (r *route) GenRouters() ([]router, error) {
 }
 
 type router struct {
-	node     gost.Node
-	server   *gost.Server
-	handler  gost.Handler
-	chain    *gost.Chain
-	resolver gost.Resolver
-	hosts    *gost.Hosts
+	route         string // the key of the route of the router
+	service       string // the label of the metrics of the service
+	node          gost.Node
+	server        *gost.Server
+	handler       gost.Handler
+	chain         *gost.Chain
+	authenticator gost.Authenticator
+	resolver      gost.Resolver
+	hosts         *gost.Hosts
+	vhosts        *gost.VirtualHosts
+	listen        func() (gost.Listener, error)
+	watchdog      *watchdog
 }
 
+var (
+	rebindMinDelay = 1 * time.Second
+	rebindMaxDelay = 1 * time.Minute
+)
+
+// the states of the listener reported by the watchdog events.
+const (
+	listenerDown    = "down"
+	listenerRetry   = "retry"
+	listenerRebound = "rebound"
+)
+
+// listenerEvent is the event of the listener watchdog on the state change of the listener of a router.
+type listenerEvent struct {
+	Route   string
+	Node    string
+	Addr    string
+	State   string
+	Attempt int           // the rebind attempt of the retry event
+	Delay   time.Duration // the delay before the next attempt of the retry event
+	Err     error
+}
+
+// logListenerEvent is the default handler of the listener events, it logs the events.
+func logListenerEvent(ev listenerEvent) {
+	switch ev.State {
+	case listenerDown:
+		log.Logf("[watchdog] %s : listener on %s is down: %v", ev.Node, ev.Addr, ev.Err)
+	case listenerRetry:
+		log.Logf("[watchdog] %s : rebind #%d failed: %v, retry in %v", ev.Node, ev.Attempt, ev.Err, ev.Delay)
+	case listenerRebound:
+		log.Logf("[watchdog] %s : listener on %s is rebound", ev.Node, ev.Addr)
+	}
+}
+
+// watchdog is the state of the listener watchdog of a router, it is shared by the copies of the router.
+type watchdog struct {
+	closed bool
+	mux    sync.Mutex
+	events func(listenerEvent) // receives the events of the listener if it is set
+}
+
+func (r *router) emit(ev listenerEvent) {
+	if r.watchdog.events == nil {
+		return
+	}
+	ev.Route = r.route
+	ev.Node = r.node.String()
+	r.watchdog.events(ev)
+}
+
+// Serve serves on the listener of the router. If the listener dies unexpectedly,
+// such as the interface disappears or the address is reassigned,
+// the watchdog rebinds it with the exponential backoff until the router is closed.
 func (r *router) Serve() error {
 	log.Logf("%s on %s", r.node.String(), r.server.Addr())
-	return r.server.Serve(r.handler)
+	for {
+		err := r.server.Serve(r.handler)
+		if r.listen == nil || r.watchdog == nil || r.closed() {
+			return err
+		}
+
+		r.emit(listenerEvent{State: listenerDown, Addr: r.node.Addr, Err: err})
+		r.server.Close()
+
+		ln, ok := r.rebind()
+		if !ok {
+			return err
+		}
+		r.watchdog.mux.Lock()
+		if r.watchdog.closed {
+			r.watchdog.mux.Unlock()
+			ln.Close()
+			return err
+		}
+		r.server.SetListener(ln)
+		r.watchdog.mux.Unlock()
+		r.emit(listenerEvent{State: listenerRebound, Addr: ln.Addr().String()})
+	}
+}
+
+// rebind creates the listener again, it retries until succeeded or the router is closed.
+func (r *router) rebind() (gost.Listener, bool) {
+	delay := rebindMinDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		if r.closed() {
+			return nil, false
+		}
+
+		ln, err := r.listen()
+		if err == nil {
+			return ln, true
+		}
+		if delay *= 2; delay > rebindMaxDelay {
+			delay = rebindMaxDelay
+		}
+		r.emit(listenerEvent{State: listenerRetry, Addr: r.node.Addr, Attempt: attempt, Delay: delay, Err: err})
+	}
+}
+
+func (r *router) closed() bool {
+	r.watchdog.mux.Lock()
+	defer r.watchdog.mux.Unlock()
+
+	return r.watchdog.closed
 }
 
 func (r *router) Close() error {
 	if r == nil || r.server == nil {
 		return nil
 	}
+	r.stop()
 	return r.server.Close()
 }
+
+// Shutdown closes the router like Close, then waits for the connections being handled to finish until ctx is done.
+func (r *router) Shutdown(ctx context.Context) error {
+	if r == nil || r.server == nil {
+		return nil
+	}
+	r.stop()
+	return r.server.Shutdown(ctx)
+}
+
+// stop stops the resources and the watchdog of the router, the listener of the server is closed by the caller.
+// The listener rebound by the watchdog is either set to the server before it is stopped, or closed by the watchdog.
+func (r *router) stop() {
+	// the shared resources are stopped by the registry.
+	var reloaders []interface{}
+	if r.authenticator != nil {
+		reloaders = append(reloaders, r.authenticator)
+	}
+	if r.resolver != nil {
+		reloaders = append(reloaders, r.resolver)
+	}
+	if r.hosts != nil {
+		reloaders = append(reloaders, r.hosts)
+	}
+	if r.node.Bypass != nil {
+		reloaders = append(reloaders, r.node.Bypass)
+	}
+	if r.vhosts != nil {
+		reloaders = append(reloaders, r.vhosts)
+	}
+	for _, v := range reloaders {
+		if s, ok := v.(gost.Stoppable); ok && !defaultRegistry.IsShared(v) {
+			s.Stop()
+		}
+	}
+	if !defaultRegistry.IsShared(r.chain) {
+		defaultRegistry.StopHealthChecks(r.chain)
+	}
+	defaultMetrics.SetChain(r.service, nil)
+	if r.watchdog != nil {
+		r.watchdog.mux.Lock()
+		r.watchdog.closed = true
+		r.watchdog.mux.Unlock()
+	}
+}
+
+func closeRouters(rts []router) {
+	for i := range rts {
+		rts[i].Close()
+	}
+}
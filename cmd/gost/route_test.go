@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gost"
+)
+
+// freeAddr returns a local TCP address which is not listened on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestGenRoutersCloseListeners(t *testing.T) {
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	r := &route{
+		ServeNodes: stringList{
+			"socks5://" + addr1,
+			"http://" + addr2 + "?log_level=verbose", // fails after the listener is created.
+		},
+	}
+	if _, err := r.GenRouters(); err == nil {
+		t.Fatal("the unknown log level should fail")
+	}
+
+	for _, addr := range []string{addr1, addr2} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("the listener on %s should be closed: %v", addr, err)
+			continue
+		}
+		ln.Close()
+	}
+}
+
+func TestRouterRebind(t *testing.T) {
+	defer func(min, max time.Duration) {
+		rebindMinDelay, rebindMaxDelay = min, max
+	}(rebindMinDelay, rebindMaxDelay)
+	rebindMinDelay, rebindMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+
+	addr := freeAddr(t)
+	ln, err := gost.TCPListener(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fails := 2 // the rebind attempts failing before the listener is rebound
+	node, _ := gost.ParseNode("socks5://" + addr)
+	events := make(chan listenerEvent, 16)
+	r := &router{
+		route:   "test",
+		node:    node,
+		server:  &gost.Server{Listener: ln},
+		handler: gost.SOCKS5Handler(),
+		listen: func() (gost.Listener, error) {
+			if fails > 0 {
+				fails--
+				return nil, errors.New("interface is down")
+			}
+			return gost.TCPListener(addr)
+		},
+		watchdog: &watchdog{
+			events: func(ev listenerEvent) { events <- ev },
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.Serve() }()
+
+	// the listener dies.
+	ln.Close()
+
+	for i, state := range []string{listenerDown, listenerRetry, listenerRetry, listenerRebound} {
+		select {
+		case ev := <-events:
+			if ev.State != state || ev.Route != "test" {
+				t.Fatalf("event #%d should be %s, got %+v", i, state, ev)
+			}
+			if state == listenerRetry && ev.Attempt != i {
+				t.Errorf("event #%d should be the attempt %d, got %d", i, i, ev.Attempt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event #%d %s timeout", i, state)
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("the rebound listener should accept: %v", err)
+	}
+	conn.Close()
+	if r.server.Addr().String() != addr {
+		t.Errorf("server address should be %s, got %s", addr, r.server.Addr())
+	}
+
+	r.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve should return once the router is closed")
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("no event should be emitted once the router is closed, got %+v", ev)
+	default:
+	}
+}
+
+func TestRouterCloseWhileRebinding(t *testing.T) {
+	defer func(min time.Duration) { rebindMinDelay = min }(rebindMinDelay)
+	rebindMinDelay = 10 * time.Millisecond
+
+	ln, err := gost.TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := gost.ParseNode("socks5://" + ln.Addr().String())
+	retried := make(chan struct{}, 1)
+	r := &router{
+		node:    node,
+		server:  &gost.Server{Listener: ln},
+		handler: gost.SOCKS5Handler(),
+		listen: func() (gost.Listener, error) {
+			return nil, errors.New("address is not available")
+		},
+		watchdog: &watchdog{
+			events: func(ev listenerEvent) {
+				if ev.State == listenerRetry {
+					select {
+					case retried <- struct{}{}:
+					default:
+					}
+				}
+			},
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.Serve() }()
+
+	ln.Close()
+	select {
+	case <-retried:
+	case <-time.After(time.Second):
+		t.Fatal("rebind should be retried")
+	}
+	r.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve should return once the router is closed while rebinding")
+	}
+}
+
+// writeCert writes the certificate issued by the CA to the PEM files in dir, it returns the file names.
+func writeCert(t *testing.T, dir string, caCert, caKey []byte, name string, hosts ...string) (certFile, keyFile string) {
+	certPEM, keyPEM, err := gost.IssueCertificate(caCert, caKey, name, hosts, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTLSClientVerification(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey, err := gost.GenerateCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	otherCert, otherKey, _ := gost.GenerateCA("other CA", time.Hour)
+
+	serverCert, serverKey := writeCert(t, dir, caCert, caKey, "server", "server.gost")
+	clientCert, clientKey := writeCert(t, dir, caCert, caKey, "client")
+	untrustedCert, untrustedKey := writeCert(t, dir, otherCert, otherKey, "untrusted")
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	addr := freeAddr(t)
+	rts, err := (&route{
+		ServeNodes: stringList{
+			fmt.Sprintf("socks5+tls://%s?cert=%s&key=%s&ca=%s", addr, serverCert, serverKey, caFile),
+		},
+	}).GenRouters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRouters(rts)
+	go rts[0].Serve()
+
+	for _, tc := range []struct {
+		name   string
+		params string
+		ok     bool
+	}{
+		{"verified", fmt.Sprintf("secure=true&ca=%s&servername=server.gost&cert=%s&key=%s", caFile, clientCert, clientKey), true},
+		{"skip verify", fmt.Sprintf("cert=%s&key=%s", clientCert, clientKey), true},
+		{"no client cert", fmt.Sprintf("secure=true&ca=%s&servername=server.gost", caFile), false},
+		{"untrusted client cert", fmt.Sprintf("secure=true&ca=%s&servername=server.gost&cert=%s&key=%s", caFile, untrustedCert, untrustedKey), false},
+		// the server certificate is not valid for the address without the server name.
+		{"no servername", fmt.Sprintf("secure=true&ca=%s&cert=%s&key=%s", caFile, clientCert, clientKey), false},
+		{"wrong servername", fmt.Sprintf("secure=true&ca=%s&servername=other.gost&cert=%s&key=%s", caFile, clientCert, clientKey), false},
+	} {
+		chain, err := (&route{
+			ChainNodes: stringList{fmt.Sprintf("socks5+tls://%s?%s", addr, tc.params)},
+		}).parseChain()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err = func() error {
+			conn, err := chain.Dial(echo.Addr().String())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				return err
+			}
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			return err
+		}()
+		if tc.ok && err != nil {
+			t.Errorf("%s: handshake should be accepted: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: handshake should be rejected", tc.name)
+		}
+	}
+}
+
+func TestParseDNSRulesOrder(t *testing.T) {
+	for _, tc := range []struct {
+		ns       string
+		policies []string
+	}{
+		{"socks5://127.0.0.1:1080", nil},
+		{"socks5://127.0.0.1:1080?dns_local=*.cn&dns_remote=*", []string{gost.DNSLocal, gost.DNSRemote}},
+		{"socks5://127.0.0.1:1080?dns_remote=*.onion&retry=1&dns_local=*", []string{gost.DNSRemote, gost.DNSLocal}},
+	} {
+		nodes, err := parseChainNode(tc.ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var policies []string
+		for _, rule := range nodes[0].DNSRules {
+			policies = append(policies, rule.Policy)
+		}
+		if !reflect.DeepEqual(policies, tc.policies) {
+			t.Errorf("%s: policies should be %v, got %v", tc.ns, tc.policies, policies)
+		}
+	}
+
+	// the first rule in the config order matching the target is applied.
+	nodes, _ := parseChainNode("socks5://127.0.0.1:1080?dns_remote=*.example.com&dns_local=*")
+	if rule := nodes[0].DNSRules[0]; !rule.Patterns.Contains("www.example.com") || rule.Policy != gost.DNSRemote {
+		t.Errorf("www.example.com should be resolved remotely, got %+v", rule)
+	}
+}
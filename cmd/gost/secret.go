@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var secretRefRegexp = regexp.MustCompile(`\$\$\{|\$\{(env|file):([^}]+)\}`)
+
+// expandSecrets replaces the secret references in s with the referenced values,
+// the reference can be ${env:NAME} for environment variable, or ${file:/path/to/file} for file content.
+// As the config strings are node URLs, the values are percent-encoded.
+// The escaped '$${' is the literal '${', it is the last expansion of the config.
+func expandSecrets(s string) (string, error) {
+	var err error
+	s = secretRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := secretRefRegexp.FindStringSubmatch(ref)
+		var v string
+		switch m[1] {
+		case "env":
+			var ok bool
+			if v, ok = os.LookupEnv(m[2]); !ok {
+				err = fmt.Errorf("secret %s: environment variable is not set", ref)
+			}
+		case "file":
+			data, er := ioutil.ReadFile(m[2])
+			if er != nil {
+				err = fmt.Errorf("secret %s: %v", ref, er)
+			}
+			v = strings.TrimRight(string(data), "\r\n")
+		}
+		return strings.Replace(url.QueryEscape(v), "+", "%20", -1)
+	})
+	return s, err
+}
+
+// resolveSecrets expands the secret references in all nodes of the config.
+func (cfg *baseConfig) resolveSecrets() (err error) {
+	expand := func(nodes stringList) error {
+		for i := range nodes {
+			if nodes[i], err = expandSecrets(nodes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, r := range cfg.routes() {
+		if err = expand(r.ServeNodes); err != nil {
+			return
+		}
+		if err = expand(r.ChainNodes); err != nil {
+			return
+		}
+	}
+	for _, nodes := range cfg.Chains {
+		if err = expand(nodes); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ginuerzh/gost"
+)
+
+// speedTestCmd transfers the data through the chain to the speed test service of the peer gost node,
+// and reports the throughput of both directions.
+func speedTestCmd(args []string) error {
+	var rt route
+	fs := flag.NewFlagSet("speedtest", flag.ExitOnError)
+	fs.Var(&rt.ChainNodes, "F", "forward address, can make a forward chain")
+	configFile := fs.String("C", "", "configure file or HTTP(S) URL, its chain is used if -F is not set")
+	chainName := fs.String("chain", "", "the name of the chain defined in the configure file")
+	size := fs.String("n", "10M", "volume of each direction, such as 512K, 10M, 1G")
+	dir := fs.String("dir", "both", "direction of the transfer: up, down or both")
+	timeout := fs.Duration("t", time.Minute, "timeout of each direction")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gost speedtest [-F node]... [-C config] [-n size] target")
+		fmt.Fprintln(os.Stderr, "The target is the address of the speedtest service, such as 'gost -L speedtest://:8000'.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	n, err := parseSize(*size)
+	if fs.NArg() != 1 || err != nil || n <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target := fs.Arg(0)
+
+	var dirs []bool // true for upload
+	switch *dir {
+	case "up":
+		dirs = []bool{true}
+	case "down":
+		dirs = []bool{false}
+	case "both":
+		dirs = []bool{true, false}
+	default:
+		return fmt.Errorf("speedtest: unknown direction %s", *dir)
+	}
+
+	chain, err := parseCmdChain(&rt, *configFile, *chainName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("SPEEDTEST %s via %d hop(s), %s each direction\n", target, len(chain.NodeGroups()), formatSize(float64(n)))
+	var failed bool
+	for _, upload := range dirs {
+		name := "download"
+		if upload {
+			name = "upload"
+		}
+
+		result, err := speedTest(chain, target, upload, n, *timeout)
+		if err != nil {
+			fmt.Printf("%-8s : %s\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%-8s : %s in %v, %s/s (%.2f Mbps)\n", name, formatSize(float64(result.Bytes)),
+			result.Duration.Round(time.Millisecond), formatSize(result.Rate()), result.Rate()*8/1e6)
+	}
+	if failed {
+		return fmt.Errorf("speedtest: %s failed", target)
+	}
+	return nil
+}
+
+func speedTest(chain *gost.Chain, target string, upload bool, size int64, timeout time.Duration) (gost.SpeedTestResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := chain.DialContext(ctx, target)
+	if err != nil {
+		return gost.SpeedTestResult{}, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	return gost.SpeedTest(conn, upload, size)
+}
+
+// parseSize parses the size with the optional unit suffix K, M or G (base 1024).
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	var unit int64 = 1
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * unit, err
+}
+
+func formatSize(n float64) string {
+	for _, unit := range []string{"B", "KB", "MB"} {
+		if n < 1024 {
+			return fmt.Sprintf("%.2f %s", n, unit)
+		}
+		n /= 1024
+	}
+	return fmt.Sprintf("%.2f GB", n)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+)
+
+// maxIncludeDepth is the max nesting depth of the included configs.
+const maxIncludeDepth = 8
+
+var errIncludeDepth = errors.New("include: nesting too deep")
+
+// routes returns the pointers to all routes of the config, the base route is the first one.
+func (cfg *baseConfig) routes() []*route {
+	routes := []*route{&cfg.route}
+	for i := range cfg.Routes {
+		routes = append(routes, &cfg.Routes[i])
+	}
+	return routes
+}
+
+// prepare processes the includes, templates and secret references of the config loaded from source.
+func (cfg *baseConfig) prepare(source string) error {
+	if err := cfg.resolveIncludes(source, 0); err != nil {
+		return err
+	}
+	if err := cfg.resolveChains(); err != nil {
+		return err
+	}
+	if err := cfg.expandVars(); err != nil {
+		return err
+	}
+	return cfg.resolveSecrets()
+}
+
+// includePath returns the path of the included config relative to the source.
+func includePath(source, s string) string {
+	if isRemoteConfig(s) || filepath.IsAbs(s) {
+		return s
+	}
+	if isRemoteConfig(source) {
+		base, err := url.Parse(source)
+		if err != nil {
+			return s
+		}
+		ref, err := url.Parse(s)
+		if err != nil {
+			return s
+		}
+		return base.ResolveReference(ref).String()
+	}
+	return filepath.Join(filepath.Dir(source), s)
+}
+
+// resolveIncludes loads the included configs and merges them into cfg.
+// The routes of the included config are added before the routes of cfg,
+// the vars and chains defined in cfg take precedence over the included ones.
+func (cfg *baseConfig) resolveIncludes(source string, depth int) error {
+	if len(cfg.Include) == 0 {
+		return nil
+	}
+	if depth >= maxIncludeDepth {
+		return errIncludeDepth
+	}
+
+	var routes []route
+	for _, s := range cfg.Include {
+		fname := includePath(source, s)
+		data, err := loadConfig(fname)
+		if err != nil {
+			return fmt.Errorf("include %s: %v", s, err)
+		}
+		c := &baseConfig{}
+		if err := json.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("include %v", configError(s, data, err))
+		}
+		if err := c.resolveIncludes(fname, depth+1); err != nil {
+			return err
+		}
+
+		if len(c.ServeNodes) > 0 {
+			routes = append(routes, c.route)
+		}
+		routes = append(routes, c.Routes...)
+
+		for k, v := range c.Vars {
+			if _, ok := cfg.Vars[k]; !ok {
+				if cfg.Vars == nil {
+					cfg.Vars = make(map[string]string)
+				}
+				cfg.Vars[k] = v
+			}
+		}
+		for k, v := range c.Chains {
+			if _, ok := cfg.Chains[k]; !ok {
+				if cfg.Chains == nil {
+					cfg.Chains = make(map[string]stringList)
+				}
+				cfg.Chains[k] = v
+			}
+		}
+	}
+	cfg.Routes = append(routes, cfg.Routes...)
+	cfg.Include = nil
+
+	return nil
+}
+
+// resolveChains prepends the nodes of the named chain to the chain nodes of each route.
+func (cfg *baseConfig) resolveChains() error {
+	for _, r := range cfg.routes() {
+		if r.Chain == "" {
+			continue
+		}
+		nodes, ok := cfg.Chains[r.Chain]
+		if !ok {
+			return fmt.Errorf("chain %s: not found", r.Chain)
+		}
+		r.ChainNodes = append(append(stringList(nil), nodes...), r.ChainNodes...)
+		r.chainName, r.Chain = r.Chain, ""
+	}
+	return nil
+}
+
+var varRefRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z0-9_.-]+)\}`)
+
+// expandVars replaces the variable references ${name} in all nodes with the values defined in Vars,
+// the escaped '$${' is kept for expandSecrets.
+func (cfg *baseConfig) expandVars() (err error) {
+	expand := func(nodes stringList) {
+		for i := range nodes {
+			nodes[i] = varRefRegexp.ReplaceAllStringFunc(nodes[i], func(ref string) string {
+				if ref == "$${" {
+					return ref
+				}
+				name := ref[2 : len(ref)-1]
+				v, ok := cfg.Vars[name]
+				if !ok && err == nil {
+					err = fmt.Errorf("var %s: not defined", ref)
+				}
+				return v
+			})
+		}
+	}
+
+	for _, r := range cfg.routes() {
+		expand(r.ServeNodes)
+		expand(r.ChainNodes)
+	}
+	for _, nodes := range cfg.Chains {
+		expand(nodes)
+	}
+	return
+}
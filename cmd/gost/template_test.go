@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// prepareConfig loads the config file like parseBaseConfig, then prepares it.
+func prepareConfig(t *testing.T, file string) (*baseConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &baseConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, cfg.prepare(file)
+}
+
+func writeFile(t *testing.T, file, data string) {
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncludeDepth(t *testing.T) {
+	dir := t.TempDir()
+	// the config at the max depth may be included, but it can not include any further.
+	nested := func(n int) string {
+		for i := 1; i <= n; i++ {
+			data := fmt.Sprintf(`{"ServeNodes": ["socks5://:%d"]}`, 1080+i)
+			if i < n {
+				data = fmt.Sprintf(`{"Include": ["%d.json"], "ServeNodes": ["socks5://:%d"]}`, i+1, 1080+i)
+			}
+			writeFile(t, filepath.Join(dir, fmt.Sprintf("%d.json", i)), data)
+		}
+		file := filepath.Join(dir, "gost.json")
+		writeFile(t, file, `{"Include": ["1.json"]}`)
+		return file
+	}
+
+	cfg, err := prepareConfig(t, nested(maxIncludeDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Routes) != maxIncludeDepth {
+		t.Errorf("the routes of all %d included configs should be merged, got %d", maxIncludeDepth, len(cfg.Routes))
+	}
+	for i, r := range cfg.Routes {
+		if s := r.ServeNodes[0]; s != fmt.Sprintf("socks5://:%d", 1081+i) {
+			t.Errorf("the routes should be merged in the include order, route %d got %s", i, s)
+		}
+	}
+
+	if _, err := prepareConfig(t, nested(maxIncludeDepth+1)); err != errIncludeDepth {
+		t.Errorf("the include nested too deep should fail with %v, got %v", errIncludeDepth, err)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), `{"Include": ["b.json"], "ServeNodes": ["socks5://:1080"]}`)
+	writeFile(t, filepath.Join(dir, "b.json"), `{"Include": ["a.json"], "ServeNodes": ["http://:8080"]}`)
+	if _, err := prepareConfig(t, filepath.Join(dir, "a.json")); err != errIncludeDepth {
+		t.Errorf("the include cycle should fail with %v, got %v", errIncludeDepth, err)
+	}
+
+	writeFile(t, filepath.Join(dir, "self.json"), `{"Include": ["self.json"]}`)
+	if _, err := prepareConfig(t, filepath.Join(dir, "self.json")); err != errIncludeDepth {
+		t.Errorf("the config including itself should fail with %v, got %v", errIncludeDepth, err)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "common.json"), `{
+		"Vars": {"host": "10.0.0.1", "port": "8080"},
+		"Chains": {"upstream": ["http://${host}:${port}"], "backup": ["socks5://${host}:1080"]}
+	}`)
+	file := filepath.Join(dir, "gost.json")
+	writeFile(t, file, `{
+		"Include": ["common.json"],
+		"Vars": {"port": "3128"},
+		"Chains": {"backup": ["socks5://10.0.0.2:1080"]},
+		"ServeNodes": ["socks5://:1080"],
+		"Chain": "upstream"
+	}`)
+
+	cfg, err := prepareConfig(t, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the vars of the including config take precedence over the included ones.
+	if s := cfg.ChainNodes[0]; s != "http://10.0.0.1:3128" {
+		t.Errorf("chain node should be http://10.0.0.1:3128, got %s", s)
+	}
+	if s := cfg.Chains["backup"][0]; s != "socks5://10.0.0.2:1080" {
+		t.Errorf("the chain of the including config should take precedence, got %s", s)
+	}
+
+	writeFile(t, file, `{"Include": ["common.json"], "ServeNodes": ["socks5://${user}@:1080"]}`)
+	if _, err := prepareConfig(t, file); err == nil || !strings.Contains(err.Error(), "${user}") {
+		t.Errorf("the undefined var should fail, got %v", err)
+	}
+}
+
+func TestResolveChains(t *testing.T) {
+	cfg := &baseConfig{
+		Chains: map[string]stringList{"upstream": {"http://10.0.0.1:8080", "socks5://10.0.0.2:1080"}},
+		Routes: []route{
+			{ServeNodes: stringList{"socks5://:1080"}, Chain: "upstream", ChainNodes: stringList{"relay://10.0.0.3:8421"}},
+			{ServeNodes: stringList{"http://:8080"}, ChainNodes: stringList{"relay://10.0.0.3:8421"}},
+		},
+	}
+	if err := cfg.resolveChains(); err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.Routes[0]
+	if len(r.ChainNodes) != 3 || r.ChainNodes[0] != "http://10.0.0.1:8080" || r.ChainNodes[2] != "relay://10.0.0.3:8421" {
+		t.Errorf("the nodes of the named chain should be prepended: %v", r.ChainNodes)
+	}
+	if r.Chain != "" || r.chainName != "upstream" {
+		t.Errorf("the named chain should be resolved: %q (%q)", r.Chain, r.chainName)
+	}
+	if len(cfg.Routes[1].ChainNodes) != 1 {
+		t.Errorf("the route without the named chain should be unchanged: %v", cfg.Routes[1].ChainNodes)
+	}
+	r.ChainNodes[0] = "http://10.0.0.9:8080"
+	if cfg.Chains["upstream"][0] != "http://10.0.0.1:8080" {
+		t.Error("the route should not share the nodes of the named chain")
+	}
+
+	cfg.Routes[1].Chain = "missing"
+	if err := cfg.resolveChains(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("the unknown chain should fail, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// tracerouteCmd walks the chain hop by hop to the target, and reports which hop fails with which reply code.
+func tracerouteCmd(args []string) error {
+	var rt route
+	fs := flag.NewFlagSet("traceroute", flag.ExitOnError)
+	fs.Var(&rt.ChainNodes, "F", "forward address, can make a forward chain")
+	configFile := fs.String("C", "", "configure file or HTTP(S) URL, its chain is used if -F is not set")
+	chainName := fs.String("chain", "", "the name of the chain defined in the configure file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gost traceroute [-F node]... [-C config] target")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	target := fs.Arg(0)
+	if _, port, _ := net.SplitHostPort(target); port == "" {
+		target = net.JoinHostPort(target, "80")
+	}
+
+	chain, err := parseCmdChain(&rt, *configFile, *chainName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("TRACEROUTE %s via %d hop(s)\n", target, len(chain.NodeGroups()))
+	hops, err := chain.Trace(target)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tNODE\tSTAGE\tTIME\tRESULT")
+	var failed error
+	for _, hop := range hops {
+		hopID, name := "-", hop.Addr
+		if hop.Hop > 0 {
+			hopID, name = fmt.Sprint(hop.Hop), hop.Node.String()
+		}
+
+		result := "ok"
+		if hop.Err != nil {
+			failed = hop.Err
+			result = fmt.Sprintf("FAIL: %s", hop.Err)
+			if hop.Code != 0 {
+				result = fmt.Sprintf("FAIL (code %d): %s", hop.Code, hop.Err)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", hopID, name, hop.Stage, hop.Duration.Round(10*time.Microsecond), result)
+	}
+	w.Flush()
+
+	if failed != nil {
+		return fmt.Errorf("traceroute: %s failed", target)
+	}
+	return nil
+}
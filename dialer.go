@@ -0,0 +1,38 @@
+package gost
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Dialer dials through the chain, it is compatible with net.Dialer,
+// so it can be used by the standard library, such as the DialContext of http.Transport.
+type Dialer struct {
+	Chain   *Chain
+	Options []ChainOption
+}
+
+// NewDialer creates a Dialer through the chain with the options.
+func NewDialer(chain *Chain, opts ...ChainOption) *Dialer {
+	return &Dialer{
+		Chain:   chain,
+		Options: opts,
+	}
+}
+
+// Dial connects to the address addr on the network through the chain.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the network through the chain using the context ctx.
+// Only the TCP networks are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s unsupported", network)
+	}
+	return d.Chain.DialContext(ctx, addr, d.Options...)
+}
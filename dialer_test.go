@@ -0,0 +1,46 @@
+package gost
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer httpSrv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go Serve(ln, SOCKS5Handler())
+
+	chain := NewChain(Node{
+		Addr:   ln.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+	})
+	dialer := NewDialer(chain)
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	resp, err := client.Get(httpSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "hello" {
+		t.Errorf("unexpected response: %s", b)
+	}
+
+	if _, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:53"); err == nil {
+		t.Error("udp should be unsupported")
+	}
+}
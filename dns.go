@@ -0,0 +1,187 @@
+package gost
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errNoNameServer = errors.New("no name server")
+
+// readDNSMsg reads a DNS message from r, the messages of the stream are prefixed with their 2-byte lengths.
+func readDNSMsg(r io.Reader, stream bool) (*dns.Msg, error) {
+	var b []byte
+	if stream {
+		var l [2]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		b = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+	} else {
+		b = make([]byte, mediumBufferSize)
+		n, err := r.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[:n]
+	}
+
+	m := &dns.Msg{}
+	if err := m.Unpack(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeDNSMsg writes the DNS message m to w, the messages of the stream are prefixed with their 2-byte lengths.
+func writeDNSMsg(w io.Writer, m *dns.Msg, stream bool) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	if stream {
+		b = append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+type dnsHandler struct {
+	raddr    string
+	servers  []NameServer
+	queryLog *queryLogger
+	options  *HandlerOptions
+}
+
+// DNSHandler creates a server Handler for DNS proxy server,
+// the queries are forwarded to the name servers raddr through the chain.
+// The raddr is a comma-separated name server list, such as '1.1.1.1:53/tcp,https://1.0.0.1/dns-query'.
+// The queries are read from the UDP datagrams, or the TCP stream, and logged by the query log option if any.
+func DNSHandler(raddr string, opts ...HandlerOption) Handler {
+	h := &dnsHandler{
+		raddr: raddr,
+	}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *dnsHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+
+	h.servers = nil
+	for _, ns := range ParseNameServers(h.raddr) {
+		ns.Timeout = h.options.Timeout
+		ns.Chain = h.options.Chain
+		if err := ns.Init(); err != nil {
+			h.options.Logger.Logf("[dns] %s : %s", ns, err)
+			continue
+		}
+		h.servers = append(h.servers, ns)
+	}
+
+	h.queryLog = nil
+	if ss := h.options.QueryLog; len(ss) > 0 {
+		ql, err := newQueryLogger(ss[0], ss[1:]...)
+		if err != nil {
+			h.options.Logger.Logf("[dns] %s", err)
+		}
+		h.queryLog = ql
+	}
+}
+
+func (h *dnsHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	_, udp := conn.LocalAddr().(*net.UDPAddr)
+	for {
+		query, err := readDNSMsg(conn, !udp)
+		if err != nil {
+			if err != io.EOF && h.options.Logger.Debug() {
+				h.options.Logger.Logf("[dns] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			}
+			return
+		}
+
+		if udp { // the datagrams are answered concurrently.
+			go h.serve(conn, query, false)
+			continue
+		}
+		if err := h.serve(conn, query, true); err != nil {
+			return
+		}
+	}
+}
+
+func (h *dnsHandler) serve(conn net.Conn, query *dns.Msg, stream bool) error {
+	var qname string
+	var qtype uint16
+	if len(query.Question) > 0 {
+		qname, qtype = query.Question[0].Name, query.Question[0].Qtype
+	}
+
+	start := time.Now()
+	reply, ns, err := h.exchange(query)
+	rcode := -1
+	if err == nil {
+		rcode = reply.Rcode
+	}
+	if h.queryLog != nil {
+		h.options.Logger.Log(h.queryLog.entry(conn.RemoteAddr().String(), qname, qtype, ns.String(), rcode, time.Since(start)))
+	}
+	if err != nil {
+		h.options.Logger.Warnf("[dns] %s -> %s : %s %s", conn.RemoteAddr(), ns, qname, err)
+		reply = &dns.Msg{}
+		reply.SetRcode(query, dns.RcodeServerFailure)
+	} else if h.queryLog == nil && h.options.Logger.Debug() { // otherwise the query is logged in the mode of the query log.
+		h.options.Logger.Logf("[dns] %s <-> %s : %s %s",
+			conn.RemoteAddr(), ns, qname, dns.RcodeToString[reply.Rcode])
+	}
+
+	if !stream && reply.Len() > udpMsgSize(query) { // the client retries over TCP.
+		reply.Truncated = true
+		reply.Answer, reply.Ns, reply.Extra = nil, nil, nil
+	}
+	return writeDNSMsg(conn, reply, stream)
+}
+
+// exchange sends the query to the name servers in order, until one of them replies.
+func (h *dnsHandler) exchange(query *dns.Msg) (reply *dns.Msg, ns NameServer, err error) {
+	timeout := h.options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultResolverTimeout
+	}
+
+	err = errNoNameServer
+	for _, ns = range h.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		reply, err = ns.exchanger.Exchange(ctx, query)
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// udpMsgSize returns the maximum size of the UDP reply to the query, advertised by its EDNS0 option.
+func udpMsgSize(query *dns.Msg) int {
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
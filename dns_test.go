@@ -0,0 +1,198 @@
+package gost
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsTestServer starts a name server on network, which answers the A queries with 10.0.0.1 and 10.0.0.2.
+func dnsTestServer(t *testing.T, network string) (addr string, closer func()) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(r)
+		for i, ttl := range []uint32{60, 30} {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(10, 0, 0, byte(i+1)),
+			})
+		}
+		w.WriteMsg(m)
+	})
+
+	started := make(chan struct{})
+	srv := &dns.Server{Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	if network == "tcp" {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Listener, addr = ln, ln.Addr().String()
+	} else {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.PacketConn, addr = pc, pc.LocalAddr().String()
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return addr, func() { srv.Shutdown() }
+}
+
+func dnsTestQuery(t *testing.T, network, addr string) {
+	client := &dns.Client{Net: network, Timeout: 3 * time.Second}
+	query := &dns.Msg{}
+	query.SetQuestion("example.test.", dns.TypeA)
+	reply, _, err := client.Exchange(query, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 2 || reply.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("unexpected answer: %v", reply.Answer)
+	}
+}
+
+func TestDNSHandlerUDP(t *testing.T) {
+	upstream, closer := dnsTestServer(t, "udp")
+	defer closer()
+
+	ln, err := UDPDirectForwardListener("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Handler:  DNSHandler("127.0.0.1:1/tcp," + upstream), // the first one is unreachable
+		Listener: ln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	dnsTestQuery(t, "udp", ln.Addr().String())
+}
+
+func TestDNSHandlerQueryLog(t *testing.T) {
+	upstream, closer := dnsTestServer(t, "udp")
+	defer closer()
+
+	ln, err := UDPDirectForwardListener("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &testLogger{}
+	serviceLogger, _ := NewServiceLogger("", logger, LogLevelInfo, "")
+	server := &Server{
+		Handler:  DNSHandler(upstream, QueryLogHandlerOption("hash", "secret"), LoggerHandlerOption(serviceLogger)),
+		Listener: ln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	dnsTestQuery(t, "udp", ln.Addr().String())
+
+	ql, _ := newQueryLogger("hash", "secret")
+	queries := logger.lines("")
+	if len(queries) != 1 || !strings.Contains(queries[0], "[dns] 127.0.0.1:") ||
+		!strings.Contains(queries[0], " -> "+upstream+"/udp : "+ql.name("example.test")+" A NOERROR") {
+		t.Errorf("unexpected query log: %v", queries)
+	}
+}
+
+func TestDNSHandlerChain(t *testing.T) {
+	upstream, closer := dnsTestServer(t, "tcp")
+	defer closer()
+
+	socksSrv := &Server{
+		Handler:  SOCKS5Handler(),
+		Listener: mustTCPListener(t),
+	}
+	go socksSrv.Run()
+	defer socksSrv.Close()
+
+	chain := NewChain(Node{
+		Addr:   socksSrv.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+	})
+	server := &Server{
+		Handler:  DNSHandler(upstream, ChainHandlerOption(chain)), // UDP name server is queried over TCP
+		Listener: mustTCPListener(t),
+	}
+	go server.Run()
+	defer server.Close()
+
+	dnsTestQuery(t, "tcp", server.Addr().String())
+}
+
+func TestDNSHandlerNoServer(t *testing.T) {
+	ln, err := UDPDirectForwardListener("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Handler:  DNSHandler(""),
+		Listener: ln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	client := &dns.Client{Net: "udp", Timeout: 3 * time.Second}
+	query := &dns.Msg{}
+	query.SetQuestion("example.test.", dns.TypeA)
+	reply, _, err := client.Exchange(query, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode should be SERVFAIL, got %s", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestResolverChain(t *testing.T) {
+	upstream, closer := dnsTestServer(t, "tcp")
+	defer closer()
+
+	socksSrv := &Server{
+		Handler:  SOCKS5Handler(),
+		Listener: mustTCPListener(t),
+	}
+	go socksSrv.Run()
+	defer socksSrv.Close()
+
+	ns := NameServer{
+		Addr: upstream,
+		Chain: NewChain(Node{
+			Addr:   socksSrv.Addr().String(),
+			Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+		}),
+	}
+	if err := ns.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r := newResolver(0, ns)
+	ips, err := r.Resolve("example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("unexpected addresses: %v", ips)
+	}
+
+	v, ok := r.mCache.Load("example.test")
+	if !ok {
+		t.Fatal("addresses should be cached")
+	}
+	if item := v.(*resolverCacheItem); item.ttl != 30*time.Second {
+		t.Errorf("addresses should be cached for the shortest TTL 30s, got %v", item.ttl)
+	}
+}
+
+func mustTCPListener(t *testing.T) Listener {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
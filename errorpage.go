@@ -0,0 +1,85 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorPages renders the bodies of the error responses of the HTTP proxy, such as 403, 407 and 503.
+// The page of a status code is rendered by the template named by the code (such as {{define "407"}}...{{end}}) if defined,
+// otherwise by the root template, with the ErrorPage as the data.
+type ErrorPages struct {
+	tmpl *template.Template
+}
+
+// ErrorPage is the data of the error page template.
+type ErrorPage struct {
+	// ID identifies the error, it is also logged, so the error seen by the user can be found in the logs.
+	ID     string
+	Code   int
+	Status string
+	Client string
+	Host   string
+	Time   time.Time
+}
+
+// ParseErrorPages parses the error page templates from r.
+func ParseErrorPages(r io.Reader) (*ErrorPages, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("error").Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return &ErrorPages{tmpl: tmpl}, nil
+}
+
+// NewErrorPage creates the data of an error page with a new ID.
+func NewErrorPage(code int, client, host string) *ErrorPage {
+	return &ErrorPage{
+		ID:     newErrorID(),
+		Code:   code,
+		Status: http.StatusText(code),
+		Client: client,
+		Host:   host,
+		Time:   time.Now(),
+	}
+}
+
+// Render renders the page as the body of the response resp.
+func (p *ErrorPages) Render(resp *http.Response, page *ErrorPage) error {
+	if p == nil {
+		return nil
+	}
+
+	tmpl := p.tmpl.Lookup(strconv.Itoa(page.Code))
+	if tmpl == nil {
+		tmpl = p.tmpl
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, page); err != nil {
+		return err
+	}
+
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Gost-Error-Id", page.ID)
+	resp.ContentLength = int64(buf.Len())
+	resp.Body = ioutil.NopCloser(buf)
+	return nil
+}
+
+// newErrorID generates a random ID for the error reported to the client, which is also logged for correlation.
+func newErrorID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
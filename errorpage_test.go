@@ -0,0 +1,78 @@
+package gost
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const errorPagesTestTemplate = `<h1>{{.Code}} {{.Status}}</h1><p>Host: {{.Host}}</p><p>Error ID: {{.ID}}</p>
+{{define "407"}}<p>Please sign in, contact admin@example.com. Error ID: {{.ID}}</p>{{end}}`
+
+func TestErrorPages(t *testing.T) {
+	pages, err := ParseErrorPages(bytes.NewBufferString(errorPagesTestTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		code int
+		host string
+		want string
+	}{
+		{http.StatusForbidden, "<script>", "<h1>403 Forbidden</h1><p>Host: &lt;script&gt;</p>"},
+		{http.StatusProxyAuthRequired, "example.com", "Please sign in"},
+	} {
+		page := NewErrorPage(tc.code, "127.0.0.1:1000", tc.host)
+		resp := &http.Response{Header: http.Header{}}
+		if err := pages.Render(resp, page); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if !strings.Contains(string(b), tc.want) || !strings.Contains(string(b), page.ID) {
+			t.Errorf("%d unexpected page: %s", tc.code, b)
+		}
+		if resp.Header.Get("Gost-Error-Id") != page.ID || resp.ContentLength != int64(len(b)) {
+			t.Errorf("%d unexpected header: %v", tc.code, resp.Header)
+		}
+	}
+
+	if _, err := ParseErrorPages(bytes.NewBufferString("{{.Code")); err == nil {
+		t.Error("invalid template should fail")
+	}
+}
+
+func TestHTTPProxyWithErrorPages(t *testing.T) {
+	pages, _ := ParseErrorPages(bytes.NewBufferString(errorPagesTestTemplate))
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler: HTTPHandler(
+			UsersHandlerOption(url.UserPassword("admin", "123456")),
+			ErrorPagesHandlerOption(pages),
+		),
+	}
+	go server.Run()
+	defer server.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Error("should failed with status code 407, got", resp.Status)
+	}
+	if id := resp.Header.Get("Gost-Error-Id"); id == "" || !strings.Contains(string(b), id) {
+		t.Errorf("the page should contain the error ID: %s", b)
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/ginuerzh/gosocks5"
 	"github.com/go-log/log"
+	"github.com/shadowsocks/go-shadowsocks2/core"
 	smux "gopkg.in/xtaci/smux.v1"
 )
 
@@ -122,17 +123,17 @@ func (h *tcpDirectForwardHandler) Handle(conn net.Conn) {
 	for i := 0; i < retries; i++ {
 		node, err = h.group.Next()
 		if err != nil {
-			log.Logf("[tcp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
+			h.options.Logger.Logf("[tcp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
 			return
 		}
 
-		log.Logf("[tcp] %s - %s", conn.RemoteAddr(), node.Addr)
+		h.options.Logger.Logf("[tcp] %s - %s", conn.RemoteAddr(), node.Addr)
 		cc, err = h.options.Chain.Dial(node.Addr,
 			RetryChainOption(h.options.Retries),
 			TimeoutChainOption(h.options.Timeout),
 		)
 		if err != nil {
-			log.Logf("[tcp] %s -> %s : %s", conn.RemoteAddr(), node.Addr, err)
+			h.options.Logger.Logf("[tcp] %s -> %s : %s", conn.RemoteAddr(), node.Addr, err)
 			node.MarkDead()
 		} else {
 			break
@@ -143,11 +144,12 @@ func (h *tcpDirectForwardHandler) Handle(conn net.Conn) {
 	}
 
 	node.ResetDead()
+	cc = relayConn(h.options, conn, cc, node.Addr)
 	defer cc.Close()
 
-	log.Logf("[tcp] %s <-> %s", conn.RemoteAddr(), node.Addr)
+	h.options.Logger.Logf("[tcp] %s <-> %s", conn.RemoteAddr(), node.Addr)
 	transport(conn, cc)
-	log.Logf("[tcp] %s >-< %s", conn.RemoteAddr(), node.Addr)
+	h.options.Logger.Logf("[tcp] %s >-< %s", conn.RemoteAddr(), node.Addr)
 }
 
 type udpDirectForwardHandler struct {
@@ -182,7 +184,7 @@ func (h *udpDirectForwardHandler) Handle(conn net.Conn) {
 
 	node, err := h.group.Next()
 	if err != nil {
-		log.Logf("[udp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
+		h.options.Logger.Logf("[udp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
 		return
 	}
 
@@ -191,20 +193,20 @@ func (h *udpDirectForwardHandler) Handle(conn net.Conn) {
 		raddr, err := net.ResolveUDPAddr("udp", node.Addr)
 		if err != nil {
 			node.MarkDead()
-			log.Logf("[udp] %s - %s : %s", conn.LocalAddr(), node.Addr, err)
+			h.options.Logger.Logf("[udp] %s - %s : %s", conn.LocalAddr(), node.Addr, err)
 			return
 		}
 		cc, err = net.DialUDP("udp", nil, raddr)
 		if err != nil {
 			node.MarkDead()
-			log.Logf("[udp] %s - %s : %s", conn.LocalAddr(), node.Addr, err)
+			h.options.Logger.Logf("[udp] %s - %s : %s", conn.LocalAddr(), node.Addr, err)
 			return
 		}
 	} else {
 		var err error
 		cc, err = getSOCKS5UDPTunnel(h.options.Chain, nil)
 		if err != nil {
-			log.Logf("[udp] %s - %s : %s", conn.LocalAddr(), node.Addr, err)
+			h.options.Logger.Logf("[udp] %s - %s : %s", conn.LocalAddr(), node.Addr, err)
 			return
 		}
 		cc = &udpTunnelConn{Conn: cc, raddr: node.Addr}
@@ -213,9 +215,9 @@ func (h *udpDirectForwardHandler) Handle(conn net.Conn) {
 	defer cc.Close()
 	node.ResetDead()
 
-	log.Logf("[udp] %s <-> %s", conn.RemoteAddr(), node.Addr)
+	h.options.Logger.Logf("[udp] %s <-> %s", conn.RemoteAddr(), node.Addr)
 	transport(conn, cc)
-	log.Logf("[udp] %s >-< %s", conn.RemoteAddr(), node.Addr)
+	h.options.Logger.Logf("[udp] %s >-< %s", conn.RemoteAddr(), node.Addr)
 }
 
 type tcpRemoteForwardHandler struct {
@@ -259,12 +261,12 @@ func (h *tcpRemoteForwardHandler) Handle(conn net.Conn) {
 	for i := 0; i < retries; i++ {
 		node, err = h.group.Next()
 		if err != nil {
-			log.Logf("[rtcp] %s - %s : %s", conn.LocalAddr(), h.raddr, err)
+			h.options.Logger.Logf("[rtcp] %s - %s : %s", conn.LocalAddr(), h.raddr, err)
 			return
 		}
 		cc, err = net.DialTimeout("tcp", node.Addr, h.options.Timeout)
 		if err != nil {
-			log.Logf("[rtcp] %s -> %s : %s", conn.LocalAddr(), node.Addr, err)
+			h.options.Logger.Logf("[rtcp] %s -> %s : %s", conn.LocalAddr(), node.Addr, err)
 			node.MarkDead()
 		} else {
 			break
@@ -277,9 +279,9 @@ func (h *tcpRemoteForwardHandler) Handle(conn net.Conn) {
 	defer cc.Close()
 	node.ResetDead()
 
-	log.Logf("[rtcp] %s <-> %s", conn.LocalAddr(), node.Addr)
+	h.options.Logger.Logf("[rtcp] %s <-> %s", conn.LocalAddr(), node.Addr)
 	transport(cc, conn)
-	log.Logf("[rtcp] %s >-< %s", conn.LocalAddr(), node.Addr)
+	h.options.Logger.Logf("[rtcp] %s >-< %s", conn.LocalAddr(), node.Addr)
 }
 
 type udpRemoteForwardHandler struct {
@@ -314,28 +316,28 @@ func (h *udpRemoteForwardHandler) Handle(conn net.Conn) {
 
 	node, err := h.group.Next()
 	if err != nil {
-		log.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
+		h.options.Logger.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
 		return
 	}
 
 	raddr, err := net.ResolveUDPAddr("udp", node.Addr)
 	if err != nil {
 		node.MarkDead()
-		log.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), node.Addr, err)
+		h.options.Logger.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), node.Addr, err)
 		return
 	}
 	cc, err := net.DialUDP("udp", nil, raddr)
 	if err != nil {
 		node.MarkDead()
-		log.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), node.Addr, err)
+		h.options.Logger.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), node.Addr, err)
 		return
 	}
 	defer cc.Close()
 	node.ResetDead()
 
-	log.Logf("[rudp] %s <-> %s", conn.RemoteAddr(), node.Addr)
+	h.options.Logger.Logf("[rudp] %s <-> %s", conn.RemoteAddr(), node.Addr)
 	transport(conn, cc)
-	log.Logf("[rudp] %s >-< %s", conn.RemoteAddr(), node.Addr)
+	h.options.Logger.Logf("[rudp] %s >-< %s", conn.RemoteAddr(), node.Addr)
 }
 
 type udpDirectForwardListener struct {
@@ -584,6 +586,10 @@ func (c *udpServerConn) SetWriteDeadline(t time.Time) error {
 
 type tcpRemoteForwardListener struct {
 	addr       net.Addr
+	tunnel     string
+	token      string
+	secret     *SecretTunnelConfig
+	cipher     core.Cipher
 	chain      *Chain
 	connChan   chan net.Conn
 	ln         net.Listener
@@ -619,6 +625,56 @@ func TCPRemoteForwardListener(addr string, chain *Chain) (Listener, error) {
 	return ln, err
 }
 
+// TCPRemoteTunnelListener creates a Listener for the reverse tunnel client.
+// The tunnel is registered on the server (the last node of the chain, which must be a SOCKS5 node) by name,
+// the token is required if the server restricts the tunnels to the named services.
+// The requests for the public address of the tunnel will be routed back through this listener.
+func TCPRemoteTunnelListener(name, token string, chain *Chain) (Listener, error) {
+	return newTCPRemoteTunnelListener(name, token, nil, chain)
+}
+
+// TCPRemoteSecretListener creates a Listener for the secret tunnel (STCP) provider.
+// The tunnel is registered on the server like TCPRemoteTunnelListener, but it is not exposed publicly,
+// only the visitors knowing the secret can connect to it by SecretTunnelHandler.
+// The data is encrypted end-to-end by the secret, the server never sees the plaintext.
+// If P2P is enabled by the config, the direct connection to the visitor will be tried first.
+func TCPRemoteSecretListener(name, token string, config *SecretTunnelConfig, chain *Chain) (Listener, error) {
+	if config == nil {
+		config = &SecretTunnelConfig{}
+	}
+	return newTCPRemoteTunnelListener(name, token, config, chain)
+}
+
+func newTCPRemoteTunnelListener(name, token string, secret *SecretTunnelConfig, chain *Chain) (Listener, error) {
+	if chain.LastNode().Protocol != "socks5" {
+		return nil, errors.New("tunnel: the last node of the chain must be SOCKS5")
+	}
+
+	var cipher core.Cipher
+	if secret != nil {
+		var err error
+		if cipher, err = secretTunnelCipher(secret.Secret); err != nil {
+			return nil, err
+		}
+	}
+
+	ln := &tcpRemoteForwardListener{
+		addr:     &net.TCPAddr{},
+		tunnel:   name,
+		token:    token,
+		secret:   secret,
+		cipher:   cipher,
+		chain:    chain,
+		connChan: make(chan net.Conn, 1024),
+		closed:   make(chan struct{}),
+		errChan:  make(chan error),
+	}
+
+	go ln.listenLoop()
+
+	return ln, nil
+}
+
 func (l *tcpRemoteForwardListener) isChainValid() bool {
 	lastNode := l.chain.LastNode()
 	if (lastNode.Protocol == "forward" && lastNode.Transport == "ssh") ||
@@ -659,15 +715,35 @@ func (l *tcpRemoteForwardListener) listenLoop() {
 
 		tempDelay = 0
 
-		select {
-		case l.connChan <- conn:
-		default:
-			conn.Close()
-			log.Logf("[rtcp] %s - %s: connection queue is full", conn.RemoteAddr(), conn.LocalAddr())
+		if l.cipher != nil {
+			go l.serveSecret(conn)
+			continue
 		}
+		l.queue(conn)
 	}
 }
 
+func (l *tcpRemoteForwardListener) queue(conn net.Conn) {
+	select {
+	case l.connChan <- conn:
+	default:
+		conn.Close()
+		log.Logf("[rtcp] %s - %s: connection queue is full", conn.RemoteAddr(), conn.LocalAddr())
+	}
+}
+
+// serveSecret decrypts the connection from the visitor of the secret tunnel,
+// and tries to upgrade it to the direct connection if the visitor requests P2P.
+func (l *tcpRemoteForwardListener) serveSecret(conn net.Conn) {
+	cc, err := p2pProvide(l.cipher.StreamConn(conn), l.secret, l.cipher)
+	if err != nil {
+		log.Logf("[rtcp] tunnel %s : %s", l.tunnel, err)
+		conn.Close()
+		return
+	}
+	l.queue(cc)
+}
+
 func (l *tcpRemoteForwardListener) Accept() (conn net.Conn, err error) {
 	if l.ln != nil {
 		return l.ln.Accept()
@@ -689,7 +765,7 @@ func (l *tcpRemoteForwardListener) accept() (conn net.Conn, err error) {
 	}
 
 	if lastNode.Protocol == "socks5" {
-		if lastNode.GetBool("mbind") {
+		if l.tunnel != "" || lastNode.GetBool("mbind") {
 			return l.muxAccept() // multiplexing support for binding.
 		}
 
@@ -745,7 +821,17 @@ func (l *tcpRemoteForwardListener) getSession() (s *muxSession, err error) {
 	if err != nil {
 		return nil, err
 	}
-	req := gosocks5.NewRequest(CmdMuxBind, toSocksAddr(l.addr))
+	cmd, addr := CmdMuxBind, toSocksAddr(l.addr)
+	if l.tunnel != "" {
+		addr = &gosocks5.Addr{Type: gosocks5.AddrDomain, Host: l.tunnel}
+		if l.token != "" {
+			addr.Host = l.token + "@" + l.tunnel
+		}
+		if l.cipher != nil {
+			cmd = CmdSecretBind
+		}
+	}
+	req := gosocks5.NewRequest(cmd, addr)
 	if err := req.Write(conn); err != nil {
 		log.Log("[rtcp] SOCKS5 BIND request: ", err)
 		return nil, err
@@ -757,8 +843,8 @@ func (l *tcpRemoteForwardListener) getSession() (s *muxSession, err error) {
 		return nil, err
 	}
 	if rep.Rep != gosocks5.Succeeded {
-		log.Logf("[rtcp] bind on %s failure", l.addr)
-		return nil, fmt.Errorf("Bind on %s failure", l.addr.String())
+		log.Logf("[rtcp] bind on %s failure", l.bindName())
+		return nil, fmt.Errorf("Bind on %s failure", l.bindName())
 	}
 	log.Logf("[rtcp] BIND ON %s OK", rep.Addr)
 
@@ -775,6 +861,14 @@ func (l *tcpRemoteForwardListener) getSession() (s *muxSession, err error) {
 	return l.session, nil
 }
 
+// bindName returns the name of the bind address, the token of the tunnel is not included.
+func (l *tcpRemoteForwardListener) bindName() string {
+	if l.tunnel != "" {
+		return "tunnel " + l.tunnel
+	}
+	return l.addr.String()
+}
+
 func (l *tcpRemoteForwardListener) waitConnectSOCKS5(conn net.Conn) (net.Conn, error) {
 	conn, err := socks5Handshake(conn, nil, l.chain.LastNode().User)
 	if err != nil {
@@ -2,9 +2,12 @@ package gost
 
 import (
 	"crypto/rand"
+	"io/ioutil"
+	"net"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func tcpDirectForwardRoundtrip(targetURL string, data []byte) error {
@@ -49,6 +52,51 @@ func TestTCPDirectForward(t *testing.T) {
 	}
 }
 
+func TestTCPDirectForwardHalfClose(t *testing.T) {
+	// the target replies after the request is finished by the half-close of the client.
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tln.Close()
+	go func() {
+		conn, err := tln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("re: "), b...))
+	}()
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(tln.Addr().String())
+	h.Init()
+	server := &Server{
+		Listener: ln,
+		Handler:  h,
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil || string(b) != "re: hello" {
+		t.Errorf("the reply after the half-close should be relayed, got %q, %v", b, err)
+	}
+}
+
 func BenchmarkTCPDirectForward(b *testing.B) {
 	httpSrv := httptest.NewServer(httpTestHandler)
 	defer httpSrv.Close()
@@ -0,0 +1,313 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// GeoIP is a database mapping the IP networks to the countries and the autonomous systems.
+// It is loaded from the lines of 'network country [asn]', such as '1.0.0.0/24 AU AS13335',
+// which can be converted from the CSV databases of the GeoIP vendors.
+type GeoIP struct {
+	entries  []geoEntry // the flattened ranges of the networks
+	networks int        // the number of the loaded networks
+	period   time.Duration
+	stopped  chan struct{}
+	mux      sync.RWMutex
+}
+
+type geoEntry struct {
+	start, end net.IP // 16-byte form
+	country    string
+	asn        string
+}
+
+// NewGeoIP creates a GeoIP database.
+func NewGeoIP() *GeoIP {
+	return &GeoIP{
+		stopped: make(chan struct{}),
+	}
+}
+
+// Lookup returns the country code and the AS number of the IP address of addr,
+// they are empty if the address is not found.
+func (geo *GeoIP) Lookup(addr string) (country, asn string) {
+	if geo == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	ip = ip.To16()
+
+	geo.mux.RLock()
+	defer geo.mux.RUnlock()
+
+	n := sort.Search(len(geo.entries), func(i int) bool {
+		return bytes.Compare(geo.entries[i].start, ip) > 0
+	})
+	if n == 0 {
+		return
+	}
+	if e := geo.entries[n-1]; bytes.Compare(ip, e.end) <= 0 {
+		return e.country, e.asn
+	}
+	return
+}
+
+// Reload parses config from r, then live reloads the database.
+func (geo *GeoIP) Reload(r io.Reader) error {
+	var entries []geoEntry
+	var period time.Duration
+
+	if r == nil || geo.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.Replace(scanner.Text(), ",", " ", -1)
+		ss := splitLine(line)
+		if len(ss) == 0 {
+			continue
+		}
+		if ss[0] == "reload" { // reload option
+			if len(ss) > 1 {
+				period, _ = time.ParseDuration(ss[1])
+			}
+			continue
+		}
+		if len(ss) < 2 {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(ss[0])
+		if err != nil {
+			continue
+		}
+		e := geoEntry{
+			start:   ipNet.IP.To16(),
+			end:     make(net.IP, net.IPv6len),
+			country: strings.ToUpper(ss[1]),
+		}
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range e.end {
+			e.end[i] = e.start[i] | ^mask[i]
+		}
+		if len(ss) > 2 {
+			e.asn = normalizeASN(ss[2])
+		}
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// the enclosing networks are sorted before the nested ones,
+	// the later entry of the same network takes precedence.
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].start, entries[j].start); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(entries[i].end, entries[j].end) > 0
+	})
+
+	geo.mux.Lock()
+	defer geo.mux.Unlock()
+
+	geo.entries = flattenGeoEntries(entries)
+	geo.networks = len(entries)
+	geo.period = period
+
+	return nil
+}
+
+// flattenGeoEntries splits the nested networks of the sorted entries into the ranges which do not overlap,
+// each address is mapped by the most specific network containing it, so Lookup finds it by the nearest start.
+func flattenGeoEntries(entries []geoEntry) []geoEntry {
+	var flat, stack []geoEntry
+	var next net.IP // the start of the range to be mapped, nil once the last address is mapped
+
+	emit := func(e geoEntry, end net.IP) {
+		if next == nil || bytes.Compare(next, end) > 0 {
+			return
+		}
+		flat = append(flat, geoEntry{start: next, end: end, country: e.country, asn: e.asn})
+		next = nextIP(end)
+	}
+	for _, e := range entries {
+		// the enclosing networks ending before the entry are mapped to their ends.
+		for len(stack) > 0 && bytes.Compare(stack[len(stack)-1].end, e.start) < 0 {
+			emit(stack[len(stack)-1], stack[len(stack)-1].end)
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 && next != nil && bytes.Compare(next, e.start) < 0 {
+			emit(stack[len(stack)-1], prevIP(e.start))
+		}
+		next = e.start
+		stack = append(stack, e)
+	}
+	for len(stack) > 0 {
+		emit(stack[len(stack)-1], stack[len(stack)-1].end)
+		stack = stack[:len(stack)-1]
+	}
+	return flat
+}
+
+// nextIP returns the address after ip, it is nil if ip is the last address.
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// prevIP returns the address before ip, ip must not be the first address.
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP(nil), ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		if prev[i]--; prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// Period returns the reload period.
+func (geo *GeoIP) Period() time.Duration {
+	if geo.Stopped() {
+		return -1
+	}
+
+	geo.mux.RLock()
+	defer geo.mux.RUnlock()
+
+	return geo.period
+}
+
+// Stop stops reloading.
+func (geo *GeoIP) Stop() {
+	select {
+	case <-geo.stopped:
+	default:
+		close(geo.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (geo *GeoIP) Stopped() bool {
+	select {
+	case <-geo.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (geo *GeoIP) String() string {
+	geo.mux.RLock()
+	n := geo.networks
+	geo.mux.RUnlock()
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "reload: %v\n", geo.Period())
+	fmt.Fprintf(b, "entries: %d\n", n)
+	return b.String()
+}
+
+func normalizeASN(s string) string {
+	s = strings.ToUpper(s)
+	if !strings.HasPrefix(s, "AS") {
+		s = "AS" + s
+	}
+	return s
+}
+
+// GeoFilter restricts the clients by their countries or AS numbers in the GeoIP database.
+type GeoFilter struct {
+	geo      *GeoIP
+	rules    map[string]bool
+	reversed bool
+}
+
+// NewGeoFilter creates a GeoFilter, the rules are the country codes (such as 'US') or the AS numbers (such as 'AS13335').
+// Only the clients matching the rules are allowed, or if reversed is true, the matched clients are blocked.
+// The clients not found in the database never match the rules.
+func NewGeoFilter(geo *GeoIP, reversed bool, rules ...string) *GeoFilter {
+	f := &GeoFilter{
+		geo:      geo,
+		rules:    make(map[string]bool),
+		reversed: reversed,
+	}
+	for _, rule := range rules {
+		rule = strings.ToUpper(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+		if len(rule) > 2 {
+			rule = normalizeASN(rule)
+		}
+		f.rules[rule] = true
+	}
+	return f
+}
+
+// Allow reports whether the client address addr is allowed.
+func (f *GeoFilter) Allow(addr string) bool {
+	if f == nil || len(f.rules) == 0 {
+		return true
+	}
+	country, asn := f.geo.Lookup(addr)
+	matched := (country != "" && f.rules[country]) || (asn != "" && f.rules[asn])
+	return matched != f.reversed
+}
+
+type geoListener struct {
+	Listener
+	filter *GeoFilter
+}
+
+// GeoListener wraps the listener ln, the connections from the clients not allowed by the filter are closed once accepted.
+func GeoListener(ln Listener, filter *GeoFilter) Listener {
+	if filter == nil {
+		return ln
+	}
+	return &geoListener{Listener: ln, filter: filter}
+}
+
+func (l *geoListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.Allow(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		if Debug {
+			country, asn := l.filter.geo.Lookup(conn.RemoteAddr().String())
+			log.Logf("[geo] %s - %s : rejected (%s %s)", conn.RemoteAddr(), conn.LocalAddr(), country, asn)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var geoIPData = `
+reload 10s
+# network country asn
+1.0.0.0/24,AU,13335
+8.8.8.0/24 US AS15169
+10.0.0.0/8 XX
+2001:db8::/32 DE AS3320
+invalid cn
+`
+
+var geoIPLookupTests = []struct {
+	addr    string
+	country string
+	asn     string
+}{
+	{"1.0.0.1", "AU", "AS13335"},
+	{"1.0.1.1", "", ""},
+	{"8.8.8.8:53", "US", "AS15169"},
+	{"10.255.255.255", "XX", ""},
+	{"[2001:db8::1]:443", "DE", "AS3320"},
+	{"2001:db9::1", "", ""},
+	{"0.0.0.1", "", ""},
+	{"example.com:80", "", ""},
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	var geo *GeoIP
+	if country, asn := geo.Lookup("1.0.0.1"); country != "" || asn != "" {
+		t.Error("nil database should not find any address")
+	}
+
+	geo = NewGeoIP()
+	if err := geo.Reload(bytes.NewBufferString(geoIPData)); err != nil {
+		t.Fatal(err)
+	}
+	if geo.Period() != 10*time.Second {
+		t.Errorf("unexpected reload period: %v", geo.Period())
+	}
+
+	for i, tc := range geoIPLookupTests {
+		country, asn := geo.Lookup(tc.addr)
+		if country != tc.country || asn != tc.asn {
+			t.Errorf("#%d %s: want %s %s, got %s %s", i, tc.addr, tc.country, tc.asn, country, asn)
+		}
+	}
+}
+
+var geoIPNestedData = `
+10.0.0.0/8 US AS1
+10.1.0.0/16 CA AS2
+10.1.2.0/24 MX
+10.1.2.0/24 BR
+10.2.0.0/16 GB
+::/0 ZZ
+2001:db8::/32 DE AS3320
+`
+
+func TestGeoIPLookupNested(t *testing.T) {
+	geo := NewGeoIP()
+	if err := geo.Reload(bytes.NewBufferString(geoIPNestedData)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		addr    string
+		country string
+		asn     string
+	}{
+		{"10.0.0.1", "US", "AS1"},
+		{"10.1.0.1", "CA", "AS2"},
+		{"10.1.2.3", "BR", ""},
+		{"10.1.3.1", "CA", "AS2"},
+		{"10.1.255.255", "CA", "AS2"},
+		{"10.2.5.5", "GB", ""},
+		{"10.3.0.1", "US", "AS1"},
+		{"10.255.255.255", "US", "AS1"},
+		{"11.0.0.1", "ZZ", ""},
+		{"::", "ZZ", ""},
+		{"2001:db8::1", "DE", "AS3320"},
+		{"2001:db9::1", "ZZ", ""},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "ZZ", ""},
+	} {
+		country, asn := geo.Lookup(tc.addr)
+		if country != tc.country || asn != tc.asn {
+			t.Errorf("#%d %s: want %s %s, got %s %s", i, tc.addr, tc.country, tc.asn, country, asn)
+		}
+	}
+}
+
+var geoFilterTests = []struct {
+	reversed bool
+	rules    []string
+	addr     string
+	allow    bool
+}{
+	{false, nil, "1.0.0.1", true},
+	{false, []string{"au"}, "1.0.0.1", true},
+	{false, []string{"AU"}, "8.8.8.8", false},
+	{false, []string{"AU"}, "192.168.1.1", false},
+	{false, []string{"15169"}, "8.8.8.8", true},
+	{false, []string{"US", "as3320"}, "[2001:db8::1]:443", true},
+	{true, []string{"AU"}, "1.0.0.1", false},
+	{true, []string{"AU"}, "8.8.8.8", true},
+	{true, []string{"AU"}, "192.168.1.1", true},
+}
+
+func TestGeoFilter(t *testing.T) {
+	geo := NewGeoIP()
+	geo.Reload(bytes.NewBufferString(geoIPData))
+
+	var filter *GeoFilter
+	if !filter.Allow("1.0.0.1") {
+		t.Error("nil filter should allow all clients")
+	}
+
+	for i, tc := range geoFilterTests {
+		filter := NewGeoFilter(geo, tc.reversed, tc.rules...)
+		if filter.Allow(tc.addr) != tc.allow {
+			t.Errorf("#%d test failed: %v %v, %s", i, tc.reversed, tc.rules, tc.addr)
+		}
+	}
+}
+
+func TestGeoListener(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	geo := NewGeoIP()
+	geo.Reload(bytes.NewBufferString("127.0.0.0/8 ZZ\n::1/128 ZZ\n"))
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	for i, tc := range []struct {
+		reversed bool
+		ok       bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		ln, err := TCPListener("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Handler:  SOCKS5Handler(),
+			Listener: GeoListener(ln, NewGeoFilter(geo, tc.reversed, "ZZ")),
+		}
+		go server.Run()
+
+		err = proxyRoundtrip(client, server, httpSrv.URL, sendData)
+		if (err == nil) != tc.ok {
+			t.Errorf("#%d unexpected result: %v", i, err)
+		}
+		server.Close()
+	}
+}
@@ -12,11 +12,14 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-log/log"
+	"golang.org/x/net/idna"
 )
 
 // Version is the gost version.
@@ -63,10 +66,15 @@ var (
 	ReadTimeout = 10 * time.Second
 	// WriteTimeout is the timeout for writing.
 	WriteTimeout = 10 * time.Second
+	// HTTPIdleTimeout is the timeout of waiting for the next request on the kept-alive connection of the HTTP proxy.
+	HTTPIdleTimeout = 60 * time.Second
 	// PingTimeout is the timeout for pinging.
 	PingTimeout = 30 * time.Second
 	// PingRetries is the reties of ping.
 	PingRetries = 1
+	// MuxKeepAliveTimeout is the keepalive timeout of the server sessions of the multiplexed transports,
+	// the session is closed if nothing is received from the client within it.
+	MuxKeepAliveTimeout = 30 * time.Second
 	// default udp node TTL in second for udp port forwarding.
 	defaultTTL = 60 * time.Second
 )
@@ -202,6 +210,76 @@ func splitLine(line string) []string {
 	return ss
 }
 
+// normalizeAddr converts the IPv4-mapped IPv6 address addr to IPv4, such as '[::ffff:1.2.3.4]:80' to '1.2.3.4:80',
+// so the rules written as IPv4 also apply to it.
+func normalizeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !strings.Contains(host, ":") {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return net.JoinHostPort(ip.To4().String(), port)
+	}
+	return addr
+}
+
+// zonePattern matches the bracketed IPv6 address with the zone identifier, such as '[fe80::1%eth0]'.
+var zonePattern = regexp.MustCompile(`\[([0-9A-Fa-f:.]+)%([^\]]+)\]`)
+
+// escapeZone escapes the zone identifiers of the bracketed IPv6 addresses in s to the URL form,
+// such as '[fe80::1%eth0]:80' to '[fe80::1%25eth0]:80', the escaped ones are kept.
+func escapeZone(s string) string {
+	return zonePattern.ReplaceAllStringFunc(s, func(m string) string {
+		ss := zonePattern.FindStringSubmatch(m)
+		if strings.HasPrefix(ss[2], "25") {
+			return m
+		}
+		return "[" + ss[1] + "%25" + ss[2] + "]"
+	})
+}
+
+// splitHostZone splits the zone identifier from the IPv6 literal host, such as 'fe80::1%eth0'.
+// The zone is only meaningful to the host dialing, it is stripped for the wire encoding of the address.
+func splitHostZone(host string) (ip, zone string) {
+	if n := strings.LastIndexByte(host, '%'); n > 0 && net.ParseIP(host[:n]) != nil {
+		return host[:n], host[n+1:]
+	}
+	return host, ""
+}
+
+// errDomainTooLong is returned when the domain exceeds 255 bytes, the limit of the address encodings of SOCKS.
+var errDomainTooLong = errors.New("domain name too long")
+
+// toASCIIAddr converts the internationalized domain of the address addr to the punycode form,
+// such as 'bücher.example:80' to 'xn--bcher-kva.example:80', so it can be encoded and resolved.
+func toASCIIAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, nil
+	}
+	if ip, _ := splitHostZone(host); net.ParseIP(ip) != nil {
+		return addr, nil
+	}
+
+	ascii := true
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if !ascii {
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", err
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	if len(host) > 255 {
+		return "", errDomainTooLong
+	}
+	return addr, nil
+}
+
 func connStateCallback(conn net.Conn, cs http.ConnState) {
 	switch cs {
 	case http.StateNew:
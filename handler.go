@@ -2,14 +2,15 @@ package gost
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"net"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/ginuerzh/gosocks4"
 	"github.com/ginuerzh/gosocks5"
-	"github.com/go-log/log"
 )
 
 // Handler is a proxy server handler
@@ -20,26 +21,47 @@ type Handler interface {
 
 // HandlerOptions describes the options for Handler.
 type HandlerOptions struct {
-	Addr          string
-	Chain         *Chain
-	Users         []*url.Userinfo
-	Authenticator Authenticator
-	TLSConfig     *tls.Config
-	Whitelist     *Permissions
-	Blacklist     *Permissions
-	Strategy      Strategy
-	MaxFails      int
-	FailTimeout   time.Duration
-	Bypass        *Bypass
-	Retries       int
-	Timeout       time.Duration
-	Resolver      Resolver
-	Hosts         *Hosts
-	ProbeResist   string
-	KnockingHost  string
-	Node          Node
-	Host          string
-	IPs           []string
+	Addr             string
+	Chain            *Chain
+	Users            []*url.Userinfo
+	Authenticator    Authenticator
+	TLSConfig        *tls.Config
+	Whitelist        *Permissions
+	Blacklist        *Permissions
+	Strategy         Strategy
+	MaxFails         int
+	FailTimeout      time.Duration
+	Bypass           *Bypass
+	Retries          int
+	Timeout          time.Duration
+	HandshakeTimeout time.Duration
+	TTL              time.Duration
+	Resolver         Resolver
+	Hosts            *Hosts
+	DNSPolicy        string
+	ProbeResist      string
+	KnockingHost     string
+	Node             Node
+	Host             string
+	IPs              []string
+	VirtualHosts     *VirtualHosts
+	Tunnels          *Tunnels
+	Traffic          *Traffic
+	Metrics          *Metrics
+	Sessions         *Sessions
+	Mirror           *Mirror
+	Inspector        Inspector
+	ScanDetector     *ScanDetector
+	Banner           *Banner
+	Reputation       *Reputation
+	ACL              *ACL
+	ErrorPages       *ErrorPages
+	ErrorDetail      bool
+	Validator        *Validator
+	QueryLog         []string
+	BindPeer         bool
+	Name             string
+	Logger           *ServiceLogger
 }
 
 // HandlerOption allows a common way to set handler options.
@@ -146,6 +168,28 @@ func TimeoutHandlerOption(timeout time.Duration) HandlerOption {
 	}
 }
 
+// HandshakeTimeoutHandlerOption sets the handshake_timeout option of HandlerOptions,
+// the timeout of reading the request of the client, ReadTimeout by default.
+func HandshakeTimeoutHandlerOption(timeout time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.HandshakeTimeout = timeout
+	}
+}
+
+func (opts *HandlerOptions) handshakeTimeout() time.Duration {
+	if opts.HandshakeTimeout > 0 {
+		return opts.HandshakeTimeout
+	}
+	return ReadTimeout
+}
+
+// TTLHandlerOption sets the TTL option of HandlerOptions, the idle timeout of the UDP sessions.
+func TTLHandlerOption(ttl time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.TTL = ttl
+	}
+}
+
 // ResolverHandlerOption sets the resolver option of HandlerOptions.
 func ResolverHandlerOption(resolver Resolver) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -153,6 +197,151 @@ func ResolverHandlerOption(resolver Resolver) HandlerOption {
 	}
 }
 
+// DNSPolicyHandlerOption sets the DNSPolicy option of HandlerOptions,
+// which is the DNS resolution policy of the targets if it is not set by the chain.
+func DNSPolicyHandlerOption(policy string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.DNSPolicy = policy
+	}
+}
+
+// VirtualHostsHandlerOption sets the VirtualHosts option of HandlerOptions.
+func VirtualHostsHandlerOption(vhosts *VirtualHosts) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.VirtualHosts = vhosts
+	}
+}
+
+// TunnelsHandlerOption sets the Tunnels option of HandlerOptions.
+func TunnelsHandlerOption(tunnels *Tunnels) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Tunnels = tunnels
+	}
+}
+
+// TrafficHandlerOption sets the Traffic option of HandlerOptions.
+func TrafficHandlerOption(traffic *Traffic) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Traffic = traffic
+	}
+}
+
+// MetricsHandlerOption sets the Metrics option of HandlerOptions.
+func MetricsHandlerOption(metrics *Metrics) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Metrics = metrics
+	}
+}
+
+// SessionsHandlerOption sets the Sessions option of HandlerOptions.
+func SessionsHandlerOption(sessions *Sessions) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Sessions = sessions
+	}
+}
+
+// MirrorHandlerOption sets the Mirror option of HandlerOptions.
+func MirrorHandlerOption(mirror *Mirror) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Mirror = mirror
+	}
+}
+
+// InspectorHandlerOption sets the Inspector option of HandlerOptions.
+func InspectorHandlerOption(inspector Inspector) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Inspector = inspector
+	}
+}
+
+// ScanDetectorHandlerOption sets the ScanDetector option of HandlerOptions.
+func ScanDetectorHandlerOption(detector *ScanDetector) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.ScanDetector = detector
+	}
+}
+
+// BannerHandlerOption sets the Banner option of HandlerOptions.
+func BannerHandlerOption(banner *Banner) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Banner = banner
+	}
+}
+
+// ReputationHandlerOption sets the Reputation option of HandlerOptions.
+func ReputationHandlerOption(reputation *Reputation) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Reputation = reputation
+	}
+}
+
+// ACLHandlerOption sets the ACL option of HandlerOptions.
+func ACLHandlerOption(acl *ACL) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.ACL = acl
+	}
+}
+
+// ErrorPagesHandlerOption sets the ErrorPages option of HandlerOptions.
+func ErrorPagesHandlerOption(pages *ErrorPages) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.ErrorPages = pages
+	}
+}
+
+// ErrorDetailHandlerOption sets the ErrorDetail option of HandlerOptions.
+// If enabled, the SOCKS5 server appends the reason of the failure after the failure reply of the connect request,
+// which is logged by the gost clients. It is an extension of SOCKS5, and may expose the internal information to the clients.
+func ErrorDetailHandlerOption(b bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.ErrorDetail = b
+	}
+}
+
+// ValidatorHandlerOption sets the Validator option of HandlerOptions.
+func ValidatorHandlerOption(v *Validator) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Validator = v
+	}
+}
+
+// QueryLogHandlerOption sets the QueryLog option of HandlerOptions,
+// the queries served by the DNS handler are logged in the mode with the args, like the querylog option of the resolver.
+// The queries are not logged if the mode is empty.
+func QueryLogHandlerOption(mode string, args ...string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.QueryLog = nil
+		if mode != "" {
+			opts.QueryLog = append([]string{mode}, args...)
+		}
+	}
+}
+
+// BindPeerHandlerOption sets the BindPeer option of HandlerOptions.
+// If enabled, the address of the SOCKS5 BIND request is the peer expected to connect back as RFC 1928,
+// such as the FTP active mode, the server binds a random port and accepts only the peer.
+// Otherwise the address is the one to bind on, such as the remote port forwarding of gost.
+func BindPeerHandlerOption(b bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.BindPeer = b
+	}
+}
+
+// NameHandlerOption sets the Name option of HandlerOptions,
+// the name of the service labels the telemetry of the service, such as the traffic statistics.
+func NameHandlerOption(name string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Name = name
+	}
+}
+
+// LoggerHandlerOption sets the Logger option of HandlerOptions.
+func LoggerHandlerOption(logger *ServiceLogger) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Logger = logger
+	}
+}
+
 // HostsHandlerOption sets the Hosts option of HandlerOptions.
 func HostsHandlerOption(hosts *Hosts) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -195,6 +384,75 @@ func IPsHandlerOption(ips []string) HandlerOption {
 	}
 }
 
+// canRelay reports whether the client of the identities ids is allowed to connect to the target addr,
+// according to the ACL, the reputation lists and the port scan detection of the handler.
+func canRelay(opts *HandlerOptions, client, addr string, ids ...string) bool {
+	resolve := resolveFunc(opts, client, addr)
+	if !opts.ACL.AllowResolve("tcp", client, addr, resolve, ids...) {
+		return false
+	}
+	if opts.Reputation != nil && opts.Reputation.Contains(addr, resolve()...) {
+		return false
+	}
+	return opts.ScanDetector.Allow(client, addr)
+}
+
+// aclAllow reports whether the request of action from the client to the target addr is allowed by the ACL of the handler,
+// the IP and CIDR rules are matched against the resolved addresses of the domain name.
+func aclAllow(opts *HandlerOptions, action, client, addr string, ids ...string) bool {
+	return opts.ACL.AllowResolve(action, client, addr, resolveFunc(opts, client, addr), ids...)
+}
+
+// resolveFunc returns the function resolving the domain name of the address addr once, see lookupIPs.
+func resolveFunc(opts *HandlerOptions, client, addr string) func() []net.IP {
+	var ips []net.IP
+	var once sync.Once
+	return func() []net.IP {
+		once.Do(func() {
+			ips = lookupIPs(opts, client, addr)
+		})
+		return ips
+	}
+}
+
+// lookupIPs resolves the domain name of the address addr for the client by the hosts and the resolver of the handler,
+// then by the system resolver like the dial to the target. It returns nil if the host is an IP address.
+func lookupIPs(opts *HandlerOptions, client, addr string) []net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip, _ := splitHostZone(host); host == "" || net.ParseIP(ip) != nil {
+		return nil
+	}
+
+	if ip := opts.Hosts.Lookup(host); ip != nil {
+		return []net.IP{ip}
+	}
+	if opts.Resolver != nil {
+		if ips, _ := resolverFor(opts.Resolver, client).Resolve(host); len(ips) > 0 {
+			return ips
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	addrs, _ := net.DefaultResolver.LookupIPAddr(ctx, host)
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+// relayConn wraps the connection cc from the client conn to the target addr,
+// for the session tracking, the traffic mirroring and inspection of the handler.
+func relayConn(opts *HandlerOptions, conn, cc net.Conn, addr string) net.Conn {
+	cc = opts.Sessions.Conn(conn, cc, opts.Logger.ConnID(), serviceName(opts), addr)
+	cc = opts.Mirror.Conn(cc, addr)
+	return inspectConn(opts.Inspector, conn, cc, addr, opts.Node)
+}
+
 type autoHandler struct {
 	options *HandlerOptions
 }
@@ -219,7 +477,7 @@ func (h *autoHandler) Handle(conn net.Conn) {
 	br := bufio.NewReader(conn)
 	b, err := br.Peek(1)
 	if err != nil {
-		log.Logf("[auto] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Logf("[auto] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		conn.Close()
 		return
 	}
@@ -244,6 +502,34 @@ func (h *autoHandler) Handle(conn net.Conn) {
 	handler.Handle(cc)
 }
 
+// wrappedConn is the client connection wrapped by the listener, such as RateLimitListener and MetricsListener.
+type wrappedConn interface {
+	net.Conn
+	unwrap() net.Conn
+	// rewrap wraps another connection the same way, the connections share the state of the wrapper.
+	rewrap(conn net.Conn) net.Conn
+}
+
+// unwrapConn returns the client connection accepted by the underlying listener of the wrapping listeners,
+// and the function wrapping another connection the same way, such as the duplicate of the connection.
+func unwrapConn(conn net.Conn) (net.Conn, func(net.Conn) net.Conn) {
+	var wrappers []wrappedConn
+	for {
+		c, ok := conn.(wrappedConn)
+		if !ok {
+			break
+		}
+		wrappers = append(wrappers, c)
+		conn = c.unwrap()
+	}
+	return conn, func(conn net.Conn) net.Conn {
+		for i := len(wrappers) - 1; i >= 0; i-- {
+			conn = wrappers[i].rewrap(conn)
+		}
+		return conn
+	}
+}
+
 type bufferdConn struct {
 	net.Conn
 	br *bufio.Reader
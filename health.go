@@ -0,0 +1,115 @@
+package gost
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// HealthChecker probes the nodes of a node group periodically, through the chain of the preceding hops.
+// The node failed to be probed is marked dead, then it is filtered from the selection by the FailFilter of the group,
+// and the node probed successfully is alive again.
+type HealthChecker struct {
+	chain   *Chain
+	group   *NodeGroup
+	period  time.Duration
+	stopped chan struct{}
+}
+
+// NewHealthChecker creates a HealthChecker for the node group, the nodes are probed through the chain every period.
+func NewHealthChecker(chain *Chain, group *NodeGroup, period time.Duration) *HealthChecker {
+	return &HealthChecker{
+		chain:   chain,
+		group:   group,
+		period:  period,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Run probes the nodes every period until the checker is stopped.
+func (hc *HealthChecker) Run() {
+	if hc.period <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(hc.period)
+	defer ticker.Stop()
+
+	for {
+		hc.Check()
+
+		select {
+		case <-ticker.C:
+		case <-hc.stopped:
+			return
+		}
+	}
+}
+
+// Check probes all the nodes of the group once, concurrently.
+func (hc *HealthChecker) Check() {
+	var wg sync.WaitGroup
+	for _, node := range hc.group.Nodes() {
+		wg.Add(1)
+		go func(node Node) {
+			defer wg.Done()
+			hc.probe(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// probe connects to the node through the chain, the node is marked dead or alive by the connection result.
+func (hc *HealthChecker) probe(node Node) {
+	route := NewChain()
+	if hc.chain != nil {
+		route.nodeGroups = append(route.nodeGroups, hc.chain.NodeGroups()...)
+	}
+	route.nodeGroups = append(route.nodeGroups, NewNodeGroup(node))
+
+	fails := node.marker.FailCount()
+	r, err := route.selectRoute()
+	if err == nil {
+		var conn net.Conn
+		if conn, err = r.getConn(context.Background()); err == nil {
+			conn.Close()
+		}
+	}
+
+	if err != nil {
+		if node.marker.FailCount() <= fails {
+			return // the preceding hops are down, the node is unknown.
+		}
+		if fails == 0 {
+			log.Logf("[health] %s is down : %s", node.String(), err)
+		} else if Debug {
+			log.Logf("[health] %s is down (%d fails) : %s", node.String(), fails+1, err)
+		}
+		return
+	}
+	if fails > 0 {
+		log.Logf("[health] %s is up after %d fails", node.String(), fails)
+	}
+}
+
+// Stop stops the checker.
+func (hc *HealthChecker) Stop() {
+	select {
+	case <-hc.stopped:
+	default:
+		close(hc.stopped)
+	}
+}
+
+// Stopped checks whether the checker is stopped.
+func (hc *HealthChecker) Stopped() bool {
+	select {
+	case <-hc.stopped:
+		return true
+	default:
+		return false
+	}
+}
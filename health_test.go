@@ -0,0 +1,141 @@
+package gost
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func healthTestNode(id int, addr string) Node {
+	return Node{
+		ID:     id,
+		Addr:   addr,
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+		marker: &failMarker{},
+	}
+}
+
+// closedAddr returns an address no one is listening on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestHealthChecker(t *testing.T) {
+	ln := mustTCPListener(t)
+	server := &Server{Handler: SOCKS5Handler(), Listener: ln}
+	go server.Run()
+	defer server.Close()
+
+	deadAddr := closedAddr(t)
+	group := NewNodeGroup(healthTestNode(1, ln.Addr().String()), healthTestNode(2, deadAddr))
+	group.SetSelector(nil, WithFilter(&FailFilter{}))
+
+	hc := NewHealthChecker(nil, group, time.Second)
+	hc.Check()
+	stats := group.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if !stats[0].Alive || stats[0].Fails != 0 {
+		t.Errorf("node 1 should be alive: %+v", stats[0])
+	}
+	if stats[1].Alive || stats[1].Fails != 1 || stats[1].FailCount != 1 || stats[1].FailTime.IsZero() {
+		t.Errorf("node 2 should be dead: %+v", stats[1])
+	}
+	for i := 0; i < 4; i++ {
+		if node, _ := group.Next(); node.ID != 1 {
+			t.Errorf("dead node %d should not be selected", node.ID)
+		}
+	}
+
+	// the node is up again.
+	ln2, err := TCPListener(deadAddr)
+	if err != nil {
+		t.Skip(err)
+	}
+	server2 := &Server{Handler: SOCKS5Handler(), Listener: ln2}
+	go server2.Run()
+	defer server2.Close()
+
+	hc.Check()
+	if st := group.Stats()[1]; !st.Alive || st.FailCount != 0 || st.Fails != 1 {
+		t.Errorf("node 2 should be alive: %+v", st)
+	}
+}
+
+func TestHealthCheckerPrecedingHop(t *testing.T) {
+	ln := mustTCPListener(t)
+	server := &Server{Handler: SOCKS5Handler(), Listener: ln}
+	go server.Run()
+	defer server.Close()
+
+	prev := NewChain(healthTestNode(1, closedAddr(t)))
+	group := NewNodeGroup(healthTestNode(1, ln.Addr().String()))
+
+	NewHealthChecker(prev, group, time.Second).Check()
+	if st := group.Stats()[0]; st.Fails != 0 {
+		t.Errorf("node should not be marked dead by the failure of the preceding hop: %+v", st)
+	}
+	if n := prev.Nodes()[0]; n.marker.FailCount() != 1 {
+		t.Error("the preceding hop should be marked dead")
+	}
+}
+
+func TestHealthCheckerStop(t *testing.T) {
+	group := NewNodeGroup(healthTestNode(1, closedAddr(t)))
+	hc := NewHealthChecker(nil, group, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		hc.Run()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hc.Stop()
+	if !hc.Stopped() {
+		t.Error("checker should be stopped")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("checker should exit after stopped")
+	}
+	if st := group.Stats()[0]; st.Fails < 2 {
+		t.Errorf("node should be probed periodically: %+v", st)
+	}
+}
+
+func TestChainNodeConns(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	ln := mustTCPListener(t)
+	server := &Server{Handler: SOCKS5Handler(), Listener: ln}
+	go server.Run()
+	defer server.Close()
+
+	group := NewNodeGroup(healthTestNode(1, ln.Addr().String()))
+	chain := NewChain()
+	chain.AddNodeGroup(group)
+
+	conn, err := chain.Dial(httpSrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := group.Stats()[0]; st.Conns != 1 {
+		t.Errorf("node should have 1 active connection, got %d", st.Conns)
+	}
+	conn.Close()
+	conn.Close()
+	if st := group.Stats()[0]; st.Conns != 0 {
+		t.Errorf("node should have no active connection, got %d", st.Conns)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -19,6 +21,7 @@ import (
 
 type httpConnector struct {
 	User *url.Userinfo
+	Auth string
 }
 
 // HTTPConnector creates a Connector for HTTP proxy client.
@@ -27,6 +30,13 @@ func HTTPConnector(user *url.Userinfo) Connector {
 	return &httpConnector{User: user}
 }
 
+// HTTPAuthConnector creates a Connector for HTTP proxy client with the authentication scheme auth,
+// which is one of HTTPAuthBasic (the default), HTTPAuthNTLM and HTTPAuthNegotiate.
+// For the NTLM and Negotiate schemes, the user name may be in form of 'DOMAIN\user'.
+func HTTPAuthConnector(user *url.Userinfo, auth string) Connector {
+	return &httpConnector{User: user, Auth: strings.ToLower(auth)}
+}
+
 func (c *httpConnector) Connect(conn net.Conn, addr string, options ...ConnectOption) (net.Conn, error) {
 	opts := &ConnectOptions{}
 	for _, option := range options {
@@ -53,6 +63,10 @@ func (c *httpConnector) Connect(conn net.Conn, addr string, options ...ConnectOp
 		ProtoMinor: 1,
 		Header:     make(http.Header),
 	}
+	if host, _, _ := net.SplitHostPort(addr); strings.Contains(host, "%") {
+		// the zone of the IPv6 address is dropped from the request line by the http package.
+		req.URL.Opaque = escapeZone(addr)
+	}
 	req.Header.Set("User-Agent", ua)
 	req.Header.Set("Proxy-Connection", "keep-alive")
 
@@ -61,13 +75,57 @@ func (c *httpConnector) Connect(conn net.Conn, addr string, options ...ConnectOp
 		user = c.User
 	}
 
+	var scheme string
+	switch c.Auth {
+	case HTTPAuthNTLM:
+		scheme = "NTLM"
+	case HTTPAuthNegotiate:
+		scheme = "Negotiate"
+	}
+
 	if user != nil {
 		u := user.Username()
+		p, _ := user.Password()
+		if scheme != "" {
+			req.Header.Set("Proxy-Authorization",
+				scheme+" "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+		} else {
+			req.Header.Set("Proxy-Authorization",
+				"Basic "+base64.StdEncoding.EncodeToString([]byte(u+":"+p)))
+		}
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := httpRoundTrip(conn, br, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusProxyAuthRequired && user != nil && scheme != "" {
+		// the NTLM handshake continues on the same connection.
+		challenge, err := parseNTLMChallenge(httpAuthToken(resp.Header, scheme))
+		if err != nil {
+			return nil, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
 		p, _ := user.Password()
 		req.Header.Set("Proxy-Authorization",
-			"Basic "+base64.StdEncoding.EncodeToString([]byte(u+":"+p)))
+			scheme+" "+base64.StdEncoding.EncodeToString(ntlmAuthenticateMessage(challenge, user.Username(), p)))
+		if resp, err = httpRoundTrip(conn, br, req); err != nil {
+			return nil, err
+		}
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ReplyError{Protocol: "http", Code: resp.StatusCode, Msg: resp.Status}
+	}
+
+	return conn, nil
+}
+
+func httpRoundTrip(conn net.Conn, br *bufio.Reader, req *http.Request) (*http.Response, error) {
 	if err := req.Write(conn); err != nil {
 		return nil, err
 	}
@@ -77,7 +135,7 @@ func (c *httpConnector) Connect(conn net.Conn, addr string, options ...ConnectOp
 		log.Log(string(dump))
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	resp, err := http.ReadResponse(br, req)
 	if err != nil {
 		return nil, err
 	}
@@ -86,18 +144,31 @@ func (c *httpConnector) Connect(conn net.Conn, addr string, options ...ConnectOp
 		dump, _ := httputil.DumpResponse(resp, false)
 		log.Log(string(dump))
 	}
+	return resp, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", resp.Status)
+// httpAuthToken returns the decoded token of the authentication scheme in the Proxy-Authenticate header.
+func httpAuthToken(header http.Header, scheme string) []byte {
+	for _, v := range header["Proxy-Authenticate"] {
+		if len(v) > len(scheme) && strings.EqualFold(v[:len(scheme)], scheme) && v[len(scheme)] == ' ' {
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(scheme):]))
+			return b
+		}
 	}
-
-	return conn, nil
+	return nil
 }
 
 type httpHandler struct {
 	options *HandlerOptions
 }
 
+// session returns a copy of the handler serving a connection, whose logs are tagged with a new connection ID.
+func (h *httpHandler) session() *httpHandler {
+	opts := *h.options
+	opts.Logger = h.options.Logger.WithConn(newConnID())
+	return &httpHandler{options: &opts}
+}
+
 // HTTPHandler creates a server Handler for HTTP proxy server.
 func HTTPHandler(opts ...HandlerOption) Handler {
 	h := &httpHandler{}
@@ -117,20 +188,41 @@ func (h *httpHandler) Init(options ...HandlerOption) {
 func (h *httpHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	req, err := http.ReadRequest(bufio.NewReader(conn))
+	h = h.session()
+	conn = h.options.Traffic.ServiceConn(conn, h.options.Name)
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(h.options.handshakeTimeout()))
+	req, err := http.ReadRequest(br)
 	if err != nil {
-		log.Logf("[http] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Logf("[http] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
 	defer req.Body.Close()
 
+	if br.Buffered() > 0 {
+		// the data sent along with the request, such as the WebSocket frames following the upgrade request,
+		// is relayed after the request.
+		conn = &bufferdConn{Conn: conn, br: br}
+	}
+
 	h.handleRequest(conn, req)
 }
 
+// handleRequest handles the request req and the following requests on the connection conn,
+// conn reads the data following the request if it is a *bufferdConn.
 func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
-	if req == nil {
-		return
+	bc, ok := conn.(*bufferdConn)
+	if !ok {
+		bc = &bufferdConn{Conn: conn, br: bufio.NewReader(conn)}
+	}
+	for req != nil {
+		req = h.serveRequest(bc, req)
 	}
+}
+
+// serveRequest handles the request req, the next request is returned if the connection is kept alive.
+func (h *httpHandler) serveRequest(conn *bufferdConn, req *http.Request) *http.Request {
 
 	// try to get the actual host.
 	if v := req.Header.Get("Gost-Target"); v != "" {
@@ -143,17 +235,18 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 	if _, port, _ := net.SplitHostPort(host); port == "" {
 		host = net.JoinHostPort(host, "80")
 	}
+	host = normalizeAddr(host)
 
 	u, _, _ := basicProxyAuth(req.Header.Get("Proxy-Authorization"))
 	if u != "" {
 		u += "@"
 	}
-	log.Logf("[http] %s%s -> %s -> %s",
+	h.options.Logger.Logf("[http] %s%s -> %s -> %s",
 		u, conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if Debug {
+	if h.options.Logger.Debug() {
 		dump, _ := httputil.DumpRequest(req, false)
-		log.Logf("[http] %s -> %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+		h.options.Logger.Logf("[http] %s -> %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
 	}
 
 	req.Header.Del("Gost-Target")
@@ -165,49 +258,52 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 	}
 	resp.Header.Add("Proxy-Agent", "gost/"+Version)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[http] %s - %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, conn.RemoteAddr().String(), host, PeerIdentities(conn)...) {
+		h.options.Logger.Logf("[http] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		resp.StatusCode = http.StatusForbidden
+		h.errorPage(conn, resp, host)
 
-		if Debug {
+		if h.options.Logger.Debug() {
 			dump, _ := httputil.DumpResponse(resp, false)
-			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+			h.options.Logger.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
 		}
 
 		resp.Write(conn)
-		return
+		return nil
 	}
 
 	if h.options.Bypass.Contains(host) {
 		resp.StatusCode = http.StatusForbidden
 
-		log.Logf("[http] %s - %s bypass %s",
+		h.options.Logger.Logf("[http] %s - %s bypass %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
-		if Debug {
+		h.errorPage(conn, resp, host)
+		if h.options.Logger.Debug() {
 			dump, _ := httputil.DumpResponse(resp, false)
-			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+			h.options.Logger.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
 		}
 
 		resp.Write(conn)
-		return
+		return nil
 	}
 
 	if !h.authenticate(conn, req, resp) {
-		return
+		return nil
 	}
 
 	if req.Method == "PRI" || (req.Method != http.MethodConnect && req.URL.Scheme != "http") {
 		resp.StatusCode = http.StatusBadRequest
 
-		if Debug {
+		if h.options.Logger.Debug() {
 			dump, _ := httputil.DumpResponse(resp, false)
-			log.Logf("[http] %s <- %s\n%s",
+			h.options.Logger.Logf("[http] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), string(dump))
 		}
 
 		resp.Write(conn)
-		return
+		return nil
 	}
 
 	req.Header.Del("Proxy-Authorization")
@@ -226,7 +322,7 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(host)
 		if err != nil {
-			log.Logf("[http] %s -> %s : %s",
+			h.options.Logger.Warnf("[http] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
@@ -238,73 +334,137 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", host)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		// forward http request
 		lastNode := route.LastNode()
 		if req.Method != http.MethodConnect && lastNode.Protocol == "http" {
 			err = h.forwardRequest(conn, req, route)
 			if err == nil {
-				return
+				return nil
 			}
-			log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			h.options.Logger.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
 
 		cc, err = route.Dial(host,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, conn.RemoteAddr().String())),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Warnf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
 	if err != nil {
 		resp.StatusCode = http.StatusServiceUnavailable
+		h.errorPage(conn, resp, host)
 
-		if Debug {
+		if h.options.Logger.Debug() {
 			dump, _ := httputil.DumpResponse(resp, false)
-			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+			h.options.Logger.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
 		}
 
 		resp.Write(conn)
-		return
+		return nil
 	}
+	cc = relayConn(h.options, conn, cc, host)
 	defer cc.Close()
 
 	if req.Method == http.MethodConnect {
 		b := []byte("HTTP/1.1 200 Connection established\r\n" +
 			"Proxy-Agent: gost/" + Version + "\r\n\r\n")
-		if Debug {
-			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(b))
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(b))
 		}
 		conn.Write(b)
 	} else {
-		req.Header.Del("Proxy-Connection")
+		return h.relayRequest(conn, req, cc, host)
+	}
+
+	h.options.Logger.Logf("[http] %s <-> %s", conn.RemoteAddr(), host)
+	if err := transport(conn, cc); err != nil && h.options.Logger.Debug() {
+		h.options.Logger.Logf("[http] %s - %s : %s", conn.RemoteAddr(), host, err)
+	}
+	h.options.Logger.Logf("[http] %s >-< %s", conn.RemoteAddr(), host)
+	return nil
+}
 
-		if err = req.Write(cc); err != nil {
-			log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
-			return
+// relayRequest sends the plain request req to the host through the connection cc and relays the response back.
+// The next request on the connection conn is returned if both sides keep the connection alive,
+// the connections are relayed as is after the protocol is switched, such as the WebSocket upgrade.
+func (h *httpHandler) relayRequest(conn *bufferdConn, req *http.Request, cc net.Conn, host string) *http.Request {
+	req.Header.Del("Proxy-Connection")
+
+	if err := req.Write(cc); err != nil {
+		h.options.Logger.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), host, err)
+		return nil
+	}
+
+	br := bufio.NewReader(cc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		h.options.Logger.Logf("[http] %s <- %s : %s", conn.RemoteAddr(), host, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if h.options.Logger.Debug() {
+		dump, _ := httputil.DumpResponse(resp, false)
+		h.options.Logger.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), host, string(dump))
+	}
+	if err := resp.Write(conn); err != nil {
+		h.options.Logger.Logf("[http] %s <- %s : %s", conn.RemoteAddr(), host, err)
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.options.Logger.Logf("[http] %s <-> %s", conn.RemoteAddr(), host)
+		transport(conn, &bufferdConn{Conn: cc, br: br})
+		h.options.Logger.Logf("[http] %s >-< %s", conn.RemoteAddr(), host)
+		return nil
+	}
+	if req.Close || resp.Close {
+		return nil
+	}
+
+	// the idle connection is closed if the next request does not come in time.
+	conn.SetReadDeadline(time.Now().Add(HTTPIdleTimeout))
+	next, err := http.ReadRequest(conn.br)
+	if err != nil {
+		if err != io.EOF {
+			h.options.Logger.Logf("[http] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		}
+		return nil
 	}
+	conn.SetReadDeadline(time.Time{})
 
-	log.Logf("[http] %s <-> %s", conn.RemoteAddr(), host)
-	transport(conn, cc)
-	log.Logf("[http] %s >-< %s", conn.RemoteAddr(), host)
+	// the origin-form requests of the connection not from a proxy client, such as the one of the SNI proxy,
+	// are made absolute like the first one.
+	if req.URL.Host == "" && !next.URL.IsAbs() {
+		next.URL.Scheme = "http"
+	}
+	return next
 }
 
 func (h *httpHandler) authenticate(conn net.Conn, req *http.Request, resp *http.Response) (ok bool) {
 	u, p, _ := basicProxyAuth(req.Header.Get("Proxy-Authorization"))
-	if Debug && (u != "" || p != "") {
-		log.Logf("[http] %s -> %s : Authorization '%s' '%s'",
+	if h.options.Logger.Debug() && (u != "" || p != "") {
+		h.options.Logger.Logf("[http] %s -> %s : Authorization '%s' '%s'",
 			conn.RemoteAddr(), conn.LocalAddr(), u, p)
 	}
-	if h.options.Authenticator == nil || h.options.Authenticator.Authenticate(u, p) {
+	if h.options.Authenticator == nil {
 		return true
 	}
+	if h.options.Authenticator.Authenticate(u, p) {
+		setTrafficUser(conn, u)
+		setRateLimitUser(conn, u)
+		return true
+	}
+	h.options.Banner.Fail(conn.RemoteAddr().String())
 
 	// probing resistance is enabled, and knocking host is mismatch.
 	if ss := strings.SplitN(h.options.ProbeResist, ":", 2); len(ss) == 2 &&
@@ -328,10 +488,10 @@ func (h *httpHandler) authenticate(conn net.Conn, req *http.Request, resp *http.
 				defer cc.Close()
 
 				req.Write(cc)
-				log.Logf("[http] %s <-> %s : forward to %s",
+				h.options.Logger.Logf("[http] %s <-> %s : forward to %s",
 					conn.RemoteAddr(), conn.LocalAddr(), ss[1])
 				transport(conn, cc)
-				log.Logf("[http] %s >-< %s : forward to %s",
+				h.options.Logger.Logf("[http] %s >-< %s : forward to %s",
 					conn.RemoteAddr(), conn.LocalAddr(), ss[1])
 				return
 			}
@@ -349,10 +509,11 @@ func (h *httpHandler) authenticate(conn net.Conn, req *http.Request, resp *http.
 	}
 
 	if resp.StatusCode == 0 {
-		log.Logf("[http] %s <- %s : proxy authentication required",
+		h.options.Logger.Logf("[http] %s <- %s : proxy authentication required",
 			conn.RemoteAddr(), conn.LocalAddr())
 		resp.StatusCode = http.StatusProxyAuthRequired
 		resp.Header.Add("Proxy-Authenticate", "Basic realm=\"gost\"")
+		h.errorPage(conn, resp, req.Host)
 	} else {
 		resp.Header = http.Header{}
 		resp.Header.Set("Server", "nginx/1.14.1")
@@ -362,9 +523,9 @@ func (h *httpHandler) authenticate(conn net.Conn, req *http.Request, resp *http.
 		}
 	}
 
-	if Debug {
+	if h.options.Logger.Debug() {
 		dump, _ := httputil.DumpResponse(resp, false)
-		log.Logf("[http] %s <- %s\n%s",
+		h.options.Logger.Logf("[http] %s <- %s\n%s",
 			conn.RemoteAddr(), conn.LocalAddr(), string(dump))
 	}
 
@@ -372,6 +533,22 @@ func (h *httpHandler) authenticate(conn net.Conn, req *http.Request, resp *http.
 	return
 }
 
+// errorPage renders the error page of the response resp if the error pages are set, the error ID is logged for correlation.
+func (h *httpHandler) errorPage(conn net.Conn, resp *http.Response, host string) {
+	if h.options.ErrorPages == nil {
+		return
+	}
+	page := NewErrorPage(resp.StatusCode, conn.RemoteAddr().String(), host)
+	if id := h.options.Logger.ConnID(); id != "" {
+		page.ID = id
+	}
+	if err := h.options.ErrorPages.Render(resp, page); err != nil {
+		h.options.Logger.Logf("[http] %s - %s : error page: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	h.options.Logger.Logf("[http] %s - %s : error %s : %d %s", conn.RemoteAddr(), conn.LocalAddr(), page.ID, page.Code, host)
+}
+
 func (h *httpHandler) forwardRequest(conn net.Conn, req *http.Request, route *Chain) error {
 	if route.IsEmpty() {
 		return nil
@@ -398,14 +575,14 @@ func (h *httpHandler) forwardRequest(conn net.Conn, req *http.Request, route *Ch
 		req.URL.Scheme = "http" // make sure that the URL is absolute
 	}
 	if err = req.WriteProxy(cc); err != nil {
-		log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		return nil
 	}
 	cc.SetWriteDeadline(time.Time{})
 
-	log.Logf("[http] %s <-> %s", conn.RemoteAddr(), req.Host)
+	h.options.Logger.Logf("[http] %s <-> %s", conn.RemoteAddr(), req.Host)
 	transport(conn, cc)
-	log.Logf("[http] %s >-< %s", conn.RemoteAddr(), req.Host)
+	h.options.Logger.Logf("[http] %s >-< %s", conn.RemoteAddr(), req.Host)
 	return nil
 }
 
@@ -88,7 +88,7 @@ func (c *http2Connector) Connect(conn net.Conn, addr string, options ...ConnectO
 
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, errors.New(resp.Status)
+		return nil, &ReplyError{Protocol: "http2", Code: resp.StatusCode, Msg: resp.Status}
 	}
 	hc := &http2Conn{
 		r:      resp.Body,
@@ -260,7 +260,7 @@ func (tr *h2Transporter) Dial(addr string, options ...DialOption) (net.Conn, err
 
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, errors.New(resp.Status)
+		return nil, &ReplyError{Protocol: "http2", Code: resp.StatusCode, Msg: resp.Status}
 	}
 	conn := &http2Conn{
 		r:      resp.Body,
@@ -308,9 +308,10 @@ func (h *http2Handler) Init(options ...HandlerOption) {
 func (h *http2Handler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	h2c, ok := conn.(*http2ServerConn)
+	c, _ := unwrapConn(conn)
+	h2c, ok := c.(*http2ServerConn)
 	if !ok {
-		log.Log("[http2] wrong connection type")
+		h.options.Logger.Log("[http2] wrong connection type")
 		return
 	}
 
@@ -326,31 +327,33 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 	if _, port, _ := net.SplitHostPort(host); port == "" {
 		host = net.JoinHostPort(host, "80")
 	}
+	host = normalizeAddr(host)
 
 	laddr := h.options.Addr
 	u, _, _ := basicProxyAuth(r.Header.Get("Proxy-Authorization"))
 	if u != "" {
 		u += "@"
 	}
-	log.Logf("[http2] %s%s -> %s -> %s",
+	h.options.Logger.Logf("[http2] %s%s -> %s -> %s",
 		u, r.RemoteAddr, h.options.Node.String(), host)
 
-	if Debug {
+	if h.options.Logger.Debug() {
 		dump, _ := httputil.DumpRequest(r, false)
-		log.Logf("[http2] %s - %s\n%s", r.RemoteAddr, laddr, string(dump))
+		h.options.Logger.Logf("[http2] %s - %s\n%s", r.RemoteAddr, laddr, string(dump))
 	}
 
 	w.Header().Set("Proxy-Agent", "gost/"+Version)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[http2] %s - %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, r.RemoteAddr, host, certIdentities(r.TLS)...) {
+		h.options.Logger.Logf("[http2] %s - %s : Unauthorized to tcp connect to %s",
 			r.RemoteAddr, laddr, host)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	if h.options.Bypass.Contains(host) {
-		log.Logf("[http2] %s - %s bypass %s",
+		h.options.Logger.Logf("[http2] %s - %s bypass %s",
 			r.RemoteAddr, laddr, host)
 		w.WriteHeader(http.StatusForbidden)
 		return
@@ -385,7 +388,7 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(host)
 		if err != nil {
-			log.Logf("[http2] %s -> %s : %s",
+			h.options.Logger.Logf("[http2] %s -> %s : %s",
 				r.RemoteAddr, laddr, err)
 			continue
 		}
@@ -397,17 +400,18 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", host)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		cc, err = route.Dial(host,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, r.RemoteAddr)),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[http2] %s -> %s : %s", r.RemoteAddr, laddr, err)
+		h.options.Logger.Logf("[http2] %s -> %s : %s", r.RemoteAddr, laddr, err)
 	}
 
 	if err != nil {
@@ -427,41 +431,42 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 			// we take over the underly connection
 			conn, _, err := hj.Hijack()
 			if err != nil {
-				log.Logf("[http2] %s -> %s : %s",
+				h.options.Logger.Logf("[http2] %s -> %s : %s",
 					r.RemoteAddr, laddr, err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 			defer conn.Close()
 
-			log.Logf("[http2] %s <-> %s : downgrade to HTTP/1.1", r.RemoteAddr, host)
+			h.options.Logger.Logf("[http2] %s <-> %s : downgrade to HTTP/1.1", r.RemoteAddr, host)
 			transport(conn, cc)
-			log.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
+			h.options.Logger.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
 			return
 		}
 
-		log.Logf("[http2] %s <-> %s", r.RemoteAddr, host)
+		h.options.Logger.Logf("[http2] %s <-> %s", r.RemoteAddr, host)
 		transport(&readWriter{r: r.Body, w: flushWriter{w}}, cc)
-		log.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
+		h.options.Logger.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
 		return
 	}
 
-	log.Logf("[http2] %s <-> %s", r.RemoteAddr, host)
+	h.options.Logger.Logf("[http2] %s <-> %s", r.RemoteAddr, host)
 	if err := h.forwardRequest(w, r, cc); err != nil {
-		log.Logf("[http2] %s - %s : %s", r.RemoteAddr, host, err)
+		h.options.Logger.Logf("[http2] %s - %s : %s", r.RemoteAddr, host, err)
 	}
-	log.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
+	h.options.Logger.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
 }
 
 func (h *http2Handler) authenticate(w http.ResponseWriter, r *http.Request, resp *http.Response) (ok bool) {
 	laddr := h.options.Addr
 	u, p, _ := basicProxyAuth(r.Header.Get("Proxy-Authorization"))
-	if Debug && (u != "" || p != "") {
-		log.Logf("[http2] %s - %s : Authorization '%s' '%s'", r.RemoteAddr, laddr, u, p)
+	if h.options.Logger.Debug() && (u != "" || p != "") {
+		h.options.Logger.Logf("[http2] %s - %s : Authorization '%s' '%s'", r.RemoteAddr, laddr, u, p)
 	}
 	if h.options.Authenticator == nil || h.options.Authenticator.Authenticate(u, p) {
 		return true
 	}
+	h.options.Banner.Fail(r.RemoteAddr)
 
 	// probing resistance is enabled, and knocking host is mismatch.
 	if ss := strings.SplitN(h.options.ProbeResist, ":", 2); len(ss) == 2 &&
@@ -484,11 +489,11 @@ func (h *http2Handler) authenticate(w http.ResponseWriter, r *http.Request, resp
 			cc, err := net.Dial("tcp", ss[1])
 			if err == nil {
 				defer cc.Close()
-				log.Logf("[http2] %s <-> %s : forward to %s", r.RemoteAddr, laddr, ss[1])
+				h.options.Logger.Logf("[http2] %s <-> %s : forward to %s", r.RemoteAddr, laddr, ss[1])
 				if err := h.forwardRequest(w, r, cc); err != nil {
-					log.Logf("[http2] %s - %s : %s", r.RemoteAddr, laddr, err)
+					h.options.Logger.Logf("[http2] %s - %s : %s", r.RemoteAddr, laddr, err)
 				}
-				log.Logf("[http2] %s >-< %s : forward to %s", r.RemoteAddr, laddr, ss[1])
+				h.options.Logger.Logf("[http2] %s >-< %s : forward to %s", r.RemoteAddr, laddr, ss[1])
 				return
 			}
 		case "file":
@@ -504,7 +509,7 @@ func (h *http2Handler) authenticate(w http.ResponseWriter, r *http.Request, resp
 	}
 
 	if resp.StatusCode == 0 {
-		log.Logf("[http2] %s <- %s : proxy authentication required", r.RemoteAddr, laddr)
+		h.options.Logger.Logf("[http2] %s <- %s : proxy authentication required", r.RemoteAddr, laddr)
 		resp.StatusCode = http.StatusProxyAuthRequired
 		resp.Header.Add("Proxy-Authenticate", "Basic realm=\"gost\"")
 	} else {
@@ -519,9 +524,9 @@ func (h *http2Handler) authenticate(w http.ResponseWriter, r *http.Request, resp
 		}
 	}
 
-	if Debug {
+	if h.options.Logger.Debug() {
 		dump, _ := httputil.DumpResponse(resp, false)
-		log.Logf("[http2] %s <- %s\n%s", r.RemoteAddr, laddr, string(dump))
+		h.options.Logger.Logf("[http2] %s <- %s\n%s", r.RemoteAddr, laddr, string(dump))
 	}
 
 	h.writeResponse(w, resp)
@@ -1,15 +1,21 @@
 package gost
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 var httpProxyTests = []struct {
@@ -83,6 +89,263 @@ func TestHTTPProxyAuth(t *testing.T) {
 	}
 }
 
+func TestHTTPConnectIPv6Zone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go HTTPConnector(nil).Connect(c1, "[fe80::1%eth0]:80")
+
+	req, err := http.ReadRequest(bufio.NewReader(c2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Host != "[fe80::1%eth0]:80" {
+		t.Errorf("the zone should be kept, got %s", req.Host)
+	}
+}
+
+// ntlmTestProxy serves the NTLM handshake of the CONNECT requests on conn as the proxy with the scheme.
+func ntlmTestProxy(conn net.Conn, scheme, user, password string) error {
+	br := bufio.NewReader(conn)
+	challenge := ntlmTestChallengeMessage(ntlmTestServerChallenge, ntlmTestTargetInfo)
+	for i := 0; i < 2; i++ {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return err
+		}
+		auth := strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), scheme+" ")
+		b, _ := base64.StdEncoding.DecodeString(auth)
+		if i == 0 {
+			if !bytes.Equal(b, ntlmNegotiateMessage()) {
+				return fmt.Errorf("unexpected negotiate message: %s", auth)
+			}
+			body := "proxy authentication required"
+			fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"gost\"\r\n"+
+				"Proxy-Authenticate: %s %s\r\nContent-Length: %d\r\n\r\n%s",
+				scheme, base64.StdEncoding.EncodeToString(challenge), len(body), body)
+			continue
+		}
+
+		if len(b) < 64 {
+			return fmt.Errorf("unexpected authenticate message: %s", auth)
+		}
+		nt := b[binary.LittleEndian.Uint32(b[24:]):][:binary.LittleEndian.Uint16(b[20:])]
+		if !ntlmTestVerify(nt, user, password, "CORP", ntlmTestServerChallenge) {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+			return nil
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+	return nil
+}
+
+func TestHTTPConnectNTLM(t *testing.T) {
+	for _, tc := range []struct {
+		auth, scheme string
+		password     string
+		ok           bool
+	}{
+		{HTTPAuthNTLM, "NTLM", "123456", true},
+		{HTTPAuthNegotiate, "Negotiate", "123456", true},
+		{HTTPAuthNTLM, "NTLM", "654321", false},
+	} {
+		c1, c2 := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- ntlmTestProxy(c2, tc.scheme, "admin", "123456")
+		}()
+
+		_, err := HTTPAuthConnector(url.UserPassword(`CORP\admin`, tc.password), tc.auth).Connect(c1, "example.com:443")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s with password %s: %v", tc.auth, tc.password, err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("%s: %v", tc.auth, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// upgradeTestServer switches the protocol of the upgrade request, then echoes the data.
+func upgradeTestServer(ln net.Listener, upgrade chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	upgrade <- req.Header.Get("Connection") + " " + req.Header.Get("Upgrade")
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	io.Copy(conn, br)
+}
+
+func TestHTTPProxyUpgrade(t *testing.T) {
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tln.Close()
+	upgrade := make(chan string, 1)
+	go upgradeTestServer(tln, upgrade)
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the first frame is sent along with the upgrade request.
+	fmt.Fprintf(conn, "GET http://%s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nhello",
+		tln.Addr(), tln.Addr())
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("should switch protocols, got", resp.Status)
+	}
+	if s := <-upgrade; s != "Upgrade websocket" {
+		t.Errorf("the upgrade headers should be kept, got %q", s)
+	}
+
+	conn.Write([]byte(" world"))
+	b := make([]byte, 11)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "hello world" {
+		t.Errorf("the data should be relayed after the upgrade, got %q, %v", b, err)
+	}
+}
+
+func TestHTTPProxyKeepAlive(t *testing.T) {
+	var srvs []*httptest.Server
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("server%d", i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", name, r.Method, b)
+		}))
+		defer srv.Close()
+		srvs = append(srvs, srv)
+	}
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the requests to the different hosts are sent on the same connection.
+	br := bufio.NewReader(conn)
+	for i, tc := range []struct {
+		srv    *httptest.Server
+		method string
+		body   string
+		close  bool
+	}{
+		{srvs[0], http.MethodGet, "", false},
+		{srvs[1], http.MethodPost, "hello", false},
+		{srvs[0], http.MethodGet, "", true},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.srv.URL, strings.NewReader(tc.body))
+		req.Close = tc.close
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("#%d %v", i, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if expected := fmt.Sprintf("server%d %s %s", i%2, tc.method, tc.body); string(b) != expected {
+			t.Errorf("#%d should get %q, got %q", i, expected, b)
+		}
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error("the connection should be closed, got", err)
+	}
+}
+
+func TestHTTPProxyKeepAliveIdle(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	defer func(d time.Duration) { HTTPIdleTimeout = d }(HTTPIdleTimeout)
+	HTTPIdleTimeout = 100 * time.Millisecond
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	br := bufio.NewReader(conn)
+	req, _ := http.NewRequest(http.MethodGet, httpSrv.URL, nil)
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// no more request is sent, the idle connection is closed by the proxy.
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatal("the idle connection should be closed, got", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the idle connection should be closed in %v, got %v", HTTPIdleTimeout, d)
+	}
+}
+
 func TestHTTPProxyWithInvalidRequest(t *testing.T) {
 	httpSrv := httptest.NewServer(httpTestHandler)
 	defer httpSrv.Close()
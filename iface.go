@@ -0,0 +1,158 @@
+package gost
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// interfaceCheckPeriod is the period of checking the addresses of the interface bound by the InterfaceListener.
+var interfaceCheckPeriod = 5 * time.Second
+
+var errInterfaceAddrChanged = errors.New("interface address changed")
+
+// InterfaceAddr resolves the address addr whose host is a network interface name, such as 'eth1:1080',
+// to the current address of the interface. The IPv4 address is preferred, then the global IPv6 address,
+// then the link-local IPv6 address with the zone. The address is returned as is if the host is not an interface name.
+func InterfaceAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ifi, err := net.InterfaceByName(host)
+	if err != nil {
+		return addr, nil
+	}
+
+	ips, err := interfaceIPs(ifi)
+	if err != nil {
+		return "", err
+	}
+	var ip string
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip = v.String()
+			break
+		}
+		if ip == "" && !v.IsLinkLocalUnicast() {
+			ip = v.String()
+		}
+	}
+	if ip == "" {
+		ip = ips[0].String() + "%" + ifi.Name
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
+func interfaceIPs(ifi *net.Interface) ([]net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipn.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no address", ifi.Name)
+	}
+	return ips, nil
+}
+
+type interfaceListener struct {
+	Listener
+	name      string
+	ip        net.IP
+	err       error
+	mux       sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// InterfaceListener wraps the listener ln bound to the address of the network interface name.
+// The addresses of the interface are checked periodically, the listener is closed with an error
+// once the bound address is removed from the interface, so it can be bound to the new address again.
+func InterfaceListener(ln Listener, name string) Listener {
+	var ip net.IP
+	switch addr := ln.Addr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		return ln
+	}
+
+	l := &interfaceListener{
+		Listener: ln,
+		name:     name,
+		ip:       ip,
+		closed:   make(chan struct{}),
+	}
+	go l.watch()
+	return l
+}
+
+func (l *interfaceListener) watch() {
+	ticker := time.NewTicker(interfaceCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.check(); err != nil {
+				log.Logf("[iface] %s : %s : %v", l.name, l.Addr(), err)
+				l.mux.Lock()
+				l.err = err
+				l.mux.Unlock()
+				l.Close()
+				return
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *interfaceListener) check() error {
+	ifi, err := net.InterfaceByName(l.name)
+	if err != nil {
+		return err
+	}
+	ips, err := interfaceIPs(ifi)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if ip.Equal(l.ip) {
+			return nil
+		}
+	}
+	return errInterfaceAddrChanged
+}
+
+func (l *interfaceListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.mux.Lock()
+		if l.err != nil {
+			err = l.err
+		}
+		l.mux.Unlock()
+	}
+	return conn, err
+}
+
+func (l *interfaceListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
@@ -0,0 +1,95 @@
+package gost
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagLoopback != 0 {
+			if addrs, _ := ifis[i].Addrs(); len(addrs) > 0 {
+				return &ifis[i]
+			}
+		}
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	ifi := loopbackInterface(t)
+
+	addr, err := InterfaceAddr(ifi.Name + ":1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() || port != "1080" {
+		t.Errorf("unexpected address of interface %s: %s", ifi.Name, addr)
+	}
+
+	for _, addr := range []string{":1080", "127.0.0.1:1080", "[::1]:1080", "example.com:1080", "localhost"} {
+		if out, err := InterfaceAddr(addr); err != nil || out != addr {
+			t.Errorf("%s should not be changed, got %s, %v", addr, out, err)
+		}
+	}
+}
+
+func TestInterfaceListener(t *testing.T) {
+	ifi := loopbackInterface(t)
+
+	period := interfaceCheckPeriod
+	interfaceCheckPeriod = 10 * time.Millisecond
+	defer func() { interfaceCheckPeriod = period }()
+
+	addr, err := InterfaceAddr(ifi.Name + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tln, err := TCPListener(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := InterfaceListener(tln, ifi.Name)
+	defer ln.Close()
+
+	go func(addr string) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+	}(ln.Addr().String())
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("the listener should be kept while the address is bound to the interface:", err)
+	}
+	conn.Close()
+
+	// the bound address is not an address of the interface.
+	tln, err = TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = InterfaceListener(tln, "gost-test-none")
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func(ln Listener) {
+		_, err := ln.Accept()
+		errc <- err
+	}(ln)
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("the listener should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("the listener should be closed once the interface is gone")
+	}
+}
@@ -0,0 +1,297 @@
+package gost
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+var (
+	flowID    uint64
+	flows     = make(map[uint64]*Flow)
+	flowsLock sync.RWMutex
+)
+
+// Flow is a relayed connection under inspection, it is in the active flows until it is closed.
+type Flow struct {
+	// ID is the unique ID of the flow.
+	ID uint64
+	// Client is the address of the client.
+	Client string
+	// Target is the target address requested by the client.
+	Target string
+	// Node is the server node that the flow is accepted by.
+	Node  string
+	Start time.Time
+
+	rate   int64
+	conns  []net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// LookupFlow returns the active flow with the id, it returns nil if the flow is not found or closed.
+func LookupFlow(id uint64) *Flow {
+	flowsLock.RLock()
+	defer flowsLock.RUnlock()
+
+	return flows[id]
+}
+
+// Kill closes the flow.
+func (f *Flow) Kill() {
+	f.once.Do(func() {
+		close(f.closed)
+		for _, c := range f.conns {
+			c.Close()
+		}
+
+		flowsLock.Lock()
+		delete(flows, f.ID)
+		flowsLock.Unlock()
+	})
+}
+
+// Throttle limits the bandwidth of the flow to rate bytes per second in each direction,
+// 0 removes the limit.
+func (f *Flow) Throttle(rate int64) {
+	atomic.StoreInt64(&f.rate, rate)
+}
+
+// Closed reports whether the flow is closed.
+func (f *Flow) Closed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *Flow) throttle(n int) {
+	if rate := atomic.LoadInt64(&f.rate); rate > 0 && n > 0 {
+		select {
+		case <-time.After(time.Duration(n) * time.Second / time.Duration(rate)):
+		case <-f.closed:
+		}
+	}
+}
+
+// Inspector is the interface for the detectors consuming the payload of the flows,
+// for example, to flag the suspicious flows, and then throttle or kill them.
+// The chunk is the data sent from the client to the target if upstream is true, otherwise the reverse.
+// Inspect is called synchronously on the relay path, so it must not block, and must not retain the chunk.
+type Inspector interface {
+	Inspect(flow *Flow, upstream bool, chunk []byte)
+}
+
+// InspectorFunc is an adapter to allow the use of ordinary functions as Inspector.
+type InspectorFunc func(flow *Flow, upstream bool, chunk []byte)
+
+// Inspect calls f(flow, upstream, chunk).
+func (f InspectorFunc) Inspect(flow *Flow, upstream bool, chunk []byte) {
+	f(flow, upstream, chunk)
+}
+
+type sampledInspector struct {
+	inspector Inspector
+	rate      uint64
+	size      int
+	n         uint64
+}
+
+// SampledInspector creates an Inspector that samples the chunks for the inspector,
+// one of every rate chunks is inspected, and the chunk is truncated to size bytes.
+// A rate or size less than 1 means no sampling for it.
+func SampledInspector(inspector Inspector, rate, size int) Inspector {
+	if rate < 1 {
+		rate = 1
+	}
+	return &sampledInspector{
+		inspector: inspector,
+		rate:      uint64(rate),
+		size:      size,
+	}
+}
+
+func (si *sampledInspector) Inspect(flow *Flow, upstream bool, chunk []byte) {
+	if atomic.AddUint64(&si.n, 1)%si.rate != 0 {
+		return
+	}
+	if si.size > 0 && len(chunk) > si.size {
+		chunk = chunk[:si.size]
+	}
+	si.inspector.Inspect(flow, upstream, chunk)
+}
+
+// inspectConn wraps the connection cc from the client conn to the target addr for inspection.
+func inspectConn(inspector Inspector, conn, cc net.Conn, addr string, node Node) net.Conn {
+	if inspector == nil {
+		return cc
+	}
+
+	f := &Flow{
+		ID:     atomic.AddUint64(&flowID, 1),
+		Client: conn.RemoteAddr().String(),
+		Target: addr,
+		Node:   node.String(),
+		Start:  time.Now(),
+		conns:  []net.Conn{conn, cc},
+		closed: make(chan struct{}),
+	}
+	flowsLock.Lock()
+	flows[f.ID] = f
+	flowsLock.Unlock()
+
+	return &inspectedConn{Conn: cc, flow: f, inspector: inspector}
+}
+
+type inspectedConn struct {
+	net.Conn
+	flow      *Flow
+	inspector Inspector
+}
+
+func (c *inspectedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.inspector.Inspect(c.flow, false, b[:n])
+		c.flow.throttle(n)
+	}
+	return
+}
+
+func (c *inspectedConn) Write(b []byte) (n int, err error) {
+	if len(b) > 0 {
+		c.inspector.Inspect(c.flow, true, b)
+		c.flow.throttle(len(b))
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *inspectedConn) Close() error {
+	c.flow.Kill()
+	return nil
+}
+
+// inspectSample is the message sent to the remote inspector for each inspected chunk.
+type inspectSample struct {
+	ID       uint64 `json:"id"`
+	Client   string `json:"client"`
+	Target   string `json:"target"`
+	Node     string `json:"node"`
+	Upstream bool   `json:"upstream"`
+	Data     []byte `json:"data"`
+}
+
+type remoteInspector struct {
+	addr string
+	ch   chan *inspectSample
+}
+
+// RemoteInspector creates an Inspector that streams the chunks to the external detector at the TCP address addr.
+// Each chunk is sent as a line of JSON object with the flow metadata:
+// {"id": 1, "client": "...", "target": "...", "node": "...", "upstream": true, "data": "<base64>"}
+// The detector can send back the commands line by line to control the flows:
+// 'kill <id>' closes the flow, 'throttle <id> <rate>' limits the flow to rate bytes per second.
+// The chunks are dropped if the detector is unavailable or too slow, so the relay is never blocked.
+func RemoteInspector(addr string) Inspector {
+	ri := &remoteInspector{
+		addr: addr,
+		ch:   make(chan *inspectSample, MirrorBufferSize),
+	}
+	go ri.run()
+	return ri
+}
+
+func (ri *remoteInspector) Inspect(flow *Flow, upstream bool, chunk []byte) {
+	sample := &inspectSample{
+		ID:       flow.ID,
+		Client:   flow.Client,
+		Target:   flow.Target,
+		Node:     flow.Node,
+		Upstream: upstream,
+		Data:     append([]byte(nil), chunk...),
+	}
+	select {
+	case ri.ch <- sample:
+	default:
+	}
+}
+
+func (ri *remoteInspector) run() {
+	for {
+		if err := ri.serve(); err != nil {
+			log.Logf("[inspect] %s : %s", ri.addr, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (ri *remoteInspector) serve() error {
+	conn, err := net.DialTimeout("tcp", ri.addr, DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Logf("[inspect] %s connected", ri.addr)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ri.control(conn)
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case sample := <-ri.ch:
+			if err := enc.Encode(sample); err != nil {
+				return err
+			}
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+// control reads the commands from the detector.
+func (ri *remoteInspector) control(conn net.Conn) error {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		ss := strings.Fields(scanner.Text())
+		if len(ss) < 2 {
+			continue
+		}
+		id, _ := strconv.ParseUint(ss[1], 10, 64)
+		flow := LookupFlow(id)
+		if flow == nil {
+			continue
+		}
+
+		switch ss[0] {
+		case "kill":
+			log.Logf("[inspect] %s -> %s : killed by %s", flow.Client, flow.Target, ri.addr)
+			flow.Kill()
+		case "throttle":
+			if len(ss) < 3 {
+				continue
+			}
+			rate, _ := strconv.ParseInt(ss[2], 10, 64)
+			log.Logf("[inspect] %s -> %s : throttled to %d B/s by %s", flow.Client, flow.Target, rate, ri.addr)
+			flow.Throttle(rate)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,128 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func inspectProxyRoundtrip(inspector Inspector, targetURL string, data []byte) error {
+	ln, err := TCPListener("")
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	server := &Server{
+		Handler:  SOCKS5Handler(InspectorHandlerOption(inspector)),
+		Listener: ln,
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestInspector(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	var mux sync.Mutex
+	var upstream, downstream []byte
+	var flow *Flow
+	inspector := InspectorFunc(func(f *Flow, up bool, chunk []byte) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		flow = f
+		if up {
+			upstream = append(upstream, chunk...)
+		} else {
+			downstream = append(downstream, chunk...)
+		}
+	})
+	if err := inspectProxyRoundtrip(inspector, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	if flow == nil || flow.ID == 0 || flow.Target == "" || flow.Client == "" {
+		t.Fatalf("invalid flow: %+v", flow)
+	}
+	if !bytes.Contains(upstream, sendData) || !bytes.Contains(downstream, sendData) {
+		t.Error("the data of both directions should be inspected")
+	}
+
+	// wait for the relay to finish.
+	for i := 0; i < 10 && !flow.Closed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if LookupFlow(flow.ID) != nil {
+		t.Error("the closed flow should be removed from the active flows")
+	}
+}
+
+func TestInspectorKill(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	inspector := InspectorFunc(func(f *Flow, up bool, chunk []byte) {
+		if LookupFlow(f.ID) != f {
+			t.Error("the flow should be active")
+		}
+		f.Kill()
+	})
+	if err := inspectProxyRoundtrip(inspector, httpSrv.URL, sendData); err == nil {
+		t.Error("the killed flow should failed")
+	}
+}
+
+func TestInspectorThrottle(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	inspector := InspectorFunc(func(f *Flow, up bool, chunk []byte) {
+		f.Throttle(1024)
+	})
+	start := time.Now()
+	if err := inspectProxyRoundtrip(inspector, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	// at least 128 bytes request body and 128 bytes response body at 1KB/s.
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("the throttled flow should take more time, got %v", d)
+	}
+}
+
+func TestSampledInspector(t *testing.T) {
+	var chunks [][]byte
+	inspector := SampledInspector(InspectorFunc(func(f *Flow, up bool, chunk []byte) {
+		chunks = append(chunks, chunk)
+	}), 2, 4)
+
+	for _, s := range []string{"a", "bbbbbb", "c", "dd", "eeeee"} {
+		inspector.Inspect(&Flow{}, true, []byte(s))
+	}
+	if len(chunks) != 2 || string(chunks[0]) != "bbbb" || string(chunks[1]) != "dd" {
+		t.Errorf("unexpected sampled chunks: %q", chunks)
+	}
+}
@@ -48,7 +48,8 @@ type KCPConfig struct {
 	Signal       bool   `json:"signal"` // Signal enables the signal SIGUSR1 feature.
 }
 
-// Init initializes the KCP config.
+// Init initializes the KCP config, the mode presets the NoDelay, Interval, Resend and NoCongestion,
+// they are kept as is in the manual mode.
 func (c *KCPConfig) Init() {
 	switch c.Mode {
 	case "normal":
@@ -128,6 +129,13 @@ func (tr *kcpTransporter) Dial(addr string, options ...DialOption) (conn net.Con
 		delete(tr.sessions, addr) // session is dead
 		ok = false
 	}
+	if ok && !session.reserve(opts.MaxStreams) {
+		if session.session != nil {
+			session.retire() // the pending session is retired by its Handshake
+		}
+		delete(tr.sessions, addr)
+		ok = false // session is full
+	}
 	if !ok {
 		timeout := opts.Timeout
 		if timeout <= 0 {
@@ -137,10 +145,10 @@ func (tr *kcpTransporter) Dial(addr string, options ...DialOption) (conn net.Con
 		if err != nil {
 			return
 		}
-		session = &muxSession{conn: conn}
+		session = &muxSession{conn: conn, pending: 1} // the stream being dialed
 		tr.sessions[addr] = session
 	}
-	return session.conn, nil
+	return newMuxDialConn(session, &tr.sessionMutex), nil
 }
 
 func (tr *kcpTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
@@ -163,6 +171,10 @@ func (tr *kcpTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (
 	defer conn.SetDeadline(time.Time{})
 
 	session, ok := tr.sessions[opts.Addr]
+	if dc, dialed := conn.(*muxDialConn); dialed {
+		conn, session = dc.handshake() // the session on which Dial reserved the stream
+		ok = true
+	}
 	if !ok || session.session == nil {
 		s, err := tr.initSession(opts.Addr, conn, config)
 		if err != nil {
@@ -170,8 +182,15 @@ func (tr *kcpTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (
 			delete(tr.sessions, opts.Addr)
 			return nil, err
 		}
-		session = s
-		tr.sessions[opts.Addr] = session
+		if !ok {
+			session = s
+			tr.sessions[opts.Addr] = session
+		} else {
+			session.conn, session.session = s.conn, s.session
+			if tr.sessions[opts.Addr] != session {
+				session.retire() // the session is replaced after Dial
+			}
+		}
 	}
 	cc, err := session.GetConn()
 	if err != nil {
@@ -214,9 +233,8 @@ func (tr *kcpTransporter) initSession(addr string, conn net.Conn, config *KCPCon
 	}
 
 	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
+	smuxConfig := muxConfig(time.Duration(config.KeepAlive) * time.Second)
 	smuxConfig.MaxReceiveBuffer = config.SockBuf
-	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
 	var cc net.Conn = kcpconn
 	if !config.NoComp {
 		cc = newCompStreamConn(kcpconn)
@@ -233,10 +251,11 @@ func (tr *kcpTransporter) Multiplex() bool {
 }
 
 type kcpListener struct {
-	config   *KCPConfig
-	ln       *kcp.Listener
-	connChan chan net.Conn
-	errChan  chan error
+	config    *KCPConfig
+	ln        *kcp.Listener
+	connChan  chan net.Conn
+	errChan   chan error
+	closeOnce sync.Once
 }
 
 // KCPListener creates a Listener for KCP proxy server.
@@ -298,9 +317,8 @@ func (l *kcpListener) listenLoop() {
 }
 
 func (l *kcpListener) mux(conn net.Conn) {
-	smuxConfig := smux.DefaultConfig()
+	smuxConfig := muxServerConfig(time.Duration(l.config.KeepAlive) * time.Second)
 	smuxConfig.MaxReceiveBuffer = l.config.SockBuf
-	smuxConfig.KeepAliveInterval = time.Duration(l.config.KeepAlive) * time.Second
 
 	log.Logf("[kcp] %s - %s", conn.RemoteAddr(), l.Addr())
 
@@ -350,8 +368,12 @@ func (l *kcpListener) Addr() net.Addr {
 	return l.ln.Addr()
 }
 
-func (l *kcpListener) Close() error {
-	return l.ln.Close()
+// Close closes the listener, the listener of the KCP session panics if it is closed more than once.
+func (l *kcpListener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		err = l.ln.Close()
+	})
+	return
 }
 
 func blockCrypt(key, crypt, salt string) (block kcp.BlockCrypt) {
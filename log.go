@@ -1,8 +1,23 @@
 package gost
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	golog "github.com/go-log/log"
 )
 
 func init() {
@@ -34,3 +49,297 @@ func (l *NopLogger) Log(v ...interface{}) {
 // Logf does nothing
 func (l *NopLogger) Logf(format string, v ...interface{}) {
 }
+
+// The log levels of a service, from the most verbose to the least.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+	LogLevelOff   = "off"
+)
+
+var logLevels = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+	LogLevelOff:   4,
+}
+
+// The log output formats of a service.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// ServiceLogger is the logger of a service with its own level and sink,
+// the outputs are prefixed by the service name if set, so the logs of multiple services can be told apart.
+// The nil ServiceLogger uses the default logger, and the debug log is enabled by the global Debug flag.
+type ServiceLogger struct {
+	logger *log.Logger // nil for the default logger
+	name   string
+	level  string
+	json   bool
+	conn   string
+}
+
+// NewServiceLogger creates a ServiceLogger of the service name writing to w with the level and the format.
+// The debug log is enabled by the global Debug flag if the level is empty.
+// The outputs are written by the standard log package if w is nil.
+func NewServiceLogger(name string, w io.Writer, level, format string) (*ServiceLogger, error) {
+	switch level {
+	case "": // follows the global Debug flag
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError, LogLevelOff:
+	default:
+		return nil, fmt.Errorf("unknown log level %s", level)
+	}
+	switch format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %s", format)
+	}
+	if w == nil {
+		w = log.Writer()
+	}
+
+	l := &ServiceLogger{
+		name:  name,
+		level: level,
+		json:  format == LogFormatJSON,
+	}
+	if l.json {
+		l.logger = log.New(w, "", 0)
+		return l, nil
+	}
+	var prefix string
+	if name != "" {
+		prefix = "[" + name + "] "
+	}
+	l.logger = log.New(w, prefix, log.Flags()|log.Lmsgprefix)
+	return l, nil
+}
+
+// WithConn returns a copy of the logger whose outputs are tagged with the connection ID id,
+// so all the logs of a session can be correlated.
+func (l *ServiceLogger) WithConn(id string) *ServiceLogger {
+	c := &ServiceLogger{}
+	if l != nil {
+		*c = *l
+	}
+	c.conn = id
+	if c.logger != nil && !c.json {
+		c.logger = log.New(c.logger.Writer(), "["+id+"] "+c.logger.Prefix(), c.logger.Flags())
+	}
+	return c
+}
+
+// ConnID returns the connection ID of the logger, it is empty if the logger is not of a connection.
+func (l *ServiceLogger) ConnID() string {
+	if l == nil {
+		return ""
+	}
+	return l.conn
+}
+
+// debugOverride overrides the global Debug flag for the loggers at runtime, see SetDebug.
+// It is 0 to follow the Debug flag, 1 to enable and 2 to disable the debug log.
+var debugOverride int32
+
+// SetDebug enables or disables the debug log of the loggers following the global Debug flag at runtime,
+// unlike setting Debug, it is safe while the services are running.
+func SetDebug(enabled bool) {
+	v := int32(2)
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&debugOverride, v)
+}
+
+// DebugEnabled reports whether the debug log of the loggers following the global Debug flag is enabled.
+func DebugEnabled() bool {
+	switch atomic.LoadInt32(&debugOverride) {
+	case 1:
+		return true
+	case 2:
+		return false
+	}
+	return Debug
+}
+
+func (l *ServiceLogger) enabled(level string) bool {
+	if l == nil || l.logger == nil || l.level == "" {
+		return level != LogLevelDebug || DebugEnabled()
+	}
+	return logLevels[level] >= logLevels[l.level]
+}
+
+// Debug reports whether the debug log is enabled.
+func (l *ServiceLogger) Debug() bool {
+	return l.enabled(LogLevelDebug)
+}
+
+// Log writes the outputs to the sink of the service at the info level.
+func (l *ServiceLogger) Log(v ...interface{}) {
+	if l.enabled(LogLevelInfo) {
+		l.output(LogLevelInfo, fmt.Sprintln(v...))
+	}
+}
+
+// Logf writes the outputs to the sink of the service at the info level.
+func (l *ServiceLogger) Logf(format string, v ...interface{}) {
+	if l.enabled(LogLevelInfo) {
+		l.output(LogLevelInfo, fmt.Sprintf(format, v...))
+	}
+}
+
+// Warnf writes the outputs to the sink of the service at the warn level.
+func (l *ServiceLogger) Warnf(format string, v ...interface{}) {
+	if l.enabled(LogLevelWarn) {
+		l.output(LogLevelWarn, fmt.Sprintf(format, v...))
+	}
+}
+
+// Errorf writes the outputs to the sink of the service at the error level.
+func (l *ServiceLogger) Errorf(format string, v ...interface{}) {
+	if l.enabled(LogLevelError) {
+		l.output(LogLevelError, fmt.Sprintf(format, v...))
+	}
+}
+
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Service string `json:"service,omitempty"`
+	Conn    string `json:"conn,omitempty"`
+	Caller  string `json:"caller,omitempty"`
+	Msg     string `json:"msg"`
+}
+
+// output writes the log s, it must be called by the logging methods directly for the caller information.
+func (l *ServiceLogger) output(level, s string) {
+	if l == nil || l.logger == nil {
+		if id := l.ConnID(); id != "" {
+			s = "[" + id + "] " + s
+		}
+		if _, ok := golog.DefaultLogger.(*LogLogger); ok {
+			log.Output(3, s)
+		} else {
+			golog.DefaultLogger.Logf("%s", s)
+		}
+		return
+	}
+
+	if !l.json {
+		l.logger.Output(3, s)
+		return
+	}
+	e := logEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   level,
+		Service: l.name,
+		Conn:    l.conn,
+		Msg:     strings.TrimSuffix(s, "\n"),
+	}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		e.Caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+	l.logger.Output(0, b.String())
+}
+
+// newConnID generates a random ID for the connection, which tags all the logs of the session.
+func newConnID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RotateWriter is the log file rotated once its size exceeds the limit,
+// the rotated files are renamed with the suffixes '.1', '.2' and so on, the ones beyond the backups are removed.
+type RotateWriter struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+	mux     sync.Mutex
+}
+
+// NewRotateWriter opens the log file path for appending, which is rotated once it exceeds maxSize bytes,
+// and at most backups rotated files are kept.
+func NewRotateWriter(path string, maxSize int64, backups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *RotateWriter) rotate() error {
+	w.f.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.backups))
+	for i := w.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.backups > 0 {
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+	return w.open()
+}
+
+// Write writes b to the log file, the file is rotated before if it would exceed the size limit.
+func (w *RotateWriter) Write(b []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			w.f = nil
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file.
+func (w *RotateWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
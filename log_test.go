@@ -0,0 +1,208 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServiceLogger(t *testing.T) {
+	for _, tc := range []struct {
+		level string
+		debug bool
+		out   string
+	}{
+		{LogLevelInfo, false, "log_test.go:"},
+		{LogLevelDebug, true, "[socks] hello"},
+		{LogLevelOff, false, ""},
+	} {
+		buf := &bytes.Buffer{}
+		logger, err := NewServiceLogger("socks", buf, tc.level, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Logf("hello %s", "world")
+		if logger.Debug() != tc.debug {
+			t.Errorf("%s: debug should be %v", tc.level, tc.debug)
+		}
+		if tc.out == "" && buf.Len() > 0 || !strings.Contains(buf.String(), tc.out) {
+			t.Errorf("%s: unexpected output %q", tc.level, buf.String())
+		}
+	}
+
+	if _, err := NewServiceLogger("socks", nil, "verbose", ""); err == nil {
+		t.Error("unknown log level should fail")
+	}
+
+	var logger *ServiceLogger
+	if logger.Debug() != Debug {
+		t.Error("nil logger should follow the global debug flag")
+	}
+}
+
+func TestServiceLoggerLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := NewServiceLogger("socks", buf, LogLevelWarn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Logf("info")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+	if s := buf.String(); strings.Contains(s, "info") || !strings.Contains(s, "warn") || !strings.Contains(s, "error") {
+		t.Errorf("only the warn and error logs should be written: %q", s)
+	}
+	if logger.Debug() {
+		t.Error("debug log should be disabled")
+	}
+
+	buf.Reset()
+	logger, _ = NewServiceLogger("socks", buf, LogLevelError, "")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+	if s := buf.String(); strings.Contains(s, "warn") || !strings.Contains(s, "error") {
+		t.Errorf("only the error logs should be written: %q", s)
+	}
+}
+
+func TestServiceLoggerJSON(t *testing.T) {
+	if _, err := NewServiceLogger("socks", nil, "", "xml"); err == nil {
+		t.Error("unknown log format should fail")
+	}
+
+	buf := &bytes.Buffer{}
+	logger, err := NewServiceLogger("socks", buf, LogLevelInfo, LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.WithConn("0a1b2c3d").Warnf("hello %s", "world")
+
+	var e logEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("should be a JSON line: %q", buf.String())
+	}
+	if e.Level != LogLevelWarn || e.Service != "socks" || e.Conn != "0a1b2c3d" || e.Msg != "hello world" ||
+		!strings.HasPrefix(e.Caller, "log_test.go:") || e.Time == "" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestServiceLoggerConn(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, _ := NewServiceLogger("socks", buf, LogLevelInfo, "")
+	conn := logger.WithConn("0a1b2c3d")
+	conn.Logf("hello")
+	logger.Logf("world")
+
+	if conn.ConnID() != "0a1b2c3d" || logger.ConnID() != "" {
+		t.Error("only the logger of the connection has the ID")
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "[0a1b2c3d] [socks] hello") || strings.Contains(lines[1], "0a1b2c3d") {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	var nop *ServiceLogger
+	if nop.WithConn("0a1b2c3d").ConnID() != "0a1b2c3d" {
+		t.Error("the default logger of the connection should have the ID")
+	}
+}
+
+func TestServiceLoggerProxy(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	w := &syncWriter{}
+	logger, _ := NewServiceLogger("socks-a", w, LogLevelInfo, "")
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  SOCKS5Handler(LoggerHandlerOption(logger)),
+	}
+	go server.Run()
+	defer server.Close()
+
+	if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	s := w.String()
+	if !strings.Contains(s, "[socks-a] [socks5]") {
+		t.Errorf("the logs should be written to the sink of the service with the name: %q", s)
+	}
+	ids := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if n := strings.Index(line, "] [socks-a]"); n > 0 {
+			ids[line[strings.LastIndex(line[:n], "[")+1:n]] = true
+		}
+	}
+	if len(ids) != 1 {
+		t.Errorf("the logs of the connection should be tagged with the same ID: %q", s)
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gost.log")
+	w, err := NewRotateWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, s := range []string{"1111111\n", "2222222\n", "3333333\n", "4444444\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		path:        "4444444\n",
+		path + ".1": "3333333\n",
+		path + ".2": "2222222\n",
+	} {
+		if b, _ := ioutil.ReadFile(name); string(b) != content {
+			t.Errorf("%s: should be %q, got %q", name, content, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("the rotated files beyond the backups should be removed")
+	}
+
+	w.Close()
+	if _, err := w.Write([]byte("5")); err == nil {
+		t.Error("closed writer should fail")
+	}
+}
+
+type syncWriter struct {
+	buf bytes.Buffer
+	mux sync.Mutex
+}
+
+func (w *syncWriter) Write(b []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.buf.Write(b)
+}
+
+func (w *syncWriter) String() string {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.buf.String()
+}
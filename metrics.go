@@ -0,0 +1,449 @@
+package gost
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dialBuckets are the upper bounds of the buckets of the dial latency histogram, in seconds.
+var dialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts the observed durations by the dialBuckets, the last count is of the durations exceeding all buckets.
+type histogram struct {
+	counts [12]uint64
+	sum    int64 // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(dialBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+type serviceCounter struct {
+	conns int64
+	total int64
+	in    int64
+	out   int64
+}
+
+type handshakeErrorKey struct {
+	service  string
+	protocol string
+	code     int
+}
+
+// Metrics collects the statistics of the services and the nodes of their chains,
+// which are exposed in the Prometheus text format by the metrics endpoint.
+type Metrics struct {
+	services    map[string]*serviceCounter
+	errors      map[handshakeErrorKey]*uint64
+	chains      map[string]*Chain
+	reputations map[string]*Reputation
+	mux         sync.Mutex
+}
+
+// NewMetrics creates a Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		services:    make(map[string]*serviceCounter),
+		errors:      make(map[handshakeErrorKey]*uint64),
+		chains:      make(map[string]*Chain),
+		reputations: make(map[string]*Reputation),
+	}
+}
+
+func (m *Metrics) service(service string) *serviceCounter {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	c := m.services[service]
+	if c == nil {
+		c = &serviceCounter{}
+		m.services[service] = c
+	}
+	return c
+}
+
+// SetChain reports the statistics of the nodes of the chain, labeled by the service using the chain.
+func (m *Metrics) SetChain(service string, chain *Chain) {
+	if m == nil {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if chain.IsEmpty() {
+		delete(m.chains, service)
+		return
+	}
+	m.chains[service] = chain
+}
+
+// ClearChains stops reporting the nodes of the chains, such as the chains replaced by the reloaded config.
+func (m *Metrics) ClearChains() {
+	if m == nil {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.chains = make(map[string]*Chain)
+}
+
+// Chains returns the chains of the services whose nodes are reported.
+func (m *Metrics) Chains() map[string]*Chain {
+	if m == nil {
+		return nil
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	chains := make(map[string]*Chain, len(m.chains))
+	for name, chain := range m.chains {
+		chains[name] = chain
+	}
+	return chains
+}
+
+// SetReputation reports the statistics of the lists of the reputation rep, named by its config, such as the file.
+// The reputation is not reported any more if rep is nil.
+func (m *Metrics) SetReputation(name string, rep *Reputation) {
+	if m == nil {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if rep == nil {
+		delete(m.reputations, name)
+		return
+	}
+	m.reputations[name] = rep
+}
+
+// HandshakeError counts the failed handshake of the protocol by the reply code.
+func (m *Metrics) HandshakeError(service, protocol string, code int) {
+	if m == nil {
+		return
+	}
+
+	m.mux.Lock()
+	key := handshakeErrorKey{service: service, protocol: protocol, code: code}
+	c := m.errors[key]
+	if c == nil {
+		c = new(uint64)
+		m.errors[key] = c
+	}
+	m.mux.Unlock()
+
+	atomic.AddUint64(c, 1)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+
+	m.mux.Lock()
+	services := make(map[string]serviceCounter, len(m.services))
+	for name, c := range m.services {
+		services[name] = serviceCounter{
+			conns: atomic.LoadInt64(&c.conns),
+			total: atomic.LoadInt64(&c.total),
+			in:    atomic.LoadInt64(&c.in),
+			out:   atomic.LoadInt64(&c.out),
+		}
+	}
+	failures := make(map[handshakeErrorKey]uint64, len(m.errors))
+	for key, c := range m.errors {
+		failures[key] = atomic.LoadUint64(c)
+	}
+	reputations := make([]string, 0, len(m.reputations))
+	for name := range m.reputations {
+		reputations = append(reputations, name)
+	}
+	sort.Strings(reputations)
+	var lists []ReputationStats
+	for _, name := range reputations {
+		lists = append(lists, m.reputations[name].Stats()...)
+	}
+	m.mux.Unlock()
+	chains := m.Chains()
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeMetricHeader(buf, "gost_service_connections", "gauge", "The active connections of the service.")
+	for _, name := range names {
+		fmt.Fprintf(buf, "gost_service_connections{service=%s} %d\n", labelValue(name), services[name].conns)
+	}
+	writeMetricHeader(buf, "gost_service_connections_total", "counter", "The connections accepted by the service.")
+	for _, name := range names {
+		fmt.Fprintf(buf, "gost_service_connections_total{service=%s} %d\n", labelValue(name), services[name].total)
+	}
+	writeMetricHeader(buf, "gost_service_transfer_bytes_total", "counter",
+		"The bytes received from (in) and sent to (out) the clients of the service.")
+	for _, name := range names {
+		fmt.Fprintf(buf, "gost_service_transfer_bytes_total{service=%s,direction=\"in\"} %d\n", labelValue(name), services[name].in)
+		fmt.Fprintf(buf, "gost_service_transfer_bytes_total{service=%s,direction=\"out\"} %d\n", labelValue(name), services[name].out)
+	}
+
+	keys := make([]handshakeErrorKey, 0, len(failures))
+	for key := range failures {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].code < keys[j].code
+	})
+	writeMetricHeader(buf, "gost_handshake_errors_total", "counter", "The failed handshakes by the reply code.")
+	for _, key := range keys {
+		fmt.Fprintf(buf, "gost_handshake_errors_total{service=%s,protocol=%s,code=\"%d\"} %d\n",
+			labelValue(key.service), labelValue(key.protocol), key.code, failures[key])
+	}
+
+	writeMetricHeader(buf, "gost_reputation_entries", "gauge", "The entries of the reputation list.")
+	for _, st := range lists {
+		fmt.Fprintf(buf, "gost_reputation_entries{list=%s,source=%s} %d\n", labelValue(st.Name), labelValue(st.Source), st.Entries)
+	}
+	writeMetricHeader(buf, "gost_reputation_hits_total", "counter", "The addresses matched by the reputation list.")
+	for _, st := range lists {
+		fmt.Fprintf(buf, "gost_reputation_hits_total{list=%s,source=%s} %d\n", labelValue(st.Name), labelValue(st.Source), st.Hits)
+	}
+
+	names = names[:0]
+	for name := range chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type nodeMetrics struct {
+		labels string
+		stats  NodeStats
+	}
+	var nodes []nodeMetrics
+	for _, name := range names {
+		for _, group := range chains[name].NodeGroups() {
+			for _, st := range group.Stats() {
+				nodes = append(nodes, nodeMetrics{
+					labels: fmt.Sprintf("service=%s,node_id=\"%d\",node=%s", labelValue(name), st.ID, labelValue(st.Addr)),
+					stats:  st,
+				})
+			}
+		}
+	}
+
+	writeMetricHeader(buf, "gost_node_up", "gauge", "Whether the node is available for the selection.")
+	for _, n := range nodes {
+		up := 0
+		if n.stats.Alive {
+			up = 1
+		}
+		fmt.Fprintf(buf, "gost_node_up{%s} %d\n", n.labels, up)
+	}
+	writeMetricHeader(buf, "gost_node_connections", "gauge", "The active connections through the node.")
+	for _, n := range nodes {
+		fmt.Fprintf(buf, "gost_node_connections{%s} %d\n", n.labels, n.stats.Conns)
+	}
+	writeMetricHeader(buf, "gost_node_failures_total", "counter", "The failures of the node.")
+	for _, n := range nodes {
+		fmt.Fprintf(buf, "gost_node_failures_total{%s} %d\n", n.labels, n.stats.Fails)
+	}
+	writeMetricHeader(buf, "gost_node_transfer_bytes_total", "counter",
+		"The bytes received from (in) and sent to (out) the connections through the node.")
+	for _, n := range nodes {
+		fmt.Fprintf(buf, "gost_node_transfer_bytes_total{%s,direction=\"in\"} %d\n", n.labels, n.stats.BytesIn)
+		fmt.Fprintf(buf, "gost_node_transfer_bytes_total{%s,direction=\"out\"} %d\n", n.labels, n.stats.BytesOut)
+	}
+	writeMetricHeader(buf, "gost_node_dial_duration_seconds", "histogram",
+		"The latency of the connections established through the node.")
+	for _, n := range nodes {
+		h := n.stats.dials
+		if h == nil {
+			continue
+		}
+		var count uint64
+		for i, le := range dialBuckets {
+			count += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(buf, "gost_node_dial_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				n.labels, strconv.FormatFloat(le, 'g', -1, 64), count)
+		}
+		count += atomic.LoadUint64(&h.counts[len(dialBuckets)])
+		fmt.Fprintf(buf, "gost_node_dial_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", n.labels, count)
+		fmt.Fprintf(buf, "gost_node_dial_duration_seconds_sum{%s} %g\n",
+			n.labels, time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+		fmt.Fprintf(buf, "gost_node_dial_duration_seconds_count{%s} %d\n", n.labels, count)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
+
+type metricsConn struct {
+	net.Conn
+	counter *serviceCounter
+	once    *sync.Once
+}
+
+func (c *metricsConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.counter.in, int64(n))
+	return
+}
+
+func (c *metricsConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.counter.out, int64(n))
+	return
+}
+
+func (c *metricsConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.counter.conns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the connection if it supports half-close.
+func (c *metricsConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+func (c *metricsConn) addSpliced(read, written int64) {
+	atomic.AddInt64(&c.counter.in, read)
+	atomic.AddInt64(&c.counter.out, written)
+}
+
+func (c *metricsConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *metricsConn) rewrap(conn net.Conn) net.Conn {
+	return &metricsConn{Conn: conn, counter: c.counter, once: c.once}
+}
+
+type metricsListener struct {
+	Listener
+	counter *serviceCounter
+}
+
+// MetricsListener wraps the listener ln to count the connections accepted by the service and their traffic.
+func MetricsListener(ln Listener, metrics *Metrics, service string) Listener {
+	if metrics == nil {
+		return ln
+	}
+	return &metricsListener{Listener: ln, counter: metrics.service(service)}
+}
+
+func (l *metricsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.counter.conns, 1)
+	atomic.AddInt64(&l.counter.total, 1)
+	return &metricsConn{Conn: conn, counter: l.counter, once: &sync.Once{}}, nil
+}
+
+// socks5MetricsConn counts the failed SOCKS5 request by the reply code, which is the first message written.
+type socks5MetricsConn struct {
+	net.Conn
+	metrics *Metrics
+	service string
+	replied bool
+}
+
+func (c *socks5MetricsConn) Write(b []byte) (int, error) {
+	if !c.replied && len(b) >= 2 {
+		c.replied = true
+		if code := int(b[1]); code != 0 {
+			c.metrics.HandshakeError(c.service, "socks5", code)
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// serviceName returns the name of the service labeling the metrics, it is the node of the service if it has no name.
+func serviceName(options *HandlerOptions) string {
+	if options.Name != "" {
+		return options.Name
+	}
+	return options.Node.String()
+}
+
+type metricsHandler struct {
+	options *HandlerOptions
+}
+
+// MetricsHandler creates a server Handler for the metrics endpoint,
+// it responds to the HTTP GET requests with the metrics in the Prometheus text format.
+// The requests are authenticated by HTTP basic auth if the authenticator is set.
+func MetricsHandler(opts ...HandlerOption) Handler {
+	h := &metricsHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *metricsHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *metricsHandler) Handle(conn net.Conn) {
+	serveAPI("metrics", h.options, conn, func(req *http.Request, resp *http.Response) {
+		if req.Method != http.MethodGet {
+			resp.StatusCode = http.StatusMethodNotAllowed
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := h.options.Metrics.WritePrometheus(buf); err != nil {
+			h.options.Logger.Logf("[metrics] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			resp.StatusCode = http.StatusInternalServerError
+			return
+		}
+		setResponseBody(resp, "text/plain; version=0.0.4", buf)
+	})
+}
@@ -0,0 +1,190 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func metricsText(t *testing.T, m *Metrics) string {
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func assertMetrics(t *testing.T, text string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics should contain %q, got:\n%s", line, text)
+		}
+	}
+}
+
+func TestMetricsListener(t *testing.T) {
+	metrics := NewMetrics()
+	ln := MetricsListener(mustTCPListener(t), metrics, `a"b`)
+	defer ln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		conn.Read(make([]byte, 2))
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := conn.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ok"))
+	assertMetrics(t, metricsText(t, metrics),
+		`gost_service_connections{service="a\"b"} 1`,
+		`gost_service_transfer_bytes_total{service="a\"b",direction="in"} 5`,
+		`gost_service_transfer_bytes_total{service="a\"b",direction="out"} 2`,
+	)
+
+	// the duplicate of the connection takes over the accounting.
+	raw, wrap := unwrapConn(conn)
+	if _, ok := raw.(*net.TCPConn); !ok {
+		t.Fatalf("should unwrap the TCP connection, got %T", raw)
+	}
+	dup := wrap(raw)
+	dup.Close()
+	conn.Close()
+	assertMetrics(t, metricsText(t, metrics),
+		`gost_service_connections{service="a\"b"} 0`,
+		`gost_service_connections_total{service="a\"b"} 1`,
+	)
+}
+
+func TestMetricsSOCKS5(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	metrics := NewMetrics()
+	server := &Server{
+		Listener: MetricsListener(mustTCPListener(t), metrics, "socks"),
+		Handler: SOCKS5Handler(
+			MetricsHandlerOption(metrics),
+			NameHandlerOption("socks"),
+			BypassHandlerOption(NewBypassPatterns(false, "blocked.test")),
+		),
+	}
+	go server.Run()
+	defer server.Close()
+
+	node := Node{
+		ID:     1,
+		Addr:   server.Addr().String(),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+		marker: &failMarker{},
+	}
+	chain := NewChain(node)
+	metrics.SetChain("client", chain)
+
+	if _, err := chain.Dial("blocked.test:80"); err == nil {
+		t.Error("dial to the bypassed host should fail")
+	}
+
+	conn, err := chain.Dial(httpSrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, httpSrv.URL, nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.Close()
+
+	text := metricsText(t, metrics)
+	assertMetrics(t, text,
+		`gost_handshake_errors_total{service="socks",protocol="socks5",code="2"} 1`,
+		`gost_service_connections_total{service="socks"} 2`,
+		`gost_node_up{service="client",node_id="1",node="`+node.Addr+`"} 1`,
+		`gost_node_dial_duration_seconds_count{service="client",node_id="1",node="`+node.Addr+`"} 1`,
+		`gost_node_dial_duration_seconds_bucket{service="client",node_id="1",node="`+node.Addr+`",le="+Inf"} 1`,
+	)
+	st := chain.NodeGroups()[0].Stats()[0]
+	if st.BytesOut <= int64(len(httpSrv.URL)) || st.BytesIn <= 0 {
+		t.Errorf("traffic through the node should be counted: %+v", st)
+	}
+
+	metrics.ClearChains()
+	if text := metricsText(t, metrics); strings.Contains(text, "gost_node_up{") {
+		t.Errorf("nodes of the cleared chains should not be reported:\n%s", text)
+	}
+}
+
+func TestMetricsReputation(t *testing.T) {
+	f, err := ioutil.TempFile("", "gost-reputation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.0/8\n192.168.0.0/16\n")
+	f.Close()
+
+	rep := NewReputation()
+	defer rep.Stop()
+	rep.Reload(strings.NewReader("custom " + f.Name()))
+	rep.Contains("10.1.1.1:80")
+	rep.Contains("192.168.1.1:80")
+	rep.Contains("172.16.1.1:80")
+
+	metrics := NewMetrics()
+	metrics.SetReputation("reputation.txt", rep)
+	source := labelValue(f.Name())
+	assertMetrics(t, metricsText(t, metrics),
+		"gost_reputation_entries{list=\"custom\",source="+source+"} 2",
+		"gost_reputation_hits_total{list=\"custom\",source="+source+"} 2",
+	)
+
+	metrics.SetReputation("reputation.txt", nil)
+	if text := metricsText(t, metrics); strings.Contains(text, "gost_reputation_hits_total{") {
+		t.Errorf("the removed reputation should not be reported:\n%s", text)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.HandshakeError("s", "socks5", 5)
+
+	server := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  MetricsHandler(MetricsHandlerOption(metrics)),
+	}
+	go server.Run()
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected response: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	assertMetrics(t, string(body), `gost_handshake_errors_total{service="s",protocol="socks5",code="5"} 1`)
+}
@@ -0,0 +1,161 @@
+package gost
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-log/log"
+)
+
+var (
+	// MirrorBufferSize is the max number of the pending chunks of a mirrored connection,
+	// the chunks are dropped if the mirror endpoint can not keep up.
+	MirrorBufferSize = 64
+)
+
+// Mirror mirrors a copy of the relayed traffic to a secondary endpoint, such as an IDS sensor or analytics collector.
+// For each matched connection, a TCP connection is made to the endpoint,
+// and the data sent from the client to the target is copied to it, the data from the endpoint is discarded.
+// Mirroring never affects the primary relay path: the endpoint is connected asynchronously,
+// and the data is dropped if the endpoint is unavailable or too slow.
+type Mirror struct {
+	addr     string
+	matchers []Matcher
+}
+
+// NewMirror creates a Mirror to the endpoint addr.
+// The matchers are the rules of the target addresses to be mirrored, all connections are mirrored if it is empty.
+func NewMirror(addr string, matchers ...Matcher) *Mirror {
+	m := &Mirror{addr: addr}
+	for _, matcher := range matchers {
+		if matcher != nil {
+			m.matchers = append(m.matchers, matcher)
+		}
+	}
+	return m
+}
+
+// NewMirrorPatterns creates a Mirror to the endpoint addr, with the matcher patterns as its rules.
+func NewMirrorPatterns(addr string, patterns ...string) *Mirror {
+	var matchers []Matcher
+	for _, pattern := range patterns {
+		if pattern != "" {
+			matchers = append(matchers, NewMatcher(strings.TrimSpace(pattern)))
+		}
+	}
+	return NewMirror(addr, matchers...)
+}
+
+// Addr returns the address of the mirror endpoint.
+func (m *Mirror) Addr() string {
+	if m == nil {
+		return ""
+	}
+	return m.addr
+}
+
+// Match reports whether the connection to the target address should be mirrored.
+func (m *Mirror) Match(addr string) bool {
+	if m == nil || m.addr == "" {
+		return false
+	}
+	if len(m.matchers) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, matcher := range m.matchers {
+		if matcher.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn wraps the connection cc to the target address addr,
+// the data written to cc are mirrored to the endpoint if addr matches the rules.
+func (m *Mirror) Conn(cc net.Conn, addr string) net.Conn {
+	if !m.Match(addr) {
+		return cc
+	}
+
+	c := &mirrorConn{
+		Conn: cc,
+		ch:   make(chan []byte, MirrorBufferSize),
+	}
+	go c.mirror(m.addr, addr)
+	return c
+}
+
+type mirrorConn struct {
+	net.Conn
+	ch      chan []byte
+	closed  bool
+	dropped bool
+	mux     sync.Mutex
+}
+
+func (c *mirrorConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n <= 0 {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.ch <- append([]byte(nil), b[:n]...):
+	default:
+		if !c.dropped {
+			c.dropped = true
+			log.Logf("[mirror] %s : mirror is too slow, data dropped", c.Conn.RemoteAddr())
+		}
+	}
+	return
+}
+
+func (c *mirrorConn) Close() error {
+	c.mux.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+	c.mux.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *mirrorConn) mirror(endpoint, target string) {
+	defer func() {
+		for range c.ch {
+		}
+	}()
+
+	mc, err := net.DialTimeout("tcp", endpoint, DialTimeout)
+	if err != nil {
+		log.Logf("[mirror] %s -> %s : %s", target, endpoint, err)
+		return
+	}
+	defer mc.Close()
+
+	if Debug {
+		log.Logf("[mirror] %s -> %s", target, endpoint)
+	}
+	go io.Copy(ioutil.Discard, mc)
+
+	for b := range c.ch {
+		if _, err := mc.Write(b); err != nil {
+			log.Logf("[mirror] %s -> %s : %s", target, endpoint, err)
+			return
+		}
+	}
+}
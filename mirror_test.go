@@ -0,0 +1,104 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var mirrorMatchTests = []struct {
+	addr     string
+	patterns []string
+	target   string
+	match    bool
+}{
+	{"", nil, "example.com:80", false},
+	{"127.0.0.1:9000", nil, "example.com:80", true},
+	{"127.0.0.1:9000", []string{""}, "example.com:80", true},
+	{"127.0.0.1:9000", []string{"*.example.com"}, "example.com:80", false},
+	{"127.0.0.1:9000", []string{"*.example.com"}, "www.example.com:80", true},
+	{"127.0.0.1:9000", []string{"10.0.0.0/8", "example.com"}, "10.1.2.3:443", true},
+	{"127.0.0.1:9000", []string{"10.0.0.0/8", "example.com"}, "example.com", true},
+	{"127.0.0.1:9000", []string{"10.0.0.0/8", "example.com"}, "192.168.1.1:443", false},
+}
+
+func TestMirrorMatch(t *testing.T) {
+	var mirror *Mirror
+	if mirror.Match("example.com:80") {
+		t.Error("nil mirror should not match")
+	}
+
+	for i, tc := range mirrorMatchTests {
+		mirror := NewMirrorPatterns(tc.addr, tc.patterns...)
+		if mirror.Match(tc.target) != tc.match {
+			t.Errorf("#%d test failed: %v, %s", i, tc.patterns, tc.target)
+		}
+	}
+}
+
+func mirrorProxyRoundtrip(mirror *Mirror, targetURL string, data []byte) error {
+	ln, err := TCPListener("")
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	server := &Server{
+		Handler:  SOCKS5Handler(MirrorHandlerOption(mirror)),
+		Listener: ln,
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestMirrorProxy(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	recv := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			recv <- nil
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		b, _ := ioutil.ReadAll(conn)
+		recv <- b
+	}()
+
+	if err := mirrorProxyRoundtrip(NewMirror(ln.Addr().String()), httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-recv; !bytes.Contains(b, sendData) {
+		t.Error("the request data should be mirrored")
+	}
+
+	// the unavailable mirror should not affect the relay.
+	addr := ln.Addr().String()
+	ln.Close()
+	if err := mirrorProxyRoundtrip(NewMirror(addr), httpSrv.URL, sendData); err != nil {
+		t.Error(err)
+	}
+}
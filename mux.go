@@ -2,13 +2,44 @@ package gost
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	smux "gopkg.in/xtaci/smux.v1"
 )
 
+// muxRetirePeriod is the period of checking the streams of the retired sessions.
+var muxRetirePeriod = time.Second
+
+// muxConfig returns the smux config of the client session with the keepalive interval,
+// the default interval of smux is used if it is not positive.
+func muxConfig(keepAlive time.Duration) *smux.Config {
+	config := smux.DefaultConfig()
+	if keepAlive > 0 {
+		config.KeepAliveInterval = keepAlive
+		if config.KeepAliveTimeout < 3*keepAlive {
+			config.KeepAliveTimeout = 3 * keepAlive
+		}
+	}
+	return config
+}
+
+// muxServerConfig returns the smux config of the server session with the keepalive interval,
+// the keepalive timeout is at least MuxKeepAliveTimeout.
+func muxServerConfig(keepAlive time.Duration) *smux.Config {
+	config := muxConfig(keepAlive)
+	if config.KeepAliveTimeout < MuxKeepAliveTimeout {
+		config.KeepAliveTimeout = MuxKeepAliveTimeout
+	}
+	return config
+}
+
 type muxStreamConn struct {
 	net.Conn
-	stream *smux.Stream
+	stream    *smux.Stream
+	session   *muxSession // the client session of the stream
+	closeOnce sync.Once
 }
 
 func (c *muxStreamConn) Read(b []byte) (n int, err error) {
@@ -20,20 +51,66 @@ func (c *muxStreamConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *muxStreamConn) Close() error {
+	c.closeOnce.Do(c.session.release)
 	return c.stream.Close()
 }
 
+// muxDialConn is the connection dialed by the multiplexed transporter,
+// it carries the session on which the stream is reserved to Handshake.
+type muxDialConn struct {
+	net.Conn
+	session  *muxSession
+	mu       *sync.Mutex // the session lock of the transporter
+	reserved bool        // the stream is not taken by Handshake yet, guarded by mu
+}
+
+func newMuxDialConn(session *muxSession, mu *sync.Mutex) *muxDialConn {
+	return &muxDialConn{Conn: session.conn, session: session, mu: mu, reserved: true}
+}
+
+// handshake takes the reserved stream, it is called by Handshake under the session lock.
+func (c *muxDialConn) handshake() (net.Conn, *muxSession) {
+	c.reserved = false
+	return c.Conn, c.session
+}
+
+// Close releases the stream reserved by Dial if the connection is dropped before Handshake,
+// the connection is kept if its session is established or another stream is reserved on it.
+// The connection is closed once it is handed to Handshake.
+func (c *muxDialConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.reserved {
+		return c.Conn.Close()
+	}
+	c.reserved = false
+	if c.session.pending > 0 {
+		c.session.pending--
+	}
+	if c.session.session == nil && c.session.pending == 0 {
+		return c.Conn.Close()
+	}
+	return nil
+}
+
 type muxSession struct {
 	conn    net.Conn
 	session *smux.Session
+	streams int32 // the number of the open streams
+	pending int   // the number of the streams being opened, guarded by the session lock of the transporter
 }
 
 func (session *muxSession) GetConn() (net.Conn, error) {
+	if session.pending > 0 {
+		session.pending-- // the stream reserved by Dial
+	}
 	stream, err := session.session.OpenStream()
 	if err != nil {
 		return nil, err
 	}
-	return &muxStreamConn{Conn: session.conn, stream: stream}, nil
+	atomic.AddInt32(&session.streams, 1)
+	return &muxStreamConn{Conn: session.conn, stream: stream, session: session}, nil
 }
 
 func (session *muxSession) Accept() (net.Conn, error) {
@@ -61,3 +138,37 @@ func (session *muxSession) IsClosed() bool {
 func (session *muxSession) NumStreams() int {
 	return session.session.NumStreams()
 }
+
+// reserve counts the stream being opened by the session, it reports false without counting
+// if the number of the streams reaches the limit max, there is no limit if max is not positive.
+// The streams are counted by Dial and GetConn under the session lock of the transporter,
+// so the concurrent dials do not exceed the limit.
+func (session *muxSession) reserve(max int) bool {
+	if max > 0 && int(atomic.LoadInt32(&session.streams))+session.pending >= max {
+		return false
+	}
+	session.pending++
+	return true
+}
+
+// release uncounts the open stream once it is closed.
+func (session *muxSession) release() {
+	if session != nil {
+		atomic.AddInt32(&session.streams, -1)
+	}
+}
+
+// retire closes the session once all its streams are closed, the new streams are opened by a new session.
+func (session *muxSession) retire() {
+	go func() {
+		ticker := time.NewTicker(muxRetirePeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if session.IsClosed() || atomic.LoadInt32(&session.streams) <= 0 {
+				session.Close()
+				return
+			}
+		}
+	}()
+}
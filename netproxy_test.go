@@ -0,0 +1,52 @@
+package gost
+
+import (
+	"crypto/rand"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestNetProxyDialer(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for _, tc := range []struct {
+		scheme string
+		ln     func() (Listener, error)
+	}{
+		{"socks5+tcp", func() (Listener, error) { return TCPListener("") }},
+		{"socks5+tls", func() (Listener, error) { return TLSListener("", nil) }},
+	} {
+		ln, err := tc.ln()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Listener: ln,
+			Handler:  SOCKS5Handler(UsersHandlerOption(url.UserPassword("admin", "123456"))),
+		}
+		go server.Run()
+
+		u, _ := url.Parse(tc.scheme + "://admin:123456@" + ln.Addr().String())
+		dialer, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, _ := url.Parse(httpSrv.URL)
+		conn, err := dialer.Dial("tcp", target.Host)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.scheme, err)
+		}
+		if err := httpRoundtrip(conn, httpSrv.URL, sendData); err != nil {
+			t.Errorf("%s: %v", tc.scheme, err)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
@@ -32,6 +32,7 @@ type Node struct {
 	Client           *Client
 	marker           *failMarker
 	Bypass           *Bypass
+	DNSRules         []DNSRule
 }
 
 // ParseNode parses the node info.
@@ -46,15 +47,20 @@ func ParseNode(s string) (node Node, err error) {
 	if !strings.Contains(s, "://") {
 		s = "auto://" + s
 	}
-	u, err := url.Parse(s)
+	u, err := url.Parse(escapeZone(s))
 	if err != nil {
 		return
 	}
 
+	remote := strings.Trim(u.EscapedPath(), "/")
+	if strings.Contains(remote, "%25") { // the IPv6 zone, such as [fe80::1%eth0]:80
+		remote, _ = url.PathUnescape(remote)
+	}
+
 	node = Node{
 		Addr:   u.Host,
 		Host:   u.Host,
-		Remote: strings.Trim(u.EscapedPath(), "/"),
+		Remote: remote,
 		Values: u.Query(),
 		User:   u.User,
 		marker: &failMarker{},
@@ -76,12 +82,15 @@ func ParseNode(s string) (node Node, err error) {
 
 	switch node.Transport {
 	case "tls", "mtls", "ws", "mws", "wss", "mwss", "kcp", "ssh", "quic", "ssu", "http2", "h2", "h2c", "obfs4":
+	case "tproxy": // TCP transparent proxy of the TPROXY target, 'tproxy+udp' for UDP
 	case "https":
 		node.Protocol = "http"
 		node.Transport = "tls"
 	case "tcp", "udp": // started from v2.1, tcp and udp are for local port forwarding
 	case "rtcp", "rudp": // rtcp and rudp are for remote port forwarding
-	case "ohttp": // obfs-http
+	case "ohttp", "otls": // obfs-http, obfs-tls
+	case "dns": // DNS proxy over UDP, 'dns+tcp' for TCP
+		node.Transport = "udp"
 	default:
 		node.Transport = "tcp"
 	}
@@ -92,7 +101,19 @@ func ParseNode(s string) (node Node, err error) {
 		node.Protocol = "socks5"
 	case "tcp", "udp", "rtcp", "rudp": // port forwarding
 	case "direct", "remote", "forward": // forwarding
-	case "redirect": // TCP transparent proxy
+	case "redirect", "red": // TCP transparent proxy of the REDIRECT target
+		node.Protocol = "redirect"
+	case "tproxy": // transparent proxy of the TPROXY target
+	case "vhost": // reverse proxy
+	case "stcp": // secret tunnel visitor
+	case "rendezvous": // P2P rendezvous server
+	case "traffic": // traffic report endpoint
+	case "metrics": // Prometheus metrics endpoint
+	case "ban": // banned clients admin endpoint
+	case "admin": // runtime inspection and control endpoint
+	case "speedtest": // speed test service
+	case "tor": // Tor SOCKS port
+	case "dns": // DNS proxy
 	default:
 		node.Protocol = ""
 	}
@@ -237,6 +258,65 @@ func (group *NodeGroup) GetNode(i int) Node {
 	return group.nodes[i]
 }
 
+// NodeStats is the statistics of a node in the group.
+type NodeStats struct {
+	ID        int
+	Addr      string
+	Alive     bool      // the node is not filtered by the filters of the group selector, such as FailFilter
+	Conns     int64     // the active connections through the node
+	Fails     uint64    // the total failures
+	FailCount uint32    // the consecutive failures
+	FailTime  time.Time // the time of the last failure
+	BytesIn   int64     // the bytes received from the connections through the node
+	BytesOut  int64     // the bytes sent to the connections through the node
+	dials     *histogram
+}
+
+// Stats returns the statistics of the nodes in the group.
+func (group *NodeGroup) Stats() []NodeStats {
+	if group == nil {
+		return nil
+	}
+
+	group.mux.RLock()
+	defer group.mux.RUnlock()
+
+	sopts := SelectOptions{}
+	for _, opt := range group.selectorOptions {
+		opt(&sopts)
+	}
+	alive := group.nodes
+	for _, filter := range sopts.Filters {
+		alive = filter.Filter(alive)
+	}
+
+	var stats []NodeStats
+	for _, node := range group.nodes {
+		st := NodeStats{
+			ID:        node.ID,
+			Addr:      node.Addr,
+			Conns:     node.marker.Conns(),
+			Fails:     node.marker.Fails(),
+			FailCount: node.marker.FailCount(),
+		}
+		st.BytesIn, st.BytesOut = node.marker.Bytes()
+		if node.marker != nil {
+			st.dials = &node.marker.dials
+		}
+		if ft := node.marker.FailTime(); ft > 0 {
+			st.FailTime = time.Unix(ft, 0)
+		}
+		for i := range alive {
+			if alive[i].marker == node.marker {
+				st.Alive = true
+				break
+			}
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
 // Next selects a node from group.
 // It also selects IP if the IP list exists.
 func (group *NodeGroup) Next() (node Node, err error) {
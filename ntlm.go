@@ -0,0 +1,169 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// The authentication schemes of the HTTP proxy client.
+const (
+	HTTPAuthBasic     = "basic"
+	HTTPAuthNTLM      = "ntlm"
+	HTTPAuthNegotiate = "negotiate" // SPNEGO with the NTLM tokens, Kerberos is not supported.
+)
+
+const (
+	ntlmNegotiateUnicode     = 0x00000001
+	ntlmRequestTarget        = 0x00000004
+	ntlmNegotiateNTLM        = 0x00000200
+	ntlmNegotiateAlwaysSign  = 0x00008000
+	ntlmNegotiateExtendedSec = 0x00080000
+	ntlmNegotiateTargetInfo  = 0x00800000
+	ntlmNegotiate128         = 0x20000000
+	ntlmNegotiate56          = 0x80000000
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+var errNTLMChallenge = errors.New("invalid NTLM challenge message")
+
+// ntlmNegotiateMessage returns the NTLM NEGOTIATE_MESSAGE, the first message of the NTLM handshake.
+func ntlmNegotiateMessage() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateUnicode|ntlmRequestTarget|ntlmNegotiateNTLM|
+		ntlmNegotiateAlwaysSign|ntlmNegotiateExtendedSec|ntlmNegotiate128|ntlmNegotiate56)
+	return b
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+// parseNTLMChallenge parses the NTLM CHALLENGE_MESSAGE from the server.
+func parseNTLMChallenge(b []byte) (*ntlmChallenge, error) {
+	if len(b) < 32 || !bytes.Equal(b[:8], ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(b[20:]),
+		challenge: b[24:32],
+	}
+	if c.flags&ntlmNegotiateTargetInfo != 0 && len(b) >= 48 {
+		n := int(binary.LittleEndian.Uint16(b[40:]))
+		off := int(binary.LittleEndian.Uint32(b[44:]))
+		if off+n > len(b) {
+			return nil, errNTLMChallenge
+		}
+		c.targetInfo = b[off : off+n]
+	}
+	return c, nil
+}
+
+// timestamp returns the server timestamp in the target info, if present.
+func (c *ntlmChallenge) timestamp() []byte {
+	for b := c.targetInfo; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		n := int(binary.LittleEndian.Uint16(b[2:]))
+		if id == ntlmAvEOL || len(b) < 4+n {
+			break
+		}
+		if id == ntlmAvTimestamp && n == 8 {
+			return b[4:12]
+		}
+		b = b[4+n:]
+	}
+	return nil
+}
+
+// ntlmAuthenticateMessage returns the NTLM AUTHENTICATE_MESSAGE with the NTLMv2 response to the challenge c.
+// The user may be in form of 'DOMAIN\user'.
+func ntlmAuthenticateMessage(c *ntlmChallenge, user, password string) []byte {
+	var domain string
+	if n := strings.Index(user, `\`); n >= 0 {
+		domain, user = user[:n], user[n+1:]
+	}
+
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+
+	ts := c.timestamp()
+	lm, nt := ntlmV2Response(ntowfv2(user, password, domain), c.challenge, clientChallenge, ts, c.targetInfo)
+	if ts != nil {
+		lm = make([]byte, 24) // the LMv2 response is omitted if the server provides the timestamp.
+	}
+
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(user), nil, nil}
+	b := make([]byte, 64)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	for i, field := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(b[pos:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(b[pos+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(b[pos+4:], uint32(len(b)))
+		b = append(b, field...)
+	}
+	flags := c.flags &^ ntlmNegotiateTargetInfo
+	binary.LittleEndian.PutUint32(b[60:], flags|ntlmNegotiateUnicode|ntlmNegotiateNTLM)
+	return b
+}
+
+// ntowfv2 computes the NTLMv2 response key of the user.
+func ntowfv2(user, password, domain string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+// ntlmV2Response computes the LMv2 and NTLMv2 responses by the response key, the server and client challenges.
+// The timestamp is the current time if ts is nil.
+func ntlmV2Response(key, serverChallenge, clientChallenge, ts, targetInfo []byte) (lm, nt []byte) {
+	if ts == nil {
+		ts = make([]byte, 8)
+		// the number of 100 nanoseconds since January 1, 1601.
+		binary.LittleEndian.PutUint64(ts, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, ts...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	proof := hmacMD5(key, append(append([]byte{}, serverChallenge...), temp...))
+	nt = append(proof, temp...)
+	lm = append(hmacMD5(key, append(append([]byte{}, serverChallenge...), clientChallenge...)), clientChallenge...)
+	return
+}
+
+func hmacMD5(key, data []byte) []byte {
+	h := hmac.New(md5.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, v := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
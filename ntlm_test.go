@@ -0,0 +1,103 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"unicode/utf16"
+)
+
+// the test vectors of NTLMv2 authentication in MS-NLMP 4.2.4.
+var (
+	ntlmTestServerChallenge, _ = hex.DecodeString("0123456789abcdef")
+	ntlmTestClientChallenge, _ = hex.DecodeString("aaaaaaaaaaaaaaaa")
+	ntlmTestTargetInfo, _      = hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+)
+
+func TestNTLMv2Response(t *testing.T) {
+	key := ntowfv2("User", "Password", "Domain")
+	if hex.EncodeToString(key) != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("unexpected response key: %x", key)
+	}
+
+	lm, nt := ntlmV2Response(key, ntlmTestServerChallenge, ntlmTestClientChallenge, make([]byte, 8), ntlmTestTargetInfo)
+	if hex.EncodeToString(lm) != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("unexpected LMv2 response: %x", lm)
+	}
+	if hex.EncodeToString(nt[:16]) != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("unexpected NTProofStr: %x", nt[:16])
+	}
+}
+
+func TestNTLMMessages(t *testing.T) {
+	if _, err := parseNTLMChallenge(ntlmNegotiateMessage()); err == nil {
+		t.Error("the negotiate message is not a challenge")
+	}
+
+	challenge := ntlmTestChallengeMessage(ntlmTestServerChallenge, ntlmTestTargetInfo)
+	c, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.challenge, ntlmTestServerChallenge) || !bytes.Equal(c.targetInfo, ntlmTestTargetInfo) {
+		t.Errorf("unexpected challenge: %+v", c)
+	}
+	if c.timestamp() != nil {
+		t.Error("the target info has no timestamp")
+	}
+
+	user, domain, nt := ntlmTestAuthenticateFields(t, ntlmAuthenticateMessage(c, `Domain\User`, "Password"))
+	if user != "User" || domain != "Domain" {
+		t.Errorf("unexpected user %s and domain %s", user, domain)
+	}
+	if !ntlmTestVerify(nt, "User", "Password", "Domain", ntlmTestServerChallenge) {
+		t.Error("the NTLMv2 response should be verified")
+	}
+	if ntlmTestVerify(nt, "User", "Passw0rd", "Domain", ntlmTestServerChallenge) {
+		t.Error("the NTLMv2 response should not be verified by the wrong password")
+	}
+}
+
+func ntlmTestChallengeMessage(serverChallenge, targetInfo []byte) []byte {
+	b := make([]byte, 48)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo)
+	copy(b[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(b[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(b[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(b[44:], uint32(len(b)))
+	return append(b, targetInfo...)
+}
+
+func ntlmTestAuthenticateFields(t *testing.T, b []byte) (user, domain string, nt []byte) {
+	if len(b) < 64 || !bytes.Equal(b[:8], ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 3 {
+		t.Fatalf("invalid authenticate message: %x", b)
+	}
+	field := func(pos int) []byte {
+		n := int(binary.LittleEndian.Uint16(b[pos:]))
+		off := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		if off+n > len(b) {
+			t.Fatalf("invalid field at %d: %x", pos, b)
+		}
+		return b[off : off+n]
+	}
+	decode := func(b []byte) string {
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return decode(field(36)), decode(field(28)), field(20)
+}
+
+// ntlmTestVerify verifies the NTLMv2 response nt as the server.
+func ntlmTestVerify(nt []byte, user, password, domain string, serverChallenge []byte) bool {
+	if len(nt) < 16 {
+		return false
+	}
+	proof := hmacMD5(ntowfv2(user, password, domain), append(append([]byte{}, serverChallenge...), nt[16:]...))
+	return bytes.Equal(proof, nt[:16])
+}
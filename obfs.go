@@ -5,6 +5,8 @@ package gost
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -249,6 +251,405 @@ func (c *obfsHTTPConn) Write(b []byte) (n int, err error) {
 	return c.Conn.Write(b)
 }
 
+const (
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordAlert            = 0x15
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+
+	tlsHandshakeClientHello = 0x01
+	tlsHandshakeServerHello = 0x02
+
+	tlsExtServerName           = 0x0000
+	tlsExtSupportedGroups      = 0x000a
+	tlsExtECPointFormats       = 0x000b
+	tlsExtSignatureAlgorithms  = 0x000d
+	tlsExtExtendedMasterSecret = 0x0017
+	tlsExtSessionTicket        = 0x0023
+	tlsExtRenegotiationInfo    = 0xff01
+
+	maxTLSDataLen = 16384
+)
+
+var (
+	obfsTLSCipherSuites = []uint16{
+		0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+		0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	}
+	obfsTLSSignatureAlgorithms = []uint16{
+		0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+	}
+	obfsTLSSupportedGroups = []uint16{0x001d, 0x0017, 0x0018}
+
+	errBadClientHello = errors.New("bad client hello")
+)
+
+type obfsTLSTransporter struct {
+	tcpTransporter
+}
+
+// ObfsTLSTransporter creates a Transporter that is used by TLS obfuscating tunnel client.
+func ObfsTLSTransporter() Transporter {
+	return &obfsTLSTransporter{}
+}
+
+func (tr *obfsTLSTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
+	opts := &HandshakeOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+	host, _, err := net.SplitHostPort(opts.Host)
+	if err != nil {
+		host = opts.Host
+	}
+	return &obfsTLSConn{Conn: conn, host: host}, nil
+}
+
+type obfsTLSListener struct {
+	net.Listener
+}
+
+// ObfsTLSListener creates a Listener for TLS obfuscating tunnel server.
+func ObfsTLSListener(addr string) (Listener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &obfsTLSListener{Listener: tcpKeepAliveListener{ln}}, nil
+}
+
+func (l *obfsTLSListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &obfsTLSConn{Conn: conn, isServer: true}, nil
+}
+
+// obfsTLSConn disguises the stream as a TLS session without real encryption, it is compatible with simple-obfs.
+// The client sends the first data in the session ticket of the ClientHello,
+// the server replies with the ServerHello, ChangeCipherSpec and Finished messages,
+// then the data are carried by the application data records.
+type obfsTLSConn struct {
+	net.Conn
+	host           string
+	isServer       bool
+	rbuf           bytes.Buffer
+	wbuf           bytes.Buffer
+	records        tlsRecordReader
+	helloSent      bool
+	handshaked     bool
+	handshakeMutex sync.Mutex
+	wmux           sync.Mutex
+}
+
+// Handshake reads the ClientHello on the server side, the client sends its ClientHello along with the first data.
+func (c *obfsTLSConn) Handshake() (err error) {
+	if !c.isServer {
+		return nil
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.handshaked {
+		return nil
+	}
+	if err = c.serverHandshake(); err != nil {
+		log.Logf("[otls] %s -> %s : %v", c.Conn.RemoteAddr(), c.Conn.LocalAddr(), err)
+		return
+	}
+	c.handshaked = true
+	return nil
+}
+
+func (c *obfsTLSConn) serverHandshake() error {
+	typ, b, err := readTLSRecord(c.Conn)
+	if err != nil {
+		return err
+	}
+	if typ != tlsRecordHandshake {
+		return errBadClientHello
+	}
+	sessionID, ticket, err := parseObfsClientHello(b)
+	if err != nil {
+		return err
+	}
+	if Debug {
+		log.Logf("[otls] %s -> %s : ClientHello, %d bytes of data", c.RemoteAddr(), c.LocalAddr(), len(ticket))
+	}
+	c.rbuf.Write(ticket)
+
+	// cache the server handshake messages, they are sent along with the first data.
+	writeTLSRecords(&c.wbuf, tlsRecordHandshake, obfsServerHello(sessionID))
+	writeTLSRecords(&c.wbuf, tlsRecordChangeCipherSpec, []byte{0x01})
+	finished := make([]byte, 40)
+	rand.Read(finished)
+	writeTLSRecords(&c.wbuf, tlsRecordHandshake, finished)
+	return nil
+}
+
+// sendClientHello sends the ClientHello carrying the data b, it must be called with wmux held.
+func (c *obfsTLSConn) sendClientHello(b []byte) error {
+	c.helloSent = true
+
+	ticket := b
+	if len(ticket) > maxTLSDataLen {
+		ticket = ticket[:maxTLSDataLen]
+	}
+	buf := bytes.Buffer{}
+	writeTLSRecord(&buf, tlsRecordHandshake, 0x0301, obfsClientHello(c.host, ticket))
+	writeTLSRecords(&buf, tlsRecordApplicationData, b[len(ticket):])
+	if Debug {
+		log.Logf("[otls] %s -> %s : ClientHello %s, %d bytes of data", c.LocalAddr(), c.RemoteAddr(), c.host, len(ticket))
+	}
+	_, err := buf.WriteTo(c.Conn)
+	return err
+}
+
+func (c *obfsTLSConn) Read(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return
+	}
+
+	if !c.isServer {
+		c.wmux.Lock()
+		if !c.helloSent {
+			err = c.sendClientHello(nil)
+		}
+		c.wmux.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	if c.rbuf.Len() > 0 {
+		return c.rbuf.Read(b)
+	}
+	if c.records.r == nil {
+		c.records.r = c.Conn
+	}
+	for {
+		var typ byte
+		var data []byte
+		if typ, data, err = c.records.read(); err != nil {
+			return
+		}
+		switch typ {
+		case tlsRecordApplicationData:
+			if len(data) == 0 {
+				continue
+			}
+			n = copy(b, data)
+			c.rbuf.Write(data[n:]) // the rest of the record is read next time.
+			return
+		case tlsRecordAlert:
+			return 0, io.EOF
+		}
+		// the other records are parts of the handshake, they are discarded.
+	}
+}
+
+func (c *obfsTLSConn) Write(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	if !c.isServer && !c.helloSent {
+		if err = c.sendClientHello(b); err != nil {
+			return
+		}
+		return len(b), nil
+	}
+
+	writeTLSRecords(&c.wbuf, tlsRecordApplicationData, b)
+	if _, err = c.wbuf.WriteTo(c.Conn); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func readTLSRecord(r io.Reader) (typ byte, b []byte, err error) {
+	return (&tlsRecordReader{r: r}).read()
+}
+
+// tlsRecordReader reads the TLS records into the reused buffer.
+type tlsRecordReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// read reads the next record, the data is valid until the next read.
+func (rr *tlsRecordReader) read() (typ byte, b []byte, err error) {
+	if rr.buf == nil {
+		rr.buf = make([]byte, 5+maxTLSDataLen)
+	}
+	header := rr.buf[:5]
+	if _, err = io.ReadFull(rr.r, header); err != nil {
+		return
+	}
+	typ = header[0]
+	n := 5 + int(binary.BigEndian.Uint16(header[3:]))
+	if n > len(rr.buf) {
+		rr.buf = append(rr.buf[:5], make([]byte, n-5)...)
+	}
+	if _, err = io.ReadFull(rr.r, rr.buf[5:n]); err != nil {
+		return
+	}
+	return typ, rr.buf[5:n], nil
+}
+
+func writeTLSRecord(buf *bytes.Buffer, typ byte, version uint16, b []byte) {
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, version)
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+// writeTLSRecords writes the data b as TLS 1.2 records of type typ.
+func writeTLSRecords(buf *bytes.Buffer, typ byte, b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxTLSDataLen {
+			n = maxTLSDataLen
+		}
+		writeTLSRecord(buf, typ, 0x0303, b[:n])
+		b = b[n:]
+	}
+}
+
+func writeTLSExtension(buf *bytes.Buffer, typ uint16, b []byte) {
+	binary.Write(buf, binary.BigEndian, typ)
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+func uint16List(lenBytes int, values []uint16) []byte {
+	buf := bytes.Buffer{}
+	if lenBytes == 1 {
+		buf.WriteByte(byte(len(values) * 2))
+	} else {
+		binary.Write(&buf, binary.BigEndian, uint16(len(values)*2))
+	}
+	binary.Write(&buf, binary.BigEndian, values)
+	return buf.Bytes()
+}
+
+func tlsRandom() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	binary.BigEndian.PutUint32(b, uint32(time.Now().Unix()))
+	return b
+}
+
+func tlsHandshakeMessage(typ byte, body []byte) []byte {
+	n := len(body)
+	return append([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+func obfsClientHello(host string, ticket []byte) []byte {
+	body := bytes.Buffer{}
+	body.Write([]byte{0x03, 0x03})
+	body.Write(tlsRandom())
+	sessionID := make([]byte, 32)
+	rand.Read(sessionID)
+	body.WriteByte(byte(len(sessionID)))
+	body.Write(sessionID)
+	body.Write(uint16List(2, obfsTLSCipherSuites))
+	body.Write([]byte{0x01, 0x00}) // no compression
+
+	ext := bytes.Buffer{}
+	if host != "" && net.ParseIP(host) == nil {
+		name := bytes.Buffer{}
+		binary.Write(&name, binary.BigEndian, uint16(len(host)+3))
+		name.WriteByte(0x00) // host_name
+		binary.Write(&name, binary.BigEndian, uint16(len(host)))
+		name.WriteString(host)
+		writeTLSExtension(&ext, tlsExtServerName, name.Bytes())
+	}
+	writeTLSExtension(&ext, tlsExtECPointFormats, []byte{0x01, 0x00})
+	writeTLSExtension(&ext, tlsExtSupportedGroups, uint16List(2, obfsTLSSupportedGroups))
+	writeTLSExtension(&ext, tlsExtSessionTicket, ticket)
+	writeTLSExtension(&ext, tlsExtSignatureAlgorithms, uint16List(2, obfsTLSSignatureAlgorithms))
+	writeTLSExtension(&ext, tlsExtExtendedMasterSecret, nil)
+	binary.Write(&body, binary.BigEndian, uint16(ext.Len()))
+	ext.WriteTo(&body)
+
+	return tlsHandshakeMessage(tlsHandshakeClientHello, body.Bytes())
+}
+
+// parseObfsClientHello returns the session ID and the session ticket of the ClientHello message b.
+func parseObfsClientHello(b []byte) (sessionID, ticket []byte, err error) {
+	// message type(1), length(3), version(2), random(32)
+	if len(b) < 39 || b[0] != tlsHandshakeClientHello {
+		return nil, nil, errBadClientHello
+	}
+	b = b[38:]
+
+	n := int(b[0])
+	if len(b) < 1+n {
+		return nil, nil, errBadClientHello
+	}
+	sessionID, b = b[1:1+n], b[1+n:]
+
+	if len(b) < 2 {
+		return nil, nil, errBadClientHello
+	}
+	n = int(binary.BigEndian.Uint16(b)) // cipher suites
+	if len(b) < 2+n+1 {
+		return nil, nil, errBadClientHello
+	}
+	b = b[2+n:]
+	n = int(b[0]) // compression methods
+	if len(b) < 1+n+2 {
+		return nil, nil, errBadClientHello
+	}
+	b = b[1+n+2:]
+
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n = int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return nil, nil, errBadClientHello
+		}
+		if typ == tlsExtSessionTicket {
+			ticket = b[4 : 4+n]
+		}
+		b = b[4+n:]
+	}
+	if len(b) > 0 {
+		return nil, nil, errBadClientHello
+	}
+	return
+}
+
+func obfsServerHello(sessionID []byte) []byte {
+	body := bytes.Buffer{}
+	body.Write([]byte{0x03, 0x03})
+	body.Write(tlsRandom())
+	body.WriteByte(byte(len(sessionID)))
+	body.Write(sessionID)
+	body.Write([]byte{0xc0, 0x2f}) // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	body.WriteByte(0x00)           // no compression
+
+	ext := bytes.Buffer{}
+	writeTLSExtension(&ext, tlsExtRenegotiationInfo, []byte{0x00})
+	writeTLSExtension(&ext, tlsExtExtendedMasterSecret, nil)
+	writeTLSExtension(&ext, tlsExtECPointFormats, []byte{0x01, 0x00})
+	binary.Write(&body, binary.BigEndian, uint16(ext.Len()))
+	ext.WriteTo(&body)
+
+	return tlsHandshakeMessage(tlsHandshakeServerHello, body.Bytes())
+}
+
 type obfs4Context struct {
 	cf    base.ClientFactory
 	cargs interface{} // type obfs4ClientArgs
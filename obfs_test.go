@@ -1,8 +1,10 @@
 package gost
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
+	"net"
 	"net/http/httptest"
 	"net/url"
 	"testing"
@@ -370,6 +372,212 @@ func TestSNIOverObfsHTTP(t *testing.T) {
 	}
 }
 
+func httpOverObfsTLSRoundtrip(targetURL string, data []byte,
+	clientInfo *url.Userinfo, serverInfo []*url.Userinfo) error {
+
+	ln, err := ObfsTLSListener("")
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   HTTPConnector(clientInfo),
+		Transporter: ObfsTLSTransporter(),
+	}
+
+	server := &Server{
+		Listener: ln,
+		Handler: HTTPHandler(
+			UsersHandlerOption(serverInfo...),
+		),
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestHTTPOverObfsTLS(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for i, tc := range httpProxyTests {
+		tc := tc
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			err := httpOverObfsTLSRoundtrip(httpSrv.URL, sendData, tc.cliUser, tc.srvUsers)
+			if err == nil {
+				if tc.errStr != "" {
+					t.Errorf("#%d should failed with error %s", i, tc.errStr)
+				}
+			} else {
+				if tc.errStr == "" {
+					t.Errorf("#%d got error %v", i, err)
+				}
+				if err.Error() != tc.errStr {
+					t.Errorf("#%d got error %v, want %v", i, err, tc.errStr)
+				}
+			}
+		})
+	}
+}
+
+func socks5OverObfsTLSRoundtrip(targetURL string, data []byte,
+	clientInfo *url.Userinfo, serverInfo []*url.Userinfo) error {
+
+	ln, err := ObfsTLSListener("")
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   SOCKS5Connector(clientInfo),
+		Transporter: ObfsTLSTransporter(),
+	}
+
+	server := &Server{
+		Listener: ln,
+		Handler: SOCKS5Handler(
+			UsersHandlerOption(serverInfo...),
+		),
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestSOCKS5OverObfsTLS(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	// the data is larger than a TLS record.
+	sendData := make([]byte, 40000)
+	rand.Read(sendData)
+
+	for i, tc := range socks5ProxyTests {
+		err := socks5OverObfsTLSRoundtrip(httpSrv.URL, sendData,
+			tc.cliUser,
+			tc.srvUsers,
+		)
+		if err == nil {
+			if !tc.pass {
+				t.Errorf("#%d should failed", i)
+			}
+		} else {
+			if tc.pass {
+				t.Errorf("#%d got error: %v", i, err)
+			}
+		}
+	}
+}
+
+func ssOverObfsTLSRoundtrip(targetURL string, data []byte,
+	clientInfo, serverInfo *url.Userinfo) error {
+
+	ln, err := ObfsTLSListener("")
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   ShadowConnector(clientInfo),
+		Transporter: ObfsTLSTransporter(),
+	}
+
+	server := &Server{
+		Listener: ln,
+		Handler: ShadowHandler(
+			UsersHandlerOption(serverInfo),
+		),
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestSSOverObfsTLS(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for i, tc := range ssProxyTests {
+		err := ssOverObfsTLSRoundtrip(httpSrv.URL, sendData,
+			tc.clientCipher,
+			tc.serverCipher,
+		)
+		if err == nil {
+			if !tc.pass {
+				t.Errorf("#%d should failed", i)
+			}
+		} else {
+			if tc.pass {
+				t.Errorf("#%d got error: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestObfsTLSHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	client, err := ObfsTLSTransporter().Handshake(c1, HostHandshakeOption("www.example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("hello"))
+
+	typ, b, err := readTLSRecord(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != tlsRecordHandshake {
+		t.Fatalf("the first record should be a handshake record, got %d", typ)
+	}
+	if !bytes.Contains(b, []byte("www.example.com")) {
+		t.Error("the ClientHello should contain the server name")
+	}
+	sessionID, ticket, err := parseObfsClientHello(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessionID) != 32 || string(ticket) != "hello" {
+		t.Errorf("the first data should be sent in the session ticket, got %q", ticket)
+	}
+
+	if _, _, err := parseObfsClientHello(b[:len(b)-1]); err != errBadClientHello {
+		t.Errorf("the truncated ClientHello should be rejected, got %v", err)
+	}
+
+	// the server speaks first, the client sends the ClientHello without data once it reads.
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	server := &obfsTLSConn{Conn: c4, isServer: true}
+	go func() {
+		server.Write([]byte("banner"))
+	}()
+	client = &obfsTLSConn{Conn: c3}
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "banner" {
+		t.Errorf("the client should skip the server handshake, got %q", buf[:n])
+	}
+}
+
 func httpOverObfs4Roundtrip(targetURL string, data []byte,
 	clientInfo *url.Userinfo, serverInfo []*url.Userinfo) error {
 
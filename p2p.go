@@ -0,0 +1,415 @@
+package gost
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/go-log/log"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"gopkg.in/xtaci/kcp-go.v4"
+	smux "gopkg.in/xtaci/smux.v1"
+)
+
+var (
+	// P2PTimeout is the timeout of the P2P connection setup, including the address probing and hole punching.
+	P2PTimeout = 5 * time.Second
+)
+
+const (
+	p2pModeRelay  byte = 0x00
+	p2pModeDirect byte = 0x01
+)
+
+var (
+	p2pProbeMsg = []byte("GOST-P2P-PROBE")
+	p2pPunchMsg = []byte("GOST-P2P-PUNCH")
+)
+
+// SecretTunnelConfig is the config for the secret tunnel.
+type SecretTunnelConfig struct {
+	// Secret is the secret shared between the visitor and the provider for the end-to-end encryption.
+	Secret string
+	// P2P is the address of the rendezvous server,
+	// the visitor and the provider will try to connect to each other directly by UDP hole punching,
+	// then fall back to the server relay if it fails. P2P is disabled if it is empty.
+	P2P string
+}
+
+type rendezvousHandler struct {
+	options *HandlerOptions
+}
+
+// RendezvousHandler creates a server Handler for the P2P rendezvous server,
+// it tells the UDP client its public address, which is used by the secret tunnel for hole punching.
+func RendezvousHandler(opts ...HandlerOption) Handler {
+	h := &rendezvousHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *rendezvousHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *rendezvousHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	b := make([]byte, 64)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(b[:n], p2pProbeMsg) {
+			continue
+		}
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[rendezvous] %s -> %s : probe", conn.RemoteAddr(), conn.LocalAddr())
+		}
+		if _, err := conn.Write([]byte(conn.RemoteAddr().String())); err != nil {
+			h.options.Logger.Logf("[rendezvous] %s <- %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			return
+		}
+	}
+}
+
+// p2pProbe asks the rendezvous server for the public address of pc.
+func p2pProbe(pc *net.UDPConn, rendezvous string) (string, error) {
+	raddr, err := net.ResolveUDPAddr("udp", rendezvous)
+	if err != nil {
+		return "", err
+	}
+	defer pc.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		if _, err = pc.WriteTo(p2pProbeMsg, raddr); err != nil {
+			return "", err
+		}
+		pc.SetReadDeadline(time.Now().Add(P2PTimeout / 3))
+		var n int
+		var from net.Addr
+		n, from, err = pc.ReadFrom(b)
+		if err != nil {
+			continue
+		}
+		if from.String() != raddr.String() {
+			continue
+		}
+		return string(b[:n]), nil
+	}
+	return "", err
+}
+
+// p2pPunch punches a hole to the peer by sending packets to each other,
+// until a packet from the peer is received.
+func p2pPunch(pc *net.UDPConn, peer *net.UDPAddr) error {
+	defer pc.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 64)
+	deadline := time.Now().Add(P2PTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := pc.WriteTo(p2pPunchMsg, peer); err != nil {
+			return err
+		}
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, from, err := pc.ReadFrom(b)
+		if err != nil || from.String() != peer.String() || !bytes.Equal(b[:n], p2pPunchMsg) {
+			continue
+		}
+		// make sure that the peer receives our packet too,
+		// the short packets will be dropped by the KCP.
+		for i := 0; i < 3; i++ {
+			pc.WriteTo(p2pPunchMsg, peer)
+		}
+		return nil
+	}
+	return errors.New("p2p: hole punching timeout")
+}
+
+func p2pInitSession(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetNoDelay(0, 30, 2, 1)
+	sess.SetWindowSize(1024, 1024)
+	sess.SetMtu(1350)
+}
+
+type p2pConn struct {
+	net.Conn
+	session *smux.Session
+	closer  io.Closer
+}
+
+func (c *p2pConn) Close() error {
+	err := c.Conn.Close()
+	c.session.Close()
+	if c.closer != nil {
+		c.closer.Close()
+	}
+	return err
+}
+
+// p2pDial connects to the peer directly over the punched UDP connection pc.
+func p2pDial(pc *net.UDPConn, peer *net.UDPAddr, cipher core.Cipher) (net.Conn, error) {
+	sess, err := kcp.NewConn(peer.String(), nil, 0, 0, pc)
+	if err != nil {
+		return nil, err
+	}
+	p2pInitSession(sess)
+
+	session, err := smux.Client(sess, smux.DefaultConfig())
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	conn := &p2pConn{
+		Conn:    cipher.StreamConn(stream),
+		session: session,
+	}
+
+	// hello and ack.
+	conn.SetDeadline(time.Now().Add(P2PTimeout))
+	b := []byte{p2pModeDirect}
+	if _, err = conn.Write(b); err == nil {
+		_, err = io.ReadFull(conn, b)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// p2pAccept accepts the direct connection from the peer over the punched UDP connection pc.
+func p2pAccept(pc *net.UDPConn, cipher core.Cipher) (net.Conn, error) {
+	ln, err := kcp.ServeConn(nil, 0, 0, pc)
+	if err != nil {
+		return nil, err
+	}
+	ln.SetDeadline(time.Now().Add(P2PTimeout))
+	sess, err := ln.AcceptKCP()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	p2pInitSession(sess)
+
+	session, err := smux.Server(sess, smux.DefaultConfig())
+	if err != nil {
+		sess.Close()
+		ln.Close()
+		return nil, err
+	}
+
+	type result struct {
+		stream *smux.Stream
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		stream, err := session.AcceptStream()
+		ch <- result{stream, err}
+	}()
+
+	var stream *smux.Stream
+	select {
+	case r := <-ch:
+		stream, err = r.stream, r.err
+	case <-time.After(P2PTimeout):
+		err = errors.New("p2p: accept timeout")
+	}
+	if err != nil {
+		session.Close()
+		ln.Close()
+		return nil, err
+	}
+
+	conn := &p2pConn{
+		Conn:    cipher.StreamConn(stream),
+		session: session,
+		closer:  ln,
+	}
+
+	// hello and ack.
+	conn.SetDeadline(time.Now().Add(P2PTimeout))
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(conn, b); err == nil {
+		_, err = conn.Write(b)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func writeP2PAddr(w io.Writer, addr string) error {
+	b := append([]byte{byte(len(addr))}, addr...)
+	_, err := w.Write(b)
+	return err
+}
+
+func readP2PAddr(r io.Reader) (string, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	b = make([]byte, int(b[0]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// p2pVisit negotiates the connection mode with the provider through the relay connection rc,
+// it returns the direct connection, or rc if the P2P connection can not be established.
+func p2pVisit(rc net.Conn, config *SecretTunnelConfig, cipher core.Cipher) (net.Conn, error) {
+	if config.P2P == "" {
+		_, err := rc.Write([]byte{p2pModeRelay})
+		return rc, err
+	}
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := p2pProbe(pc, config.P2P)
+	if err != nil {
+		log.Logf("[p2p] probe %s : %s", config.P2P, err)
+		pc.Close()
+		_, err = rc.Write([]byte{p2pModeRelay})
+		return rc, err
+	}
+
+	// offer
+	if _, err := rc.Write([]byte{p2pModeDirect}); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if err := writeP2PAddr(rc, addr); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	// answer
+	peerAddr, err := readP2PAddr(rc)
+	if err != nil || peerAddr == "" {
+		pc.Close()
+		return rc, err
+	}
+
+	var conn net.Conn
+	peer, err := net.ResolveUDPAddr("udp", peerAddr)
+	if err == nil {
+		err = p2pPunch(pc, peer)
+	}
+	if err == nil {
+		conn, err = p2pDial(pc, peer, cipher)
+	}
+	if err != nil {
+		pc.Close()
+		log.Logf("[p2p] %s -> %s : %s, fall back to relay", addr, peerAddr, err)
+		_, err = rc.Write([]byte{p2pModeRelay})
+		return rc, err
+	}
+
+	// decision
+	if _, err := rc.Write([]byte{p2pModeDirect}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Logf("[p2p] %s <-> %s : direct", addr, peerAddr)
+	rc.Close()
+	return conn, nil
+}
+
+// p2pProvide is the provider side of p2pVisit.
+func p2pProvide(rc net.Conn, config *SecretTunnelConfig, cipher core.Cipher) (net.Conn, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		return nil, err
+	}
+	if b[0] != p2pModeDirect {
+		return rc, nil
+	}
+
+	peerAddr, err := readP2PAddr(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	var pc *net.UDPConn
+	var addr string
+	if config.P2P != "" {
+		pc, err = net.ListenUDP("udp", nil)
+		if err == nil {
+			if addr, err = p2pProbe(pc, config.P2P); err != nil {
+				pc.Close()
+			}
+		}
+		if err != nil {
+			log.Logf("[p2p] probe %s : %s", config.P2P, err)
+		}
+	}
+	if err := writeP2PAddr(rc, addr); err != nil || addr == "" {
+		return rc, err
+	}
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		peer, err := net.ResolveUDPAddr("udp", peerAddr)
+		if err == nil {
+			err = p2pPunch(pc, peer)
+		}
+		var conn net.Conn
+		if err == nil {
+			conn, err = p2pAccept(pc, cipher)
+		}
+		if err != nil {
+			pc.Close()
+			log.Logf("[p2p] %s <- %s : %s", addr, peerAddr, err)
+		}
+		ch <- conn
+	}()
+
+	// decision
+	if _, err := io.ReadFull(rc, b); err != nil {
+		pc.Close()
+		if conn := <-ch; conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	conn := <-ch
+	if b[0] != p2pModeDirect {
+		if conn != nil {
+			conn.Close()
+		}
+		return rc, nil
+	}
+	if conn == nil {
+		return nil, errors.New("p2p: direct connection is not available")
+	}
+	log.Logf("[p2p] %s <-> %s : direct", addr, peerAddr)
+	rc.Close()
+	return conn, nil
+}
@@ -36,6 +36,19 @@ func (session *quicSession) Close() error {
 	return session.session.Close()
 }
 
+// Closed checks whether the established session is closed, by the peer or the idle timeout.
+func (session *quicSession) Closed() bool {
+	if session.session == nil {
+		return false
+	}
+	select {
+	case <-session.session.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
 type quicTransporter struct {
 	config       *QUICConfig
 	sessionMutex sync.Mutex
@@ -63,6 +76,13 @@ func (tr *quicTransporter) Dial(addr string, options ...DialOption) (conn net.Co
 	defer tr.sessionMutex.Unlock()
 
 	session, ok := tr.sessions[addr]
+	if ok && session.Closed() {
+		// the session is re-established on the new connection by the following handshake,
+		// rather than failing the stream opened on the dead session.
+		session.conn.Close()
+		delete(tr.sessions, addr)
+		ok = false
+	}
 	if !ok {
 		var cc *net.UDPConn
 		cc, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
@@ -72,7 +92,10 @@ func (tr *quicTransporter) Dial(addr string, options ...DialOption) (conn net.Co
 		conn = cc
 
 		if tr.config != nil && tr.config.Key != nil {
-			conn = &quicCipherConn{UDPConn: cc, key: tr.config.Key}
+			if conn, err = newQUICCipherConn(cc, tr.config.Key); err != nil {
+				cc.Close()
+				return nil, err
+			}
 		}
 
 		session = &quicSession{conn: conn}
@@ -160,6 +183,9 @@ func (tr *quicTransporter) Multiplex() bool {
 }
 
 // QUICConfig is the config for QUIC client and server
+//
+// TODO: 0-RTT stream establishment and the congestion control selection need the upgrade of quic-go,
+// the vendored gQUIC version has no 0-RTT API and the congestion control is always cubic.
 type QUICConfig struct {
 	TLSConfig   *tls.Config
 	Timeout     time.Duration
@@ -203,7 +229,10 @@ func QUICListener(addr string, config *QUICConfig) (Listener, error) {
 	conn = lconn
 
 	if config.Key != nil {
-		conn = &quicCipherConn{UDPConn: lconn, key: config.Key}
+		if conn, err = newQUICCipherConn(lconn, config.Key); err != nil {
+			lconn.Close()
+			return nil, err
+		}
 	}
 
 	ln, err := quic.Listen(conn, tlsConfig, quicConfig)
@@ -290,9 +319,22 @@ func (c *quicConn) RemoteAddr() net.Addr {
 	return c.raddr
 }
 
+// quicCipherConn encrypts the QUIC packets by AES-GCM, the nonce is prepended to each packet.
 type quicCipherConn struct {
 	*net.UDPConn
-	key []byte
+	aead cipher.AEAD
+}
+
+func newQUICCipherConn(conn *net.UDPConn, key []byte) (*quicCipherConn, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return &quicCipherConn{UDPConn: conn, aead: aead}, nil
 }
 
 func (conn *quicCipherConn) ReadFrom(data []byte) (n int, addr net.Addr, err error) {
@@ -311,7 +353,10 @@ func (conn *quicCipherConn) ReadFrom(data []byte) (n int, addr net.Addr, err err
 }
 
 func (conn *quicCipherConn) WriteTo(data []byte, addr net.Addr) (n int, err error) {
-	b, err := conn.encrypt(data)
+	buf := mPool.Get().([]byte)
+	defer mPool.Put(buf)
+
+	b, err := conn.encrypt(buf[:0], data)
 	if err != nil {
 		return
 	}
@@ -321,44 +366,28 @@ func (conn *quicCipherConn) WriteTo(data []byte, addr net.Addr) (n int, err erro
 		return
 	}
 
-	return len(b), nil
+	return len(data), nil
 }
 
-func (conn *quicCipherConn) encrypt(data []byte) ([]byte, error) {
-	c, err := aes.NewCipher(conn.key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+// encrypt appends the nonce and the encrypted data to dst.
+func (conn *quicCipherConn) encrypt(dst, data []byte) ([]byte, error) {
+	nonceSize := conn.aead.NonceSize()
+	dst = append(dst, make([]byte, nonceSize)...)
+	nonce := dst[len(dst)-nonceSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, data, nil), nil
+	return conn.aead.Seal(dst, nonce, data, nil), nil
 }
 
+// decrypt decrypts the data in place.
 func (conn *quicCipherConn) decrypt(data []byte) ([]byte, error) {
-	c, err := aes.NewCipher(conn.key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, err
-	}
-
-	nonceSize := gcm.NonceSize()
+	nonceSize := conn.aead.NonceSize()
 	if len(data) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
 
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+	return conn.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
 }
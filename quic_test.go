@@ -461,3 +461,51 @@ func TestHTTPOverCipherQUIC(t *testing.T) {
 		}
 	}
 }
+
+func TestQUICReconnect(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	ln, err := QUICListener("localhost:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := QUICTransporter(nil).(*quicTransporter)
+	client := &Client{
+		Connector:   HTTPConnector(nil),
+		Transporter: tr,
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.sessionMutex.Lock()
+	session := tr.sessions[server.Addr().String()]
+	tr.sessionMutex.Unlock()
+	if session == nil || session.Closed() {
+		t.Fatal("session should be established")
+	}
+	session.Close()
+	if !session.Closed() {
+		t.Fatal("session should be closed")
+	}
+
+	if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err != nil {
+		t.Fatalf("session should be re-established: %v", err)
+	}
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	if s := tr.sessions[server.Addr().String()]; s == nil || s == session || s.Closed() {
+		t.Error("closed session should be replaced")
+	}
+}
@@ -0,0 +1,224 @@
+package gost
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes per second, it is shared by the connections limited by it.
+// The bucket holds the bytes of one second at most, the bytes exceeding the tokens are waited for.
+type RateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mux    sync.Mutex
+}
+
+// NewRateLimiter creates a RateLimiter of rate bytes per second, it returns nil if rate is not positive.
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the bytes per second.
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// reserve takes n tokens from the bucket, and returns the time to wait for the tokens in debt.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes are allowed.
+func (l *RateLimiter) Wait(n int) {
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Bandwidth is the bandwidth limit of both directions, each direction has its own token bucket.
+type Bandwidth struct {
+	in  *RateLimiter
+	out *RateLimiter
+}
+
+// NewBandwidth creates a Bandwidth of rate bytes per second in each direction,
+// it returns nil if rate is not positive.
+func NewBandwidth(rate int64) *Bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &Bandwidth{
+		in:  NewRateLimiter(rate),
+		out: NewRateLimiter(rate),
+	}
+}
+
+// RateLimits is the bandwidth limits of the connections of a service, in bytes per second of each direction:
+// the bytes received from the clients, and the bytes sent to them.
+type RateLimits struct {
+	ConnRate int64      // the limit of each connection
+	UserRate int64      // the limit of each authenticated user, shared by the connections of the user
+	Service  *Bandwidth // the limit of the service, shared by all connections of the service
+	Global   *Bandwidth // the limit shared by the services
+	users    map[string]*Bandwidth
+	mux      sync.Mutex
+}
+
+// Conn wraps the client connection conn to limit its bandwidth,
+// the connection is limited by the user limit once the user is authenticated.
+func (l *RateLimits) Conn(conn net.Conn) net.Conn {
+	if l == nil {
+		return conn
+	}
+	c := &rateLimitConn{Conn: conn, limits: l}
+	for _, bw := range []*Bandwidth{NewBandwidth(l.ConnRate), l.Service, l.Global} {
+		c.add(bw)
+	}
+	return c
+}
+
+func (l *RateLimits) user(user string) *Bandwidth {
+	if l.UserRate <= 0 {
+		return nil
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.users == nil {
+		l.users = make(map[string]*Bandwidth)
+	}
+	bw := l.users[user]
+	if bw == nil {
+		bw = NewBandwidth(l.UserRate)
+		l.users[user] = bw
+	}
+	return bw
+}
+
+type rateLimitConn struct {
+	net.Conn
+	limits  *RateLimits
+	in, out []*RateLimiter
+	user    bool
+}
+
+func (c *rateLimitConn) add(bw *Bandwidth) {
+	if bw != nil {
+		c.in = append(c.in, bw.in)
+		c.out = append(c.out, bw.out)
+	}
+}
+
+func wait(limiters []*RateLimiter, n int) {
+	var d time.Duration
+	for _, l := range limiters {
+		if v := l.reserve(n); v > d {
+			d = v
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *rateLimitConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	wait(c.in, n)
+	return
+}
+
+func (c *rateLimitConn) Write(b []byte) (n int, err error) {
+	wait(c.out, len(b))
+	return c.Conn.Write(b)
+}
+
+// CloseWrite closes the write side of the connection if it supports half-close.
+func (c *rateLimitConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+func (c *rateLimitConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *rateLimitConn) rewrap(conn net.Conn) net.Conn {
+	cc := *c
+	cc.Conn = conn
+	return &cc
+}
+
+// setRateLimitUser limits the connection conn wrapped by RateLimits.Conn by the limit of the user.
+// It must be called before the connection is shared by multiple goroutines.
+func setRateLimitUser(conn net.Conn, user string) {
+	for {
+		switch c := conn.(type) {
+		case *bufferdConn:
+			conn = c.Conn
+		case *trafficConn:
+			conn = c.Conn
+		case *rateLimitConn:
+			if !c.user {
+				c.user = true
+				c.add(c.limits.user(user))
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+type rateLimitListener struct {
+	Listener
+	limits *RateLimits
+}
+
+// RateLimitListener wraps the listener ln to limit the bandwidth of the accepted connections by the limits.
+func RateLimitListener(ln Listener, limits *RateLimits) Listener {
+	if limits == nil {
+		return ln
+	}
+	return &rateLimitListener{Listener: ln, limits: limits}
+}
+
+func (l *rateLimitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.limits.Conn(conn), nil
+}
@@ -0,0 +1,127 @@
+package gost
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1000)
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("the bucket should be full, got wait %v", d)
+	}
+	if d := l.reserve(500); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("should wait about 500ms, got %v", d)
+	}
+	if d := l.reserve(500); d < 950*time.Millisecond || d > time.Second {
+		t.Errorf("the debts should be accumulated, got wait %v", d)
+	}
+
+	var nilLimiter *RateLimiter
+	if d := nilLimiter.reserve(1000); d != 0 {
+		t.Errorf("nil limiter should not limit, got wait %v", d)
+	}
+	if NewRateLimiter(0) != nil || NewBandwidth(-1) != nil {
+		t.Error("limiter of non-positive rate should be nil")
+	}
+}
+
+func TestRateLimitConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+
+	limits := &RateLimits{ConnRate: 10000}
+	conn := limits.Conn(c1)
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 15000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 2*time.Second {
+		t.Errorf("writing 20000 bytes at 10000 bytes/s should take about 1s, got %v", d)
+	}
+
+	// the other connection has its own limit.
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	go io.Copy(ioutil.Discard, c4)
+	conn2 := limits.Conn(c3)
+	defer conn2.Close()
+
+	start = time.Now()
+	if _, err := conn2.Write(make([]byte, 10000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("connection should not be limited by the others, got %v", d)
+	}
+}
+
+func TestRateLimitShared(t *testing.T) {
+	limits := &RateLimits{
+		UserRate: 1000,
+		Service:  NewBandwidth(2000),
+		Global:   NewBandwidth(3000),
+	}
+	newConn := func() *rateLimitConn {
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return limits.Conn(c1).(*rateLimitConn)
+	}
+
+	a, b, c := newConn(), newConn(), newConn()
+	if len(a.in) != 2 || a.in[0] != b.in[0] || a.out[1] != b.out[1] {
+		t.Fatal("connections should share the service and global limits")
+	}
+
+	setRateLimitUser(&bufferdConn{Conn: &trafficConn{Conn: a}}, "alice")
+	setRateLimitUser(a, "alice")
+	setRateLimitUser(b, "alice")
+	setRateLimitUser(c, "bob")
+	if len(a.in) != 3 || len(a.out) != 3 {
+		t.Fatalf("user limit should be added once, got %d", len(a.in))
+	}
+	if a.in[2] != b.in[2] || a.in[2].Rate() != 1000 {
+		t.Error("connections of the same user should share the user limit")
+	}
+	if a.in[2] == c.in[2] {
+		t.Error("users should have their own limits")
+	}
+}
+
+func TestRateLimitListener(t *testing.T) {
+	ln := mustTCPListener(t)
+	if RateLimitListener(ln, nil) != ln {
+		t.Error("listener should not be wrapped without limits")
+	}
+
+	ln = RateLimitListener(ln, &RateLimits{ConnRate: 1000})
+	defer ln.Close()
+
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, limit := unwrapConn(conn)
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Fatalf("should unwrap the TCP connection, got %T", c)
+	}
+	if lc, ok := limit(c).(*rateLimitConn); !ok || len(lc.in) != 1 {
+		t.Error("connection should be limited again by the same limits")
+	}
+}
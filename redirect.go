@@ -7,8 +7,7 @@ import (
 	"fmt"
 	"net"
 	"syscall"
-
-	"github.com/go-log/log"
+	"unsafe"
 )
 
 type tcpRedirectHandler struct {
@@ -34,34 +33,38 @@ func (h *tcpRedirectHandler) Init(options ...HandlerOption) {
 }
 
 func (h *tcpRedirectHandler) Handle(c net.Conn) {
-	conn, ok := c.(*net.TCPConn)
+	defer c.Close()
+
+	raw, wrap := unwrapConn(c)
+	conn, ok := raw.(*net.TCPConn)
 	if !ok {
-		log.Log("[red-tcp] not a TCP connection")
+		h.options.Logger.Log("[red-tcp] not a TCP connection")
+		return
 	}
 
 	srcAddr := conn.RemoteAddr()
 	dstAddr, conn, err := h.getOriginalDstAddr(conn)
 	if err != nil {
-		log.Logf("[red-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
+		h.options.Logger.Logf("[red-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
 		return
 	}
 	defer conn.Close()
 
-	log.Logf("[red-tcp] %s -> %s", srcAddr, dstAddr)
+	h.options.Logger.Logf("[red-tcp] %s -> %s", srcAddr, dstAddr)
 
 	cc, err := h.options.Chain.Dial(dstAddr.String(),
 		RetryChainOption(h.options.Retries),
 		TimeoutChainOption(h.options.Timeout),
 	)
 	if err != nil {
-		log.Logf("[red-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
+		h.options.Logger.Logf("[red-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
 		return
 	}
 	defer cc.Close()
 
-	log.Logf("[red-tcp] %s <-> %s", srcAddr, dstAddr)
-	transport(conn, cc)
-	log.Logf("[red-tcp] %s >-< %s", srcAddr, dstAddr)
+	h.options.Logger.Logf("[red-tcp] %s <-> %s", srcAddr, dstAddr)
+	transport(wrap(conn), cc)
+	h.options.Logger.Logf("[red-tcp] %s >-< %s", srcAddr, dstAddr)
 }
 
 func (h *tcpRedirectHandler) getOriginalDstAddr(conn *net.TCPConn) (addr net.Addr, c *net.TCPConn, err error) {
@@ -73,17 +76,31 @@ func (h *tcpRedirectHandler) getOriginalDstAddr(conn *net.TCPConn) (addr net.Add
 	}
 	defer fc.Close()
 
-	mreq, err := syscall.GetsockoptIPv6Mreq(int(fc.Fd()), syscall.IPPROTO_IP, 80)
-	if err != nil {
-		return
-	}
-
-	// only ipv4 support
-	ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
-	port := uint16(mreq.Multiaddr[2])<<8 + uint16(mreq.Multiaddr[3])
-	addr, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip.String(), port))
-	if err != nil {
-		return
+	if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+		// IP6T_SO_ORIGINAL_DST, the struct sockaddr_in6 fits in the IPv6MTUInfo.
+		var info *syscall.IPv6MTUInfo
+		info, err = syscall.GetsockoptIPv6MTUInfo(int(fc.Fd()), syscall.IPPROTO_IPV6, 80)
+		if err != nil {
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		addr = &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(port[0])<<8 + int(port[1]),
+		}
+	} else {
+		// SO_ORIGINAL_DST, the struct sockaddr_in fits in the IPv6Mreq.
+		var mreq *syscall.IPv6Mreq
+		mreq, err = syscall.GetsockoptIPv6Mreq(int(fc.Fd()), syscall.IPPROTO_IP, 80)
+		if err != nil {
+			return
+		}
+		ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+		port := uint16(mreq.Multiaddr[2])<<8 + uint16(mreq.Multiaddr[3])
+		addr, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip.String(), port))
+		if err != nil {
+			return
+		}
 	}
 
 	cc, err := net.FileConn(fc)
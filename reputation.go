@@ -0,0 +1,440 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+var (
+	// ReputationFetchTimeout is the timeout of fetching a reputation list from the HTTP source.
+	ReputationFetchTimeout = 30 * time.Second
+)
+
+// Reputation is a set of IP deny lists, such as Spamhaus DROP or the custom feeds,
+// it is applied to both the inbound clients and the outbound destinations.
+// Each list is loaded from a file or an HTTP(S) URL, and refreshed periodically.
+type Reputation struct {
+	lists   []*reputationList
+	period  time.Duration
+	refresh time.Duration
+	stopped chan struct{}
+	fetch   chan struct{} // requests PeriodRefresh to fetch the remote lists of the reloaded config
+	mux     sync.RWMutex
+}
+
+type reputationList struct {
+	name    string
+	source  string
+	nets    *ipSet
+	updated time.Time
+	hits    uint64
+}
+
+type ipPrefix struct {
+	ones, bits int
+}
+
+// ipSet is a set of IP networks indexed by the prefix length, an IP is looked up
+// by one map access for each of the prefix lengths in the set, so the large lists are not scanned.
+type ipSet struct {
+	nets     map[ipPrefix]map[string]struct{}
+	prefixes []ipPrefix
+	entries  int
+}
+
+func newIPSet() *ipSet {
+	return &ipSet{
+		nets: make(map[ipPrefix]map[string]struct{}),
+	}
+}
+
+func (s *ipSet) add(ipNet *net.IPNet) {
+	ones, bits := ipNet.Mask.Size()
+	ip := ipNet.IP.To16()
+	if bits == 8*net.IPv4len {
+		ip = ipNet.IP.To4()
+	}
+	if ip == nil || bits == 0 {
+		return
+	}
+
+	prefix := ipPrefix{ones: ones, bits: bits}
+	m := s.nets[prefix]
+	if m == nil {
+		m = make(map[string]struct{})
+		s.nets[prefix] = m
+		s.prefixes = append(s.prefixes, prefix)
+	}
+	m[string(ip.Mask(ipNet.Mask))] = struct{}{}
+	s.entries++
+}
+
+// Len returns the number of the entries of the set.
+func (s *ipSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.entries
+}
+
+// Contains reports whether the ip is in any network of the set.
+func (s *ipSet) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := 8 * len(ip)
+	for _, prefix := range s.prefixes {
+		if prefix.bits != bits {
+			continue
+		}
+		if _, ok := s.nets[prefix][string(ip.Mask(net.CIDRMask(prefix.ones, bits)))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReputationStats is the statistics of a reputation list.
+type ReputationStats struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Entries int       `json:"entries"`
+	Hits    uint64    `json:"hits"`
+	Updated time.Time `json:"updated"`
+}
+
+// NewReputation creates a Reputation.
+func NewReputation() *Reputation {
+	return &Reputation{
+		stopped: make(chan struct{}),
+		fetch:   make(chan struct{}, 1),
+	}
+}
+
+// Contains reports whether the IP of the address addr is listed in any list,
+// the hit is counted for the first list containing it.
+// The ips are the resolved addresses of the domain name of addr, they are checked instead.
+func (rep *Reputation) Contains(addr string, ips ...net.IP) bool {
+	if rep == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	}
+	if len(ips) == 0 {
+		return false
+	}
+
+	rep.mux.RLock()
+	defer rep.mux.RUnlock()
+
+	for _, list := range rep.lists {
+		for _, ip := range ips {
+			if list.nets.Contains(ip) {
+				atomic.AddUint64(&list.hits, 1)
+				if Debug {
+					log.Logf("[reputation] %s(%s) : listed in %s", host, ip, list.name)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Stats returns the statistics of the lists.
+func (rep *Reputation) Stats() []ReputationStats {
+	if rep == nil {
+		return nil
+	}
+
+	rep.mux.RLock()
+	defer rep.mux.RUnlock()
+
+	var stats []ReputationStats
+	for _, list := range rep.lists {
+		stats = append(stats, ReputationStats{
+			Name:    list.name,
+			Source:  list.source,
+			Entries: list.nets.Len(),
+			Hits:    atomic.LoadUint64(&list.hits),
+			Updated: list.updated,
+		})
+	}
+	return stats
+}
+
+// Reload parses config from r, then live reloads the lists and refreshes them.
+// The lists of the files are loaded at once, the remote lists are fetched by PeriodRefresh,
+// so a slow source does not block the reloading.
+// The config consists of the 'reload' and 'refresh' periods, and the lists by lines of 'name source'.
+func (rep *Reputation) Reload(r io.Reader) error {
+	var lists []*reputationList
+	var period, refresh time.Duration
+
+	if r == nil || rep.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		ss := splitLine(line)
+		if len(ss) == 0 {
+			continue
+		}
+		switch ss[0] {
+		case "reload": // reload option
+			if len(ss) > 1 {
+				period, _ = time.ParseDuration(ss[1])
+			}
+		case "refresh": // refresh option of the lists
+			if len(ss) > 1 {
+				refresh, _ = time.ParseDuration(ss[1])
+			}
+		default:
+			if len(ss) < 2 {
+				continue
+			}
+			lists = append(lists, &reputationList{name: ss[0], source: ss[1]})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	rep.mux.Lock()
+	// keep the loaded lists until they are refreshed.
+	for _, list := range lists {
+		for _, old := range rep.lists {
+			if old.name == list.name && old.source == list.source {
+				list.nets, list.updated, list.hits = old.nets, old.updated, atomic.LoadUint64(&old.hits)
+			}
+		}
+	}
+	rep.lists = lists
+	rep.period = period
+	rep.refresh = refresh
+	rep.mux.Unlock()
+
+	rep.load(func(list *reputationList) bool { return !isRemoteSource(list.source) })
+	select {
+	case rep.fetch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Refresh loads all the lists from their sources, the list is kept unchanged if it fails to be loaded.
+func (rep *Reputation) Refresh() {
+	rep.load(nil)
+}
+
+// load loads the lists selected by the filter from their sources, or all lists if filter is nil.
+func (rep *Reputation) load(filter func(list *reputationList) bool) {
+	rep.mux.RLock()
+	lists := rep.lists
+	rep.mux.RUnlock()
+
+	for _, list := range lists {
+		if filter != nil && !filter(list) {
+			continue
+		}
+		nets, err := loadReputationList(list.source)
+		if err != nil {
+			log.Logf("[reputation] %s %s : %s", list.name, list.source, err)
+			continue
+		}
+		if Debug {
+			log.Logf("[reputation] %s %s : %d entries", list.name, list.source, nets.Len())
+		}
+
+		rep.mux.Lock()
+		list.nets = nets
+		list.updated = time.Now()
+		rep.mux.Unlock()
+	}
+}
+
+// RefreshPeriod returns the refresh period of the lists.
+func (rep *Reputation) RefreshPeriod() time.Duration {
+	if rep.Stopped() {
+		return -1
+	}
+
+	rep.mux.RLock()
+	defer rep.mux.RUnlock()
+
+	return rep.refresh
+}
+
+// Period returns the reload period.
+func (rep *Reputation) Period() time.Duration {
+	if rep.Stopped() {
+		return -1
+	}
+
+	rep.mux.RLock()
+	defer rep.mux.RUnlock()
+
+	return rep.period
+}
+
+// Stop stops reloading and refreshing.
+func (rep *Reputation) Stop() {
+	select {
+	case <-rep.stopped:
+	default:
+		close(rep.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (rep *Reputation) Stopped() bool {
+	select {
+	case <-rep.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rep *Reputation) String() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "reload: %v\n", rep.Period())
+	fmt.Fprintf(b, "refresh: %v\n", rep.RefreshPeriod())
+	for _, stats := range rep.Stats() {
+		fmt.Fprintf(b, "%s %s entries=%d hits=%d\n", stats.Name, stats.Source, stats.Entries, stats.Hits)
+	}
+	return b.String()
+}
+
+// PeriodRefresh refreshes the lists of the reputation periodically, until it is stopped.
+// The remote lists are also fetched once the reputation is reloaded.
+func PeriodRefresh(rep *Reputation) {
+	for {
+		period := rep.RefreshPeriod()
+		if period < 0 {
+			log.Log("[reputation] refresh stopped")
+			return
+		}
+		if period == 0 {
+			period = time.Hour // check the refresh option again later.
+		} else if period < time.Minute {
+			period = time.Minute
+		}
+
+		select {
+		case <-time.After(period):
+			if rep.RefreshPeriod() > 0 {
+				rep.Refresh()
+			}
+		case <-rep.fetch:
+			rep.load(func(list *reputationList) bool { return isRemoteSource(list.source) })
+		case <-rep.stopped:
+		}
+	}
+}
+
+func loadReputationList(source string) (*ipSet, error) {
+	var r io.Reader
+	if isRemoteSource(source) {
+		client := &http.Client{Timeout: ReputationFetchTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return parseReputationList(r)
+}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// parseReputationList parses the list of IPs or CIDRs by lines,
+// the comments start with ';' (Spamhaus DROP format) or '#'.
+func parseReputationList(r io.Reader) (*ipSet, error) {
+	nets := newIPSet()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if n := strings.IndexByte(line, ';'); n >= 0 {
+			line = line[:n]
+		}
+		ss := splitLine(line)
+		if len(ss) == 0 {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(ss[0]); err == nil {
+			nets.add(ipNet)
+			continue
+		}
+		if ip := net.ParseIP(ss[0]); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets.add(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nets, scanner.Err()
+}
+
+type reputationListener struct {
+	Listener
+	reputation *Reputation
+}
+
+// ReputationListener wraps the listener ln, the connections from the clients listed in the reputation are closed once accepted.
+func ReputationListener(ln Listener, reputation *Reputation) Listener {
+	if reputation == nil {
+		return ln
+	}
+	return &reputationListener{Listener: ln, reputation: reputation}
+}
+
+func (l *reputationListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.reputation.Contains(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
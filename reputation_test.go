@@ -0,0 +1,208 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var reputationListTests = []struct {
+	list    string
+	entries int
+	addr    string
+	listed  bool
+}{
+	{"", 0, "1.2.3.4", false},
+	{"; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n1.19.0.0/16 ; SBL434604\n", 2, "1.10.20.1:80", true},
+	{"1.10.16.0/20 ; SBL256894\n", 1, "1.10.32.1:80", false},
+	{"# custom feed\n10.0.0.1\n2001:db8::/32\n", 2, "10.0.0.1", true},
+	{"# custom feed\n10.0.0.1\n2001:db8::/32\n", 2, "[2001:db8::1]:443", true},
+	{"# custom feed\n10.0.0.1\n2001:db8::/32\n", 2, "10.0.0.2", false},
+	{"invalid\n10.0.0.1\n", 1, "example.com:80", false},
+	{"2001:db8::/32\n10.0.0.0/8\n", 2, "[2001:db9::1]:443", false},
+	{"2001:db8::/32\n10.0.0.0/8\n", 2, "[::ffff:10.1.2.3]:80", true},
+}
+
+func TestReputationList(t *testing.T) {
+	var rep *Reputation
+	if rep.Contains("1.2.3.4") {
+		t.Error("nil reputation should not contain any address")
+	}
+
+	for i, tc := range reputationListTests {
+		nets, err := parseReputationList(bytes.NewBufferString(tc.list))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nets.Len() != tc.entries {
+			t.Errorf("#%d should have %d entries, got %d", i, tc.entries, nets.Len())
+		}
+
+		rep := NewReputation()
+		rep.lists = []*reputationList{{name: "test", nets: nets}}
+		if rep.Contains(tc.addr) != tc.listed {
+			t.Errorf("#%d test failed: %s", i, tc.addr)
+		}
+	}
+
+	// the domain name is checked by the resolved addresses.
+	nets, _ := parseReputationList(bytes.NewBufferString("10.0.0.0/8\n"))
+	rep = NewReputation()
+	rep.lists = []*reputationList{{name: "test", nets: nets}}
+	if !rep.Contains("example.com:80", net.ParseIP("192.168.1.1"), net.ParseIP("10.0.0.1")) ||
+		rep.Contains("example.com:80", net.ParseIP("192.168.1.1")) {
+		t.Error("the domain name should be checked by the resolved addresses")
+	}
+}
+
+func TestReputationReload(t *testing.T) {
+	// the remote feed is slow.
+	release := make(chan struct{})
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("1.10.16.0/20 ; SBL256894\n"))
+	}))
+	defer httpSrv.Close()
+
+	f, err := ioutil.TempFile("", "gost-reputation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.0/8\n")
+	f.Close()
+
+	rep := NewReputation()
+	defer rep.Stop()
+	config := fmt.Sprintf("reload 10s\nrefresh 1h\ndrop %s\ncustom %s\nunavailable http://127.0.0.1:1/drop.txt\n",
+		httpSrv.URL, f.Name())
+	if err := rep.Reload(bytes.NewBufferString(config)); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Period() != 10*time.Second || rep.RefreshPeriod() != time.Hour {
+		t.Errorf("unexpected periods: %v, %v", rep.Period(), rep.RefreshPeriod())
+	}
+
+	// the file list is loaded by the reloading, the remote list is fetched by the refreshing.
+	if !rep.Contains("10.1.1.1:80") || rep.Contains("1.10.16.1") {
+		t.Fatal("only the file list should be loaded by the reloading")
+	}
+	go PeriodRefresh(rep)
+	close(release)
+	for i := 0; i < 100 && rep.Stats()[0].Entries == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !rep.Contains("1.10.16.1") || !rep.Contains("10.1.1.1:80") || rep.Contains("192.168.1.1") {
+		t.Error("the lists should be loaded from the sources")
+	}
+	stats := rep.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("should have 3 lists, got %d", len(stats))
+	}
+	for i, want := range []ReputationStats{{Name: "drop", Entries: 1, Hits: 1}, {Name: "custom", Entries: 1, Hits: 2}, {Name: "unavailable"}} {
+		if stats[i].Name != want.Name || stats[i].Entries != want.Entries || stats[i].Hits != want.Hits {
+			t.Errorf("#%d unexpected stats: %+v", i, stats[i])
+		}
+	}
+
+	// the loaded lists are kept if the source is unavailable.
+	httpSrv.Close()
+	rep.Refresh()
+	if !rep.Contains("1.10.16.1") {
+		t.Error("the list should be kept")
+	}
+
+	rep.Stop()
+	if rep.Period() >= 0 || rep.RefreshPeriod() >= 0 {
+		t.Error("the stopped reputation should have negative periods")
+	}
+}
+
+func TestReputationProxy(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	for i, tc := range []struct {
+		list    string
+		inbound bool
+	}{
+		{"127.0.0.0/8\n::1\n", true},
+		{"127.0.0.0/8\n::1\n", false},
+	} {
+		nets, _ := parseReputationList(bytes.NewBufferString(tc.list))
+		rep := NewReputation()
+		rep.lists = []*reputationList{{name: "test", nets: nets}}
+
+		ln, err := TCPListener("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Handler:  SOCKS5Handler(),
+			Listener: ln,
+		}
+		if tc.inbound {
+			server.Listener = ReputationListener(ln, rep)
+		} else {
+			server.Handler = SOCKS5Handler(ReputationHandlerOption(rep))
+		}
+		go server.Run()
+
+		if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err == nil {
+			t.Errorf("#%d the listed address should be denied", i)
+		}
+		if rep.Stats()[0].Hits == 0 {
+			t.Errorf("#%d the hits should be counted", i)
+		}
+		server.Close()
+	}
+}
+
+func TestReputationProxyDomain(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+	_, port, _ := net.SplitHostPort(httpSrv.Listener.Addr().String())
+
+	nets, _ := parseReputationList(bytes.NewBufferString("127.0.0.0/8\n"))
+	rep := NewReputation()
+	rep.lists = []*reputationList{{name: "test", nets: nets}}
+
+	server := &Server{
+		Listener: mustTCPListener(t),
+		Handler: SOCKS5Handler(
+			ReputationHandlerOption(rep),
+			HostsHandlerOption(NewHosts(NewHost(net.ParseIP("127.0.0.1"), "listed.test"))),
+		),
+	}
+	go server.Run()
+	defer server.Close()
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+	conn, err := proxyConn(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := client.Connect(conn, net.JoinHostPort("listed.test", port)); err == nil {
+		t.Error("the domain name resolved to the listed address should be denied")
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -40,15 +44,40 @@ type ReloadResolver interface {
 }
 
 // NameServer is a name server.
-// Currently supported protocol: TCP, UDP and TLS.
+// Currently supported protocol: TCP, UDP, TLS and HTTPS.
 type NameServer struct {
 	Addr      string
 	Protocol  string
 	Hostname  string // for TLS handshake verification
 	Timeout   time.Duration
+	Chain     *Chain // the name server is queried through the chain, UDP queries are sent over TCP.
 	exchanger Exchanger
 }
 
+// ParseNameServers parses the comma separated name servers of s,
+// such as '1.1.1.1,8.8.8.8:53/tcp,1.1.1.1:853/tls,https://1.0.0.1/dns-query'.
+func ParseNameServers(s string) (nss []NameServer) {
+	for _, s := range strings.Split(s, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.HasPrefix(s, "https") {
+			nss = append(nss, NameServer{Addr: s, Protocol: "https"})
+			continue
+		}
+
+		ss := strings.Split(s, "/")
+		switch len(ss) {
+		case 1:
+			nss = append(nss, NameServer{Addr: ss[0]})
+		case 2:
+			nss = append(nss, NameServer{Addr: ss[0], Protocol: ss[1]})
+		}
+	}
+	return
+}
+
 // Init initializes the name server.
 func (ns *NameServer) Init() error {
 	timeout := ns.Timeout
@@ -64,6 +93,7 @@ func (ns *NameServer) Init() error {
 				Net:     "tcp",
 				Timeout: timeout,
 			},
+			chain: ns.Chain,
 		}
 	case "tls":
 		cfg := &tls.Config{
@@ -80,6 +110,7 @@ func (ns *NameServer) Init() error {
 				Timeout:   timeout,
 				TLSConfig: cfg,
 			},
+			chain: ns.Chain,
 		}
 	case "https":
 		u, err := url.Parse(ns.Addr)
@@ -92,6 +123,12 @@ func (ns *NameServer) Init() error {
 			DisableCompression: true,
 			MaxIdleConns:       1,
 		}
+		if !ns.Chain.IsEmpty() {
+			chain := ns.Chain
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return chain.DialContext(ctx, addr)
+			}
+		}
 		http2.ConfigureTransport(transport)
 
 		ns.exchanger = &dohExchanger{
@@ -110,6 +147,7 @@ func (ns *NameServer) Init() error {
 				Net:     "udp",
 				Timeout: timeout,
 			},
+			chain: ns.Chain,
 		}
 	}
 
@@ -129,13 +167,14 @@ func (ns NameServer) String() string {
 }
 
 type resolver struct {
-	Servers []NameServer
-	mCache  *sync.Map
-	TTL     time.Duration
-	period  time.Duration
-	domain  string
-	stopped chan struct{}
-	mux     sync.RWMutex
+	Servers  []NameServer
+	mCache   *sync.Map
+	TTL      time.Duration
+	period   time.Duration
+	domain   string
+	queryLog *queryLogger
+	stopped  chan struct{}
+	mux      sync.RWMutex
 }
 
 // NewResolver create a new Resolver with the given name servers and resolution timeout.
@@ -163,6 +202,11 @@ func (r *resolver) copyServers() []NameServer {
 }
 
 func (r *resolver) Resolve(host string) (ips []net.IP, err error) {
+	return r.lookup("", host)
+}
+
+// lookup resolves the host on behalf of the client, the client address is logged with the queries.
+func (r *resolver) lookup(client, host string) (ips []net.IP, err error) {
 	if r == nil {
 		return
 	}
@@ -170,11 +214,13 @@ func (r *resolver) Resolve(host string) (ips []net.IP, err error) {
 	var domain string
 	var ttl time.Duration
 	var servers []NameServer
+	var ql *queryLogger
 
 	r.mux.RLock()
 	domain = r.domain
 	ttl = r.TTL
 	servers = r.copyServers()
+	ql = r.queryLog
 	r.mux.RUnlock()
 
 	if ip := net.ParseIP(host); ip != nil {
@@ -189,11 +235,15 @@ func (r *resolver) Resolve(host string) (ips []net.IP, err error) {
 		if Debug {
 			log.Logf("[resolver] cache hit %s: %v", host, ips)
 		}
+		ql.Log(client, host, dns.TypeA, "cache", dns.RcodeSuccess, 0)
 		return
 	}
 
 	for _, ns := range servers {
-		ips, ttl, err = r.resolve(ns.exchanger, host)
+		var rcode int
+		start := time.Now()
+		ips, ttl, rcode, err = r.resolve(ns.exchanger, host)
+		ql.Log(client, host, dns.TypeA, ns.String(), rcode, time.Since(start))
 		if err != nil {
 			log.Logf("[resolver] %s via %s : %s", host, ns, err)
 			continue
@@ -211,7 +261,9 @@ func (r *resolver) Resolve(host string) (ips []net.IP, err error) {
 	return
 }
 
-func (*resolver) resolve(ex Exchanger, host string) (ips []net.IP, ttl time.Duration, err error) {
+// resolve queries the A records of host, the rcode is -1 if there is no response.
+func (*resolver) resolve(ex Exchanger, host string) (ips []net.IP, ttl time.Duration, rcode int, err error) {
+	rcode = -1
 	if ex == nil {
 		return
 	}
@@ -222,10 +274,14 @@ func (*resolver) resolve(ex Exchanger, host string) (ips []net.IP, ttl time.Dura
 	if err != nil {
 		return
 	}
+	rcode = mr.Rcode
 	for _, ans := range mr.Answer {
 		if ar, _ := ans.(*dns.A); ar != nil {
 			ips = append(ips, ar.A)
-			ttl = time.Duration(ar.Header().Ttl) * time.Second
+			// the addresses are cached for the shortest TTL of them.
+			if d := time.Duration(ar.Header().Ttl) * time.Second; len(ips) == 1 || d < ttl {
+				ttl = d
+			}
 		}
 	}
 	return
@@ -273,6 +329,7 @@ func (r *resolver) Reload(rd io.Reader) error {
 	var ttl, timeout, period time.Duration
 	var domain string
 	var nss []NameServer
+	var ql *queryLogger
 
 	if rd == nil || r.Stopped() {
 		return nil
@@ -303,6 +360,13 @@ func (r *resolver) Reload(rd io.Reader) error {
 			if len(ss) > 1 {
 				domain = ss[1]
 			}
+		case "querylog": // query logging option
+			if len(ss) > 1 {
+				var err error
+				if ql, err = newQueryLogger(ss[1], ss[2:]...); err != nil {
+					return err
+				}
+			}
 		case "search", "sortlist", "options": // we don't support these features in /etc/resolv.conf
 		case "nameserver": // nameserver option, compatible with /etc/resolv.conf
 			if len(ss) <= 1 {
@@ -346,6 +410,7 @@ func (r *resolver) Reload(rd io.Reader) error {
 	r.domain = domain
 	r.period = period
 	r.Servers = nss
+	r.queryLog = ql
 	r.mux.Unlock()
 
 	return nil
@@ -393,12 +458,105 @@ func (r *resolver) String() string {
 	fmt.Fprintf(b, "TTL %v\n", r.TTL)
 	fmt.Fprintf(b, "Reload %v\n", r.period)
 	fmt.Fprintf(b, "Domain %v\n", r.domain)
+	if r.queryLog != nil {
+		fmt.Fprintf(b, "QueryLog %v\n", r.queryLog.mode)
+	}
 	for i := range r.Servers {
 		fmt.Fprintln(b, r.Servers[i])
 	}
 	return b.String()
 }
 
+// queryLogger logs the DNS queries of the resolver for troubleshooting and abuse investigations.
+// The query names are logged according to the mode:
+// 'plain' logs the query names as is,
+// 'hash' logs the keyed hashes of the query names, the key is random if it is not specified,
+// 'domain' logs the last two labels of the query names only, such as '*.example.com'.
+type queryLogger struct {
+	mode string
+	key  []byte
+}
+
+func newQueryLogger(mode string, args ...string) (*queryLogger, error) {
+	ql := &queryLogger{mode: mode}
+	switch mode {
+	case "off":
+		return nil, nil
+	case "on", "plain":
+		ql.mode = "plain"
+	case "domain":
+	case "hash":
+		if len(args) > 0 {
+			ql.key = []byte(args[0])
+		} else {
+			ql.key = make([]byte, 16)
+			if _, err := rand.Read(ql.key); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("querylog: unknown mode %s", mode)
+	}
+	return ql, nil
+}
+
+func (ql *queryLogger) name(qname string) string {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	switch ql.mode {
+	case "hash":
+		h := hmac.New(sha256.New, ql.key)
+		h.Write([]byte(qname))
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	case "domain":
+		labels := strings.Split(qname, ".")
+		if len(labels) > 2 {
+			return "*." + strings.Join(labels[len(labels)-2:], ".")
+		}
+	}
+	return qname
+}
+
+// Log logs the query of qname with type qtype from the client to the name server upstream,
+// the client is '-' if it is unknown, and the rcode is -1 if there is no response.
+func (ql *queryLogger) Log(client, qname string, qtype uint16, upstream string, rcode int, latency time.Duration) {
+	if ql == nil {
+		return
+	}
+	log.Log(ql.entry(client, qname, qtype, upstream, rcode, latency))
+}
+
+// entry formats the log of the query, see Log.
+func (ql *queryLogger) entry(client, qname string, qtype uint16, upstream string, rcode int, latency time.Duration) string {
+	if client == "" {
+		client = "-"
+	}
+	result := "NORESPONSE"
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		result = s
+	}
+	return fmt.Sprintf("[dns] %s -> %s : %s %s %s (%v)",
+		client, upstream, ql.name(qname), dns.TypeToString[qtype], result, latency.Round(time.Microsecond))
+}
+
+type clientResolver struct {
+	*resolver
+	client string
+}
+
+// resolverFor returns the Resolver resolving the hosts on behalf of the client address,
+// the client is logged with the queries by the query log of the resolver r.
+// The resolvers other than the ones created by NewResolver are returned as is.
+func resolverFor(r Resolver, client string) Resolver {
+	if rr, ok := r.(*resolver); ok && rr != nil && client != "" {
+		return &clientResolver{resolver: rr, client: client}
+	}
+	return r
+}
+
+func (r *clientResolver) Resolve(host string) ([]net.IP, error) {
+	return r.resolver.lookup(r.client, host)
+}
+
 // Exchanger is an interface for DNS synchronous query.
 type Exchanger interface {
 	Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
@@ -407,6 +565,7 @@ type Exchanger interface {
 type dnsExchanger struct {
 	endpoint string
 	client   *dns.Client
+	chain    *Chain
 }
 
 func (ex *dnsExchanger) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
@@ -414,10 +573,39 @@ func (ex *dnsExchanger) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg,
 	if _, port, _ := net.SplitHostPort(ep); port == "" {
 		ep = net.JoinHostPort(ep, "53")
 	}
+	if !ex.chain.IsEmpty() {
+		return ex.exchangeChain(ctx, query, ep)
+	}
 	mr, _, err := ex.client.Exchange(query, ep)
 	return mr, err
 }
 
+// exchangeChain sends the query to the name server ep over the TCP connection through the chain.
+func (ex *dnsExchanger) exchangeChain(ctx context.Context, query *dns.Msg, ep string) (*dns.Msg, error) {
+	conn, err := ex.chain.DialContext(ctx, ep, TimeoutChainOption(ex.client.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if ex.client.Net == "tcp-tls" {
+		conn = tls.Client(conn, ex.client.TLSConfig)
+	}
+	conn.SetDeadline(time.Now().Add(ex.client.Timeout))
+
+	if err := writeDNSMsg(conn, query, true); err != nil {
+		return nil, err
+	}
+	mr, err := readDNSMsg(conn, true)
+	if err != nil {
+		return nil, err
+	}
+	if mr.Id != query.Id {
+		return nil, dns.ErrId
+	}
+	return mr, nil
+}
+
 type dohExchanger struct {
 	endpoint *url.URL
 	client   *http.Client
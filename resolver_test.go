@@ -2,11 +2,16 @@ package gost
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 var dnsTests = []struct {
@@ -268,3 +273,132 @@ func compareNameServer(n1, n2 *NameServer) bool {
 		n1.Protocol == n2.Protocol &&
 		n1.Timeout == n2.Timeout
 }
+
+type testExchanger struct {
+	rcode int
+}
+
+func (ex *testExchanger) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	m := &dns.Msg{}
+	m.SetRcode(query, ex.rcode)
+	if ex.rcode == dns.RcodeSuccess {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	return m, nil
+}
+
+type testLogger struct {
+	logs []string
+	mux  sync.Mutex
+}
+
+func (l *testLogger) Log(v ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.logs = append(l.logs, fmt.Sprint(v...))
+}
+
+func (l *testLogger) Logf(format string, v ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Write(b []byte) (int, error) {
+	l.Log(string(b))
+	return len(b), nil
+}
+
+// lines returns the logs of the prefix.
+func (l *testLogger) lines(prefix string) []string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var lines []string
+	for _, s := range l.logs {
+		if strings.HasPrefix(s, prefix) {
+			lines = append(lines, s)
+		}
+	}
+	return lines
+}
+
+var queryLoggerTests = []struct {
+	mode  string
+	args  []string
+	qname string
+	name  string
+}{
+	{"plain", nil, "www.Example.com.", "www.example.com"},
+	{"on", nil, "www.example.com", "www.example.com"},
+	{"domain", nil, "a.b.example.com.", "*.example.com"},
+	{"domain", nil, "example.com", "example.com"},
+	{"hash", []string{"secret"}, "www.example.com", "hash"},
+}
+
+func TestQueryLogger(t *testing.T) {
+	for i, tc := range queryLoggerTests {
+		ql, err := newQueryLogger(tc.mode, tc.args...)
+		if err != nil {
+			t.Fatalf("#%d %v", i, err)
+		}
+		name := ql.name(tc.qname)
+		if tc.name == "hash" {
+			ql2, _ := newQueryLogger(tc.mode, tc.args...)
+			if name == tc.qname || len(name) != 16 || ql2.name(tc.qname) != name {
+				t.Errorf("#%d unexpected hashed name %s", i, name)
+			}
+			continue
+		}
+		if name != tc.name {
+			t.Errorf("#%d name should be %s, got %s", i, tc.name, name)
+		}
+	}
+
+	if ql, err := newQueryLogger("off"); ql != nil || err != nil {
+		t.Error("query logger should be disabled")
+	}
+	if _, err := newQueryLogger("unknown"); err == nil {
+		t.Error("unknown mode should failed")
+	}
+}
+
+func TestResolverQueryLog(t *testing.T) {
+	logger := &testLogger{}
+	SetLogger(logger)
+	defer SetLogger(&NopLogger{})
+
+	r := newResolver(0)
+	if err := r.Reload(bytes.NewBufferString("querylog domain")); err != nil {
+		t.Fatal(err)
+	}
+	r.Servers = []NameServer{
+		{Addr: "192.0.2.53", exchanger: &testExchanger{rcode: dns.RcodeNameError}},
+		{Addr: "192.0.2.54", exchanger: &testExchanger{rcode: dns.RcodeSuccess}},
+	}
+	ips, err := r.Resolve("www.example.com")
+	if err != nil || len(ips) != 1 {
+		t.Fatalf("unexpected result: %v, %v", ips, err)
+	}
+	resolverFor(r, "10.0.0.1:1000").Resolve("www.example.com")
+	if r := resolverFor(nil, "10.0.0.1:1000"); r != nil {
+		t.Errorf("nil resolver should not be wrapped, got %v", r)
+	}
+
+	queries := logger.lines("[dns]")
+	if len(queries) != 3 {
+		t.Fatalf("should log 3 queries, got %v", queries)
+	}
+	for i, s := range []string{
+		"[dns] - -> 192.0.2.53:53/udp : *.example.com A NXDOMAIN",
+		"[dns] - -> 192.0.2.54:53/udp : *.example.com A NOERROR",
+		"[dns] 10.0.0.1:1000 -> cache : *.example.com A NOERROR",
+	} {
+		if !strings.HasPrefix(queries[i], s) {
+			t.Errorf("#%d query log should be %s, got %s", i, s, queries[i])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package gost
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// ScanDetector detects the clients connecting to many distinct targets (host:port) in a short time window,
+// so that a compromised client can not use the server as a port scanner.
+// When a client exceeds the threshold, the new connections from it are either blocked for a duration,
+// or throttled for a duration by delaying each of them to the rate of threshold connections per window, according to the action.
+type ScanDetector struct {
+	threshold int
+	window    time.Duration
+	block     bool
+	duration  time.Duration
+	shards    [scanShards]scanShard
+}
+
+// scanShards is the number of the shards of the clients, each shard is locked and swept independently.
+const scanShards = 16
+
+type scanShard struct {
+	clients   map[string]*scanClient
+	lastSweep time.Time
+	mux       sync.Mutex
+}
+
+type scanClient struct {
+	targets map[string]time.Time // at most threshold+1 targets within the window
+	until   time.Time            // blocked or throttled until
+}
+
+// NewScanDetector creates a ScanDetector allowing at most threshold distinct targets per client within the window.
+// The action is either 'block' or 'throttle', which applies to the client for the duration once it exceeds the threshold.
+func NewScanDetector(threshold int, window time.Duration, action string, duration time.Duration) *ScanDetector {
+	if window <= 0 {
+		window = time.Minute
+	}
+	if duration <= 0 {
+		duration = window
+	}
+	d := &ScanDetector{
+		threshold: threshold,
+		window:    window,
+		block:     action != "throttle",
+		duration:  duration,
+	}
+	for i := range d.shards {
+		d.shards[i].clients = make(map[string]*scanClient)
+	}
+	return d
+}
+
+// Allow records the connection from the client address to the target address,
+// and reports whether it is allowed. It delays the connection before returning if the client is throttled.
+// The connections are not recorded while the client is blocked or throttled.
+func (d *ScanDetector) Allow(client, target string) bool {
+	if d == nil || d.threshold <= 0 {
+		return true
+	}
+	client = scanClientIP(client)
+	now := time.Now()
+
+	shard := d.shard(client)
+	shard.mux.Lock()
+	d.sweep(shard, now)
+	c := shard.clients[client]
+	if c == nil {
+		c = &scanClient{targets: make(map[string]time.Time)}
+		shard.clients[client] = c
+	}
+	limited := now.Before(c.until)
+	if !limited {
+		limited = d.record(c, client, target, now)
+	}
+	shard.mux.Unlock()
+
+	if !limited {
+		return true
+	}
+	if d.block {
+		return false
+	}
+	time.Sleep(d.window / time.Duration(d.threshold))
+	return true
+}
+
+// record records the target of the client, it reports whether the client exceeds the threshold.
+// It must be called with the lock of the shard held.
+func (d *ScanDetector) record(c *scanClient, client, target string, now time.Time) bool {
+	if _, ok := c.targets[target]; !ok {
+		for t, ts := range c.targets {
+			if now.Sub(ts) > d.window {
+				delete(c.targets, t)
+			}
+		}
+	}
+	c.targets[target] = now
+	if len(c.targets) <= d.threshold {
+		return false
+	}
+
+	c.until = now.Add(d.duration)
+	// the client is limited for the duration, the targets are not recorded until then.
+	c.targets = make(map[string]time.Time)
+	c.targets[target] = now
+	if d.block {
+		log.Logf("[scan] %s : %d distinct targets in %v, blocked for %v", client, d.threshold+1, d.window, d.duration)
+	} else {
+		log.Logf("[scan] %s : %d distinct targets in %v, throttled for %v", client, d.threshold+1, d.window, d.duration)
+	}
+	return true
+}
+
+// Blocked reports whether the client address is blocked or throttled currently.
+func (d *ScanDetector) Blocked(client string) bool {
+	if d == nil {
+		return false
+	}
+	client = scanClientIP(client)
+
+	shard := d.shard(client)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	c := shard.clients[client]
+	return c != nil && time.Now().Before(c.until)
+}
+
+func (d *ScanDetector) shard(client string) *scanShard {
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	return &d.shards[h.Sum32()%scanShards]
+}
+
+// sweep removes the idle clients of the shard periodically, it must be called with the lock of the shard held.
+func (d *ScanDetector) sweep(shard *scanShard, now time.Time) {
+	if now.Sub(shard.lastSweep) < d.window {
+		return
+	}
+	shard.lastSweep = now
+
+	for addr, c := range shard.clients {
+		if now.Before(c.until) {
+			continue
+		}
+		idle := true
+		for _, ts := range c.targets {
+			if now.Sub(ts) <= d.window {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(shard.clients, addr)
+		}
+	}
+}
+
+func scanClientIP(client string) string {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
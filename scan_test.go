@@ -0,0 +1,130 @@
+package gost
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScanDetector(t *testing.T) {
+	var detector *ScanDetector
+	if !detector.Allow("1.2.3.4:1000", "example.com:80") {
+		t.Error("nil detector should allow all connections")
+	}
+
+	detector = NewScanDetector(3, time.Minute, "block", time.Minute)
+	for i := 0; i < 10; i++ {
+		// the same target does not count.
+		if !detector.Allow("1.2.3.4:1000", "example.com:80") {
+			t.Fatal("the connections to the same target should be allowed")
+		}
+	}
+	for i := 1; i < 3; i++ {
+		if !detector.Allow(fmt.Sprintf("1.2.3.4:%d", 1000+i), fmt.Sprintf("example.com:%d", 80+i)) {
+			t.Fatalf("#%d target should be allowed", i)
+		}
+	}
+	if detector.Allow("1.2.3.4:2000", "example.com:1") {
+		t.Error("the client exceeding the threshold should be blocked")
+	}
+	if !detector.Blocked("1.2.3.4") {
+		t.Error("the client should be blocked")
+	}
+	if detector.Allow("1.2.3.4:2001", "example.com:80") {
+		t.Error("the blocked client should be blocked for all targets")
+	}
+	if !detector.Allow("5.6.7.8:1000", "example.com:1") {
+		t.Error("the other clients should not be affected")
+	}
+}
+
+func TestScanDetectorWindow(t *testing.T) {
+	detector := NewScanDetector(2, 100*time.Millisecond, "block", 100*time.Millisecond)
+	detector.Allow("1.2.3.4:1000", "example.com:1")
+	detector.Allow("1.2.3.4:1000", "example.com:2")
+	time.Sleep(150 * time.Millisecond)
+	if !detector.Allow("1.2.3.4:1000", "example.com:3") {
+		t.Error("the targets out of the window should not count")
+	}
+
+	detector.Allow("1.2.3.4:1000", "example.com:4")
+	if detector.Allow("1.2.3.4:1000", "example.com:5") {
+		t.Fatal("the client exceeding the threshold should be blocked")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !detector.Allow("1.2.3.4:1000", "example.com:6") {
+		t.Error("the client should be unblocked after the duration")
+	}
+}
+
+func TestScanDetectorLimitedNotRecorded(t *testing.T) {
+	detector := NewScanDetector(2, time.Minute, "block", time.Minute)
+	for i := 0; i < 100; i++ {
+		detector.Allow("1.2.3.4:1000", fmt.Sprintf("example.com:%d", i))
+	}
+	if !detector.Blocked("1.2.3.4") {
+		t.Fatal("the client should be blocked")
+	}
+
+	shard := detector.shard("1.2.3.4")
+	shard.mux.Lock()
+	n := len(shard.clients["1.2.3.4"].targets)
+	shard.mux.Unlock()
+	if n > 3 {
+		t.Errorf("the targets of the blocked client should not be recorded, got %d", n)
+	}
+}
+
+func TestScanDetectorThrottle(t *testing.T) {
+	detector := NewScanDetector(2, 200*time.Millisecond, "throttle", time.Minute)
+	detector.Allow("1.2.3.4:1000", "example.com:1")
+	detector.Allow("1.2.3.4:1000", "example.com:2")
+
+	start := time.Now()
+	if !detector.Allow("1.2.3.4:1000", "example.com:3") {
+		t.Error("the throttled client should be allowed")
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("the throttled connection should be delayed, got %v", d)
+	}
+}
+
+func TestScanDetectorProxy(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	detector := NewScanDetector(1, time.Minute, "block", time.Minute)
+	server := &Server{
+		Handler:  SOCKS5Handler(ScanDetectorHandlerOption(detector)),
+		Listener: ln,
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+
+	// another target exceeds the threshold.
+	httpSrv2 := httptest.NewServer(httpTestHandler)
+	defer httpSrv2.Close()
+	if err := proxyRoundtrip(client, server, httpSrv2.URL, sendData); err == nil {
+		t.Error("the scanning client should be blocked")
+	}
+}
@@ -79,6 +79,8 @@ func NewStrategy(s string) Strategy {
 		return &RandomStrategy{}
 	case "fifo":
 		return &FIFOStrategy{}
+	case "least":
+		return &LeastConnStrategy{}
 	case "round":
 		fallthrough
 	default:
@@ -156,6 +158,34 @@ func (s *FIFOStrategy) String() string {
 	return "fifo"
 }
 
+// LeastConnStrategy is a strategy for node selector.
+// The node with the least active connections will be selected,
+// the nodes with the same connections are selected by round-robin algorithm.
+type LeastConnStrategy struct {
+	counter uint64
+}
+
+// Apply applies the least-connections strategy for the nodes.
+func (s *LeastConnStrategy) Apply(nodes []Node) Node {
+	if len(nodes) == 0 {
+		return Node{}
+	}
+
+	offset := int((atomic.AddUint64(&s.counter, 1) - 1) % uint64(len(nodes)))
+	node := nodes[offset]
+	for i := 1; i < len(nodes); i++ {
+		n := nodes[(offset+i)%len(nodes)]
+		if n.marker.Conns() < node.marker.Conns() {
+			node = n
+		}
+	}
+	return node
+}
+
+func (s *LeastConnStrategy) String() string {
+	return "least"
+}
+
 // Filter is used to filter a node during the selection process
 type Filter interface {
 	Filter([]Node) []Node
@@ -164,15 +194,18 @@ type Filter interface {
 
 // default options for FailFilter
 const (
-	DefaultMaxFails    = 1
-	DefaultFailTimeout = 30 * time.Second
+	DefaultMaxFails       = 1
+	DefaultFailTimeout    = 30 * time.Second
+	DefaultMaxFailTimeout = 10 * time.Minute
 )
 
 // FailFilter filters the dead node.
 // A node is marked as dead if its failed count is greater than MaxFails.
+// The dead node is filtered for FailTimeout, which doubles on each further consecutive failure up to MaxFailTimeout.
 type FailFilter struct {
-	MaxFails    int
-	FailTimeout time.Duration
+	MaxFails       int
+	FailTimeout    time.Duration
+	MaxFailTimeout time.Duration
 }
 
 // Filter filters dead nodes.
@@ -185,6 +218,10 @@ func (f *FailFilter) Filter(nodes []Node) []Node {
 	if failTimeout == 0 {
 		failTimeout = DefaultFailTimeout
 	}
+	maxFailTimeout := f.MaxFailTimeout
+	if maxFailTimeout == 0 {
+		maxFailTimeout = DefaultMaxFailTimeout
+	}
 
 	if len(nodes) <= 1 || maxFails < 0 {
 		return nodes
@@ -194,13 +231,25 @@ func (f *FailFilter) Filter(nodes []Node) []Node {
 		marker := nodes[i].marker.Clone()
 		// log.Logf("%s: %d/%d %v/%v", nodes[i], marker.FailCount(), f.MaxFails, marker.FailTime(), f.FailTimeout)
 		if marker.FailCount() < uint32(maxFails) ||
-			time.Since(time.Unix(marker.FailTime(), 0)) >= failTimeout {
+			time.Since(time.Unix(marker.FailTime(), 0)) >= backoff(failTimeout, maxFailTimeout, marker.FailCount()-uint32(maxFails)) {
 			nl = append(nl, nodes[i])
 		}
 	}
 	return nl
 }
 
+// backoff returns the timeout doubled n times, which does not exceed max unless the timeout does.
+func backoff(timeout, max time.Duration, n uint32) time.Duration {
+	d := timeout
+	for ; n > 0 && d < max; n-- {
+		d *= 2
+	}
+	if d > max && timeout < max {
+		d = max
+	}
+	return d
+}
+
 func (f *FailFilter) String() string {
 	return "fail"
 }
@@ -225,9 +274,15 @@ func (f *InvalidFilter) String() string {
 	return "invalid"
 }
 
+// failMarker holds the status of a node shared by its copies:
+// the consecutive failures, the total failures, the active connections and their traffic.
 type failMarker struct {
 	failTime  int64
 	failCount uint32
+	fails     uint64
+	conns     int64
+	in, out   int64
+	dials     histogram
 	mux       sync.RWMutex
 }
 
@@ -263,6 +318,57 @@ func (m *failMarker) Mark() {
 
 	m.failTime = time.Now().Unix()
 	m.failCount++
+	m.fails++
+}
+
+// Fails returns the total failures.
+func (m *failMarker) Fails() uint64 {
+	if m == nil {
+		return 0
+	}
+
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	return m.fails
+}
+
+// Conns returns the active connections.
+func (m *failMarker) Conns() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.conns)
+}
+
+func (m *failMarker) addConns(n int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.conns, n)
+}
+
+// Bytes returns the bytes received from and sent to the connections through the node.
+func (m *failMarker) Bytes() (in, out int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.in), atomic.LoadInt64(&m.out)
+}
+
+func (m *failMarker) addBytes(in, out int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.in, in)
+	atomic.AddInt64(&m.out, out)
+}
+
+func (m *failMarker) observeDial(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.dials.observe(d)
 }
 
 func (m *failMarker) Reset() {
@@ -285,10 +391,11 @@ func (m *failMarker) Clone() *failMarker {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 
-	fc, ft := m.failCount, m.failTime
+	fc, ft, fs := m.failCount, m.failTime, m.fails
 
 	return &failMarker{
 		failCount: fc,
 		failTime:  ft,
+		fails:     fs,
 	}
 }
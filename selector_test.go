@@ -149,3 +149,78 @@ func TestSelector(t *testing.T) {
 		t.Error("unexpected node:", node)
 	}
 }
+
+func TestLeastConnStrategy(t *testing.T) {
+	nodes := []Node{
+		Node{ID: 1, marker: &failMarker{}},
+		Node{ID: 2, marker: &failMarker{}},
+		Node{ID: 3, marker: &failMarker{}},
+	}
+	s := NewStrategy("least")
+	t.Log(s.String())
+
+	nodes[0].marker.addConns(2)
+	nodes[1].marker.addConns(1)
+	nodes[2].marker.addConns(1)
+	seen := make(map[int]bool)
+	for i := 0; i < len(nodes); i++ {
+		node := s.Apply(nodes)
+		if node.ID == 1 {
+			t.Error("unexpected node", node.ID)
+		}
+		seen[node.ID] = true
+	}
+	if !seen[2] || !seen[3] {
+		t.Error("the nodes with the least connections should be selected in turn", seen)
+	}
+
+	nodes[2].marker.addConns(-1)
+	for i := 0; i < len(nodes); i++ {
+		if node := s.Apply(nodes); node.ID != 3 {
+			t.Error("unexpected node", node.ID)
+		}
+	}
+}
+
+func TestFailFilterBackoff(t *testing.T) {
+	for i, tc := range []struct {
+		timeout, max time.Duration
+		n            uint32
+		result       time.Duration
+	}{
+		{30 * time.Second, 10 * time.Minute, 0, 30 * time.Second},
+		{30 * time.Second, 10 * time.Minute, 1, 60 * time.Second},
+		{30 * time.Second, 10 * time.Minute, 4, 8 * time.Minute},
+		{30 * time.Second, 10 * time.Minute, 5, 10 * time.Minute},
+		{30 * time.Second, 10 * time.Minute, 100, 10 * time.Minute},
+		{30 * time.Second, 30 * time.Second, 3, 30 * time.Second},
+		{time.Hour, 10 * time.Minute, 3, time.Hour},
+	} {
+		if d := backoff(tc.timeout, tc.max, tc.n); d != tc.result {
+			t.Errorf("#%d: backoff should be %v, got %v", i, tc.result, d)
+		}
+	}
+
+	nodes := []Node{
+		Node{ID: 1, marker: &failMarker{}},
+		Node{ID: 2, marker: &failMarker{}},
+	}
+	filter := &FailFilter{FailTimeout: 10 * time.Second}
+	nodes[0].MarkDead()
+	nodes[0].MarkDead()
+	nodes[0].marker.failTime = time.Now().Add(-15 * time.Second).Unix()
+	if v := filter.Filter(nodes); len(v) != 1 || v[0].ID != 2 {
+		t.Error("the node should be dead for 20s after 2 fails", v)
+	}
+	nodes[0].marker.failTime = time.Now().Add(-25 * time.Second).Unix()
+	if v := filter.Filter(nodes); len(v) != 2 {
+		t.Error("the node should be alive after 20s", v)
+	}
+	if fails := nodes[0].marker.Fails(); fails != 2 {
+		t.Errorf("total fails should be 2, got %d", fails)
+	}
+	nodes[0].ResetDead()
+	if fails := nodes[0].marker.Fails(); fails != 2 {
+		t.Errorf("total fails should be kept after reset, got %d", fails)
+	}
+}
@@ -1,8 +1,13 @@
 package gost
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-log/log"
@@ -18,6 +23,9 @@ type Server struct {
 	Listener Listener
 	Handler  Handler
 	options  *ServerOptions
+	active   sync.WaitGroup
+	conns    int64
+	mux      sync.RWMutex // guards the Listener replaced by SetListener
 }
 
 // Init intializes server with given options.
@@ -32,24 +40,65 @@ func (s *Server) Init(opts ...ServerOption) {
 
 // Addr returns the address of the server
 func (s *Server) Addr() net.Addr {
-	return s.Listener.Addr()
+	return s.listener().Addr()
 }
 
 // Close closes the server
 func (s *Server) Close() error {
-	return s.Listener.Close()
+	return s.listener().Close()
+}
+
+// SetListener replaces the listener of the server, such as the one rebound after the old listener dies.
+// It is safe for concurrent use with Addr, Close and Shutdown.
+func (s *Server) SetListener(ln Listener) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.Listener = ln
+}
+
+func (s *Server) listener() Listener {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.Listener
+}
+
+// Conns returns the connections being handled.
+func (s *Server) Conns() int64 {
+	return atomic.LoadInt64(&s.conns)
+}
+
+// Shutdown closes the listener, then waits for the connections being handled to finish until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Serve serves as a proxy server.
 func (s *Server) Serve(h Handler, opts ...ServerOption) error {
 	s.Init(opts...)
 
-	if s.Listener == nil {
+	l := s.listener()
+	if l == nil {
 		ln, err := TCPListener("")
 		if err != nil {
 			return err
 		}
-		s.Listener = ln
+		s.SetListener(ln)
+		l = ln
 	}
 
 	if h == nil {
@@ -59,7 +108,6 @@ func (s *Server) Serve(h Handler, opts ...ServerOption) error {
 		h = HTTPHandler()
 	}
 
-	l := s.Listener
 	var tempDelay time.Duration
 	for {
 		conn, e := l.Accept()
@@ -89,7 +137,13 @@ func (s *Server) Serve(h Handler, opts ...ServerOption) error {
 			}
 		*/
 
-		go h.Handle(conn)
+		s.active.Add(1)
+		atomic.AddInt64(&s.conns, 1)
+		go func() {
+			defer s.active.Done()
+			defer atomic.AddInt64(&s.conns, -1)
+			h.Handle(conn)
+		}()
 	}
 }
 
@@ -98,6 +152,12 @@ func (s *Server) Run() error {
 	return s.Serve(s.Handler)
 }
 
+// Serve serves the handler h on the standard listener ln, such as the one created by net.Listen.
+func Serve(ln net.Listener, h Handler) error {
+	s := &Server{Listener: ln}
+	return s.Serve(h)
+}
+
 // ServerOptions holds the options for Server.
 type ServerOptions struct {
 }
@@ -141,27 +201,104 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-func transport(rw1, rw2 io.ReadWriter) error {
-	errc := make(chan error, 1)
-	go func() {
-		buf := lPool.Get().([]byte)
-		defer lPool.Put(buf)
+// errHalfClosed indicates that one direction of the transport is finished and the write side of its destination is closed.
+var errHalfClosed = errors.New("half closed")
 
-		_, err := io.CopyBuffer(rw1, rw2, buf)
-		errc <- err
-	}()
+type closeWriter interface {
+	CloseWrite() error
+}
 
-	go func() {
+// transport relays the data between rw1 and rw2 until one direction is finished.
+// If the destination of the finished direction supports half-close, such as *net.TCPConn,
+// its write side is closed and the other direction is relayed until it is finished too.
+func transport(rw1, rw2 io.ReadWriter) error {
+	if c := getPacketCapture(); c != nil {
+		rw1, rw2 = c.capture(rw1, rw2)
+	}
+
+	errc := make(chan error, 2)
+	relay := func(dst, src io.ReadWriter) {
 		buf := lPool.Get().([]byte)
 		defer lPool.Put(buf)
 
-		_, err := io.CopyBuffer(rw2, rw1, buf)
+		_, err := copyBuffer(dst, src, buf)
+		captureClose(dst)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			if cw.CloseWrite() == nil {
+				err = errHalfClosed
+			}
+		}
 		errc <- err
-	}()
+	}
+	go relay(rw1, rw2)
+	go relay(rw2, rw1)
 
 	err := <-errc
-	if err != nil && err == io.EOF {
+	if err == errHalfClosed {
+		err = <-errc
+	}
+	if err == errHalfClosed || err == io.EOF {
 		err = nil
 	}
 	return err
 }
+
+// spliceChunkSize is the maximum bytes spliced at once, the counters of the connections are updated after each chunk.
+const spliceChunkSize = 1 << 20
+
+// spliceCounter is implemented by the connection wrappers which only count the bytes read and written,
+// they are bypassed by the relay between two TCP connections to splice the data in the kernel,
+// and the spliced bytes are added to them instead.
+type spliceCounter interface {
+	unwrap() net.Conn
+	addSpliced(read, written int64)
+}
+
+// spliceConn returns the TCP connection under the counters of rw, or nil if rw is not a TCP connection
+// or it is wrapped by the ones which process the data. The buffered connection is bypassed only
+// if it is the source src of the relay, which is read by the relay alone, and its buffer is drained.
+func spliceConn(rw io.ReadWriter, src bool) (*net.TCPConn, []spliceCounter) {
+	var counters []spliceCounter
+	for {
+		switch c := rw.(type) {
+		case *net.TCPConn:
+			return c, counters
+		case *bufferdConn:
+			if !src || c.br.Buffered() > 0 {
+				return nil, nil
+			}
+			rw = c.Conn
+		case spliceCounter:
+			counters = append(counters, c)
+			rw = c.unwrap()
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// copyBuffer copies from src to dst until EOF. The data is spliced if both are TCP connections on Linux,
+// otherwise it is copied through the buffer buf, instead of the buffer allocated by the io.ReaderFrom
+// or io.WriterTo of *net.TCPConn.
+func copyBuffer(dst, src io.ReadWriter, buf []byte) (written int64, err error) {
+	if runtime.GOOS == "linux" {
+		if d, dcs := spliceConn(dst, false); d != nil {
+			if s, scs := spliceConn(src, true); s != nil {
+				for {
+					n, err := d.ReadFrom(&io.LimitedReader{R: s, N: spliceChunkSize})
+					for _, c := range scs {
+						c.addSpliced(n, 0)
+					}
+					for _, c := range dcs {
+						c.addSpliced(0, n)
+					}
+					written += n
+					if err != nil || n < spliceChunkSize {
+						return written, err
+					}
+				}
+			}
+		}
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
@@ -0,0 +1,182 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type blockingHandler chan struct{}
+
+func (h blockingHandler) Init(...HandlerOption) {}
+
+func (h blockingHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+	<-h
+}
+
+func TestServerShutdown(t *testing.T) {
+	h := make(blockingHandler)
+	server := &Server{Listener: mustTCPListener(t), Handler: h}
+	go server.Run()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; server.Conns() != 1; i++ {
+		if i > 100 {
+			t.Fatal("connection should be handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown should wait for the active connection, got %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", server.Addr().String(), time.Second); err == nil {
+		t.Error("listener should be closed")
+	}
+
+	close(h)
+	server.Shutdown(context.Background()) // the error of closing the closed listener is ignored.
+	if n := server.Conns(); n != 0 {
+		t.Errorf("connections should be drained, got %d", n)
+	}
+}
+
+// tcpPair returns the both ends of a TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+func TestCopyBuffer(t *testing.T) {
+	data := make([]byte, 3*spliceChunkSize+100)
+	rand.Read(data)
+
+	for i, wrap := range []func(net.Conn) net.Conn{
+		func(c net.Conn) net.Conn { return c },
+		// the counters are bypassed by the splice.
+		func(c net.Conn) net.Conn {
+			return &metricsConn{Conn: &trafficConn{Conn: c}, counter: &serviceCounter{}, once: &sync.Once{}}
+		},
+		// the data is copied through the buffer.
+		func(c net.Conn) net.Conn { return (&RateLimits{ConnRate: 1 << 30}).Conn(c) },
+	} {
+		src, peer1 := tcpPair(t)
+		dst, peer2 := tcpPair(t)
+
+		go func() {
+			peer1.Write(data)
+			peer1.Close()
+		}()
+		received := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(peer2)
+			received <- b
+		}()
+
+		wsrc, wdst := wrap(src), wrap(dst)
+		n, err := copyBuffer(wdst, wsrc, make([]byte, largeBufferSize))
+		if err != nil || n != int64(len(data)) {
+			t.Errorf("#%d copied %d bytes, %v", i, n, err)
+		}
+		dst.CloseWrite()
+		if b := <-received; !bytes.Equal(b, data) {
+			t.Errorf("#%d received %d bytes, the data mismatches", i, len(b))
+		}
+		if mc, ok := wsrc.(*metricsConn); ok {
+			if in := atomic.LoadInt64(&mc.counter.in); in != int64(len(data)) {
+				t.Errorf("#%d the spliced bytes should be counted, got %d", i, in)
+			}
+			if tc := mc.Conn.(*trafficConn); tc.in != int64(len(data)) {
+				t.Errorf("#%d the spliced bytes should be counted by the traffic, got %d", i, tc.in)
+			}
+			if out := atomic.LoadInt64(&wdst.(*metricsConn).counter.out); out != int64(len(data)) {
+				t.Errorf("#%d the spliced bytes should be counted, got %d", i, out)
+			}
+		}
+
+		src.Close()
+		dst.Close()
+		peer2.Close()
+	}
+}
+
+func TestSpliceConn(t *testing.T) {
+	c1, c2 := tcpPair(t)
+	defer c1.Close()
+	defer c2.Close()
+
+	if c, _ := spliceConn(&bufferdConn{Conn: &trafficConn{Conn: c1}, br: bufio.NewReader(c1)}, true); c != c1 {
+		t.Error("the connection with the empty buffer should be spliced")
+	}
+
+	if c, _ := spliceConn(&bufferdConn{Conn: c1, br: bufio.NewReader(c1)}, false); c != nil {
+		t.Error("the buffered connection should not be spliced as the destination")
+	}
+
+	c2.Write([]byte("hello"))
+	br := bufio.NewReader(c1)
+	br.Peek(1)
+	if c, _ := spliceConn(&bufferdConn{Conn: c1, br: br}, true); c != nil {
+		t.Error("the buffered data should be read at first")
+	}
+	if c, _ := spliceConn(newIdleConn(c1, time.Minute), true); c != nil {
+		t.Error("the connection which processes the data should not be spliced")
+	}
+}
+
+// TestTransportBufferdConn relays the buffered connection in both directions at the same time,
+// its buffer must not be touched by the other direction, run it with -race.
+func TestTransportBufferdConn(t *testing.T) {
+	c1, peer1 := tcpPair(t)
+	c2, peer2 := tcpPair(t)
+	defer peer1.Close()
+	defer peer2.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go peer1.Write(data)
+	go io.Copy(peer2, peer2) // echo
+
+	br := bufio.NewReader(c1)
+	br.Peek(1)
+	go func() {
+		// the direction to the idle connection is copied through the buffer of the buffered connection.
+		transport(&bufferdConn{Conn: c1, br: br}, newIdleConn(c2, time.Minute))
+		c1.Close()
+		c2.Close()
+	}()
+
+	b := make([]byte, len(data))
+	peer1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer1, b); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("the echoed data mismatches: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package gost
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session is an active session relayed by a service from the client to the target.
+type Session struct {
+	ID       string    `json:"id"` // the connection ID tagging the logs of the session if any
+	Service  string    `json:"service"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	BytesIn  int64     `json:"bytes_in"`  // the bytes received from the client
+	BytesOut int64     `json:"bytes_out"` // the bytes sent to the client
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // in seconds
+}
+
+type session struct {
+	Session
+	in, out int64
+	conns   []net.Conn
+}
+
+// Sessions tracks the active sessions of the services, the sessions can be listed and killed at runtime.
+type Sessions struct {
+	sessions map[string]*session
+	mux      sync.RWMutex
+}
+
+// NewSessions creates a Sessions.
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*session),
+	}
+}
+
+// List returns the active sessions, sorted by the start time.
+func (s *Sessions) List() []Session {
+	if s == nil {
+		return nil
+	}
+	now := time.Now()
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	sessions := []Session{}
+	for _, ss := range s.sessions {
+		v := ss.Session
+		v.BytesIn = atomic.LoadInt64(&ss.in)
+		v.BytesOut = atomic.LoadInt64(&ss.out)
+		v.Duration = now.Sub(v.Start).Seconds()
+		sessions = append(sessions, v)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Start.Equal(sessions[j].Start) {
+			return sessions[i].Start.Before(sessions[j].Start)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Kill closes the session of the id, it reports whether the session is found.
+func (s *Sessions) Kill(id string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mux.RLock()
+	ss := s.sessions[id]
+	s.mux.RUnlock()
+
+	if ss == nil {
+		return false
+	}
+	for _, c := range ss.conns {
+		c.Close()
+	}
+	return true
+}
+
+// Conn tracks the session of the connection cc from the client conn to the target addr,
+// the session is ended once the returned connection is closed.
+// The id is the connection ID of the session, a random one is used if it is empty.
+func (s *Sessions) Conn(conn, cc net.Conn, id, service, addr string) net.Conn {
+	if s == nil {
+		return cc
+	}
+
+	ss := &session{
+		Session: Session{
+			Service: service,
+			Client:  conn.RemoteAddr().String(),
+			Target:  addr,
+			Start:   time.Now(),
+		},
+		conns: []net.Conn{conn, cc},
+	}
+
+	s.mux.Lock()
+	for id == "" || s.sessions[id] != nil {
+		id = newConnID()
+	}
+	ss.ID = id
+	s.sessions[id] = ss
+	s.mux.Unlock()
+
+	return &sessionConn{Conn: cc, session: ss, sessions: s}
+}
+
+func (s *Sessions) remove(ss *session) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.sessions[ss.ID] == ss {
+		delete(s.sessions, ss.ID)
+	}
+}
+
+// sessionConn is the connection to the target of the session.
+type sessionConn struct {
+	net.Conn
+	session  *session
+	sessions *Sessions
+	once     sync.Once
+}
+
+func (c *sessionConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.session.out, int64(n))
+	return
+}
+
+func (c *sessionConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.session.in, int64(n))
+	return
+}
+
+func (c *sessionConn) Close() error {
+	c.once.Do(func() {
+		c.sessions.remove(c.session)
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the connection if it supports half-close.
+func (c *sessionConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+func (c *sessionConn) addSpliced(read, written int64) {
+	atomic.AddInt64(&c.session.out, read)
+	atomic.AddInt64(&c.session.in, written)
+}
+
+func (c *sessionConn) unwrap() net.Conn {
+	return c.Conn
+}
@@ -61,7 +61,7 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	br := bufio.NewReader(conn)
 	hdr, err := br.Peek(dissector.RecordHeaderLen)
 	if err != nil {
-		log.Logf("[sni] %s -> %s : %s",
+		h.options.Logger.Logf("[sni] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
@@ -69,12 +69,14 @@ func (h *sniHandler) Handle(conn net.Conn) {
 
 	if hdr[0] != dissector.Handshake {
 		// We assume it is an HTTP request
-		req, err := http.ReadRequest(bufio.NewReader(conn))
+		hr := bufio.NewReader(conn)
+		req, err := http.ReadRequest(hr)
 		if err != nil {
-			log.Logf("[sni] %s -> %s : %s",
+			h.options.Logger.Logf("[sni] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			return
 		}
+		conn = &bufferdConn{br: hr, Conn: conn}
 		if !req.URL.IsAbs() {
 			req.URL.Scheme = "http" // make sure that the URL is absolute
 		}
@@ -86,7 +88,7 @@ func (h *sniHandler) Handle(conn net.Conn) {
 
 	b, host, err := readClientHelloRecord(conn, "", false)
 	if err != nil {
-		log.Logf("[sni] %s -> %s : %s",
+		h.options.Logger.Logf("[sni] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
@@ -97,16 +99,17 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	}
 	host = net.JoinHostPort(host, sport)
 
-	log.Logf("[sni] %s -> %s -> %s",
+	h.options.Logger.Logf("[sni] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[sni] %s -> %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, conn.RemoteAddr().String(), host, PeerIdentities(conn)...) {
+		h.options.Logger.Logf("[sni] %s -> %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
 	}
 	if h.options.Bypass.Contains(host) {
-		log.Log("[sni] %s - %s bypass %s",
+		h.options.Logger.Logf("[sni] %s - %s bypass %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
 	}
@@ -124,7 +127,7 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(host)
 		if err != nil {
-			log.Logf("[sni] %s -> %s : %s",
+			h.options.Logger.Logf("[sni] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
@@ -136,33 +139,35 @@ func (h *sniHandler) Handle(conn net.Conn) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", host)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		cc, err = route.Dial(host,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, conn.RemoteAddr().String())),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[sni] %s -> %s : %s",
+		h.options.Logger.Logf("[sni] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
 	if err != nil {
 		return
 	}
+	cc = relayConn(h.options, conn, cc, host)
 	defer cc.Close()
 
 	if _, err := cc.Write(b); err != nil {
-		log.Logf("[sni] %s -> %s : %s",
+		h.options.Logger.Logf("[sni] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
-	log.Logf("[sni] %s <-> %s", cc.LocalAddr(), host)
+	h.options.Logger.Logf("[sni] %s <-> %s", cc.LocalAddr(), host)
 	transport(conn, cc)
-	log.Logf("[sni] %s >-< %s", cc.LocalAddr(), host)
+	h.options.Logger.Logf("[sni] %s >-< %s", cc.LocalAddr(), host)
 }
 
 // sniSniffConn is a net.Conn that reads from r, fails on Writes,
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -146,3 +147,47 @@ func TestSNIProxy(t *testing.T) {
 		})
 	}
 }
+
+func TestSNIProxyHTTPKeepAlive(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer httpSrv.Close()
+	u, _ := url.Parse(httpSrv.URL)
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  SNIHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the origin-form requests are sent on the same connection.
+	br := bufio.NewReader(conn)
+	for i, path := range []string{"/first", "/second", "/third"} {
+		req, _ := http.NewRequest(http.MethodGet, httpSrv.URL+path, nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("#%d %v", i, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "GET "+path {
+			t.Errorf("#%d %s %s: status %d, got %q", i, u.Host, path, resp.StatusCode, b)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package gost
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"errors"
@@ -9,7 +10,9 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ginuerzh/gosocks4"
@@ -33,6 +36,12 @@ const (
 	CmdMuxBind uint8 = 0xF2
 	// CmdUDPTun is an extended SOCKS5 request CMD for UDP over TCP.
 	CmdUDPTun uint8 = 0xF3
+	// CmdSecretBind is an extended SOCKS5 request CMD for
+	// registering a multiplexed secret tunnel, which is not exposed publicly.
+	CmdSecretBind uint8 = 0xF4
+	// CmdSecretConnect is an extended SOCKS5 request CMD for
+	// connecting to a secret tunnel by name.
+	CmdSecretConnect uint8 = 0xF5
 )
 
 type clientSelector struct {
@@ -100,6 +109,8 @@ type serverSelector struct {
 	// Users     []*url.Userinfo
 	Authenticator Authenticator
 	TLSConfig     *tls.Config
+	Banner        *Banner
+	Logger        *ServiceLogger
 }
 
 func (selector *serverSelector) Methods() []uint8 {
@@ -111,8 +122,8 @@ func (selector *serverSelector) AddMethod(methods ...uint8) {
 }
 
 func (selector *serverSelector) Select(methods ...uint8) (method uint8) {
-	if Debug {
-		log.Logf("[socks5] %d %d %v", gosocks5.Ver5, len(methods), methods)
+	if selector.Logger.Debug() {
+		selector.Logger.Logf("[socks5] %d %d %v", gosocks5.Ver5, len(methods), methods)
 	}
 	method = gosocks5.MethodNoAuth
 	for _, m := range methods {
@@ -136,47 +147,53 @@ func (selector *serverSelector) Select(methods ...uint8) (method uint8) {
 }
 
 func (selector *serverSelector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
-	if Debug {
-		log.Logf("[socks5] %d %d", gosocks5.Ver5, method)
+	if selector.Logger.Debug() {
+		selector.Logger.Logf("[socks5] %d %d", gosocks5.Ver5, method)
 	}
 	switch method {
 	case MethodTLS:
 		conn = tls.Server(conn, selector.TLSConfig)
 
 	case gosocks5.MethodUserPass, MethodTLSAuth:
+		raw := conn
 		if method == MethodTLSAuth {
 			conn = tls.Server(conn, selector.TLSConfig)
 		}
 
 		req, err := gosocks5.ReadUserPassRequest(conn)
 		if err != nil {
-			log.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			selector.Logger.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 			return nil, err
 		}
-		if Debug {
-			log.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), req.String())
+		if selector.Logger.Debug() {
+			selector.Logger.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), req.String())
 		}
 
 		if selector.Authenticator != nil && !selector.Authenticator.Authenticate(req.Username, req.Password) {
 			resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Failure)
 			if err := resp.Write(conn); err != nil {
-				log.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+				selector.Logger.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 				return nil, err
 			}
-			if Debug {
-				log.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), resp)
+			if selector.Logger.Debug() {
+				selector.Logger.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), resp)
 			}
-			log.Logf("[socks5] %s - %s: proxy authentication required", conn.RemoteAddr(), conn.LocalAddr())
+			selector.Logger.Warnf("[socks5] %s - %s: proxy authentication required", conn.RemoteAddr(), conn.LocalAddr())
+			selector.Banner.Fail(conn.RemoteAddr().String())
 			return nil, gosocks5.ErrAuthFailure
 		}
 
 		resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Succeeded)
 		if err := resp.Write(conn); err != nil {
-			log.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			selector.Logger.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 			return nil, err
 		}
-		if Debug {
-			log.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), resp)
+		if selector.Authenticator != nil {
+			setTrafficUser(raw, req.Username)
+			setRateLimitUser(raw, req.Username)
+		}
+		if selector.Logger.Debug() {
+			selector.Logger.Logf("[socks5] %s - %s: %s", conn.RemoteAddr(), conn.LocalAddr(), resp)
 		}
 	case gosocks5.MethodNoAcceptable:
 		return nil, gosocks5.ErrBadMethod
@@ -219,16 +236,14 @@ func (c *socks5Connector) Connect(conn net.Conn, addr string, options ...Connect
 	}
 	conn = cc
 
-	host, port, err := net.SplitHostPort(addr)
+	if addr, err = toASCIIAddr(addr); err != nil {
+		return nil, err
+	}
+	socksAddr, err := newSocks5Addr(addr)
 	if err != nil {
 		return nil, err
 	}
-	p, _ := strconv.Atoi(port)
-	req := gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{
-		Type: gosocks5.AddrDomain,
-		Host: host,
-		Port: uint16(p),
-	})
+	req := gosocks5.NewRequest(gosocks5.CmdConnect, socksAddr)
 	if err := req.Write(conn); err != nil {
 		return nil, err
 	}
@@ -247,12 +262,52 @@ func (c *socks5Connector) Connect(conn net.Conn, addr string, options ...Connect
 	}
 
 	if reply.Rep != gosocks5.Succeeded {
-		return nil, errors.New("Service unavailable")
+		detail := readSOCKS5ErrorDetail(conn)
+		if detail != "" {
+			log.Logf("[socks5] %s -> %s : %s", conn.LocalAddr(), addr, detail)
+		}
+		return nil, &ReplyError{Protocol: "socks5", Code: int(reply.Rep), Msg: "Service unavailable", Detail: detail}
 	}
 
 	return conn, nil
 }
 
+const (
+	socks5ErrorDetailMagic   = "GOSTERR"
+	socks5ErrorDetailTimeout = 500 * time.Millisecond
+)
+
+// writeSOCKS5ErrorDetail writes the error detail trailer: the magic, the 1-byte length and the detail.
+func writeSOCKS5ErrorDetail(w io.Writer, detail string) error {
+	if len(detail) > 255 {
+		detail = detail[:255]
+	}
+	b := make([]byte, 0, len(socks5ErrorDetailMagic)+1+len(detail))
+	b = append(b, socks5ErrorDetailMagic...)
+	b = append(b, byte(len(detail)))
+	b = append(b, detail...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readSOCKS5ErrorDetail reads the error detail trailer after the failure reply.
+// The server closes the connection after the failure reply, so it does not block the client for long
+// if the server does not support the extension.
+func readSOCKS5ErrorDetail(conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(socks5ErrorDetailTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, len(socks5ErrorDetailMagic)+1)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b[:len(socks5ErrorDetailMagic)]) != socks5ErrorDetailMagic {
+		return ""
+	}
+	detail := make([]byte, b[len(b)-1])
+	if _, err := io.ReadFull(conn, detail); err != nil {
+		return ""
+	}
+	return string(detail)
+}
+
 type socks5BindConnector struct {
 	User *url.Userinfo
 }
@@ -380,11 +435,7 @@ func (tr *socks5MuxBindTransporter) Dial(addr string, options ...DialOption) (co
 		ok = false
 	}
 	if !ok {
-		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
-		} else {
-			conn, err = opts.Chain.Dial(addr)
-		}
+		conn, err = opts.dial(addr, timeout)
 		if err != nil {
 			return
 		}
@@ -639,6 +690,14 @@ func (c *socks5UDPTunConnector) Connect(conn net.Conn, addr string, options ...C
 	return &udpTunnelConn{Conn: conn, raddr: taddr.String()}, nil
 }
 
+// socks4Userid returns the user ID field of the SOCKS4(A) request, which is the name of the user.
+func socks4Userid(user *url.Userinfo) []byte {
+	if user == nil || user.Username() == "" {
+		return nil
+	}
+	return []byte(user.Username())
+}
+
 type socks4Connector struct{}
 
 // SOCKS4Connector creates a Connector for SOCKS4 proxy client.
@@ -673,7 +732,7 @@ func (c *socks4Connector) Connect(conn net.Conn, addr string, options ...Connect
 			Type: gosocks4.AddrIPv4,
 			Host: taddr.IP.String(),
 			Port: uint16(taddr.Port),
-		}, nil,
+		}, socks4Userid(opts.User),
 	)
 	if err := req.Write(conn); err != nil {
 		return nil, err
@@ -693,7 +752,7 @@ func (c *socks4Connector) Connect(conn net.Conn, addr string, options ...Connect
 	}
 
 	if reply.Code != gosocks4.Granted {
-		return nil, fmt.Errorf("[socks4] %d", reply.Code)
+		return nil, &ReplyError{Protocol: "socks4", Code: int(reply.Code), Msg: fmt.Sprintf("[socks4] %d", reply.Code)}
 	}
 
 	return conn, nil
@@ -720,6 +779,10 @@ func (c *socks4aConnector) Connect(conn net.Conn, addr string, options ...Connec
 	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{})
 
+	addr, err := toASCIIAddr(addr)
+	if err != nil {
+		return nil, err
+	}
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -727,7 +790,7 @@ func (c *socks4aConnector) Connect(conn net.Conn, addr string, options ...Connec
 	p, _ := strconv.Atoi(port)
 
 	req := gosocks4.NewRequest(gosocks4.CmdConnect,
-		&gosocks4.Addr{Type: gosocks4.AddrDomain, Host: host, Port: uint16(p)}, nil)
+		&gosocks4.Addr{Type: gosocks4.AddrDomain, Host: host, Port: uint16(p)}, socks4Userid(opts.User))
 	if err := req.Write(conn); err != nil {
 		return nil, err
 	}
@@ -746,7 +809,7 @@ func (c *socks4aConnector) Connect(conn net.Conn, addr string, options ...Connec
 	}
 
 	if reply.Code != gosocks4.Granted {
-		return nil, fmt.Errorf("[socks4a] %d", reply.Code)
+		return nil, &ReplyError{Protocol: "socks4a", Code: int(reply.Code), Msg: fmt.Sprintf("[socks4a] %d", reply.Code)}
 	}
 
 	return conn, nil
@@ -755,6 +818,20 @@ func (c *socks4aConnector) Connect(conn net.Conn, addr string, options ...Connec
 type socks5Handler struct {
 	selector *serverSelector
 	options  *HandlerOptions
+	ids      []string   // the identities of the client of the session
+	idle     *idleTimer // the idle timer of the client connection of the session
+}
+
+// session returns a copy of the handler serving a connection, whose logs are tagged with a new connection ID.
+func (h *socks5Handler) session() *socks5Handler {
+	opts := *h.options
+	opts.Logger = h.options.Logger.WithConn(newConnID())
+	selector := *h.selector
+	selector.Logger = opts.Logger
+	return &socks5Handler{
+		selector: &selector,
+		options:  &opts,
+	}
 }
 
 // SOCKS5Handler creates a server Handler for SOCKS5 proxy server.
@@ -782,6 +859,8 @@ func (h *socks5Handler) Init(options ...HandlerOption) {
 		// Users:     h.options.Users,
 		Authenticator: h.options.Authenticator,
 		TLSConfig:     tlsConfig,
+		Banner:        h.options.Banner,
+		Logger:        h.options.Logger,
 	}
 	// methods that socks5 server supported
 	h.selector.AddMethod(
@@ -795,16 +874,53 @@ func (h *socks5Handler) Init(options ...HandlerOption) {
 func (h *socks5Handler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	conn = gosocks5.ServerConn(conn, h.selector)
-	req, err := gosocks5.ReadRequest(conn)
+	// the negotiation is aborted if the client stalls.
+	conn.SetDeadline(time.Now().Add(h.options.handshakeTimeout()))
+
+	h = h.session()
+
+	// the legacy SOCKS4(A) clients are served on the same listener,
+	// unless the authentication is required, which SOCKS4(A) does not support.
+	br := bufio.NewReader(conn)
+	if b, err := br.Peek(1); err == nil && b[0] == gosocks4.Ver4 {
+		cc := &bufferdConn{Conn: conn, br: br}
+		if h.options.Authenticator != nil {
+			h.options.Logger.Logf("[socks5] %s - %s : SOCKS4 request rejected, authentication required",
+				conn.RemoteAddr(), conn.LocalAddr())
+			gosocks4.NewReply(gosocks4.RejectedUserid, nil).Write(cc)
+			return
+		}
+		(&socks4Handler{options: h.options}).Handle(cc)
+		return
+	}
+	conn = &bufferdConn{Conn: conn, br: br}
+
+	h.ids = PeerIdentities(conn)
+	h.idle = idleTimerOf(conn)
+	conn = gosocks5.ServerConn(h.options.Traffic.ServiceConn(conn, h.options.Name), h.selector)
+	req, cc, deviations, err := readSOCKS5Request(conn, h.options.Validator)
 	if err != nil {
-		log.Logf("[socks5] %s -> %s : %s",
-			conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Warnf("[socks5] %s -> %s : %s %v",
+			conn.RemoteAddr(), conn.LocalAddr(), err, deviations)
 		return
 	}
+	if h.options.Logger.Debug() && len(deviations) > 0 {
+		counts := h.options.Validator.Counts()
+		for _, d := range deviations {
+			h.options.Logger.Logf("[socks5] %s -> %s : tolerated deviation %s (%d)",
+				conn.RemoteAddr(), conn.LocalAddr(), d, counts[d])
+		}
+	}
+	conn = cc
+	conn.SetDeadline(time.Time{})
+	if h.options.Metrics != nil {
+		conn = &socks5MetricsConn{Conn: conn, metrics: h.options.Metrics, service: serviceName(h.options)}
+	}
 
-	if Debug {
-		log.Logf("[socks5] %s -> %s\n%s",
+	normalizeSOCKS5Addr(req.Addr)
+
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5] %s -> %s\n%s",
 			conn.RemoteAddr(), conn.LocalAddr(), req)
 	}
 	switch req.Cmd {
@@ -823,8 +939,14 @@ func (h *socks5Handler) Handle(conn net.Conn) {
 	case CmdUDPTun:
 		h.handleUDPTunnel(conn, req)
 
+	case CmdSecretBind:
+		h.handleSecretBind(conn, req)
+
+	case CmdSecretConnect:
+		h.handleSecretConnect(conn, req)
+
 	default:
-		log.Logf("[socks5] %s - %s : Unrecognized request: %d",
+		h.options.Logger.Logf("[socks5] %s - %s : Unrecognized request: %d",
 			conn.RemoteAddr(), conn.LocalAddr(), req.Cmd)
 	}
 }
@@ -832,27 +954,30 @@ func (h *socks5Handler) Handle(conn net.Conn) {
 func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 	host := req.Addr.String()
 
-	log.Logf("[socks5] %s -> %s -> %s",
+	h.options.Logger.Logf("[socks5] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[socks5] %s - %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, conn.RemoteAddr().String(), host, h.ids...) {
+		h.options.Logger.Logf("[socks5] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks5] %s <- %s\n%s",
+		h.errorDetail(conn, "not allowed")
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), rep)
 		}
 		return
 	}
 	if h.options.Bypass.Contains(host) {
-		log.Logf("[socks5] %s - %s : Bypass %s",
+		h.options.Logger.Logf("[socks5] %s - %s : Bypass %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks5] %s <- %s\n%s",
+		h.errorDetail(conn, "bypass")
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), rep)
 		}
 		return
@@ -872,7 +997,7 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(host)
 		if err != nil {
-			log.Logf("[socks5] %s -> %s : %s",
+			h.options.Logger.Warnf("[socks5] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
@@ -884,56 +1009,118 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", host)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		cc, err = route.Dial(host,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, conn.RemoteAddr().String())),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[socks5] %s -> %s : %s",
+		h.options.Logger.Warnf("[socks5] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
 	if err != nil {
-		rep := gosocks5.NewReply(gosocks5.HostUnreachable, nil)
+		rep := gosocks5.NewReply(socks5ReplyCode(err), nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks5] %s <- %s\n%s",
+		h.errorDetail(conn, err.Error())
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), rep)
 		}
 		return
 	}
+	cc = relayConn(h.options, conn, cc, host)
 	defer cc.Close()
 
 	rep := gosocks5.NewReply(gosocks5.Succeeded, nil)
 	if err := rep.Write(conn); err != nil {
-		log.Logf("[socks5] %s <- %s : %s",
+		h.options.Logger.Logf("[socks5] %s <- %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
-	if Debug {
-		log.Logf("[socks5] %s <- %s\n%s",
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5] %s <- %s\n%s",
 			conn.RemoteAddr(), conn.LocalAddr(), rep)
 	}
-	log.Logf("[socks5] %s <-> %s", conn.RemoteAddr(), host)
-	transport(conn, cc)
-	log.Logf("[socks5] %s >-< %s", conn.RemoteAddr(), host)
+	h.options.Logger.Logf("[socks5] %s <-> %s", conn.RemoteAddr(), host)
+	if err := transport(conn, cc); err != nil && h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5] %s - %s : %s", conn.RemoteAddr(), host, err)
+	}
+	h.options.Logger.Logf("[socks5] %s >-< %s", conn.RemoteAddr(), host)
+}
+
+// errorDetail appends the reason of the failure after the failure reply if the ErrorDetail option is enabled.
+func (h *socks5Handler) errorDetail(conn net.Conn, reason string) {
+	if !h.options.ErrorDetail {
+		return
+	}
+	id := h.options.Logger.ConnID()
+	if id == "" {
+		id = newErrorID()
+	}
+	h.options.Logger.Logf("[socks5] %s - %s : error %s : %s", conn.RemoteAddr(), conn.LocalAddr(), id, reason)
+	writeSOCKS5ErrorDetail(conn, fmt.Sprintf("id=%s %s", id, reason))
+}
+
+// normalizeSOCKS5Addr converts the IPv4-mapped IPv6 address, or the domain of the IPv4-mapped IPv6 literal, to IPv4.
+func normalizeSOCKS5Addr(addr *gosocks5.Addr) {
+	if addr == nil || addr.Type == gosocks5.AddrIPv4 {
+		return
+	}
+	if ip := net.ParseIP(addr.Host); ip != nil && ip.To4() != nil {
+		addr.Type = gosocks5.AddrIPv4
+		addr.Host = ip.To4().String()
+	}
+}
+
+// socks5ReplyCode maps the dial error err to the reply code, so the client can tell the cause of the failure.
+// The failure reply of the next SOCKS5 hop is relayed as is.
+func socks5ReplyCode(err error) uint8 {
+	var re *ReplyError
+	if errors.As(err, &re) && re.Protocol == "socks5" &&
+		re.Code > int(gosocks5.Succeeded) && re.Code <= int(gosocks5.AddrUnsupported) {
+		return uint8(re.Code)
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return gosocks5.ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return gosocks5.NetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return gosocks5.HostUnreachable
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return gosocks5.TTLExpired
+	}
+	return gosocks5.HostUnreachable
 }
 
 func (h *socks5Handler) handleBind(conn net.Conn, req *gosocks5.Request) {
 	addr := req.Addr.String()
 
-	log.Logf("[socks5-bind] %s -> %s -> %s",
+	h.options.Logger.Logf("[socks5-bind] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), addr)
 
+	if h.options.Tunnels.Restricted() {
+		h.options.Logger.Logf("[socks5-bind] %s - %s : Unauthorized to tcp bind to %s",
+			conn.RemoteAddr(), conn.LocalAddr(), addr)
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+
 	if h.options.Chain.IsEmpty() {
-		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
-			log.Logf("[socks5-bind] %s - %s : Unauthorized to tcp bind to %s",
+		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) ||
+			!aclAllow(h.options, "rtcp", conn.RemoteAddr().String(), addr, h.ids...) {
+			h.options.Logger.Logf("[socks5-bind] %s - %s : Unauthorized to tcp bind to %s",
 				conn.RemoteAddr(), conn.LocalAddr(), addr)
+			gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
 			return
 		}
 		h.bindOn(conn, addr)
@@ -942,52 +1129,110 @@ func (h *socks5Handler) handleBind(conn net.Conn, req *gosocks5.Request) {
 
 	cc, err := h.options.Chain.Conn()
 	if err != nil {
-		log.Logf("[socks5-bind] %s <- %s : %s",
+		h.options.Logger.Logf("[socks5-bind] %s <- %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		reply := gosocks5.NewReply(gosocks5.Failure, nil)
 		reply.Write(conn)
-		if Debug {
-			log.Logf("[socks5-bind] %s <- %s\n%s",
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5-bind] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), reply)
 		}
 		return
 	}
 
-	// forward request
-	// note: this type of request forwarding is defined when starting server,
-	// so we don't need to authenticate it, as it's as explicit as whitelisting
+	// forward request to the last node of the chain, the two replies are relayed back to the client.
 	defer cc.Close()
-	req.Write(cc)
-	log.Logf("[socks5-bind] %s <-> %s", conn.RemoteAddr(), addr)
+	cc, err = socks5Handshake(cc, nil, h.options.Chain.LastNode().User)
+	if err != nil {
+		h.options.Logger.Logf("[socks5-bind] %s -> %s : %s",
+			conn.RemoteAddr(), h.options.Chain.LastNode().Addr, err)
+		gosocks5.NewReply(socks5ReplyCode(err), nil).Write(conn)
+		return
+	}
+	if err := req.Write(cc); err != nil {
+		h.options.Logger.Logf("[socks5-bind] %s -> %s : %s",
+			conn.RemoteAddr(), h.options.Chain.LastNode().Addr, err)
+		return
+	}
+	h.options.Logger.Logf("[socks5-bind] %s <-> %s", conn.RemoteAddr(), addr)
+	h.idle.hold() // the connection is silent until the peer connects to the last node.
+	defer h.idle.release()
 	transport(conn, cc)
-	log.Logf("[socks5-bind] %s >-< %s", conn.RemoteAddr(), addr)
+	h.options.Logger.Logf("[socks5-bind] %s >-< %s", conn.RemoteAddr(), addr)
+}
+
+// socks5BindPeer returns the IP of the peer expected to connect back if the address addr of the BIND request is not local,
+// as the BIND request defined in RFC 1928, see BindPeerHandlerOption. Otherwise nil is returned and addr is the address to bind on.
+func socks5BindPeer(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil
+		}
+		ip = ipAddr.IP
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() {
+		return nil
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return ip
+}
+
+// outboundIP returns the local IP used to reach the IP peer.
+func outboundIP(peer net.IP) net.IP {
+	c, err := net.Dial("udp", net.JoinHostPort(peer.String(), "9"))
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
 }
 
 func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 	bindAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	var peer net.IP
+	if h.options.BindPeer {
+		peer = socks5BindPeer(addr)
+	}
+	if peer != nil {
+		// bind on the interface reaching the peer with a random port.
+		bindAddr = &net.TCPAddr{IP: outboundIP(peer)}
+	}
 	ln, err := net.ListenTCP("tcp", bindAddr) // strict mode: if the port already in use, it will return error
 	if err != nil {
-		log.Logf("[socks5-bind] %s -> %s : %s",
+		h.options.Logger.Logf("[socks5-bind] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
 		return
 	}
 
-	socksAddr := toSocksAddr(ln.Addr())
 	// Issue: may not reachable when host has multi-interface
-	socksAddr.Host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	socksAddr := toSocksBindAddr(ln.Addr(), conn.LocalAddr())
+	if peer != nil && bindAddr.IP != nil {
+		socksAddr = toSocksAddr(ln.Addr())
+	}
 	reply := gosocks5.NewReply(gosocks5.Succeeded, socksAddr)
 	if err := reply.Write(conn); err != nil {
-		log.Logf("[socks5-bind] %s <- %s : %s",
+		h.options.Logger.Logf("[socks5-bind] %s <- %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		ln.Close()
 		return
 	}
-	if Debug {
-		log.Logf("[socks5-bind] %s <- %s\n%s",
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5-bind] %s <- %s\n%s",
 			conn.RemoteAddr(), conn.LocalAddr(), reply)
 	}
-	log.Logf("[socks5-bind] %s - %s BIND ON %s OK",
+	h.options.Logger.Logf("[socks5-bind] %s - %s BIND ON %s OK",
 		conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
 
 	var pconn net.Conn
@@ -998,12 +1243,22 @@ func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 			defer close(errc)
 			defer ln.Close()
 
-			c, err := ln.AcceptTCP()
-			if err != nil {
-				errc <- err
+			for {
+				c, err := ln.AcceptTCP()
+				if err != nil {
+					errc <- err
+					return
+				}
+				// only the expected peer is accepted.
+				if peer != nil && !c.RemoteAddr().(*net.TCPAddr).IP.Equal(peer) {
+					h.options.Logger.Logf("[socks5-bind] %s <- %s : unexpected peer %s rejected",
+						conn.RemoteAddr(), socksAddr, c.RemoteAddr())
+					c.Close()
+					continue
+				}
+				pconn = c
 				return
 			}
-			pconn = c
 		}()
 
 		return errc
@@ -1025,33 +1280,35 @@ func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 
 	defer pc2.Close()
 
+	h.idle.hold() // the connection is silent until the peer connects.
 	for {
 		select {
 		case err := <-accept():
+			h.idle.release()
 			if err != nil || pconn == nil {
-				log.Logf("[socks5-bind] %s <- %s : %v", conn.RemoteAddr(), addr, err)
+				h.options.Logger.Logf("[socks5-bind] %s <- %s : %v", conn.RemoteAddr(), addr, err)
 				return
 			}
 			defer pconn.Close()
 
 			reply := gosocks5.NewReply(gosocks5.Succeeded, toSocksAddr(pconn.RemoteAddr()))
 			if err := reply.Write(pc2); err != nil {
-				log.Logf("[socks5-bind] %s <- %s : %v", conn.RemoteAddr(), addr, err)
+				h.options.Logger.Logf("[socks5-bind] %s <- %s : %v", conn.RemoteAddr(), addr, err)
 			}
-			if Debug {
-				log.Logf("[socks5-bind] %s <- %s\n%s", conn.RemoteAddr(), addr, reply)
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[socks5-bind] %s <- %s\n%s", conn.RemoteAddr(), addr, reply)
 			}
-			log.Logf("[socks5-bind] %s <- %s PEER %s ACCEPTED", conn.RemoteAddr(), socksAddr, pconn.RemoteAddr())
+			h.options.Logger.Logf("[socks5-bind] %s <- %s PEER %s ACCEPTED", conn.RemoteAddr(), socksAddr, pconn.RemoteAddr())
 
-			log.Logf("[socks5-bind] %s <-> %s", conn.RemoteAddr(), pconn.RemoteAddr())
+			h.options.Logger.Logf("[socks5-bind] %s <-> %s", conn.RemoteAddr(), pconn.RemoteAddr())
 			if err = transport(pc2, pconn); err != nil {
-				log.Logf("[socks5-bind] %s - %s : %v", conn.RemoteAddr(), pconn.RemoteAddr(), err)
+				h.options.Logger.Logf("[socks5-bind] %s - %s : %v", conn.RemoteAddr(), pconn.RemoteAddr(), err)
 			}
-			log.Logf("[socks5-bind] %s >-< %s", conn.RemoteAddr(), pconn.RemoteAddr())
+			h.options.Logger.Logf("[socks5-bind] %s >-< %s", conn.RemoteAddr(), pconn.RemoteAddr())
 			return
 		case err := <-pipe():
 			if err != nil {
-				log.Logf("[socks5-bind] %s -> %s : %v", conn.RemoteAddr(), addr, err)
+				h.options.Logger.Logf("[socks5-bind] %s -> %s : %v", conn.RemoteAddr(), addr, err)
 			}
 			ln.Close()
 			return
@@ -1061,55 +1318,58 @@ func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 
 func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request) {
 	addr := req.Addr.String()
-	if !Can("udp", addr, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[socks5-udp] Unauthorized to udp connect to %s", addr)
+	if !Can("udp", addr, h.options.Whitelist, h.options.Blacklist) ||
+		!aclAllow(h.options, "udp", conn.RemoteAddr().String(), addr, h.ids...) {
+		h.options.Logger.Logf("[socks5-udp] Unauthorized to udp connect to %s", addr)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), req.Addr, rep)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), req.Addr, rep)
 		}
 		return
 	}
 
 	relay, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		reply := gosocks5.NewReply(gosocks5.Failure, nil)
 		reply.Write(conn)
-		if Debug {
-			log.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), reply)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), reply)
 		}
 		return
 	}
 	defer relay.Close()
 
-	socksAddr := toSocksAddr(relay.LocalAddr())
-	socksAddr.Host, _, _ = net.SplitHostPort(conn.LocalAddr().String()) // replace the IP to the out-going interface's
+	socksAddr := toSocksBindAddr(relay.LocalAddr(), conn.LocalAddr())
 	reply := gosocks5.NewReply(gosocks5.Succeeded, socksAddr)
 	if err := reply.Write(conn); err != nil {
-		log.Logf("[socks5-udp] %s <- %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		h.options.Logger.Logf("[socks5-udp] %s <- %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
-	if Debug {
-		log.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), reply)
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), reply)
 	}
-	log.Logf("[socks5-udp] %s - %s BIND ON %s OK", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
+	h.options.Logger.Logf("[socks5-udp] %s - %s BIND ON %s OK", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
 
 	// serve as standard socks5 udp relay local <-> remote
 	if h.options.Chain.IsEmpty() {
 		peer, er := net.ListenUDP("udp", nil)
 		if er != nil {
-			log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), er)
+			h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), er)
 			return
 		}
 		defer peer.Close()
 
-		go h.transportUDP(relay, peer)
-		log.Logf("[socks5-udp] %s <-> %s : associated on %s", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
+		go func() {
+			h.transportUDP(relay, peer, newUDPAssociation(conn.RemoteAddr(), h.options.TTL))
+			conn.Close() // the association terminates with the relay.
+		}()
+		h.options.Logger.Logf("[socks5-udp] %s <-> %s : associated on %s", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
 		if err := h.discardClientData(conn); err != nil {
-			log.Logf("[socks5-udp] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			h.options.Logger.Logf("[socks5-udp] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		}
-		log.Logf("[socks5-udp] %s >-< %s : associated on %s", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
+		h.options.Logger.Logf("[socks5-udp] %s >-< %s : associated on %s", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
 		return
 	}
 
@@ -1117,50 +1377,53 @@ func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request) {
 	cc, err := h.options.Chain.Conn()
 	// connection error
 	if err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), socksAddr, err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), socksAddr, err)
 		return
 	}
 	defer cc.Close()
 
 	cc, err = socks5Handshake(cc, nil, h.options.Chain.LastNode().User)
 	if err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), socksAddr, err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), socksAddr, err)
 		return
 	}
 
 	cc.SetWriteDeadline(time.Now().Add(WriteTimeout))
 	r := gosocks5.NewRequest(CmdUDPTun, nil)
 	if err := r.Write(cc); err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), cc.RemoteAddr(), err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), cc.RemoteAddr(), err)
 		return
 	}
 	cc.SetWriteDeadline(time.Time{})
-	if Debug {
-		log.Logf("[socks5-udp] %s -> %s\n%s", conn.RemoteAddr(), cc.RemoteAddr(), r)
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5-udp] %s -> %s\n%s", conn.RemoteAddr(), cc.RemoteAddr(), r)
 	}
 	cc.SetReadDeadline(time.Now().Add(ReadTimeout))
 	reply, err = gosocks5.ReadReply(cc)
 	if err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), cc.RemoteAddr(), err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), cc.RemoteAddr(), err)
 		return
 	}
-	if Debug {
-		log.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), cc.RemoteAddr(), reply)
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), cc.RemoteAddr(), reply)
 	}
 
 	if reply.Rep != gosocks5.Succeeded {
-		log.Logf("[socks5-udp] %s <- %s : udp associate failed", conn.RemoteAddr(), cc.RemoteAddr())
+		h.options.Logger.Logf("[socks5-udp] %s <- %s : udp associate failed", conn.RemoteAddr(), cc.RemoteAddr())
 		return
 	}
 	cc.SetReadDeadline(time.Time{})
-	log.Logf("[socks5-udp] %s <-> %s [tun: %s]", conn.RemoteAddr(), socksAddr, reply.Addr)
+	h.options.Logger.Logf("[socks5-udp] %s <-> %s [tun: %s]", conn.RemoteAddr(), socksAddr, reply.Addr)
 
-	go h.tunnelClientUDP(relay, cc)
-	log.Logf("[socks5-udp] %s <-> %s", conn.RemoteAddr(), socksAddr)
+	go func() {
+		h.tunnelClientUDP(relay, cc, newUDPAssociation(conn.RemoteAddr(), h.options.TTL))
+		conn.Close()
+	}()
+	h.options.Logger.Logf("[socks5-udp] %s <-> %s", conn.RemoteAddr(), socksAddr)
 	if err := h.discardClientData(conn); err != nil {
-		log.Logf("[socks5-udp] %s - %s : %s", conn.RemoteAddr(), socksAddr, err)
+		h.options.Logger.Logf("[socks5-udp] %s - %s : %s", conn.RemoteAddr(), socksAddr, err)
 	}
-	log.Logf("[socks5-udp] %s >-< %s", conn.RemoteAddr(), socksAddr)
+	h.options.Logger.Logf("[socks5-udp] %s >-< %s", conn.RemoteAddr(), socksAddr)
 }
 
 func (h *socks5Handler) discardClientData(conn net.Conn) (err error) {
@@ -1174,15 +1437,100 @@ func (h *socks5Handler) discardClientData(conn net.Conn) (err error) {
 			}
 			break // client disconnected
 		}
-		log.Logf("[socks5-udp] read %d UNEXPECTED TCP data from client", n)
+		h.options.Logger.Logf("[socks5-udp] read %d UNEXPECTED TCP data from client", n)
 	}
 	return
 }
 
-func (h *socks5Handler) transportUDP(relay, peer net.PacketConn) (err error) {
-	errc := make(chan error, 2)
+// udpAssociation is the state of a SOCKS5 UDP association.
+// The datagrams are only accepted from the IP of the client of the association, the replies are sent to the latest client address.
+// The remote addresses the client sent to are tracked as the NAT sessions, which expire after the idle timeout ttl,
+// only the replies from the live sessions are relayed back to the client.
+type udpAssociation struct {
+	clientIP net.IP
+	ttl      time.Duration
+	client   net.Addr
+	sessions map[string]time.Time
+	swept    time.Time
+	mux      sync.Mutex
+}
 
-	var clientAddr net.Addr
+func newUDPAssociation(client net.Addr, ttl time.Duration) *udpAssociation {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	a := &udpAssociation{
+		ttl:      ttl,
+		sessions: make(map[string]time.Time),
+		swept:    time.Now(),
+	}
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		a.clientIP = addr.IP
+	case *net.UDPAddr:
+		a.clientIP = addr.IP
+	}
+	return a
+}
+
+// accept reports whether the datagram from addr is sent by the client of the association.
+func (a *udpAssociation) accept(addr net.Addr) bool {
+	if uaddr, ok := addr.(*net.UDPAddr); ok && a.clientIP != nil && !uaddr.IP.Equal(a.clientIP) {
+		return false
+	}
+	a.mux.Lock()
+	a.client = addr
+	a.mux.Unlock()
+	return true
+}
+
+// Client returns the address of the client, it is nil until the client sends the first datagram.
+func (a *udpAssociation) Client() net.Addr {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.client
+}
+
+// touch creates or refreshes the session of the remote address raddr.
+func (a *udpAssociation) touch(raddr string) {
+	now := time.Now()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.sessions[raddr] = now
+	if now.Sub(a.swept) < a.ttl {
+		return
+	}
+	for k, t := range a.sessions {
+		if now.Sub(t) >= a.ttl {
+			delete(a.sessions, k)
+		}
+	}
+	a.swept = now
+}
+
+// alive reports whether the session of the remote address raddr is not expired, the live session is refreshed.
+func (a *udpAssociation) alive(raddr string) bool {
+	now := time.Now()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	t, ok := a.sessions[raddr]
+	if !ok {
+		return false
+	}
+	if now.Sub(t) >= a.ttl {
+		delete(a.sessions, raddr)
+		return false
+	}
+	a.sessions[raddr] = now
+	return true
+}
+
+func (h *socks5Handler) transportUDP(relay, peer net.PacketConn, assoc *udpAssociation) (err error) {
+	errc := make(chan error, 2)
 
 	go func() {
 		b := mPool.Get().([]byte)
@@ -1194,13 +1542,15 @@ func (h *socks5Handler) transportUDP(relay, peer net.PacketConn) (err error) {
 				errc <- err
 				return
 			}
-			if clientAddr == nil {
-				clientAddr = laddr
+			if !assoc.accept(laddr) {
+				if h.options.Logger.Debug() {
+					h.options.Logger.Logf("[socks5-udp] %s : datagram from unknown client %s dropped", relay.LocalAddr(), laddr)
+				}
+				continue
 			}
 			dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
-			if err != nil {
-				errc <- err
-				return
+			if err != nil || dgram.Header.Frag != 0 {
+				continue // drop the malformed or fragmented datagram silently
 			}
 
 			raddr, err := net.ResolveUDPAddr("udp", dgram.Header.Addr.String())
@@ -1208,15 +1558,17 @@ func (h *socks5Handler) transportUDP(relay, peer net.PacketConn) (err error) {
 				continue // drop silently
 			}
 			if h.options.Bypass.Contains(raddr.String()) {
-				log.Log("[socks5-udp] [bypass] write to", raddr)
+				h.options.Logger.Log("[socks5-udp] [bypass] write to", raddr)
 				continue // bypass
 			}
+			assoc.touch(raddr.String())
+			h.idle.touch() // the control connection is silent while the datagrams are relayed.
 			if _, err := peer.WriteTo(dgram.Data, raddr); err != nil {
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[socks5-udp] %s >>> %s length: %d", relay.LocalAddr(), raddr, len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[socks5-udp] %s >>> %s length: %d", relay.LocalAddr(), raddr, len(dgram.Data))
 			}
 		}
 	}()
@@ -1231,22 +1583,30 @@ func (h *socks5Handler) transportUDP(relay, peer net.PacketConn) (err error) {
 				errc <- err
 				return
 			}
+			clientAddr := assoc.Client()
 			if clientAddr == nil {
 				continue
 			}
+			if !assoc.alive(raddr.String()) {
+				if h.options.Logger.Debug() {
+					h.options.Logger.Logf("[socks5-udp] %s : datagram from %s without session dropped", relay.LocalAddr(), raddr)
+				}
+				continue
+			}
 			if h.options.Bypass.Contains(raddr.String()) {
-				log.Log("[socks5-udp] [bypass] read from", raddr)
+				h.options.Logger.Log("[socks5-udp] [bypass] read from", raddr)
 				continue // bypass
 			}
 			buf := bytes.Buffer{}
 			dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, toSocksAddr(raddr)), b[:n])
 			dgram.Write(&buf)
+			h.idle.touch()
 			if _, err := relay.WriteTo(buf.Bytes(), clientAddr); err != nil {
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[socks5-udp] %s <<< %s length: %d", relay.LocalAddr(), raddr, len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[socks5-udp] %s <<< %s length: %d", relay.LocalAddr(), raddr, len(dgram.Data))
 			}
 		}
 	}()
@@ -1259,11 +1619,9 @@ func (h *socks5Handler) transportUDP(relay, peer net.PacketConn) (err error) {
 	return
 }
 
-func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error) {
+func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn, assoc *udpAssociation) (err error) {
 	errc := make(chan error, 2)
 
-	var clientAddr *net.UDPAddr
-
 	go func() {
 		b := mPool.Get().([]byte)
 		defer mPool.Put(b)
@@ -1271,33 +1629,37 @@ func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error
 		for {
 			n, addr, err := uc.ReadFromUDP(b)
 			if err != nil {
-				log.Logf("[udp-tun] %s <- %s : %s", cc.RemoteAddr(), addr, err)
+				h.options.Logger.Logf("[udp-tun] %s <- %s : %s", cc.RemoteAddr(), addr, err)
 				errc <- err
 				return
 			}
 
+			if !assoc.accept(addr) {
+				if h.options.Logger.Debug() {
+					h.options.Logger.Logf("[udp-tun] %s : datagram from unknown client %s dropped", uc.LocalAddr(), addr)
+				}
+				continue
+			}
+
 			// glog.V(LDEBUG).Infof("read udp %d, % #x", n, b[:n])
 			// pipe from relay to tunnel
 			dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
-			if err != nil {
-				errc <- err
-				return
-			}
-			if clientAddr == nil {
-				clientAddr = addr
+			if err != nil || dgram.Header.Frag != 0 {
+				continue // drop the malformed or fragmented datagram silently
 			}
 			raddr := dgram.Header.Addr.String()
 			if h.options.Bypass.Contains(raddr) {
-				log.Log("[udp-tun] [bypass] write to", raddr)
+				h.options.Logger.Log("[udp-tun] [bypass] write to", raddr)
 				continue // bypass
 			}
 			dgram.Header.Rsv = uint16(len(dgram.Data))
+			h.idle.touch() // the control connection is silent while the datagrams are relayed.
 			if err := dgram.Write(cc); err != nil {
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[udp-tun] %s >>> %s length: %d", uc.LocalAddr(), dgram.Header.Addr, len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[udp-tun] %s >>> %s length: %d", uc.LocalAddr(), dgram.Header.Addr, len(dgram.Data))
 			}
 		}
 	}()
@@ -1306,30 +1668,32 @@ func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error
 		for {
 			dgram, err := gosocks5.ReadUDPDatagram(cc)
 			if err != nil {
-				log.Logf("[udp-tun] %s -> 0 : %s", cc.RemoteAddr(), err)
+				h.options.Logger.Logf("[udp-tun] %s -> 0 : %s", cc.RemoteAddr(), err)
 				errc <- err
 				return
 			}
 
 			// pipe from tunnel to relay
+			clientAddr := assoc.Client()
 			if clientAddr == nil {
 				continue
 			}
 			raddr := dgram.Header.Addr.String()
 			if h.options.Bypass.Contains(raddr) {
-				log.Log("[udp-tun] [bypass] read from", raddr)
+				h.options.Logger.Log("[udp-tun] [bypass] read from", raddr)
 				continue // bypass
 			}
 			dgram.Header.Rsv = 0
 
 			buf := bytes.Buffer{}
 			dgram.Write(&buf)
-			if _, err := uc.WriteToUDP(buf.Bytes(), clientAddr); err != nil {
+			h.idle.touch()
+			if _, err := uc.WriteTo(buf.Bytes(), clientAddr); err != nil {
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[udp-tun] %s <<< %s length: %d", uc.LocalAddr(), dgram.Header.Addr, len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[udp-tun] %s <<< %s length: %d", uc.LocalAddr(), dgram.Header.Addr, len(dgram.Data))
 			}
 		}
 	}()
@@ -1346,49 +1710,50 @@ func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request) {
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
 
-		if !Can("rudp", addr, h.options.Whitelist, h.options.Blacklist) {
-			log.Logf("[socks5-udp] Unauthorized to udp bind to %s", addr)
+		if !Can("rudp", addr, h.options.Whitelist, h.options.Blacklist) ||
+			!aclAllow(h.options, "rudp", conn.RemoteAddr().String(), addr, h.ids...) {
+			h.options.Logger.Logf("[socks5-udp] Unauthorized to udp bind to %s", addr)
+			gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
 			return
 		}
 
 		bindAddr, _ := net.ResolveUDPAddr("udp", addr)
 		uc, err := net.ListenUDP("udp", bindAddr)
 		if err != nil {
-			log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), req.Addr, err)
+			h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), req.Addr, err)
 			return
 		}
 		defer uc.Close()
 
-		socksAddr := toSocksAddr(uc.LocalAddr())
-		socksAddr.Host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+		socksAddr := toSocksBindAddr(uc.LocalAddr(), conn.LocalAddr())
 		reply := gosocks5.NewReply(gosocks5.Succeeded, socksAddr)
 		if err := reply.Write(conn); err != nil {
-			log.Logf("[socks5-udp] %s <- %s : %s", conn.RemoteAddr(), socksAddr, err)
+			h.options.Logger.Logf("[socks5-udp] %s <- %s : %s", conn.RemoteAddr(), socksAddr, err)
 			return
 		}
-		if Debug {
-			log.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), socksAddr, reply)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5-udp] %s <- %s\n%s", conn.RemoteAddr(), socksAddr, reply)
 		}
-		log.Logf("[socks5-udp] %s <-> %s", conn.RemoteAddr(), socksAddr)
+		h.options.Logger.Logf("[socks5-udp] %s <-> %s", conn.RemoteAddr(), socksAddr)
 		h.tunnelServerUDP(conn, uc)
-		log.Logf("[socks5-udp] %s >-< %s", conn.RemoteAddr(), socksAddr)
+		h.options.Logger.Logf("[socks5-udp] %s >-< %s", conn.RemoteAddr(), socksAddr)
 		return
 	}
 
 	cc, err := h.options.Chain.Conn()
 	// connection error
 	if err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), req.Addr, err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), req.Addr, err)
 		reply := gosocks5.NewReply(gosocks5.Failure, nil)
 		reply.Write(conn)
-		log.Logf("[socks5-udp] %s -> %s\n%s", conn.RemoteAddr(), req.Addr, reply)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s\n%s", conn.RemoteAddr(), req.Addr, reply)
 		return
 	}
 	defer cc.Close()
 
 	cc, err = socks5Handshake(cc, nil, h.options.Chain.LastNode().User)
 	if err != nil {
-		log.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), req.Addr, err)
+		h.options.Logger.Logf("[socks5-udp] %s -> %s : %s", conn.RemoteAddr(), req.Addr, err)
 		return
 	}
 	// tunnel <-> tunnel, direct forwarding
@@ -1396,9 +1761,9 @@ func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request) {
 	// so we don't need to authenticate it, as it's as explicit as whitelisting
 	req.Write(cc)
 
-	log.Logf("[socks5-udp] %s <-> %s [tun]", conn.RemoteAddr(), cc.RemoteAddr())
+	h.options.Logger.Logf("[socks5-udp] %s <-> %s [tun]", conn.RemoteAddr(), cc.RemoteAddr())
 	transport(conn, cc)
-	log.Logf("[socks5-udp] %s >-< %s [tun]", conn.RemoteAddr(), cc.RemoteAddr())
+	h.options.Logger.Logf("[socks5-udp] %s >-< %s [tun]", conn.RemoteAddr(), cc.RemoteAddr())
 }
 
 func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err error) {
@@ -1411,12 +1776,12 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err err
 		for {
 			n, addr, err := pc.ReadFrom(b)
 			if err != nil {
-				// log.Logf("[udp-tun] %s : %s", cc.RemoteAddr(), err)
+				// h.options.Logger.Logf("[udp-tun] %s : %s", cc.RemoteAddr(), err)
 				errc <- err
 				return
 			}
 			if h.options.Bypass.Contains(addr.String()) {
-				log.Log("[udp-tun] [bypass] read from", addr)
+				h.options.Logger.Log("[udp-tun] [bypass] read from", addr)
 				continue // bypass
 			}
 
@@ -1424,12 +1789,12 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err err
 			dgram := gosocks5.NewUDPDatagram(
 				gosocks5.NewUDPHeader(uint16(n), 0, toSocksAddr(addr)), b[:n])
 			if err := dgram.Write(cc); err != nil {
-				log.Logf("[udp-tun] %s <- %s : %s", cc.RemoteAddr(), dgram.Header.Addr, err)
+				h.options.Logger.Logf("[udp-tun] %s <- %s : %s", cc.RemoteAddr(), dgram.Header.Addr, err)
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[udp-tun] %s <<< %s length: %d", cc.RemoteAddr(), dgram.Header.Addr, len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[udp-tun] %s <<< %s length: %d", cc.RemoteAddr(), dgram.Header.Addr, len(dgram.Data))
 			}
 		}
 	}()
@@ -1438,7 +1803,7 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err err
 		for {
 			dgram, err := gosocks5.ReadUDPDatagram(cc)
 			if err != nil {
-				// log.Logf("[udp-tun] %s -> 0 : %s", cc.RemoteAddr(), err)
+				// h.options.Logger.Logf("[udp-tun] %s -> 0 : %s", cc.RemoteAddr(), err)
 				errc <- err
 				return
 			}
@@ -1449,16 +1814,16 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err err
 				continue // drop silently
 			}
 			if h.options.Bypass.Contains(addr.String()) {
-				log.Log("[udp-tun] [bypass] write to", addr)
+				h.options.Logger.Log("[udp-tun] [bypass] write to", addr)
 				continue // bypass
 			}
 			if _, err := pc.WriteTo(dgram.Data, addr); err != nil {
-				log.Logf("[udp-tun] %s -> %s : %s", cc.RemoteAddr(), addr, err)
+				h.options.Logger.Logf("[udp-tun] %s -> %s : %s", cc.RemoteAddr(), addr, err)
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[udp-tun] %s >>> %s length: %d", cc.RemoteAddr(), addr, len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[udp-tun] %s >>> %s length: %d", cc.RemoteAddr(), addr, len(dgram.Data))
 			}
 		}
 	}()
@@ -1471,10 +1836,23 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err err
 }
 
 func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request) {
+	if req.Addr.Type == gosocks5.AddrDomain && h.options.Tunnels != nil {
+		h.muxBindTunnel(conn, req.Addr.Host)
+		return
+	}
+	if h.options.Tunnels.Restricted() {
+		h.options.Logger.Logf("[socks5] mbind %s - %s : Unauthorized to tcp mbind to %s",
+			conn.RemoteAddr(), conn.LocalAddr(), req.Addr)
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
-		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
-			log.Logf("Unauthorized to tcp mbind to %s", addr)
+		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) ||
+			!aclAllow(h.options, "rtcp", conn.RemoteAddr().String(), addr, h.ids...) {
+			h.options.Logger.Logf("Unauthorized to tcp mbind to %s", addr)
+			gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
 			return
 		}
 		h.muxBindOn(conn, addr)
@@ -1483,11 +1861,11 @@ func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request) {
 
 	cc, err := h.options.Chain.Conn()
 	if err != nil {
-		log.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), req.Addr, err)
+		h.options.Logger.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), req.Addr, err)
 		reply := gosocks5.NewReply(gosocks5.Failure, nil)
 		reply.Write(conn)
-		if Debug {
-			log.Logf("[socks5] mbind %s <- %s\n%s", conn.RemoteAddr(), req.Addr, reply)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5] mbind %s <- %s\n%s", conn.RemoteAddr(), req.Addr, reply)
 		}
 		return
 	}
@@ -1497,43 +1875,42 @@ func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request) {
 	// so we don't need to authenticate it, as it's as explicit as whitelisting.
 	defer cc.Close()
 	req.Write(cc)
-	log.Logf("[socks5] mbind %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
+	h.options.Logger.Logf("[socks5] mbind %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
 	transport(conn, cc)
-	log.Logf("[socks5] mbind %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
+	h.options.Logger.Logf("[socks5] mbind %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
 }
 
 func (h *socks5Handler) muxBindOn(conn net.Conn, addr string) {
 	bindAddr, _ := net.ResolveTCPAddr("tcp", addr)
 	ln, err := net.ListenTCP("tcp", bindAddr) // strict mode: if the port already in use, it will return error
 	if err != nil {
-		log.Logf("[socks5] mbind %s -> %s : %s", conn.RemoteAddr(), addr, err)
+		h.options.Logger.Logf("[socks5] mbind %s -> %s : %s", conn.RemoteAddr(), addr, err)
 		gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
 		return
 	}
 	defer ln.Close()
 
-	socksAddr := toSocksAddr(ln.Addr())
 	// Issue: may not reachable when host has multi-interface.
-	socksAddr.Host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	socksAddr := toSocksBindAddr(ln.Addr(), conn.LocalAddr())
 	reply := gosocks5.NewReply(gosocks5.Succeeded, socksAddr)
 	if err := reply.Write(conn); err != nil {
-		log.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), addr, err)
+		h.options.Logger.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), addr, err)
 		return
 	}
-	if Debug {
-		log.Logf("[socks5] mbind %s <- %s\n%s", conn.RemoteAddr(), addr, reply)
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5] mbind %s <- %s\n%s", conn.RemoteAddr(), addr, reply)
 	}
-	log.Logf("[socks5] mbind %s - %s BIND ON %s OK", conn.RemoteAddr(), addr, socksAddr)
+	h.options.Logger.Logf("[socks5] mbind %s - %s BIND ON %s OK", conn.RemoteAddr(), addr, socksAddr)
 
 	// Upgrade connection to multiplex stream.
 	s, err := smux.Client(conn, smux.DefaultConfig())
 	if err != nil {
-		log.Logf("[socks5] mbind %s - %s : %s", conn.RemoteAddr(), socksAddr, err)
+		h.options.Logger.Logf("[socks5] mbind %s - %s : %s", conn.RemoteAddr(), socksAddr, err)
 		return
 	}
 
-	log.Logf("[socks5] mbind %s <-> %s", conn.RemoteAddr(), socksAddr)
-	defer log.Logf("[socks5] mbind %s >-< %s", conn.RemoteAddr(), socksAddr)
+	h.options.Logger.Logf("[socks5] mbind %s <-> %s", conn.RemoteAddr(), socksAddr)
+	defer h.options.Logger.Logf("[socks5] mbind %s >-< %s", conn.RemoteAddr(), socksAddr)
 
 	session := &muxSession{
 		conn:    conn,
@@ -1545,7 +1922,7 @@ func (h *socks5Handler) muxBindOn(conn net.Conn, addr string) {
 		for {
 			conn, err := session.Accept()
 			if err != nil {
-				log.Logf("[socks5] mbind accept : %v", err)
+				h.options.Logger.Logf("[socks5] mbind accept : %v", err)
 				ln.Close()
 				return
 			}
@@ -1556,10 +1933,10 @@ func (h *socks5Handler) muxBindOn(conn net.Conn, addr string) {
 	for {
 		cc, err := ln.Accept()
 		if err != nil {
-			log.Logf("[socks5] mbind %s <- %s : %v", conn.RemoteAddr(), socksAddr, err)
+			h.options.Logger.Logf("[socks5] mbind %s <- %s : %v", conn.RemoteAddr(), socksAddr, err)
 			return
 		}
-		log.Logf("[socks5] mbind %s <- %s : ACCEPT peer %s",
+		h.options.Logger.Logf("[socks5] mbind %s <- %s : ACCEPT peer %s",
 			conn.RemoteAddr(), socksAddr, cc.RemoteAddr())
 
 		go func(c net.Conn) {
@@ -1567,7 +1944,7 @@ func (h *socks5Handler) muxBindOn(conn net.Conn, addr string) {
 
 			sc, err := session.GetConn()
 			if err != nil {
-				log.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), socksAddr, err)
+				h.options.Logger.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), socksAddr, err)
 				return
 			}
 			defer sc.Close()
@@ -1577,6 +1954,175 @@ func (h *socks5Handler) muxBindOn(conn net.Conn, addr string) {
 	}
 }
 
+// muxBindTunnel registers the multiplexed connection as the reverse tunnel.
+// The address of the request is the tunnel name, and optional token in the form of 'token@name'.
+func (h *socks5Handler) muxBindTunnel(conn net.Conn, addr string) {
+	tunnels := h.options.Tunnels
+
+	name, token := addr, ""
+	if n := strings.LastIndexByte(addr, '@'); n >= 0 {
+		name, token = addr[n+1:], addr[:n]
+	}
+
+	host, err := tunnels.Authorize(name, token)
+	if err != nil {
+		h.options.Logger.Logf("[socks5] mbind %s - %s : tunnel %s: %s",
+			conn.RemoteAddr(), conn.LocalAddr(), name, err)
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+	if !Can("rtcp", host, h.options.Whitelist, h.options.Blacklist) {
+		h.options.Logger.Logf("[socks5] mbind %s - %s : Unauthorized to tunnel %s",
+			conn.RemoteAddr(), conn.LocalAddr(), host)
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+
+	// the service is exposed on a port.
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		h.muxBindOn(conn, host)
+		return
+	}
+
+	h.serveTunnel(conn, host, false)
+}
+
+// handleSecretBind registers the multiplexed connection as the secret tunnel.
+// The address of the request is the tunnel name, and optional token in the form of 'token@name'.
+func (h *socks5Handler) handleSecretBind(conn net.Conn, req *gosocks5.Request) {
+	tunnels := h.options.Tunnels
+	if tunnels == nil || req.Addr.Type != gosocks5.AddrDomain {
+		h.options.Logger.Logf("[socks5] sbind %s - %s : secret tunnel is not supported",
+			conn.RemoteAddr(), conn.LocalAddr())
+		gosocks5.NewReply(gosocks5.CmdUnsupported, nil).Write(conn)
+		return
+	}
+
+	name, token := req.Addr.Host, ""
+	if n := strings.LastIndexByte(name, '@'); n >= 0 {
+		name, token = name[n+1:], name[:n]
+	}
+	if _, err := tunnels.Authorize(name, token); err != nil {
+		h.options.Logger.Logf("[socks5] sbind %s - %s : tunnel %s: %s",
+			conn.RemoteAddr(), conn.LocalAddr(), name, err)
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+	if !Can("rtcp", name, h.options.Whitelist, h.options.Blacklist) {
+		h.options.Logger.Logf("[socks5] sbind %s - %s : Unauthorized to tunnel %s",
+			conn.RemoteAddr(), conn.LocalAddr(), name)
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+
+	h.serveTunnel(conn, name, true)
+}
+
+// serveTunnel upgrades the connection to multiplex stream and registers it as the tunnel key,
+// until the connection is closed.
+func (h *socks5Handler) serveTunnel(conn net.Conn, key string, secret bool) {
+	tunnels := h.options.Tunnels
+
+	if err := tunnels.check(key, secret); err != nil {
+		h.options.Logger.Logf("[socks5] mbind %s - %s : %s", conn.RemoteAddr(), key, err)
+		gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+		return
+	}
+
+	reply := gosocks5.NewReply(gosocks5.Succeeded, &gosocks5.Addr{
+		Type: gosocks5.AddrDomain,
+		Host: key,
+	})
+	if err := reply.Write(conn); err != nil {
+		h.options.Logger.Logf("[socks5] mbind %s <- %s : %s", conn.RemoteAddr(), key, err)
+		return
+	}
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5] mbind %s <- %s\n%s", conn.RemoteAddr(), key, reply)
+	}
+
+	// Upgrade connection to multiplex stream.
+	s, err := smux.Client(conn, smux.DefaultConfig())
+	if err != nil {
+		h.options.Logger.Logf("[socks5] mbind %s - %s : %s", conn.RemoteAddr(), key, err)
+		return
+	}
+	session := &muxSession{
+		conn:    conn,
+		session: s,
+	}
+	defer session.Close()
+
+	if err := tunnels.register(key, secret, session); err != nil {
+		h.options.Logger.Logf("[socks5] mbind %s - %s : %s", conn.RemoteAddr(), key, err)
+		return
+	}
+	defer tunnels.unregister(key, secret, session)
+
+	h.options.Logger.Logf("[socks5] mbind %s - %s TUNNEL OK", conn.RemoteAddr(), key)
+	h.options.Logger.Logf("[socks5] mbind %s <-> %s", conn.RemoteAddr(), key)
+	defer h.options.Logger.Logf("[socks5] mbind %s >-< %s", conn.RemoteAddr(), key)
+
+	for {
+		conn, err := session.Accept()
+		if err != nil {
+			h.options.Logger.Logf("[socks5] mbind accept : %v", err)
+			return
+		}
+		conn.Close() // we do not handle incoming connection.
+	}
+}
+
+// handleSecretConnect connects the visitor to the secret tunnel.
+// The server only relays the data, which is encrypted end-to-end by the secret shared between the visitor and the provider.
+func (h *socks5Handler) handleSecretConnect(conn net.Conn, req *gosocks5.Request) {
+	name := req.Addr.Host
+
+	cc, err := h.options.Tunnels.DialSecret(name)
+	if err != nil {
+		h.options.Logger.Logf("[socks5] sconnect %s -> %s : %s", conn.RemoteAddr(), name, err)
+		rep := gosocks5.NewReply(gosocks5.HostUnreachable, nil)
+		rep.Write(conn)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks5] sconnect %s <- %s\n%s", conn.RemoteAddr(), name, rep)
+		}
+		return
+	}
+	defer cc.Close()
+
+	rep := gosocks5.NewReply(gosocks5.Succeeded, nil)
+	if err := rep.Write(conn); err != nil {
+		h.options.Logger.Logf("[socks5] sconnect %s <- %s : %s", conn.RemoteAddr(), name, err)
+		return
+	}
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks5] sconnect %s <- %s\n%s", conn.RemoteAddr(), name, rep)
+	}
+
+	h.options.Logger.Logf("[socks5] sconnect %s <-> %s", conn.RemoteAddr(), name)
+	transport(conn, cc)
+	h.options.Logger.Logf("[socks5] sconnect %s >-< %s", conn.RemoteAddr(), name)
+}
+
+// toSocksBindAddr returns the address bound reported to the client, the IP is replaced by the IP of the local address of the client connection,
+// the address type follows the replaced IP.
+func toSocksBindAddr(bound, local net.Addr) *gosocks5.Addr {
+	addr := toSocksAddr(local)
+	addr.Port = toSocksAddr(bound).Port
+	return addr
+}
+
+// newSocks5Addr is like gosocks5.NewAddr, but the zone of the IPv6 address is dropped,
+// so the zoned address is encoded as the IPv6 address rather than a domain, the zone is only meaningful locally.
+func newSocks5Addr(addr string) (*gosocks5.Addr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _ = splitHostZone(host)
+	return gosocks5.NewAddr(net.JoinHostPort(host, port))
+}
+
 func toSocksAddr(addr net.Addr) *gosocks5.Addr {
 	host := "0.0.0.0"
 	port := 0
@@ -1585,8 +2131,13 @@ func toSocksAddr(addr net.Addr) *gosocks5.Addr {
 		host = h
 		port, _ = strconv.Atoi(p)
 	}
+	host, _ = splitHostZone(host)
+	typ := gosocks5.AddrIPv4
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		typ = gosocks5.AddrIPv6
+	}
 	return &gosocks5.Addr{
-		Type: gosocks5.AddrIPv4,
+		Type: typ,
 		Host: host,
 		Port: uint16(port),
 	}
@@ -1617,15 +2168,24 @@ func (h *socks4Handler) Init(options ...HandlerOption) {
 func (h *socks4Handler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	req, err := gosocks4.ReadRequest(conn)
+	// the request is read through the buffered reader of the connection, which keeps the data sent after the request.
+	br := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(h.options.handshakeTimeout()))
+	req, err := gosocks4.ReadRequest(br)
 	if err != nil {
-		log.Logf("[socks4] %s -> %s : %s",
+		h.options.Logger.Logf("[socks4] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	conn = &bufferdConn{Conn: conn, br: br}
+	if len(req.Userid) > 0 && h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks4] %s -> %s : userid %q",
+			conn.RemoteAddr(), conn.LocalAddr(), req.Userid)
+	}
 
-	if Debug {
-		log.Logf("[socks4] %s -> %s\n%s",
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks4] %s -> %s\n%s",
 			conn.RemoteAddr(), conn.LocalAddr(), req)
 	}
 
@@ -1634,11 +2194,11 @@ func (h *socks4Handler) Handle(conn net.Conn) {
 		h.handleConnect(conn, req)
 
 	case gosocks4.CmdBind:
-		log.Logf("[socks4-bind] %s - %s", conn.RemoteAddr(), req.Addr)
+		h.options.Logger.Logf("[socks4-bind] %s - %s", conn.RemoteAddr(), req.Addr)
 		h.handleBind(conn, req)
 
 	default:
-		log.Logf("[socks4] %s - %s : Unrecognized request: %d",
+		h.options.Logger.Logf("[socks4] %s - %s : Unrecognized request: %d",
 			conn.RemoteAddr(), conn.LocalAddr(), req.Cmd)
 	}
 }
@@ -1646,27 +2206,28 @@ func (h *socks4Handler) Handle(conn net.Conn) {
 func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 	addr := req.Addr.String()
 
-	log.Logf("[socks4] %s -> %s -> %s",
+	h.options.Logger.Logf("[socks4] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), addr)
 
-	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[socks4] %s - %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, conn.RemoteAddr().String(), addr, PeerIdentities(conn)...) {
+		h.options.Logger.Logf("[socks4] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), addr)
 		rep := gosocks4.NewReply(gosocks4.Rejected, nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks4] %s <- %s\n%s",
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks4] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), rep)
 		}
 		return
 	}
 	if h.options.Bypass.Contains(addr) {
-		log.Log("[socks4] %s - %s : Bypass %s",
+		h.options.Logger.Logf("[socks4] %s - %s : Bypass %s",
 			conn.RemoteAddr(), conn.LocalAddr(), addr)
 		rep := gosocks4.NewReply(gosocks4.Rejected, nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks4] %s <- %s\n%s",
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks4] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), rep)
 		}
 		return
@@ -1686,7 +2247,7 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(addr)
 		if err != nil {
-			log.Logf("[socks4] %s -> %s : %s",
+			h.options.Logger.Logf("[socks4] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
@@ -1698,45 +2259,47 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", addr)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		cc, err = route.Dial(addr,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, conn.RemoteAddr().String())),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[socks4] %s -> %s : %s",
+		h.options.Logger.Logf("[socks4] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
 	if err != nil {
 		rep := gosocks4.NewReply(gosocks4.Failed, nil)
 		rep.Write(conn)
-		if Debug {
-			log.Logf("[socks4] %s <- %s\n%s",
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks4] %s <- %s\n%s",
 				conn.RemoteAddr(), conn.LocalAddr(), rep)
 		}
 		return
 	}
+	cc = relayConn(h.options, conn, cc, addr)
 	defer cc.Close()
 
 	rep := gosocks4.NewReply(gosocks4.Granted, nil)
 	if err := rep.Write(conn); err != nil {
-		log.Logf("[socks4] %s <- %s : %s",
+		h.options.Logger.Logf("[socks4] %s <- %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
-	if Debug {
-		log.Logf("[socks4] %s <- %s\n%s",
+	if h.options.Logger.Debug() {
+		h.options.Logger.Logf("[socks4] %s <- %s\n%s",
 			conn.RemoteAddr(), conn.LocalAddr(), rep)
 	}
 
-	log.Logf("[socks4] %s <-> %s", conn.RemoteAddr(), addr)
+	h.options.Logger.Logf("[socks4] %s <-> %s", conn.RemoteAddr(), addr)
 	transport(conn, cc)
-	log.Logf("[socks4] %s >-< %s", conn.RemoteAddr(), addr)
+	h.options.Logger.Logf("[socks4] %s >-< %s", conn.RemoteAddr(), addr)
 }
 
 func (h *socks4Handler) handleBind(conn net.Conn, req *gosocks4.Request) {
@@ -1744,8 +2307,8 @@ func (h *socks4Handler) handleBind(conn net.Conn, req *gosocks4.Request) {
 	if h.options.Chain.IsEmpty() {
 		reply := gosocks4.NewReply(gosocks4.Rejected, nil)
 		reply.Write(conn)
-		if Debug {
-			log.Logf("[socks4-bind] %s <- %s\n%s", conn.RemoteAddr(), req.Addr, reply)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks4-bind] %s <- %s\n%s", conn.RemoteAddr(), req.Addr, reply)
 		}
 		return
 	}
@@ -1753,11 +2316,11 @@ func (h *socks4Handler) handleBind(conn net.Conn, req *gosocks4.Request) {
 	cc, err := h.options.Chain.Conn()
 	// connection error
 	if err != nil && err != ErrEmptyChain {
-		log.Logf("[socks4-bind] %s <- %s : %s", conn.RemoteAddr(), req.Addr, err)
+		h.options.Logger.Logf("[socks4-bind] %s <- %s : %s", conn.RemoteAddr(), req.Addr, err)
 		reply := gosocks4.NewReply(gosocks4.Failed, nil)
 		reply.Write(conn)
-		if Debug {
-			log.Logf("[socks4-bind] %s <- %s\n%s", conn.RemoteAddr(), req.Addr, reply)
+		if h.options.Logger.Debug() {
+			h.options.Logger.Logf("[socks4-bind] %s <- %s\n%s", conn.RemoteAddr(), req.Addr, reply)
 		}
 		return
 	}
@@ -1766,9 +2329,9 @@ func (h *socks4Handler) handleBind(conn net.Conn, req *gosocks4.Request) {
 	// forward request
 	req.Write(cc)
 
-	log.Logf("[socks4-bind] %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
+	h.options.Logger.Logf("[socks4-bind] %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
 	transport(conn, cc)
-	log.Logf("[socks4-bind] %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
+	h.options.Logger.Logf("[socks4-bind] %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
 }
 
 func getSOCKS5UDPTunnel(chain *Chain, addr net.Addr) (net.Conn, error) {
@@ -1965,7 +2528,7 @@ func (c *socks5UDPConn) Write(b []byte) (int, error) {
 }
 
 func (c *socks5UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	adr, err := gosocks5.NewAddr(addr.String())
+	adr, err := newSocks5Addr(addr.String())
 	if err != nil {
 		return 0, err
 	}
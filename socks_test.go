@@ -3,12 +3,22 @@ package gost
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/ginuerzh/gosocks4"
+	"github.com/ginuerzh/gosocks5"
 )
 
 var socks5ProxyTests = []struct {
@@ -165,6 +175,183 @@ func socks4ProxyRoundtrip(targetURL string, data []byte) error {
 	return proxyRoundtrip(client, server, targetURL, data)
 }
 
+// oneByteConn writes the data byte by byte, so the peer of the pipe reads at most one byte at a time.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c *oneByteConn) Write(b []byte) (n int, err error) {
+	for i := range b {
+		if _, err = c.Conn.Write(b[i : i+1]); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+func TestSOCKS5OneByteReads(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for i, tc := range []struct {
+		clientInfo *url.Userinfo
+		serverInfo []*url.Userinfo
+	}{
+		{nil, nil},
+		{url.UserPassword("admin", "123456"), []*url.Userinfo{url.UserPassword("admin", "123456")}},
+		{url.UserPassword("user", strings.Repeat("p", 255)), []*url.Userinfo{url.UserPassword("user", strings.Repeat("p", 255))}},
+	} {
+		cc, sc := net.Pipe()
+		h := SOCKS5Handler(UsersHandlerOption(tc.serverInfo...))
+		go h.Handle(sc)
+
+		cc.SetDeadline(time.Now().Add(3 * time.Second))
+		conn, err := SOCKS5Connector(tc.clientInfo).Connect(&oneByteConn{cc}, httpSrv.Listener.Addr().String())
+		if err != nil {
+			t.Errorf("#%d %v", i, err)
+			cc.Close()
+			continue
+		}
+		if err := httpRoundtrip(conn, httpSrv.URL, sendData); err != nil {
+			t.Errorf("#%d %v", i, err)
+		}
+		cc.Close()
+	}
+}
+
+func TestSOCKS5OneByteDomainRequest(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go func() {
+		defer sc.Close()
+		req, conn, _, err := readSOCKS5Request(sc, nil)
+		if err != nil {
+			return
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		fmt.Fprintf(sc, "%s %s", req.Addr, b)
+	}()
+
+	cc.SetDeadline(time.Now().Add(3 * time.Second))
+	req := gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{
+		Type: gosocks5.AddrDomain,
+		Host: strings.Repeat("a", 63) + ".example.com",
+		Port: 443,
+	})
+	w := &oneByteConn{cc}
+	if err := req.Write(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+
+	b, _ := ioutil.ReadAll(cc)
+	if want := req.Addr.String() + " data"; string(b) != want {
+		t.Errorf("should read %q, got %q", want, b)
+	}
+}
+
+func TestSOCKS5ReplyCode(t *testing.T) {
+	for i, tc := range []struct {
+		err  error
+		code uint8
+	}{
+		{errors.New("unknown"), gosocks5.HostUnreachable},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, gosocks5.ConnRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, gosocks5.NetUnreachable},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, gosocks5.HostUnreachable},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, gosocks5.TTLExpired},
+		{&ReplyError{Protocol: "socks5", Code: int(gosocks5.NotAllowed)}, gosocks5.NotAllowed},
+		{&ReplyError{Protocol: "http", Code: 403}, gosocks5.HostUnreachable},
+	} {
+		if code := socks5ReplyCode(tc.err); code != tc.code {
+			t.Errorf("#%d should reply %d, got %d", i, tc.code, code)
+		}
+	}
+
+	// the connection refused by the target.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	sln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Handler:  SOCKS5Handler(),
+		Listener: sln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := proxyConn(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = client.Connect(conn, addr)
+	if re, ok := err.(*ReplyError); !ok || re.Code != int(gosocks5.ConnRefused) {
+		t.Errorf("should be refused, got %v", err)
+	}
+}
+
+func TestSOCKS5ErrorDetail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := &Client{
+		Connector:   SOCKS5Connector(nil),
+		Transporter: TCPTransporter(),
+	}
+
+	for i, enabled := range []bool{false, true} {
+		sln, err := TCPListener("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Handler:  SOCKS5Handler(ErrorDetailHandlerOption(enabled)),
+			Listener: sln,
+		}
+		go server.Run()
+
+		conn, err := proxyConn(client, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Connect(conn, addr)
+		re, ok := err.(*ReplyError)
+		if !ok {
+			t.Fatalf("#%d should fail with reply error, got %v", i, err)
+		}
+		if enabled != strings.HasPrefix(re.Detail, "id=") {
+			t.Errorf("#%d unexpected detail: %q", i, re.Detail)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
 func TestSOCKS4Proxy(t *testing.T) {
 	httpSrv := httptest.NewServer(httpTestHandler)
 	defer httpSrv.Close()
@@ -345,7 +532,7 @@ func BenchmarkSOCKS4AProxyParallel(b *testing.B) {
 	})
 }
 
-func socks5BindRoundtrip(t *testing.T, targetURL string, data []byte) (err error) {
+func socks5BindRoundtrip(t *testing.T, targetURL string, data []byte, chain *Chain) (err error) {
 	ln, err := TCPListener("")
 	if err != nil {
 		return
@@ -357,7 +544,7 @@ func socks5BindRoundtrip(t *testing.T, targetURL string, data []byte) (err error
 	}
 
 	server := &Server{
-		Handler:  SOCKS5Handler(UsersHandlerOption(url.UserPassword("admin", "123456"))),
+		Handler:  SOCKS5Handler(UsersHandlerOption(url.UserPassword("admin", "123456")), ChainHandlerOption(chain)),
 		Listener: ln,
 	}
 
@@ -405,11 +592,151 @@ func TestSOCKS5Bind(t *testing.T) {
 	sendData := make([]byte, 128)
 	rand.Read(sendData)
 
-	if err := socks5BindRoundtrip(t, httpSrv.URL, sendData); err != nil {
+	if err := socks5BindRoundtrip(t, httpSrv.URL, sendData, nil); err != nil {
 		t.Errorf("got error: %v", err)
 	}
 }
 
+func TestSOCKS5BindChain(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Handler:  SOCKS5Handler(UsersHandlerOption(url.UserPassword("foo", "bar"))),
+		Listener: ln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	// the BIND request is forwarded to the last node of the chain.
+	chain := NewChain(Node{
+		Addr:     ln.Addr().String(),
+		User:     url.UserPassword("foo", "bar"),
+		Protocol: "socks5",
+		Client:   &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+	})
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	if err := socks5BindRoundtrip(t, httpSrv.URL, sendData, chain); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+}
+
+func TestSOCKS5BindPeer(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		peer bool
+	}{
+		{"0.0.0.0:0", false},
+		{":8080", false},
+		{"127.0.0.1:21", false},
+		{"[::]:21", false},
+		{"192.0.2.1:21", true},
+		{"[2001:db8::1]:0", true},
+	} {
+		if peer := socks5BindPeer(tc.addr); (peer != nil) != tc.peer {
+			t.Errorf("%s: the expected peer should be %v, got %v", tc.addr, tc.peer, peer)
+		}
+	}
+}
+
+// socks5BindRequest sends the BIND request of addr to the SOCKS5 server, it returns the address of the first reply.
+func socks5BindRequest(t *testing.T, server *Server, addr string) (net.Conn, *gosocks5.Addr) {
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if conn, err = socks5Handshake(conn, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	socksAddr, _ := newSocks5Addr(addr)
+	if err := gosocks5.NewRequest(gosocks5.CmdBind, socksAddr).Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := gosocks5.ReadReply(conn)
+	if err != nil || reply.Rep != gosocks5.Succeeded {
+		t.Fatalf("BIND %s should succeed: %v %v", addr, reply, err)
+	}
+	return conn, reply.Addr
+}
+
+func TestSOCKS5BindPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server := &Server{
+		Handler:  SOCKS5Handler(),
+		Listener: mustTCPListener(t),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, bound := socks5BindRequest(t, server, addr)
+	defer conn.Close()
+	if bound.String() != addr {
+		t.Errorf("the requested address %s should be bound, got %s", addr, bound)
+	}
+
+	// the non-local address is not taken as the peer without the bind_peer option.
+	cc, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.SetDeadline(time.Now().Add(3 * time.Second))
+	if cc, err = socks5Handshake(cc, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	socksAddr, _ := newSocks5Addr("192.0.2.1:21")
+	gosocks5.NewRequest(gosocks5.CmdBind, socksAddr).Write(cc)
+	if reply, err := gosocks5.ReadReply(cc); err != nil || reply.Rep == gosocks5.Succeeded {
+		t.Errorf("the non-local address should not be bound: %v %v", reply, err)
+	}
+}
+
+func TestSOCKS5BindPeerOption(t *testing.T) {
+	server := &Server{
+		Handler:  SOCKS5Handler(BindPeerHandlerOption(true)),
+		Listener: mustTCPListener(t),
+	}
+	go server.Run()
+	defer server.Close()
+
+	// the address is the peer, a random port is bound and only the peer is accepted.
+	conn, bound := socks5BindRequest(t, server, "192.0.2.1:21")
+	defer conn.Close()
+	if bound.Port == 0 || bound.Port == 21 {
+		t.Fatalf("a random port should be bound, got %s", bound)
+	}
+	cc, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := cc.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the unexpected peer should be rejected, got %v", err)
+	}
+
+	// the local address is bound as is.
+	conn2, bound := socks5BindRequest(t, server, "127.0.0.1:0")
+	defer conn2.Close()
+	if bound.Host != "127.0.0.1" {
+		t.Errorf("the local address should be bound, got %s", bound)
+	}
+}
+
 func socks5MuxBindRoundtrip(t *testing.T, targetURL string, data []byte) (err error) {
 	ln, err := TCPListener("")
 	if err != nil {
@@ -567,6 +894,33 @@ func TestSOCKS5UDP(t *testing.T) {
 }
 
 // TODO: fix a probability of timeout.
+func TestUDPAssociation(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	assoc := newUDPAssociation(&net.TCPAddr{IP: client.IP, Port: 20000}, 50*time.Millisecond)
+
+	if assoc.Client() != nil {
+		t.Error("the client address should be unknown before the first datagram")
+	}
+	if assoc.accept(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 10000}) {
+		t.Error("the datagram from other IP should be rejected")
+	}
+	if !assoc.accept(client) || assoc.Client().String() != client.String() {
+		t.Errorf("the datagram from the client should be accepted, got %v", assoc.Client())
+	}
+
+	if assoc.alive("127.0.0.1:53") {
+		t.Error("the reply without session should be rejected")
+	}
+	assoc.touch("127.0.0.1:53")
+	if !assoc.alive("127.0.0.1:53") {
+		t.Error("the reply of the session should be accepted")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if assoc.alive("127.0.0.1:53") {
+		t.Error("the idle session should expire")
+	}
+}
+
 func BenchmarkSOCKS5UDP(b *testing.B) {
 	udpSrv := newUDPTestServer(udpTestHandler)
 	udpSrv.Start()
@@ -695,6 +1049,44 @@ func TestSOCKS5UDPTun(t *testing.T) {
 	}
 }
 
+// TestSOCKS5UDPOverTunnel tests the standard UDP ASSOCIATE of the client served by the local server,
+// the datagrams are sent to the remote server through the UDP tunnel over TCP.
+func TestSOCKS5UDPOverTunnel(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	remote := &Server{
+		Handler:  SOCKS5Handler(UsersHandlerOption(url.UserPassword("admin", "123456"))),
+		Listener: mustTCPListener(t),
+	}
+	go remote.Run()
+	defer remote.Close()
+
+	chain := NewChain(Node{
+		Addr:   remote.Addr().String(),
+		User:   url.UserPassword("admin", "123456"),
+		Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()},
+	})
+	local := &Server{
+		Handler:  SOCKS5Handler(ChainHandlerOption(chain)),
+		Listener: mustTCPListener(t),
+	}
+	go local.Run()
+	defer local.Close()
+
+	client := &Client{
+		Connector:   SOCKS5UDPConnector(nil),
+		Transporter: TCPTransporter(),
+	}
+	if err := udpRoundtrip(t, client, local, udpSrv.Addr(), sendData); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+}
+
 func BenchmarkSOCKS5UDPTun(b *testing.B) {
 	udpSrv := newUDPTestServer(udpTestHandler)
 	udpSrv.Start()
@@ -788,3 +1180,178 @@ func BenchmarkSOCKS5UDPTunSingleConn(b *testing.B) {
 		}
 	}
 }
+
+func TestSOCKS4OnSOCKS5Listener(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	server := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  SOCKS5Handler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	for _, connector := range []Connector{SOCKS4Connector(), SOCKS4AConnector(), SOCKS5Connector(nil)} {
+		client := &Client{Connector: connector, Transporter: TCPTransporter()}
+		if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err != nil {
+			t.Errorf("%T: %v", connector, err)
+		}
+	}
+
+	authServer := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  SOCKS5Handler(UsersHandlerOption(url.UserPassword("admin", "123456"))),
+	}
+	go authServer.Run()
+	defer authServer.Close()
+
+	client := &Client{Connector: SOCKS4AConnector(), Transporter: TCPTransporter()}
+	if err := proxyRoundtrip(client, authServer, httpSrv.URL, sendData); err == nil {
+		t.Error("SOCKS4 request should be rejected when the authentication is required")
+	}
+}
+
+func TestSOCKS4OnSOCKS5ListenerConnID(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	w := &syncWriter{}
+	logger, _ := NewServiceLogger("socks-a", w, LogLevelInfo, "")
+	server := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  SOCKS5Handler(LoggerHandlerOption(logger)),
+	}
+	go server.Run()
+	defer server.Close()
+
+	client := &Client{Connector: SOCKS4AConnector(), Transporter: TCPTransporter()}
+	if err := proxyRoundtrip(client, server, httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	s := w.String()
+	if !strings.Contains(s, "[socks-a] [socks4]") {
+		t.Fatalf("the SOCKS4 request should be logged: %q", s)
+	}
+	ids := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if n := strings.Index(line, "] [socks-a]"); n > 0 {
+			ids[line[strings.LastIndex(line[:n], "[")+1:n]] = true
+		} else {
+			t.Errorf("the logs of the SOCKS4 connection should be tagged with the connection ID: %q", line)
+		}
+	}
+	if len(ids) != 1 {
+		t.Errorf("the logs of the connection should be tagged with the same ID: %q", s)
+	}
+}
+
+func TestSOCKS4Userid(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	reqs := make(chan *gosocks4.Request, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := gosocks4.ReadRequest(conn); err == nil {
+				reqs <- req
+				gosocks4.NewReply(gosocks4.Granted, nil).Write(conn)
+			}
+			conn.Close()
+		}
+	}()
+
+	user := url.User("alice")
+	for _, connector := range []Connector{SOCKS4Connector(), SOCKS4AConnector()} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = connector.Connect(conn, "127.0.0.1:80", UserConnectOption(user))
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%T: %v", connector, err)
+		}
+		if req := <-reqs; string(req.Userid) != "alice" {
+			t.Errorf("%T: user ID should be sent, got %q", connector, req.Userid)
+		}
+	}
+}
+
+func TestSOCKS4PipelinedRequest(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	server := &Server{
+		Listener: mustTCPListener(t),
+		Handler:  SOCKS4Handler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the SOCKS4A request and the HTTP request are sent in one segment.
+	host, port, _ := net.SplitHostPort(httpSrv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	buf := &bytes.Buffer{}
+	req := gosocks4.NewRequest(gosocks4.CmdConnect, &gosocks4.Addr{Type: gosocks4.AddrDomain, Host: host, Port: uint16(p)}, nil)
+	if err := req.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("GET / HTTP/1.0\r\n\r\n")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := gosocks4.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != gosocks4.Granted {
+		t.Fatalf("request should be granted, got %d", reply.Code)
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.0 200")) {
+		t.Errorf("the data sent along with the request should be relayed, got %q", resp)
+	}
+}
+
+func TestSOCKS5ConnectIPv6Zone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go SOCKS5Connector(nil).Connect(c1, "[fe80::1%eth0]:80")
+
+	gosocks5.ReadMethods(c2)
+	gosocks5.WriteMethod(gosocks5.MethodNoAuth, c2)
+	req, err := gosocks5.ReadRequest(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Addr.Type != gosocks5.AddrIPv6 || req.Addr.Host != "fe80::1" || req.Addr.Port != 80 {
+		t.Errorf("the zoned address should be encoded as the IPv6 address without the zone, got %d %s", req.Addr.Type, req.Addr)
+	}
+}
@@ -0,0 +1,155 @@
+package gost
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	speedTestUpload   = 'U'
+	speedTestDownload = 'D'
+)
+
+var (
+	// MaxSpeedTestSize is the max volume of a speed test transfer.
+	MaxSpeedTestSize int64 = 1 << 32
+
+	errSpeedTestSize = errors.New("speedtest: invalid size")
+)
+
+// SpeedTestResult is the result of a speed test transfer.
+type SpeedTestResult struct {
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Rate returns the throughput in bytes per second.
+func (r SpeedTestResult) Rate() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+type speedTestHandler struct {
+	options *HandlerOptions
+}
+
+// SpeedTestHandler creates a server Handler for the speed test service, which is the peer of SpeedTest.
+// The client requests by a mode byte ('U' for upload, 'D' for download) followed by the 8-byte big-endian size,
+// then the data of the size is sent by the client and acknowledged by the server with the 8-byte size received,
+// or sent by the server.
+func SpeedTestHandler(opts ...HandlerOption) Handler {
+	h := &speedTestHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *speedTestHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *speedTestHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	var b [9]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		h.options.Logger.Logf("[speedtest] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	size := int64(binary.BigEndian.Uint64(b[1:]))
+	if size < 0 || size > MaxSpeedTestSize {
+		h.options.Logger.Logf("[speedtest] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), errSpeedTestSize)
+		return
+	}
+
+	start := time.Now()
+	var n int64
+	var err error
+	switch b[0] {
+	case speedTestUpload:
+		n, err = io.CopyN(ioutil.Discard, conn, size)
+		if err == nil {
+			binary.BigEndian.PutUint64(b[1:], uint64(n))
+			_, err = conn.Write(b[1:])
+		}
+	case speedTestDownload:
+		n, err = io.CopyN(conn, speedTestReader{}, size)
+	default:
+		h.options.Logger.Logf("[speedtest] %s - %s : unknown mode %d", conn.RemoteAddr(), conn.LocalAddr(), b[0])
+		return
+	}
+	if err != nil {
+		h.options.Logger.Logf("[speedtest] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	h.options.Logger.Logf("[speedtest] %s - %s : %c %d bytes in %v",
+		conn.RemoteAddr(), conn.LocalAddr(), b[0], n, time.Since(start))
+}
+
+// SpeedTest transfers size bytes over the connection conn to the speed test service,
+// from the client to the service if upload is true, otherwise the reverse.
+func SpeedTest(conn net.Conn, upload bool, size int64) (result SpeedTestResult, err error) {
+	if size < 0 || size > MaxSpeedTestSize {
+		err = errSpeedTestSize
+		return
+	}
+
+	var b [9]byte
+	b[0] = speedTestDownload
+	if upload {
+		b[0] = speedTestUpload
+	}
+	binary.BigEndian.PutUint64(b[1:], uint64(size))
+
+	start := time.Now()
+	if _, err = conn.Write(b[:]); err != nil {
+		return
+	}
+
+	if upload {
+		if result.Bytes, err = io.CopyN(conn, speedTestReader{}, size); err != nil {
+			return
+		}
+		// wait for the acknowledgement, so the buffered data are counted.
+		if _, err = io.ReadFull(conn, b[1:]); err != nil {
+			return
+		}
+		if n := int64(binary.BigEndian.Uint64(b[1:])); n != size {
+			err = errSpeedTestSize
+			return
+		}
+	} else {
+		if result.Bytes, err = io.CopyN(ioutil.Discard, conn, size); err != nil {
+			return
+		}
+	}
+	result.Duration = time.Since(start)
+	return
+}
+
+// speedTestData is the incompressible data block for the transfer, so the compression of the transports does not affect the result.
+var speedTestData = func() []byte {
+	b := make([]byte, 32*1024)
+	rand.Read(b)
+	return b
+}()
+
+type speedTestReader struct{}
+
+func (speedTestReader) Read(b []byte) (int, error) {
+	n := copy(b, speedTestData)
+	return n, nil
+}
@@ -0,0 +1,49 @@
+package gost
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSpeedTest(t *testing.T) {
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  SpeedTestHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	for i, tc := range []struct {
+		upload bool
+		size   int64
+	}{
+		{true, 0},
+		{true, 1},
+		{true, 1 << 20},
+		{false, 0},
+		{false, 100},
+		{false, 1 << 20},
+	} {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := SpeedTest(conn, tc.upload, tc.size)
+		conn.Close()
+		if err != nil {
+			t.Errorf("#%d %s", i, err)
+			continue
+		}
+		if result.Bytes != tc.size || result.Duration <= 0 {
+			t.Errorf("#%d unexpected result: %+v", i, result)
+		}
+	}
+
+	if _, err := SpeedTest(nil, true, MaxSpeedTestSize+1); err == nil {
+		t.Error("the size exceeding the max size should fail")
+	}
+}
@@ -102,33 +102,36 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 	}
 	cipher, err := ss.NewCipher(method, password)
 	if err != nil {
-		log.Logf("[ss] %s -> %s : %s",
+		h.options.Logger.Logf("[ss] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
+	ids := PeerIdentities(conn)
 	conn = &shadowConn{Conn: ss.NewConn(conn, cipher)}
 
-	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	conn.SetReadDeadline(time.Now().Add(h.options.handshakeTimeout()))
 	host, err := h.getRequest(conn)
 	if err != nil {
-		log.Logf("[ss] %s -> %s : %s",
+		h.options.Logger.Logf("[ss] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
 	// clear timer
 	conn.SetReadDeadline(time.Time{})
+	host = normalizeAddr(host)
 
-	log.Logf("[ss] %s -> %s -> %s",
+	h.options.Logger.Logf("[ss] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[ss] %s - %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, conn.RemoteAddr().String(), host, ids...) {
+		h.options.Logger.Logf("[ss] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
 	}
 
 	if h.options.Bypass.Contains(host) {
-		log.Logf("[ss] %s - %s : Bypass %s",
+		h.options.Logger.Logf("[ss] %s - %s : Bypass %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
 	}
@@ -146,7 +149,7 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(host)
 		if err != nil {
-			log.Logf("[ss] %s -> %s : %s",
+			h.options.Logger.Logf("[ss] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
@@ -158,28 +161,30 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", host)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		cc, err = route.Dial(host,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, conn.RemoteAddr().String())),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[ss] %s -> %s : %s",
+		h.options.Logger.Logf("[ss] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
 	if err != nil {
 		return
 	}
+	cc = relayConn(h.options, conn, cc, host)
 	defer cc.Close()
 
-	log.Logf("[ss] %s <-> %s", conn.RemoteAddr(), host)
+	h.options.Logger.Logf("[ss] %s <-> %s", conn.RemoteAddr(), host)
 	transport(conn, cc)
-	log.Logf("[ss] %s >-< %s", conn.RemoteAddr(), host)
+	h.options.Logger.Logf("[ss] %s >-< %s", conn.RemoteAddr(), host)
 }
 
 const (
@@ -203,7 +208,8 @@ func (h *shadowHandler) getRequest(r io.Reader) (host string, err error) {
 	// buf size should at least have the same size with the largest possible
 	// request size (when addrType is 3, domain name has at most 256 bytes)
 	// 1(addrType) + 1(lenByte) + 256(max length address) + 2(port)
-	buf := make([]byte, smallBufferSize)
+	buf := sPool.Get().([]byte)
+	defer sPool.Put(buf)
 
 	// read till we get possible domain length field
 	if _, err = io.ReadFull(r, buf[:idType+1]); err != nil {
@@ -424,23 +430,23 @@ func (h *shadowUDPdHandler) Handle(conn net.Conn) {
 	if h.options.Chain.IsEmpty() {
 		cc, err = net.ListenUDP("udp", nil)
 		if err != nil {
-			log.Logf("[ssu] %s - : %s", conn.LocalAddr(), err)
+			h.options.Logger.Logf("[ssu] %s - : %s", conn.LocalAddr(), err)
 			return
 		}
 	} else {
 		var c net.Conn
 		c, err = getSOCKS5UDPTunnel(h.options.Chain, nil)
 		if err != nil {
-			log.Logf("[ssu] %s - : %s", conn.LocalAddr(), err)
+			h.options.Logger.Logf("[ssu] %s - : %s", conn.LocalAddr(), err)
 			return
 		}
 		cc = &udpTunnelConn{Conn: c}
 	}
 	defer cc.Close()
 
-	log.Logf("[ssu] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
+	h.options.Logger.Logf("[ssu] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
 	h.transportUDP(conn, cc)
-	log.Logf("[ssu] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
+	h.options.Logger.Logf("[ssu] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
 }
 
 func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
@@ -456,18 +462,18 @@ func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
 
 			n, err := sc.Read(b[3:]) // add rsv and frag fields to make it the standard SOCKS5 UDP datagram
 			if err != nil {
-				// log.Logf("[ssu] %s - %s : %s", sc.RemoteAddr(), sc.LocalAddr(), err)
+				// h.options.Logger.Logf("[ssu] %s - %s : %s", sc.RemoteAddr(), sc.LocalAddr(), err)
 				errc <- err
 				return
 			}
 			dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n+3]))
 			if err != nil {
-				log.Logf("[ssu] %s - %s : %s", sc.RemoteAddr(), sc.LocalAddr(), err)
+				h.options.Logger.Logf("[ssu] %s - %s : %s", sc.RemoteAddr(), sc.LocalAddr(), err)
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[ssu] %s >>> %s length: %d", sc.RemoteAddr(), dgram.Header.Addr.String(), len(dgram.Data))
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[ssu] %s >>> %s length: %d", sc.RemoteAddr(), dgram.Header.Addr.String(), len(dgram.Data))
 			}
 			addr, err := net.ResolveUDPAddr("udp", dgram.Header.Addr.String())
 			if err != nil {
@@ -475,7 +481,7 @@ func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
 				return
 			}
 			if h.options.Bypass.Contains(addr.String()) {
-				log.Log("[ssu] [bypass] write to", addr)
+				h.options.Logger.Log("[ssu] [bypass] write to", addr)
 				continue // bypass
 			}
 			if _, err := cc.WriteTo(dgram.Data, addr); err != nil {
@@ -495,18 +501,18 @@ func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
 				errc <- err
 				return
 			}
-			if Debug {
-				log.Logf("[ssu] %s <<< %s length: %d", sc.RemoteAddr(), addr, n)
+			if h.options.Logger.Debug() {
+				h.options.Logger.Logf("[ssu] %s <<< %s length: %d", sc.RemoteAddr(), addr, n)
 			}
 			if h.options.Bypass.Contains(addr.String()) {
-				log.Log("[ssu] [bypass] read from", addr)
+				h.options.Logger.Log("[ssu] [bypass] read from", addr)
 				continue // bypass
 			}
 			dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, toSocksAddr(addr)), b[:n])
 			buf := bytes.Buffer{}
 			dgram.Write(&buf)
 			if buf.Len() < 10 {
-				log.Logf("[ssu] %s <- %s : invalid udp datagram", sc.RemoteAddr(), addr)
+				h.options.Logger.Logf("[ssu] %s <- %s : invalid udp datagram", sc.RemoteAddr(), addr)
 				continue
 			}
 			if _, err := sc.Write(buf.Bytes()[3:]); err != nil {
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/ginuerzh/gosocks5"
-	"github.com/go-log/log"
 	"github.com/shadowsocks/go-shadowsocks2/core"
 )
 
@@ -39,7 +38,7 @@ func (c *shadow2Connector) Connect(conn net.Conn, addr string, options ...Connec
 	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{})
 
-	socksAddr, err := gosocks5.NewAddr(addr)
+	socksAddr, err := newSocks5Addr(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -108,17 +107,18 @@ func (h *shadow2Handler) Handle(conn net.Conn) {
 
 	cipher, err := core.PickCipher(method, nil, password)
 	if err != nil {
-		log.Logf("[ss2] %s -> %s : %s",
+		h.options.Logger.Logf("[ss2] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
 
+	ids := PeerIdentities(conn)
 	conn = cipher.StreamConn(conn)
-	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	conn.SetReadDeadline(time.Now().Add(h.options.handshakeTimeout()))
 
 	addr, err := readAddr(conn)
 	if err != nil {
-		log.Logf("[ss2] %s -> %s : %s",
+		h.options.Logger.Logf("[ss2] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
@@ -126,18 +126,19 @@ func (h *shadow2Handler) Handle(conn net.Conn) {
 	// clear timer
 	conn.SetReadDeadline(time.Time{})
 
-	host := addr.String()
-	log.Logf("[ss2] %s -> %s -> %s",
+	host := normalizeAddr(addr.String())
+	h.options.Logger.Logf("[ss2] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[ss2] %s - %s : Unauthorized to tcp connect to %s",
+	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) ||
+		!canRelay(h.options, conn.RemoteAddr().String(), host, ids...) {
+		h.options.Logger.Logf("[ss2] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
 	}
 
 	if h.options.Bypass.Contains(host) {
-		log.Logf("[ss2] %s - %s : Bypass %s",
+		h.options.Logger.Logf("[ss2] %s - %s : Bypass %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
 	}
@@ -155,7 +156,7 @@ func (h *shadow2Handler) Handle(conn net.Conn) {
 	for i := 0; i < retries; i++ {
 		route, err = h.options.Chain.selectRouteFor(host)
 		if err != nil {
-			log.Logf("[ss2] %s -> %s : %s",
+			h.options.Logger.Logf("[ss2] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
 			continue
 		}
@@ -167,28 +168,30 @@ func (h *shadow2Handler) Handle(conn net.Conn) {
 			fmt.Fprintf(&buf, "%d@%s -> ", nd.ID, nd.String())
 		}
 		fmt.Fprintf(&buf, "%s", host)
-		log.Log("[route]", buf.String())
+		h.options.Logger.Log("[route]", buf.String())
 
 		cc, err = route.Dial(host,
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
+			ResolverChainOption(resolverFor(h.options.Resolver, conn.RemoteAddr().String())),
+			DNSPolicyChainOption(h.options.DNSPolicy),
 		)
 		if err == nil {
 			break
 		}
-		log.Logf("[ss2] %s -> %s : %s",
+		h.options.Logger.Logf("[ss2] %s -> %s : %s",
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 	}
 
 	if err != nil {
 		return
 	}
+	cc = relayConn(h.options, conn, cc, host)
 	defer cc.Close()
 
-	log.Logf("[ss2] %s <-> %s", conn.RemoteAddr(), host)
+	h.options.Logger.Logf("[ss2] %s <-> %s", conn.RemoteAddr(), host)
 	transport(conn, cc)
-	log.Logf("[ss2] %s >-< %s", conn.RemoteAddr(), host)
+	h.options.Logger.Logf("[ss2] %s >-< %s", conn.RemoteAddr(), host)
 }
 
 func readAddr(r io.Reader) (*gosocks5.Addr, error) {
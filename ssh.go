@@ -14,6 +14,7 @@ import (
 
 	"github.com/go-log/log"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // Applicable SSH Request types for Port Forwarding - RFC 4254 7.X
@@ -120,6 +121,50 @@ func (c *sshRemoteForwardConnector) Connect(conn net.Conn, addr string, options
 	return sc, nil
 }
 
+// SSHClientConfig holds the SSH client config.
+type SSHClientConfig struct {
+	// AgentSocket is the path of the UNIX socket of the SSH agent, such as $SSH_AUTH_SOCK,
+	// the keys of the agent are used for the public key authentication.
+	AgentSocket string
+	// Signers are the private keys for the public key authentication, such as the one of the identity file.
+	Signers []ssh.Signer
+	// HostKeyCallback verifies the host key of the server, such as by the known_hosts file,
+	// the host key is not verified if it is nil.
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// sshClientConn establishes the SSH client connection over conn to the server opts.Addr.
+// The private keys and the keys of the SSH agent are tried before the password of the user.
+func sshClientConn(conn net.Conn, opts *HandshakeOptions, timeout time.Duration) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	config := &ssh.ClientConfig{
+		Timeout:         timeout,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	if c := opts.SSHConfig; c != nil {
+		if c.HostKeyCallback != nil {
+			config.HostKeyCallback = c.HostKeyCallback
+		}
+		if len(c.Signers) > 0 {
+			config.Auth = append(config.Auth, ssh.PublicKeys(c.Signers...))
+		}
+		if c.AgentSocket != "" {
+			ac, err := net.DialTimeout("unix", c.AgentSocket, timeout)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			defer ac.Close() // the agent is only used by the authentication.
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(ac).Signers))
+		}
+	}
+	if opts.User != nil {
+		config.User = opts.User.Username()
+		if password, ok := opts.User.Password(); ok || len(config.Auth) == 0 {
+			config.Auth = append(config.Auth, ssh.Password(password))
+		}
+	}
+	return ssh.NewClientConn(conn, opts.Addr, config)
+}
+
 type sshForwardTransporter struct {
 	sessions     map[string]*sshSession
 	sessionMutex sync.Mutex
@@ -148,11 +193,7 @@ func (tr *sshForwardTransporter) Dial(addr string, options ...DialOption) (conn
 
 	session, ok := tr.sessions[addr]
 	if !ok || session.Closed() {
-		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
-		} else {
-			conn, err = opts.Chain.Dial(addr)
-		}
+		conn, err = opts.dial(addr, timeout)
 		if err != nil {
 			return
 		}
@@ -177,18 +218,6 @@ func (tr *sshForwardTransporter) Handshake(conn net.Conn, options ...HandshakeOp
 		timeout = HandshakeTimeout
 	}
 
-	config := ssh.ClientConfig{
-		Timeout:         timeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	if opts.User != nil {
-		config.User = opts.User.Username()
-		password, _ := opts.User.Password()
-		config.Auth = []ssh.AuthMethod{
-			ssh.Password(password),
-		}
-	}
-
 	tr.sessionMutex.Lock()
 	defer tr.sessionMutex.Unlock()
 
@@ -196,8 +225,12 @@ func (tr *sshForwardTransporter) Handshake(conn net.Conn, options ...HandshakeOp
 	defer conn.SetDeadline(time.Time{})
 
 	session, ok := tr.sessions[opts.Addr]
+	if ok && session.client != nil && conn != session.conn {
+		// the connection via the previous hop is not needed as the session is reused.
+		conn.Close()
+	}
 	if !ok || session.client == nil {
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, opts.Addr, &config)
+		sshConn, chans, reqs, err := sshClientConn(conn, opts, timeout)
 		if err != nil {
 			conn.Close()
 			delete(tr.sessions, opts.Addr)
@@ -257,11 +290,7 @@ func (tr *sshTunnelTransporter) Dial(addr string, options ...DialOption) (conn n
 
 	session, ok := tr.sessions[addr]
 	if !ok || session.Closed() {
-		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
-		} else {
-			conn, err = opts.Chain.Dial(addr)
-		}
+		conn, err = opts.dial(addr, timeout)
 		if err != nil {
 			return
 		}
@@ -286,18 +315,6 @@ func (tr *sshTunnelTransporter) Handshake(conn net.Conn, options ...HandshakeOpt
 		timeout = HandshakeTimeout
 	}
 
-	config := ssh.ClientConfig{
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	// TODO: support pubkey auth.
-	if opts.User != nil {
-		config.User = opts.User.Username()
-		password, _ := opts.User.Password()
-		config.Auth = []ssh.AuthMethod{
-			ssh.Password(password),
-		}
-	}
-
 	tr.sessionMutex.Lock()
 	defer tr.sessionMutex.Unlock()
 
@@ -306,7 +323,7 @@ func (tr *sshTunnelTransporter) Handshake(conn net.Conn, options ...HandshakeOpt
 
 	session, ok := tr.sessions[opts.Addr]
 	if !ok || session.client == nil {
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, opts.Addr, &config)
+		sshConn, chans, reqs, err := sshClientConn(conn, opts, timeout)
 		if err != nil {
 			conn.Close()
 			delete(tr.sessions, opts.Addr)
@@ -465,7 +482,7 @@ func (h *sshForwardHandler) Init(options ...HandlerOption) {
 	}
 	h.config = &ssh.ServerConfig{}
 
-	h.config.PasswordCallback = defaultSSHPasswordCallback(h.options.Authenticator)
+	h.config.PasswordCallback = defaultSSHPasswordCallback(h.options.Authenticator, h.options.Banner)
 	if h.options.Authenticator == nil {
 		h.config.NoClientAuth = true
 	}
@@ -476,7 +493,7 @@ func (h *sshForwardHandler) Init(options ...HandlerOption) {
 	if tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
 		signer, err := ssh.NewSignerFromKey(tlsConfig.Certificates[0].PrivateKey)
 		if err != nil {
-			log.Log("[ssh-forward]", err)
+			h.options.Logger.Log("[ssh-forward]", err)
 		}
 		h.config.AddHostKey(signer)
 	}
@@ -485,15 +502,15 @@ func (h *sshForwardHandler) Init(options ...HandlerOption) {
 func (h *sshForwardHandler) Handle(conn net.Conn) {
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, h.config)
 	if err != nil {
-		log.Logf("[ssh-forward] %s -> %s : %s", conn.RemoteAddr(), h.options.Node.Addr, err)
+		h.options.Logger.Logf("[ssh-forward] %s -> %s : %s", conn.RemoteAddr(), h.options.Node.Addr, err)
 		conn.Close()
 		return
 	}
 	defer sshConn.Close()
 
-	log.Logf("[ssh-forward] %s <-> %s", conn.RemoteAddr(), h.options.Node.Addr)
+	h.options.Logger.Logf("[ssh-forward] %s <-> %s", conn.RemoteAddr(), h.options.Node.Addr)
 	h.handleForward(sshConn, chans, reqs)
-	log.Logf("[ssh-forward] %s >-< %s", conn.RemoteAddr(), h.options.Node.Addr)
+	h.options.Logger.Logf("[ssh-forward] %s >-< %s", conn.RemoteAddr(), h.options.Node.Addr)
 }
 
 func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
@@ -506,7 +523,7 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 			case RemoteForwardRequest:
 				go h.tcpipForwardRequest(conn, req, quit)
 			default:
-				// log.Log("[ssh] unknown request type:", req.Type, req.WantReply)
+				// h.options.Logger.Log("[ssh] unknown request type:", req.Type, req.WantReply)
 				if req.WantReply {
 					req.Reply(false, nil)
 				}
@@ -522,7 +539,7 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 			case DirectForwardRequest:
 				channel, requests, err := newChannel.Accept()
 				if err != nil {
-					log.Log("[ssh] Could not accept channel:", err)
+					h.options.Logger.Log("[ssh] Could not accept channel:", err)
 					continue
 				}
 				p := directForward{}
@@ -535,7 +552,7 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 				go ssh.DiscardRequests(requests)
 				go h.directPortForwardChannel(channel, fmt.Sprintf("%s:%d", p.Host1, p.Port1))
 			default:
-				log.Log("[ssh] Unknown channel type:", t)
+				h.options.Logger.Log("[ssh] Unknown channel type:", t)
 				newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 			}
 		}
@@ -547,15 +564,15 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 func (h *sshForwardHandler) directPortForwardChannel(channel ssh.Channel, raddr string) {
 	defer channel.Close()
 
-	log.Logf("[ssh-tcp] %s - %s", h.options.Node.Addr, raddr)
+	h.options.Logger.Logf("[ssh-tcp] %s - %s", h.options.Node.Addr, raddr)
 
 	if !Can("tcp", raddr, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[ssh-tcp] Unauthorized to tcp connect to %s", raddr)
+		h.options.Logger.Logf("[ssh-tcp] Unauthorized to tcp connect to %s", raddr)
 		return
 	}
 
 	if h.options.Bypass.Contains(raddr) {
-		log.Logf("[ssh-tcp] [bypass] %s", raddr)
+		h.options.Logger.Logf("[ssh-tcp] [bypass] %s", raddr)
 		return
 	}
 
@@ -564,16 +581,17 @@ func (h *sshForwardHandler) directPortForwardChannel(channel ssh.Channel, raddr
 		TimeoutChainOption(h.options.Timeout),
 		HostsChainOption(h.options.Hosts),
 		ResolverChainOption(h.options.Resolver),
+		DNSPolicyChainOption(h.options.DNSPolicy),
 	)
 	if err != nil {
-		log.Logf("[ssh-tcp] %s - %s : %s", h.options.Node.Addr, raddr, err)
+		h.options.Logger.Logf("[ssh-tcp] %s - %s : %s", h.options.Node.Addr, raddr, err)
 		return
 	}
 	defer conn.Close()
 
-	log.Logf("[ssh-tcp] %s <-> %s", h.options.Node.Addr, raddr)
+	h.options.Logger.Logf("[ssh-tcp] %s <-> %s", h.options.Node.Addr, raddr)
 	transport(conn, channel)
-	log.Logf("[ssh-tcp] %s >-< %s", h.options.Node.Addr, raddr)
+	h.options.Logger.Logf("[ssh-tcp] %s >-< %s", h.options.Node.Addr, raddr)
 }
 
 // tcpipForward is structure for RFC 4254 7.1 "tcpip-forward" request
@@ -589,20 +607,20 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 	addr := fmt.Sprintf("%s:%d", t.Host, t.Port)
 
 	if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[ssh-rtcp] Unauthorized to tcp bind to %s", addr)
+		h.options.Logger.Logf("[ssh-rtcp] Unauthorized to tcp bind to %s", addr)
 		req.Reply(false, nil)
 		return
 	}
 
 	ln, err := net.Listen("tcp", addr) //tie to the client connection
 	if err != nil {
-		log.Log("[ssh-rtcp]", err)
+		h.options.Logger.Log("[ssh-rtcp]", err)
 		req.Reply(false, nil)
 		return
 	}
 	defer ln.Close()
 
-	log.Log("[ssh-rtcp] listening on tcp", ln.Addr())
+	h.options.Logger.Log("[ssh-rtcp] listening on tcp", ln.Addr())
 
 	replyFunc := func() error {
 		if t.Port == 0 && req.WantReply { // Client sent port 0. let them know which port is actually being used
@@ -618,7 +636,7 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 		return req.Reply(true, nil)
 	}
 	if err := replyFunc(); err != nil {
-		log.Log("[ssh-rtcp]", err)
+		h.options.Logger.Log("[ssh-rtcp]", err)
 		return
 	}
 
@@ -646,15 +664,15 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 				p.Port2 = uint32(portnum)
 				ch, reqs, err := sshConn.OpenChannel(ForwardedTCPReturnRequest, ssh.Marshal(p))
 				if err != nil {
-					log.Log("[ssh-rtcp] open forwarded channel:", err)
+					h.options.Logger.Log("[ssh-rtcp] open forwarded channel:", err)
 					return
 				}
 				defer ch.Close()
 				go ssh.DiscardRequests(reqs)
 
-				log.Logf("[ssh-rtcp] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
+				h.options.Logger.Logf("[ssh-rtcp] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
 				transport(ch, conn)
-				log.Logf("[ssh-rtcp] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
+				h.options.Logger.Logf("[ssh-rtcp] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
 			}(conn)
 		}
 	}()
@@ -666,6 +684,7 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 type SSHConfig struct {
 	Authenticator Authenticator
 	TLSConfig     *tls.Config
+	Banner        *Banner // records the authentication failures of the clients
 }
 
 type sshTunnelListener struct {
@@ -687,7 +706,7 @@ func SSHTunnelListener(addr string, config *SSHConfig) (Listener, error) {
 	}
 
 	sshConfig := &ssh.ServerConfig{}
-	sshConfig.PasswordCallback = defaultSSHPasswordCallback(config.Authenticator)
+	sshConfig.PasswordCallback = defaultSSHPasswordCallback(config.Authenticator, config.Banner)
 	if config.Authenticator == nil {
 		sshConfig.NoClientAuth = true
 	}
@@ -807,12 +826,13 @@ func getHostPortFromAddr(addr net.Addr) (host string, port int, err error) {
 // PasswordCallbackFunc is a callback function used by SSH server.
 type PasswordCallbackFunc func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)
 
-func defaultSSHPasswordCallback(au Authenticator) PasswordCallbackFunc {
+func defaultSSHPasswordCallback(au Authenticator, banner *Banner) PasswordCallbackFunc {
 	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 		if au.Authenticate(conn.User(), string(password)) {
 			return nil, nil
 		}
 		log.Logf("[ssh] %s -> %s : password rejected for %s", conn.RemoteAddr(), conn.LocalAddr(), conn.User())
+		banner.Fail(conn.RemoteAddr().String())
 		return nil, fmt.Errorf("password rejected for %s", conn.User())
 	}
 }
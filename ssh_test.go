@@ -1,13 +1,23 @@
 package gost
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func sshDirectForwardRoundtrip(targetURL string, data []byte) error {
@@ -579,3 +589,199 @@ func TestSSHForwardTunnel(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSSHJumpHosts(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	var nodes []Node
+	for i := 0; i < 2; i++ {
+		ln, err := TCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Listener: ln,
+			Handler:  SSHForwardHandler(),
+		}
+		go server.Run()
+		defer server.Close()
+
+		nodes = append(nodes, Node{
+			Addr: ln.Addr().String(),
+			Client: &Client{
+				Connector:   SSHDirectForwardConnector(),
+				Transporter: SSHForwardTransporter(),
+			},
+			HandshakeOptions: []HandshakeOption{AddrHandshakeOption(ln.Addr().String())},
+		})
+	}
+	chain := NewChain(nodes...)
+
+	// the sessions of the hops are reused by the subsequent dials.
+	for i := 0; i < 2; i++ {
+		conn, err := chain.Dial(httpSrv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = httpRoundtrip(conn, httpSrv.URL, sendData)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sshTestServer accepts one SSH connection by the public key key on ln with the host key signer.
+func sshTestServer(ln net.Listener, signer ssh.Signer, key ssh.PublicKey) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	config.AddHostKey(signer)
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if sc, chans, reqs, err := ssh.NewServerConn(conn, config); err == nil {
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "")
+			}
+		}()
+		sc.Wait()
+	}
+}
+
+func TestSSHClientAgentAndKnownHosts(t *testing.T) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	userSigner, _ := ssh.NewSignerFromKey(userKey)
+
+	dir, err := ioutil.TempDir("", "gost-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the SSH agent holding the user key.
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: userKey})
+	agentSocket := filepath.Join(dir, "agent.sock")
+	aln, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer aln.Close()
+	go func() {
+		for {
+			conn, err := aln.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+
+	for i, tc := range []struct {
+		knownKey ssh.PublicKey
+		ok       bool
+	}{
+		{hostSigner.PublicKey(), true},
+		{otherSigner.PublicKey(), false}, // the host key mismatches the known_hosts.
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sshTestServer(ln, hostSigner, userSigner.PublicKey())
+
+		knownHosts := filepath.Join(dir, fmt.Sprintf("known_hosts%d", i))
+		line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, tc.knownKey)
+		if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &HandshakeOptions{
+			Addr: ln.Addr().String(),
+			User: url.User("gost"),
+			SSHConfig: &SSHClientConfig{
+				AgentSocket:     agentSocket,
+				HostKeyCallback: callback,
+			},
+		}
+		sc, _, _, err := sshClientConn(conn, opts, HandshakeTimeout)
+		if (err == nil) != tc.ok {
+			t.Errorf("#%d the handshake should succeed: %v, got %v", i, tc.ok, err)
+		}
+		if sc != nil {
+			sc.Close()
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
+
+func TestSSHClientKey(t *testing.T) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	userSigner, _ := ssh.NewSignerFromKey(userKey)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+
+	for i, tc := range []struct {
+		signer ssh.Signer
+		ok     bool
+	}{
+		{userSigner, true},
+		{otherSigner, false}, // the key is not authorized.
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sshTestServer(ln, hostSigner, userSigner.PublicKey())
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &HandshakeOptions{
+			Addr:      ln.Addr().String(),
+			User:      url.User("gost"),
+			SSHConfig: &SSHClientConfig{Signers: []ssh.Signer{tc.signer}},
+		}
+		sc, _, _, err := sshClientConn(conn, opts, HandshakeTimeout)
+		if (err == nil) != tc.ok {
+			t.Errorf("#%d the handshake should succeed: %v, got %v", i, tc.ok, err)
+		}
+		if sc != nil {
+			sc.Close()
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
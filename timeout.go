@@ -0,0 +1,193 @@
+package gost
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// idleTimer closes the connection if there is no data read from or written to it within the timeout.
+type idleTimer struct {
+	conn    net.Conn
+	timeout time.Duration
+	last    int64 // the time of the last activity in Unix nanoseconds
+	holds   int32
+	closed  int32
+	timer   *time.Timer
+}
+
+// idleTimerOf returns the idle timer of the connection conn accepted by IdleTimeoutListener, or nil if none.
+func idleTimerOf(conn net.Conn) *idleTimer {
+	for {
+		switch c := conn.(type) {
+		case *idleConn:
+			return c.idle
+		case wrappedConn:
+			conn = c.unwrap()
+		case *bufferdConn:
+			conn = c.Conn
+		case *trafficConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// touch records the activity of the connection, such as the data relayed for it by other means.
+func (t *idleTimer) touch() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// hold keeps the connection open however long it is silent until release is called,
+// such as the control connection waiting for the peer of a BIND request.
+func (t *idleTimer) hold() {
+	if t == nil {
+		return
+	}
+	atomic.AddInt32(&t.holds, 1)
+}
+
+func (t *idleTimer) release() {
+	if t == nil {
+		return
+	}
+	t.touch()
+	atomic.AddInt32(&t.holds, -1)
+}
+
+func (t *idleTimer) check() {
+	if atomic.LoadInt32(&t.closed) == 1 {
+		return
+	}
+	if atomic.LoadInt32(&t.holds) > 0 {
+		t.timer.Reset(t.timeout)
+		return
+	}
+	d := time.Since(time.Unix(0, atomic.LoadInt64(&t.last)))
+	if d < t.timeout {
+		t.timer.Reset(t.timeout - d)
+		return
+	}
+	if Debug {
+		log.Logf("[idle] %s - %s : closed after idle for %s", t.conn.RemoteAddr(), t.conn.LocalAddr(), d.Round(time.Second))
+	}
+	t.conn.Close()
+}
+
+func (t *idleTimer) stop() {
+	atomic.StoreInt32(&t.closed, 1)
+	t.timer.Stop()
+}
+
+type idleConn struct {
+	net.Conn
+	idle *idleTimer
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) net.Conn {
+	t := &idleTimer{conn: conn, timeout: timeout}
+	t.touch()
+	t.timer = time.AfterFunc(timeout, t.check)
+	return &idleConn{Conn: conn, idle: t}
+}
+
+func (c *idleConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return
+}
+
+func (c *idleConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return
+}
+
+func (c *idleConn) Close() error {
+	c.idle.stop()
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the connection if it supports half-close.
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+func (c *idleConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+// rewrap shares the timer, the duplicate of the connection keeps the connection alive.
+func (c *idleConn) rewrap(conn net.Conn) net.Conn {
+	return &idleConn{Conn: conn, idle: c.idle}
+}
+
+type idleTimeoutListener struct {
+	Listener
+	timeout time.Duration
+}
+
+// IdleTimeoutListener wraps the listener ln to close the accepted connections which are silent for the timeout,
+// neither the client nor the target sends any data. The connections never time out if the timeout is not positive.
+func IdleTimeoutListener(ln Listener, timeout time.Duration) Listener {
+	if timeout <= 0 {
+		return ln
+	}
+	return &idleTimeoutListener{Listener: ln, timeout: timeout}
+}
+
+func (l *idleTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newIdleConn(conn, l.timeout), nil
+}
+
+type keepAliveListener struct {
+	Listener
+	period time.Duration
+}
+
+// KeepAliveListener wraps the listener ln to set the TCP keep-alive period of the accepted connections
+// instead of KeepAliveTime, the keep-alive is disabled if period is negative.
+// It only applies to the connections of the TCP and TLS based transports.
+func KeepAliveListener(ln Listener, period time.Duration) Listener {
+	if period == 0 {
+		return ln
+	}
+	return &keepAliveListener{Listener: ln, period: period}
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c, _ := unwrapConn(conn)
+	if nc, ok := c.(interface{ NetConn() net.Conn }); ok { // *tls.Conn
+		c = nc.NetConn()
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.period < 0 {
+			tc.SetKeepAlive(false)
+		} else {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		}
+	}
+	return conn, nil
+}
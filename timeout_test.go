@@ -0,0 +1,190 @@
+package gost
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestIdleTimeoutListener(t *testing.T) {
+	ln := mustTCPListener(t)
+	if IdleTimeoutListener(ln, 0) != ln {
+		t.Error("listener should not be wrapped without the timeout")
+	}
+	ln = IdleTimeoutListener(ln, 200*time.Millisecond)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the duplicate of the connection shares the timer.
+	raw, wrap := unwrapConn(conn)
+	dup := wrap(raw)
+
+	// the activity keeps the connection alive.
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := dup.Write([]byte("ping")); err != nil {
+			t.Fatalf("active connection should not be closed: %v", err)
+		}
+	}
+	io.ReadFull(client, make([]byte, 16))
+
+	start := time.Now()
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("silent connection should be closed, got %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("connection should be closed after idle for 200ms, got %v", d)
+	}
+}
+
+func TestKeepAliveListener(t *testing.T) {
+	ln := mustTCPListener(t)
+	if KeepAliveListener(ln, 0) != ln {
+		t.Error("listener should not be wrapped without the period")
+	}
+	ln = KeepAliveListener(ln, -1)
+	defer ln.Close()
+
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("connection should not be wrapped, got %T", conn)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	for _, handler := range []Handler{
+		SOCKS5Handler(HandshakeTimeoutHandlerOption(100 * time.Millisecond)),
+		SOCKS4Handler(HandshakeTimeoutHandlerOption(100 * time.Millisecond)),
+		HTTPHandler(HandshakeTimeoutHandlerOption(100 * time.Millisecond)),
+	} {
+		server := &Server{
+			Listener: mustTCPListener(t),
+			Handler:  handler,
+		}
+		go server.Run()
+
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the client stalls in the negotiation.
+		conn.Write([]byte{0x05})
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		start := time.Now()
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%T: stalled client should be disconnected, got %v", handler, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%T: stalled client should be disconnected after 100ms, got %v", handler, d)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestIdleTimeoutUDPAssociate(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	for _, tunnel := range []bool{false, true} {
+		connector := SOCKS5UDPConnector(nil)
+		if tunnel {
+			connector = SOCKS5UDPTunConnector(nil)
+		}
+		client := &Client{Connector: connector, Transporter: TCPTransporter()}
+		server := &Server{
+			Listener: IdleTimeoutListener(mustTCPListener(t), 200*time.Millisecond),
+			Handler:  SOCKS5Handler(),
+		}
+		go server.Run()
+		defer server.Close()
+
+		conn, err := proxyConn(client, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if conn, err = client.Connect(conn, udpSrv.Addr()); err != nil {
+			t.Fatal(err)
+		}
+
+		// the datagrams keep the association alive for longer than the idle timeout.
+		for i := 0; i < 6; i++ {
+			time.Sleep(100 * time.Millisecond)
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("tunnel %v #%d: %v", tunnel, i, err)
+			}
+			if _, err := conn.Read(make([]byte, 4)); err != nil {
+				t.Fatalf("tunnel %v #%d: the active association should not be closed: %v", tunnel, i, err)
+			}
+		}
+	}
+}
+
+func TestIdleTimeoutBind(t *testing.T) {
+	server := &Server{
+		Listener: IdleTimeoutListener(mustTCPListener(t), 200*time.Millisecond),
+		Handler:  SOCKS5Handler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc, err := socks5Handshake(conn, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gosocks5.NewRequest(gosocks5.CmdBind, &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "127.0.0.1"}).Write(cc); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := gosocks5.ReadReply(cc)
+	if err != nil || reply.Rep != gosocks5.Succeeded {
+		t.Fatalf("bind: %v %v", reply, err)
+	}
+
+	// the peer connects after the idle timeout.
+	time.Sleep(400 * time.Millisecond)
+	peer, err := net.Dial("tcp", reply.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	cc.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err = gosocks5.ReadReply(cc); err != nil || reply.Rep != gosocks5.Succeeded {
+		t.Fatalf("the waiting bind should not be closed: %v %v", reply, err)
+	}
+
+	// the relay is timed out by the idle timeout again.
+	if _, err := cc.Read(make([]byte, 1)); err == nil {
+		t.Error("the silent relay should be closed")
+	}
+}
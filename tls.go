@@ -66,24 +66,27 @@ func (tr *mtlsTransporter) Dial(addr string, options ...DialOption) (conn net.Co
 		delete(tr.sessions, addr)
 		ok = false // session is dead
 	}
+	if ok && !session.reserve(opts.MaxStreams) {
+		if session.session != nil {
+			session.retire() // the pending session is retired by its Handshake
+		}
+		delete(tr.sessions, addr)
+		ok = false // session is full
+	}
 	if !ok {
 		timeout := opts.Timeout
 		if timeout <= 0 {
 			timeout = DialTimeout
 		}
 
-		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
-		} else {
-			conn, err = opts.Chain.Dial(addr)
-		}
+		conn, err = opts.dial(addr, timeout)
 		if err != nil {
 			return
 		}
-		session = &muxSession{conn: conn}
+		session = &muxSession{conn: conn, pending: 1} // the stream being dialed
 		tr.sessions[addr] = session
 	}
-	return session.conn, nil
+	return newMuxDialConn(session, &tr.sessionMutex), nil
 }
 
 func (tr *mtlsTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
@@ -104,6 +107,10 @@ func (tr *mtlsTransporter) Handshake(conn net.Conn, options ...HandshakeOption)
 	defer conn.SetDeadline(time.Time{})
 
 	session, ok := tr.sessions[opts.Addr]
+	if dc, dialed := conn.(*muxDialConn); dialed {
+		conn, session = dc.handshake() // the session on which Dial reserved the stream
+		ok = true
+	}
 	if !ok || session.session == nil {
 		s, err := tr.initSession(opts.Addr, conn, opts)
 		if err != nil {
@@ -111,8 +118,15 @@ func (tr *mtlsTransporter) Handshake(conn net.Conn, options ...HandshakeOption)
 			delete(tr.sessions, opts.Addr)
 			return nil, err
 		}
-		session = s
-		tr.sessions[opts.Addr] = session
+		if !ok {
+			session = s
+			tr.sessions[opts.Addr] = session
+		} else {
+			session.conn, session.session = s.conn, s.session
+			if tr.sessions[opts.Addr] != session {
+				session.retire() // the session is replaced after Dial
+			}
+		}
 	}
 	cc, err := session.GetConn()
 	if err != nil {
@@ -137,8 +151,7 @@ func (tr *mtlsTransporter) initSession(addr string, conn net.Conn, opts *Handsha
 	}
 
 	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
-	session, err := smux.Client(conn, smuxConfig)
+	session, err := smux.Client(conn, muxConfig(opts.Interval))
 	if err != nil {
 		return nil, err
 	}
@@ -208,8 +221,7 @@ func (l *mtlsListener) listenLoop() {
 
 func (l *mtlsListener) mux(conn net.Conn) {
 	log.Logf("[mtls] %s - %s", conn.RemoteAddr(), l.Addr())
-	smuxConfig := smux.DefaultConfig()
-	mux, err := smux.Server(conn, smuxConfig)
+	mux, err := smux.Server(conn, muxServerConfig(0))
 	if err != nil {
 		log.Logf("[mtls] %s - %s : %s", conn.RemoteAddr(), l.Addr(), err)
 		return
@@ -323,3 +335,48 @@ func wrapTLSClient(conn net.Conn, tlsConfig *tls.Config, timeout time.Duration)
 
 	return tlsConn, err
 }
+
+// PeerIdentities returns the identities of the client certificate verified by the TLS based transports,
+// they are the common name and the DNS, URI and email subject alternative names of the certificate.
+// It returns nil if the client is not authenticated by a certificate.
+func PeerIdentities(conn net.Conn) []string {
+	for conn != nil {
+		if c, ok := conn.(wrappedConn); ok {
+			conn = c.unwrap()
+			continue
+		}
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return certIdentities(&state)
+		case *muxStreamConn:
+			conn = c.Conn
+		case *bufferdConn:
+			conn = c.Conn
+		case *trafficConn:
+			conn = c.Conn
+		case *websocketConn:
+			conn = c.conn.UnderlyingConn()
+		case *http2ServerConn:
+			return certIdentities(c.r.TLS)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func certIdentities(state *tls.ConnectionState) (ids []string) {
+	if state == nil || !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return append(ids, cert.EmailAddresses...)
+}
@@ -4,9 +4,11 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func httpOverTLSRoundtrip(targetURL string, data []byte, tlsConfig *tls.Config,
@@ -808,3 +810,176 @@ func TestMTLSForwardTunnel(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestMTLSMaxStreams(t *testing.T) {
+	period := muxRetirePeriod
+	muxRetirePeriod = 10 * time.Millisecond
+	defer func() { muxRetirePeriod = period }()
+
+	ln, err := MTLSListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	addr := ln.Addr().String()
+	tr := MTLSTransporter().(*mtlsTransporter)
+	dial := func(max int) (net.Conn, *muxSession) {
+		conn, err := tr.Dial(addr, MaxStreamsDialOption(max))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, err := tr.Handshake(conn, AddrHandshakeOption(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc, tr.sessions[addr]
+	}
+
+	c1, s1 := dial(0)
+	defer c1.Close()
+	c2, s2 := dial(0)
+	defer c2.Close()
+	if s1 != s2 {
+		t.Error("the streams should share the session without limit")
+	}
+
+	// the session with 2 streams is full, the new stream is opened by a new session.
+	c3, s3 := dial(2)
+	defer c3.Close()
+	if s3 == s1 {
+		t.Fatal("the new session should be established once the session is full")
+	}
+
+	c1.Close()
+	c2.Close()
+	time.Sleep(100 * time.Millisecond)
+	if !s1.IsClosed() {
+		t.Error("the retired session should be closed after its streams are closed")
+	}
+	if s3.IsClosed() {
+		t.Error("the new session should be kept")
+	}
+}
+
+func TestMTLSMaxStreamsConcurrentDial(t *testing.T) {
+	period := muxRetirePeriod
+	muxRetirePeriod = 10 * time.Millisecond
+	defer func() { muxRetirePeriod = period }()
+
+	ln, err := MTLSListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	addr := ln.Addr().String()
+	tr := MTLSTransporter().(*mtlsTransporter)
+	dial := func() net.Conn {
+		conn, err := tr.Dial(addr, MaxStreamsDialOption(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	handshake := func(conn net.Conn) *muxStreamConn {
+		cc, err := tr.Handshake(conn, AddrHandshakeOption(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc.(*muxStreamConn)
+	}
+
+	c1 := handshake(dial())
+	defer c1.Close()
+	s1 := c1.session
+
+	// the stream being dialed is counted before the handshake.
+	d2, d3 := dial(), dial()
+	c3 := handshake(d3)
+	defer c3.Close()
+	c2 := handshake(d2)
+	defer c2.Close()
+	if c2.session != s1 || c3.session == s1 {
+		t.Fatal("the stream should be opened by the session on which it is dialed")
+	}
+	if n := s1.NumStreams(); n != 2 {
+		t.Errorf("the full session should have 2 streams, got %d", n)
+	}
+
+	c1.Close()
+	c2.Close()
+	time.Sleep(100 * time.Millisecond)
+	if !s1.IsClosed() {
+		t.Error("the retired session should be closed after its streams are closed")
+	}
+	if c3.session.IsClosed() {
+		t.Error("the new session should be kept")
+	}
+}
+
+func TestMTLSMaxStreamsDialClose(t *testing.T) {
+	ln, err := MTLSListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTPHandler(),
+	}
+	go server.Run()
+	defer server.Close()
+
+	addr := ln.Addr().String()
+	tr := MTLSTransporter().(*mtlsTransporter)
+	dial := func() net.Conn {
+		conn, err := tr.Dial(addr, MaxStreamsDialOption(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	handshake := func(conn net.Conn) *muxStreamConn {
+		cc, err := tr.Handshake(conn, AddrHandshakeOption(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc.(*muxStreamConn)
+	}
+
+	// the connection of the new session is closed if it is dropped before the handshake.
+	d1 := dial()
+	d1.Close()
+	if _, err := d1.(*muxDialConn).Conn.Write([]byte{0}); err == nil {
+		t.Error("the connection of the session not established should be closed")
+	}
+
+	c1 := handshake(dial())
+	defer c1.Close()
+	s1 := c1.session
+
+	// the stream reserved by the dropped connection is released.
+	d2 := dial()
+	d2.Close()
+	if s1.IsClosed() {
+		t.Fatal("the established session should not be closed by the dropped connection")
+	}
+	c3 := handshake(dial())
+	defer c3.Close()
+	if c3.session != s1 {
+		t.Error("the released stream should be opened by the session")
+	}
+	if n := s1.NumStreams(); n != 2 {
+		t.Errorf("the session should have 2 streams, got %d", n)
+	}
+}
@@ -0,0 +1,50 @@
+package gost
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/url"
+)
+
+// The stream isolation modes of the Tor connector, the streams with different isolation keys use different circuits.
+const (
+	TorIsolateNone = "none" // all streams may share the circuits.
+	TorIsolateHost = "host" // the streams to the different hosts use different circuits.
+	TorIsolateConn = "conn" // each stream uses a new circuit.
+)
+
+// TorOnionPattern is the pattern of the onion service addresses routed to Tor by default.
+const TorOnionPattern = "*.onion"
+
+type torConnector struct {
+	isolation string
+}
+
+// TorConnector creates a Connector for the SOCKS port of Tor.
+// The streams are isolated by the isolation mode (TorIsolateHost by default), through the SOCKS5 credentials,
+// which Tor treats as the isolation key (IsolateSOCKSAuth).
+func TorConnector(isolation string) Connector {
+	if isolation == "" {
+		isolation = TorIsolateHost
+	}
+	return &torConnector{isolation: isolation}
+}
+
+func (c *torConnector) Connect(conn net.Conn, addr string, options ...ConnectOption) (net.Conn, error) {
+	var user *url.Userinfo
+	switch c.isolation {
+	case TorIsolateHost:
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		user = url.UserPassword("gost", host)
+	case TorIsolateConn:
+		b := make([]byte, 8)
+		rand.Read(b)
+		user = url.UserPassword("gost", hex.EncodeToString(b))
+	}
+
+	return SOCKS5Connector(user).Connect(conn, addr, options...)
+}
@@ -0,0 +1,96 @@
+package gost
+
+import (
+	"crypto/rand"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// torTestAuthenticator accepts all the credentials, and records the isolation keys.
+type torTestAuthenticator struct {
+	keys []string
+	mux  sync.Mutex
+}
+
+func (a *torTestAuthenticator) Authenticate(user, password string) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.keys = append(a.keys, password)
+	return true
+}
+
+func TestTorRoute(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+	u, _ := url.Parse(httpSrv.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	// the Tor SOCKS port resolving the onion address.
+	auth := &torTestAuthenticator{}
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler: SOCKS5Handler(
+			AuthenticatorHandlerOption(auth),
+			HostsHandlerOption(NewHosts(NewHost(net.ParseIP("127.0.0.1"), "gost.onion"))),
+		),
+	}
+	go server.Run()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		isolation string
+		same      bool
+	}{
+		{TorIsolateHost, true},
+		{TorIsolateConn, false},
+	} {
+		auth.keys = nil
+
+		tor := NewChain(Node{
+			Addr:   ln.Addr().String(),
+			Client: &Client{Connector: TorConnector(tc.isolation), Transporter: TCPTransporter()},
+			Values: url.Values{"dns": []string{DNSRemote}},
+		})
+		chain := NewChain()
+		chain.Rules = []RouteRule{{Patterns: NewBypassPatterns(false, TorOnionPattern), Chain: tor}}
+
+		for i := 0; i < 2; i++ {
+			conn, err := chain.Dial(net.JoinHostPort("gost.onion", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = httpRoundtrip(conn, "http://gost.onion:"+port, sendData)
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		auth.mux.Lock()
+		keys := auth.keys
+		auth.mux.Unlock()
+		if len(keys) != 2 || (keys[0] == keys[1]) != tc.same {
+			t.Errorf("%s: unexpected isolation keys %v", tc.isolation, keys)
+		}
+		if tc.isolation == TorIsolateHost && keys[0] != "gost.onion" {
+			t.Errorf("the streams should be isolated by the host, got %v", keys)
+		}
+	}
+
+	// the clearnet targets are not routed to Tor.
+	chain := NewChain()
+	chain.Rules = []RouteRule{{Patterns: NewBypassPatterns(false, TorOnionPattern), Chain: NewChain(Node{Addr: ln.Addr().String()})}}
+	if route, err := chain.selectRouteFor(u.Host); err != nil || !route.IsEmpty() {
+		t.Errorf("the clearnet target should be dialed directly, got %v, %v", route, err)
+	}
+}
@@ -0,0 +1,91 @@
+package gost
+
+import (
+	"errors"
+	"net"
+)
+
+var errTProxyUnsupported = errors.New("TPROXY is not available on this platform")
+
+type tproxyHandler struct {
+	options *HandlerOptions
+}
+
+// TProxyHandler creates a server Handler for the transparent proxy server of the TPROXY listeners,
+// the connections are relayed to their original destinations, which are the local addresses of the connections.
+func TProxyHandler(opts ...HandlerOption) Handler {
+	h := &tproxyHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *tproxyHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *tproxyHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	if _, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		h.handleUDP(conn)
+		return
+	}
+
+	srcAddr, dstAddr := conn.RemoteAddr(), conn.LocalAddr()
+	h.options.Logger.Logf("[tproxy-tcp] %s -> %s", srcAddr, dstAddr)
+
+	if !canRelay(h.options, srcAddr.String(), dstAddr.String()) {
+		h.options.Logger.Logf("[tproxy-tcp] %s - %s : Unauthorized to tcp connect to %s", srcAddr, dstAddr, dstAddr)
+		return
+	}
+
+	cc, err := h.options.Chain.Dial(dstAddr.String(),
+		RetryChainOption(h.options.Retries),
+		TimeoutChainOption(h.options.Timeout),
+	)
+	if err != nil {
+		h.options.Logger.Warnf("[tproxy-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
+		return
+	}
+	defer cc.Close()
+
+	h.options.Logger.Logf("[tproxy-tcp] %s <-> %s", srcAddr, dstAddr)
+	transport(conn, cc)
+	h.options.Logger.Logf("[tproxy-tcp] %s >-< %s", srcAddr, dstAddr)
+}
+
+func (h *tproxyHandler) handleUDP(conn net.Conn) {
+	srcAddr, dstAddr := conn.RemoteAddr(), conn.LocalAddr()
+
+	if !h.options.ACL.Allow("udp", srcAddr.String(), dstAddr.String()) {
+		h.options.Logger.Logf("[tproxy-udp] %s - %s : Unauthorized to udp connect to %s", srcAddr, dstAddr, dstAddr)
+		return
+	}
+
+	var cc net.Conn
+	var err error
+	if h.options.Chain.IsEmpty() {
+		cc, err = net.DialUDP("udp", nil, dstAddr.(*net.UDPAddr))
+	} else {
+		cc, err = getSOCKS5UDPTunnel(h.options.Chain, nil)
+		if err == nil {
+			cc = &udpTunnelConn{Conn: cc, raddr: dstAddr.String()}
+		}
+	}
+	if err != nil {
+		h.options.Logger.Warnf("[tproxy-udp] %s -> %s : %s", srcAddr, dstAddr, err)
+		return
+	}
+	defer cc.Close()
+
+	h.options.Logger.Logf("[tproxy-udp] %s <-> %s", srcAddr, dstAddr)
+	transport(conn, cc)
+	h.options.Logger.Logf("[tproxy-udp] %s >-< %s", srcAddr, dstAddr)
+}
@@ -0,0 +1,252 @@
+//go:build linux
+// +build linux
+
+package gost
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+const (
+	ipv6RecvOrigDstAddr = 0x4a // IPV6_RECVORIGDSTADDR
+	ipv6Transparent     = 0x4b // IPV6_TRANSPARENT
+)
+
+var errOrigDstNotFound = errors.New("original destination not found")
+
+// tproxyControl sets the IP_TRANSPARENT option of the socket, so it can accept the traffic to the non-local addresses
+// redirected by the TPROXY target of iptables, and send the packets from them.
+// The original destinations of the UDP packets are received along with them if origDst is true.
+func tproxyControl(network string, c syscall.RawConn, origDst bool) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		s := int(fd)
+		if err = syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+			return
+		}
+		if origDst {
+			if err = syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+				return
+			}
+		}
+		if strings.HasSuffix(network, "4") {
+			return
+		}
+		if err = syscall.SetsockoptInt(s, syscall.SOL_IPV6, ipv6Transparent, 1); err != nil {
+			return
+		}
+		if origDst {
+			err = syscall.SetsockoptInt(s, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// TCPTProxyListener creates a Listener for the TCP transparent proxy server of the TPROXY target, such as
+// 'iptables -t mangle -A PREROUTING -p tcp -j TPROXY --on-port 12345 --tproxy-mark 1'.
+// The local addresses of the accepted connections are their original destinations.
+func TCPTProxyListener(addr string) (Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return tproxyControl(network, c, false)
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpListener{Listener: tcpKeepAliveListener{ln.(*net.TCPListener)}}, nil
+}
+
+type udpTProxyListener struct {
+	ln       *net.UDPConn
+	conns    map[string]*udpServerConn
+	connMux  sync.Mutex
+	connChan chan net.Conn
+	errChan  chan error
+	ttl      time.Duration
+}
+
+// UDPTProxyListener creates a Listener for the UDP transparent proxy server of the TPROXY target, such as DNS.
+// The packets of a client to an original destination are a session, which is closed if idle for ttl.
+// The local address of the session is the original destination, the replies are sent from it.
+func UDPTProxyListener(addr string, ttl time.Duration) (Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return tproxyControl(network, c, true)
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpTProxyListener{
+		ln:       pc.(*net.UDPConn),
+		conns:    make(map[string]*udpServerConn),
+		connChan: make(chan net.Conn, 1024),
+		errChan:  make(chan error, 1),
+		ttl:      ttl,
+	}
+	go l.listenLoop()
+	return l, nil
+}
+
+func (l *udpTProxyListener) listenLoop() {
+	oob := make([]byte, 1024)
+	for {
+		b := make([]byte, mediumBufferSize)
+		n, oobn, _, raddr, err := l.ln.ReadMsgUDP(b, oob)
+		if err != nil {
+			log.Logf("[tproxy-udp] peer -> %s : %s", l.Addr(), err)
+			l.Close()
+			l.errChan <- err
+			close(l.errChan)
+			return
+		}
+		dstAddr, err := origDstAddr(oob[:oobn])
+		if err != nil {
+			log.Logf("[tproxy-udp] %s -> %s : %s", raddr, l.Addr(), err)
+			continue
+		}
+		if Debug {
+			log.Logf("[tproxy-udp] %s >>> %s : length %d", raddr, dstAddr, n)
+		}
+
+		key := raddr.String() + "/" + dstAddr.String()
+		l.connMux.Lock()
+		conn, ok := l.conns[key]
+		l.connMux.Unlock()
+		if !ok || conn.Closed() {
+			pc, err := listenTransparentUDP(dstAddr)
+			if err != nil {
+				log.Logf("[tproxy-udp] %s -> %s : %s", raddr, dstAddr, err)
+				continue
+			}
+			conn = newUDPServerConn(pc, raddr, l.ttl)
+			l.connMux.Lock()
+			l.conns[key] = conn
+			l.connMux.Unlock()
+			go l.remove(key, conn)
+
+			select {
+			case l.connChan <- &tproxyUDPConn{udpServerConn: conn}:
+			default:
+				conn.Close()
+				pc.Close()
+				log.Logf("[tproxy-udp] %s - %s: connection queue is full", raddr, dstAddr)
+			}
+		}
+
+		select {
+		case conn.rChan <- b[:n]:
+		default:
+			log.Logf("[tproxy-udp] %s -> %s : read queue is full", raddr, dstAddr)
+		}
+	}
+}
+
+// remove removes the session conn of the key once it is closed, by the handler or for idle.
+func (l *udpTProxyListener) remove(key string, conn *udpServerConn) {
+	<-conn.closed
+
+	l.connMux.Lock()
+	defer l.connMux.Unlock()
+
+	if l.conns[key] == conn {
+		delete(l.conns, key)
+	}
+}
+
+func (l *udpTProxyListener) Accept() (conn net.Conn, err error) {
+	var ok bool
+	select {
+	case conn = <-l.connChan:
+	case err, ok = <-l.errChan:
+		if !ok {
+			err = errors.New("accpet on closed listener")
+		}
+	}
+	return
+}
+
+func (l *udpTProxyListener) Addr() net.Addr {
+	return l.ln.LocalAddr()
+}
+
+func (l *udpTProxyListener) Close() error {
+	return l.ln.Close()
+}
+
+// tproxyUDPConn is the UDP session of the client, the socket bound to the original destination is closed along with it.
+type tproxyUDPConn struct {
+	*udpServerConn
+}
+
+func (c *tproxyUDPConn) Close() error {
+	c.udpServerConn.conn.Close()
+	return c.udpServerConn.Close()
+}
+
+// listenTransparentUDP creates the socket bound to the non-local address addr,
+// which the replies to the client of the original destination addr are sent from.
+func listenTransparentUDP(addr *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return err
+			}
+			return tproxyControl(network, c, false)
+		},
+	}
+	network := "udp6"
+	if addr.IP.To4() != nil {
+		network = "udp4"
+	}
+	return lc.ListenPacket(context.Background(), network, addr.String())
+}
+
+// origDstAddr parses the original destination from the control messages of the UDP packet received by the TPROXY socket.
+func origDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR &&
+			len(msg.Data) >= 8: // struct sockaddr_in
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr &&
+			len(msg.Data) >= 24: // struct sockaddr_in6
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, msg.Data[8:24])
+			return &net.UDPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errOrigDstNotFound
+}
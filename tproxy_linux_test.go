@@ -0,0 +1,99 @@
+package gost
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func testCmsg(level, typ int32, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = level
+	h.Type = typ
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestOrigDstAddr(t *testing.T) {
+	sa4 := []byte{syscall.AF_INET, 0, 0x00, 0x35, 8, 8, 4, 4, 0, 0, 0, 0, 0, 0, 0, 0}
+	sa6 := make([]byte, 28)
+	sa6[0] = syscall.AF_INET6
+	sa6[2], sa6[3] = 0x14, 0xe9
+	copy(sa6[8:24], net.ParseIP("2001:db8::1"))
+
+	tests := []struct {
+		oob  []byte
+		addr string
+	}{
+		{testCmsg(syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, sa4), "8.8.4.4:53"},
+		{testCmsg(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, sa6), "[2001:db8::1]:5353"},
+		{append(testCmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}),
+			testCmsg(syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, sa4)...), "8.8.4.4:53"},
+	}
+	for i, tc := range tests {
+		addr, err := origDstAddr(tc.oob)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if addr.String() != tc.addr {
+			t.Errorf("#%d: address should be %s, got %s", i, tc.addr, addr)
+		}
+	}
+
+	if _, err := origDstAddr(testCmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0})); err != errOrigDstNotFound {
+		t.Errorf("should be %v, got %v", errOrigDstNotFound, err)
+	}
+}
+
+func TestListenTransparentUDP(t *testing.T) {
+	pc, err := listenTransparentUDP(&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53})
+	if err != nil {
+		t.Skip(err) // requires CAP_NET_ADMIN
+	}
+	pc.Close()
+}
+
+func TestUDPTProxyListenerRemoveClosed(t *testing.T) {
+	l := &udpTProxyListener{conns: make(map[string]*udpServerConn)}
+	conns := func() int {
+		l.connMux.Lock()
+		defer l.connMux.Unlock()
+		return len(l.conns)
+	}
+	session := func(key string) *tproxyUDPConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := newUDPServerConn(pc, pc.LocalAddr(), time.Second)
+		l.connMux.Lock()
+		l.conns[key] = conn
+		l.connMux.Unlock()
+		go l.remove(key, conn)
+		return &tproxyUDPConn{udpServerConn: conn}
+	}
+
+	c1 := session("client1/dst")
+	c2 := session("client2/dst")
+	defer c2.Close()
+	if n := conns(); n != 2 {
+		t.Fatalf("the sessions should be tracked, got %d", n)
+	}
+
+	c1.Close()
+	for i := 0; i < 10 && conns() > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.connMux.Lock()
+	_, ok1 := l.conns["client1/dst"]
+	_, ok2 := l.conns["client2/dst"]
+	l.connMux.Unlock()
+	if ok1 || !ok2 {
+		t.Errorf("only the closed session should be removed, client1 %v, client2 %v", ok1, ok2)
+	}
+}
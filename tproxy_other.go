@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package gost
+
+import "time"
+
+// TCPTProxyListener creates a Listener for the TCP transparent proxy server of the TPROXY target, it is only available on Linux.
+func TCPTProxyListener(addr string) (Listener, error) {
+	return nil, errTProxyUnsupported
+}
+
+// UDPTProxyListener creates a Listener for the UDP transparent proxy server of the TPROXY target, it is only available on Linux.
+func UDPTProxyListener(addr string, ttl time.Duration) (Listener, error) {
+	return nil, errTProxyUnsupported
+}
@@ -0,0 +1,83 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tproxyTestConn is the accepted connection of the TPROXY listener,
+// the local address of which is the original destination.
+type tproxyTestConn struct {
+	net.Conn
+	laddr net.Addr
+}
+
+func (c *tproxyTestConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func tproxyTestPipe(h Handler, dst net.Addr) net.Conn {
+	c1, c2 := net.Pipe()
+	go h.Handle(&tproxyTestConn{Conn: c2, laddr: dst})
+	c1.SetDeadline(time.Now().Add(3 * time.Second))
+	return c1
+}
+
+func TestTProxyHandlerTCP(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	dst, _ := net.ResolveTCPAddr("tcp", httpSrv.Listener.Addr().String())
+	conn := tproxyTestPipe(TProxyHandler(), dst)
+	defer conn.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+	if err := httpRoundtrip(conn, httpSrv.URL, sendData); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTProxyHandlerUDP(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	dst, _ := net.ResolveUDPAddr("udp", udpSrv.Addr())
+	conn := tproxyTestPipe(TProxyHandler(), dst)
+	defer conn.Close()
+
+	sendData := []byte("Hello World!")
+	if _, err := conn.Write(sendData); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], sendData) {
+		t.Errorf("response %q should be %q", b[:n], sendData)
+	}
+}
+
+func TestTProxyHandlerACL(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	acl := NewACL()
+	acl.Reload(bytes.NewBufferString("deny udp * *"))
+
+	dst, _ := net.ResolveUDPAddr("udp", udpSrv.Addr())
+	conn := tproxyTestPipe(TProxyHandler(ACLHandlerOption(acl)), dst)
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("Hello World!")); err == nil {
+		t.Error("denied request should be closed")
+	}
+}
@@ -0,0 +1,296 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// UserTraffic is the traffic statistics of a user.
+type UserTraffic struct {
+	// Service is the name of the service the user connected to, it is empty if the service has no name.
+	Service     string `json:"service,omitempty"`
+	User        string `json:"user"`
+	Connections int64  `json:"connections"`
+	// BytesIn is the number of bytes received from the user.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of bytes sent to the user.
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// TrafficReport is a snapshot of the traffic statistics.
+type TrafficReport struct {
+	Time  time.Time     `json:"time"`
+	Users []UserTraffic `json:"users"`
+}
+
+type trafficKey struct {
+	service string
+	user    string
+}
+
+type trafficCounter struct {
+	conns int64
+	in    int64
+	out   int64
+}
+
+// Traffic accumulates the per-user byte counts and connection counts of the authenticated users,
+// labeled by the service name, the counts are kept since the Traffic is created.
+type Traffic struct {
+	users map[trafficKey]*trafficCounter
+	mux   sync.Mutex
+}
+
+// NewTraffic creates a Traffic.
+func NewTraffic() *Traffic {
+	return &Traffic{
+		users: make(map[trafficKey]*trafficCounter),
+	}
+}
+
+// Conn wraps the client connection conn to count the traffic,
+// the traffic is accounted to the user once the user is authenticated.
+func (t *Traffic) Conn(conn net.Conn) net.Conn {
+	return t.ServiceConn(conn, "")
+}
+
+// ServiceConn is like Conn, the traffic is labeled by the name of the service.
+func (t *Traffic) ServiceConn(conn net.Conn, service string) net.Conn {
+	if t == nil {
+		return conn
+	}
+	return &trafficConn{Conn: conn, traffic: t, service: service}
+}
+
+func (t *Traffic) counter(service, user string) *trafficCounter {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	key := trafficKey{service: service, user: user}
+	c := t.users[key]
+	if c == nil {
+		c = &trafficCounter{}
+		t.users[key] = c
+	}
+	return c
+}
+
+// Snapshot returns the current traffic statistics sorted by service and user.
+func (t *Traffic) Snapshot() *TrafficReport {
+	report := &TrafficReport{Time: time.Now()}
+	if t == nil {
+		return report
+	}
+
+	t.mux.Lock()
+	for key, c := range t.users {
+		report.Users = append(report.Users, UserTraffic{
+			Service:     key.service,
+			User:        key.user,
+			Connections: atomic.LoadInt64(&c.conns),
+			BytesIn:     atomic.LoadInt64(&c.in),
+			BytesOut:    atomic.LoadInt64(&c.out),
+		})
+	}
+	t.mux.Unlock()
+
+	sort.Slice(report.Users, func(i, j int) bool {
+		if report.Users[i].Service != report.Users[j].Service {
+			return report.Users[i].Service < report.Users[j].Service
+		}
+		return report.Users[i].User < report.Users[j].User
+	})
+	return report
+}
+
+// WriteJSON writes the traffic report to w in JSON format.
+func (r *TrafficReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the traffic report to w in CSV format, one line per user with the header line:
+// time,user,connections,bytes_in,bytes_out,service
+func (r *TrafficReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "user", "connections", "bytes_in", "bytes_out", "service"})
+	ts := r.Time.Format(time.RFC3339)
+	for _, u := range r.Users {
+		cw.Write([]string{
+			ts,
+			u.User,
+			strconv.FormatInt(u.Connections, 10),
+			strconv.FormatInt(u.BytesIn, 10),
+			strconv.FormatInt(u.BytesOut, 10),
+			u.Service,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteFile writes the traffic report to the file name, the format is CSV if the file has extension '.csv',
+// otherwise JSON. The file is replaced atomically.
+func (r *TrafficReport) WriteFile(name string) error {
+	buf := &bytes.Buffer{}
+	var err error
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		err = r.WriteCSV(buf)
+	} else {
+		err = r.WriteJSON(buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// PeriodTrafficReport writes the snapshot of the traffic t to the file name periodically.
+func PeriodTrafficReport(t *Traffic, name string, period time.Duration) error {
+	if t == nil || name == "" {
+		return nil
+	}
+	if period < time.Second {
+		period = time.Second
+	}
+
+	for {
+		<-time.After(period)
+		if err := t.Snapshot().WriteFile(name); err != nil {
+			log.Logf("[traffic] %s: %s", name, err)
+		}
+	}
+}
+
+type trafficConn struct {
+	net.Conn
+	traffic *Traffic
+	service string
+	counter *trafficCounter
+	// the bytes of the handshake before the user is authenticated.
+	in, out int64
+}
+
+func (c *trafficConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if c.counter != nil {
+		atomic.AddInt64(&c.counter.in, int64(n))
+	} else {
+		c.in += int64(n)
+	}
+	return
+}
+
+func (c *trafficConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if c.counter != nil {
+		atomic.AddInt64(&c.counter.out, int64(n))
+	} else {
+		c.out += int64(n)
+	}
+	return
+}
+
+func (c *trafficConn) addSpliced(read, written int64) {
+	if c.counter != nil {
+		atomic.AddInt64(&c.counter.in, read)
+		atomic.AddInt64(&c.counter.out, written)
+		return
+	}
+	// the directions are relayed by different goroutines.
+	if read > 0 {
+		c.in += read
+	}
+	if written > 0 {
+		c.out += written
+	}
+}
+
+func (c *trafficConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+// setTrafficUser accounts the traffic of the connection conn wrapped by Traffic.Conn to the user,
+// including the bytes exchanged before the authentication.
+// It must be called before the connection is shared by multiple goroutines.
+func setTrafficUser(conn net.Conn, user string) {
+	if bc, ok := conn.(*bufferdConn); ok {
+		conn = bc.Conn
+	}
+	c, ok := conn.(*trafficConn)
+	if !ok || c.counter != nil {
+		return
+	}
+	counter := c.traffic.counter(c.service, user)
+	atomic.AddInt64(&counter.conns, 1)
+	atomic.AddInt64(&counter.in, c.in)
+	atomic.AddInt64(&counter.out, c.out)
+	c.counter = counter
+}
+
+type trafficHandler struct {
+	options *HandlerOptions
+}
+
+// TrafficHandler creates a server Handler for the traffic report endpoint,
+// it responds to the HTTP GET requests with the snapshot of the traffic statistics,
+// in CSV format if the request has query 'format=csv' or the path has extension '.csv', otherwise in JSON format.
+// The requests are authenticated by HTTP basic auth if the authenticator is set.
+func TrafficHandler(opts ...HandlerOption) Handler {
+	h := &trafficHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *trafficHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *trafficHandler) Handle(conn net.Conn) {
+	serveAPI("traffic", h.options, conn, func(req *http.Request, resp *http.Response) {
+		if req.Method != http.MethodGet {
+			resp.StatusCode = http.StatusMethodNotAllowed
+			return
+		}
+		buf := &bytes.Buffer{}
+		report := h.options.Traffic.Snapshot()
+		contentType, write := "application/json", report.WriteJSON
+		if req.URL.Query().Get("format") == "csv" || strings.EqualFold(filepath.Ext(req.URL.Path), ".csv") {
+			contentType, write = "text/csv", report.WriteCSV
+		}
+		if err := write(buf); err != nil {
+			h.options.Logger.Logf("[traffic] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			resp.StatusCode = http.StatusInternalServerError
+			return
+		}
+		setResponseBody(resp, contentType, buf)
+	})
+}
@@ -0,0 +1,196 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func trafficProxyRoundtrip(traffic *Traffic, handler Handler, connector Connector, targetURL string, data []byte, opts ...HandlerOption) error {
+	ln, err := TCPListener("")
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   connector,
+		Transporter: TCPTransporter(),
+	}
+
+	handler.Init(append([]HandlerOption{
+		UsersHandlerOption(url.UserPassword("admin", "123456")),
+		TrafficHandlerOption(traffic),
+	}, opts...)...)
+	server := &Server{
+		Handler:  handler,
+		Listener: ln,
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestTrafficProxy(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	traffic := NewTraffic()
+	if err := trafficProxyRoundtrip(traffic, SOCKS5Handler(),
+		SOCKS5Connector(url.UserPassword("admin", "123456")), httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	if err := trafficProxyRoundtrip(traffic, HTTPHandler(),
+		HTTPConnector(url.UserPassword("admin", "123456")), httpSrv.URL, sendData); err != nil {
+		t.Fatal(err)
+	}
+	if err := trafficProxyRoundtrip(traffic, SOCKS5Handler(),
+		SOCKS5Connector(url.UserPassword("admin", "654321")), httpSrv.URL, sendData); err == nil {
+		t.Fatal("unauthorized user should failed")
+	}
+
+	var u UserTraffic
+	for i := 0; i < 10; i++ {
+		report := traffic.Snapshot()
+		if len(report.Users) != 1 {
+			t.Fatalf("report should have 1 user, got %d", len(report.Users))
+		}
+		u = report.Users[0]
+		if u.BytesOut >= int64(2*len(sendData)) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if u.User != "admin" || u.Connections != 2 {
+		t.Errorf("unexpected traffic: %+v", u)
+	}
+	if u.BytesIn < int64(2*len(sendData)) || u.BytesOut < int64(2*len(sendData)) {
+		t.Errorf("traffic should be at least %d bytes each direction: %+v", 2*len(sendData), u)
+	}
+}
+
+func TestTrafficServiceLabel(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	traffic := NewTraffic()
+	for _, name := range []string{"socks-b", "socks-a", "socks-a"} {
+		if err := trafficProxyRoundtrip(traffic, SOCKS5Handler(),
+			SOCKS5Connector(url.UserPassword("admin", "123456")), httpSrv.URL, sendData,
+			NameHandlerOption(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := traffic.Snapshot()
+	if len(report.Users) != 2 {
+		t.Fatalf("report should have 2 rows, got %+v", report.Users)
+	}
+	if u := report.Users[0]; u.Service != "socks-a" || u.User != "admin" || u.Connections != 2 {
+		t.Errorf("unexpected traffic: %+v", u)
+	}
+	if u := report.Users[1]; u.Service != "socks-b" || u.User != "admin" || u.Connections != 1 {
+		t.Errorf("unexpected traffic: %+v", u)
+	}
+}
+
+func TestTrafficReport(t *testing.T) {
+	report := &TrafficReport{
+		Time: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+		Users: []UserTraffic{
+			{User: "admin", Connections: 2, BytesIn: 100, BytesOut: 2000},
+			{Service: "socks", User: "test", Connections: 1, BytesIn: 10, BytesOut: 20},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := report.WriteCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,user,connections,bytes_in,bytes_out,service\n" +
+		"2019-01-02T03:04:05Z,admin,2,100,2000,\n" +
+		"2019-01-02T03:04:05Z,test,1,10,20,socks\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected CSV report:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := report.WriteJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	var r TrafficReport
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Time.Equal(report.Time) || len(r.Users) != 2 || r.Users[0] != report.Users[0] || r.Users[1] != report.Users[1] {
+		t.Errorf("unexpected JSON report:\n%s", buf.String())
+	}
+}
+
+func TestTrafficHandler(t *testing.T) {
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: ln,
+		Handler: TrafficHandler(
+			UsersHandlerOption(url.UserPassword("admin", "123456")),
+			TrafficHandlerOption(NewTraffic()),
+		),
+	}
+	go server.Run()
+	defer server.Close()
+
+	for i, tc := range []struct {
+		url         string
+		user        *url.Userinfo
+		code        int
+		contentType string
+	}{
+		{"http://gost/traffic", nil, http.StatusUnauthorized, ""},
+		{"http://gost/traffic", url.UserPassword("admin", "654321"), http.StatusUnauthorized, ""},
+		{"http://gost/traffic", url.UserPassword("admin", "123456"), http.StatusOK, "application/json"},
+		{"http://gost/traffic?format=csv", url.UserPassword("admin", "123456"), http.StatusOK, "text/csv"},
+		{"http://gost/traffic.csv", url.UserPassword("admin", "123456"), http.StatusOK, "text/csv"},
+	} {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.user != nil {
+			p, _ := tc.user.Password()
+			req.SetBasicAuth(tc.user.Username(), p)
+		}
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.code {
+			t.Errorf("#%d status code should be %d, got %d", i, tc.code, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, tc.contentType) {
+			t.Errorf("#%d content type should be %s, got %s", i, tc.contentType, ct)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package gost
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+var (
+	// ErrTunnelNotFound is returned by Tunnels.Dial if there is no tunnel registered for the host.
+	ErrTunnelNotFound = errors.New("tunnel not found")
+	// ErrTunnelExists is returned when registering a tunnel with a name that is already in use.
+	ErrTunnelExists = errors.New("tunnel already exists")
+	// ErrInvalidTunnelName is returned when registering a tunnel with a name that is not a valid DNS label.
+	ErrInvalidTunnelName = errors.New("invalid tunnel name")
+	// ErrTunnelUnauthorized is returned when registering a tunnel with an unknown service name or an invalid token.
+	ErrTunnelUnauthorized = errors.New("tunnel unauthorized")
+)
+
+var tunnelNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// TunnelService is a named reverse tunnel service.
+type TunnelService struct {
+	// Name is the service name used by the client to register the tunnel.
+	Name string
+	// Token is the shared token used to authenticate the registration.
+	Token string
+	// Expose is the public address of the service, it is either a listen address such as ':8080',
+	// or a hostname. A hostname without dot is a subdomain of the tunnels domain,
+	// the subdomain Name will be used if it is empty.
+	Expose string
+}
+
+// Tunnels is a registry of the public reverse tunnels.
+// A client registers a tunnel with a name such as 'app1' via the SOCKS5 multiplex bind request,
+// then the requests for the host 'app1.<domain>' will be routed back through that client's tunnel.
+//
+// If the services are defined, only the registrations of the services with valid tokens are accepted,
+// and each tunnel is exposed under the port or hostname configured by the service.
+// For each service a single line should be present with the following information:
+// name token [expose]
+// The domain option can be used to set the domain of the tunnels.
+// Text from a "#" character until the end of the line is a comment, and is ignored.
+//
+// The secret tunnels are registered in the same way, but they are never exposed publicly.
+type Tunnels struct {
+	domain   string
+	services map[string]TunnelService
+	tunnels  map[string]*muxSession
+	secrets  map[string]*muxSession
+	period   time.Duration
+	stopped  chan struct{}
+	mux      sync.RWMutex
+}
+
+// NewTunnels creates a Tunnels for the base domain with optional list of services.
+func NewTunnels(domain string, services ...TunnelService) *Tunnels {
+	t := &Tunnels{
+		domain:   strings.ToLower(strings.Trim(domain, ".")),
+		services: make(map[string]TunnelService),
+		tunnels:  make(map[string]*muxSession),
+		secrets:  make(map[string]*muxSession),
+		stopped:  make(chan struct{}),
+	}
+	for _, svc := range services {
+		t.services[svc.Name] = svc
+	}
+	return t
+}
+
+// Domain returns the base domain of the tunnels.
+func (t *Tunnels) Domain() string {
+	if t == nil {
+		return ""
+	}
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return t.domain
+}
+
+// Host returns the public hostname of the tunnel name.
+func (t *Tunnels) Host(name string) string {
+	return name + "." + t.Domain()
+}
+
+// Authorize checks the registration of the tunnel name with token,
+// and returns the public address (hostname or listen address) that the tunnel will be exposed on.
+func (t *Tunnels) Authorize(name, token string) (string, error) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	if len(t.services) == 0 {
+		if !tunnelNameRegexp.MatchString(name) {
+			return "", ErrInvalidTunnelName
+		}
+		return name + "." + t.domain, nil
+	}
+
+	svc, ok := t.services[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(svc.Token), []byte(token)) != 1 {
+		return "", ErrTunnelUnauthorized
+	}
+	expose := svc.Expose
+	if expose == "" {
+		expose = name
+	}
+	if !strings.Contains(expose, ":") && !strings.Contains(expose, ".") {
+		expose = expose + "." + t.domain
+	}
+	return strings.ToLower(expose), nil
+}
+
+// Restricted reports whether the tunnels are restricted to the defined services,
+// the raw port binding is not allowed in this case.
+func (t *Tunnels) Restricted() bool {
+	if t == nil {
+		return false
+	}
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return len(t.services) > 0
+}
+
+// Dial opens a connection through the tunnel registered for the hostname host, the port of host is ignored.
+func (t *Tunnels) Dial(host string) (net.Conn, error) {
+	if t == nil {
+		return nil, ErrTunnelNotFound
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return t.dial(strings.ToLower(strings.TrimSuffix(host, ".")), false)
+}
+
+// DialSecret opens a connection through the secret tunnel name.
+// The secret tunnels are not exposed publicly, they can only be reached by the visitors knowing the name.
+func (t *Tunnels) DialSecret(name string) (net.Conn, error) {
+	if t == nil {
+		return nil, ErrTunnelNotFound
+	}
+	return t.dial(name, true)
+}
+
+func (t *Tunnels) dial(key string, secret bool) (net.Conn, error) {
+	t.mux.RLock()
+	session := t.sessions(secret)[key]
+	t.mux.RUnlock()
+
+	if session == nil || session.IsClosed() {
+		return nil, ErrTunnelNotFound
+	}
+	return session.GetConn()
+}
+
+func (t *Tunnels) sessions(secret bool) map[string]*muxSession {
+	if secret {
+		return t.secrets
+	}
+	return t.tunnels
+}
+
+func (t *Tunnels) check(key string, secret bool) error {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	if s := t.sessions(secret)[key]; s != nil && !s.IsClosed() {
+		return ErrTunnelExists
+	}
+	return nil
+}
+
+func (t *Tunnels) register(key string, secret bool, session *muxSession) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	m := t.sessions(secret)
+	if s := m[key]; s != nil && !s.IsClosed() {
+		return ErrTunnelExists
+	}
+	m[key] = session
+	return nil
+}
+
+func (t *Tunnels) unregister(key string, secret bool, session *muxSession) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	m := t.sessions(secret)
+	if m[key] == session {
+		delete(m, key)
+	}
+}
+
+// Reload parses config from r, then live reloads the services.
+func (t *Tunnels) Reload(r io.Reader) error {
+	var period time.Duration
+	var domain string
+	services := make(map[string]TunnelService)
+
+	if r == nil || t.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		ss := splitLine(line)
+		if len(ss) < 2 {
+			continue // invalid lines are ignored
+		}
+
+		switch ss[0] {
+		case "reload": // reload option
+			period, _ = time.ParseDuration(ss[1])
+		case "domain":
+			domain = strings.ToLower(strings.Trim(ss[1], "."))
+		default:
+			svc := TunnelService{
+				Name:  ss[0],
+				Token: ss[1],
+			}
+			if len(ss) > 2 {
+				svc.Expose = ss[2]
+			}
+			services[svc.Name] = svc
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mux.Lock()
+	t.period = period
+	if domain != "" {
+		t.domain = domain
+	}
+	t.services = services
+	t.mux.Unlock()
+
+	return nil
+}
+
+// Period returns the reload period.
+func (t *Tunnels) Period() time.Duration {
+	if t.Stopped() {
+		return -1
+	}
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return t.period
+}
+
+// Stop stops reloading.
+func (t *Tunnels) Stop() {
+	select {
+	case <-t.stopped:
+	default:
+		close(t.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (t *Tunnels) Stopped() bool {
+	select {
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// secretTunnelCipher creates the cipher for the end-to-end encryption of the secret tunnel.
+func secretTunnelCipher(secret string) (core.Cipher, error) {
+	if secret == "" {
+		return nil, errors.New("tunnel: empty secret")
+	}
+	return core.PickCipher("AES-256-GCM", nil, secret)
+}
+
+type secretTunnelHandler struct {
+	name    string
+	config  *SecretTunnelConfig
+	options *HandlerOptions
+}
+
+// SecretTunnelHandler creates a server Handler for the secret tunnel (STCP) visitor.
+// The name is the name of the secret tunnel, and the secret of the config must be the same as the provider's.
+// The connections are relayed to the secret tunnel through the SOCKS5 server of the chain,
+// or connected to the provider directly if P2P is enabled and the hole punching succeeds.
+func SecretTunnelHandler(name string, config *SecretTunnelConfig, opts ...HandlerOption) Handler {
+	if config == nil {
+		config = &SecretTunnelConfig{}
+	}
+	h := &secretTunnelHandler{
+		name:   name,
+		config: config,
+	}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *secretTunnelHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *secretTunnelHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	h.options.Logger.Logf("[stcp] %s -> %s -> %s",
+		conn.RemoteAddr(), h.options.Node.String(), h.name)
+
+	cipher, err := secretTunnelCipher(h.config.Secret)
+	if err != nil {
+		h.options.Logger.Logf("[stcp] %s -> %s : %s", conn.RemoteAddr(), h.name, err)
+		return
+	}
+
+	cc, err := h.connect()
+	if err != nil {
+		h.options.Logger.Logf("[stcp] %s -> %s : %s", conn.RemoteAddr(), h.name, err)
+		return
+	}
+	defer cc.Close()
+
+	sc, err := p2pVisit(cipher.StreamConn(cc), h.config, cipher)
+	if err != nil {
+		h.options.Logger.Logf("[stcp] %s -> %s : %s", conn.RemoteAddr(), h.name, err)
+		return
+	}
+	defer sc.Close()
+
+	h.options.Logger.Logf("[stcp] %s <-> %s", conn.RemoteAddr(), h.name)
+	transport(conn, sc)
+	h.options.Logger.Logf("[stcp] %s >-< %s", conn.RemoteAddr(), h.name)
+}
+
+func (h *secretTunnelHandler) connect() (conn net.Conn, err error) {
+	chain := h.options.Chain
+	lastNode := chain.LastNode()
+	if lastNode.Protocol != "socks5" {
+		return nil, errors.New("the last node of the chain must be SOCKS5")
+	}
+
+	conn, err = chain.Conn(
+		RetryChainOption(h.options.Retries),
+		TimeoutChainOption(h.options.Timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func(c net.Conn) {
+		if err != nil {
+			c.Close()
+		}
+	}(conn)
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if conn, err = socks5Handshake(conn, nil, lastNode.User); err != nil {
+		return nil, err
+	}
+	req := gosocks5.NewRequest(CmdSecretConnect, &gosocks5.Addr{
+		Type: gosocks5.AddrDomain,
+		Host: h.name,
+	})
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+	rep, err := gosocks5.ReadReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Rep != gosocks5.Succeeded {
+		return nil, fmt.Errorf("connect to secret tunnel %s failure: %d", h.name, rep.Rep)
+	}
+	return conn, nil
+}
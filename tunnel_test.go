@@ -0,0 +1,321 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTunnelsDial(t *testing.T) {
+	tunnels := NewTunnels("example.com")
+
+	for i, host := range []string{"", "example.com", "app1.example.com", "a.b.example.com", "app1.example.org"} {
+		if _, err := tunnels.Dial(host); err != ErrTunnelNotFound {
+			t.Errorf("#%d dial %s should failed with %v, got %v", i, host, ErrTunnelNotFound, err)
+		}
+	}
+
+	for i, name := range []string{"", "App1", "-app1", "app1.", "a.b"} {
+		if _, err := tunnels.Authorize(name, ""); err != ErrInvalidTunnelName {
+			t.Errorf("#%d authorize %s should failed with %v, got %v", i, name, ErrInvalidTunnelName, err)
+		}
+	}
+}
+
+func tunnelRoundtrip(tunnels *Tunnels, targetURL, name, token, host string, data []byte) error {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+
+	ln, err := TCPListener("")
+	if err != nil {
+		return err
+	}
+	socksServer := &Server{
+		Listener: ln,
+		Handler:  SOCKS5Handler(TunnelsHandlerOption(tunnels)),
+	}
+	go socksServer.Run()
+	defer socksServer.Close()
+
+	ln, err = TCPListener("")
+	if err != nil {
+		return err
+	}
+	vhostServer := &Server{
+		Listener: ln,
+		Handler:  VHostHandler(TunnelsHandlerOption(tunnels)),
+	}
+	go vhostServer.Run()
+	defer vhostServer.Close()
+
+	chain := NewChain(Node{
+		Protocol: "socks5",
+		Addr:     socksServer.Addr().String(),
+		Client: &Client{
+			Connector:   SOCKS5Connector(nil),
+			Transporter: TCPTransporter(),
+		},
+	})
+	ln, err = TCPRemoteTunnelListener(name, token, chain)
+	if err != nil {
+		return err
+	}
+	h := TCPRemoteForwardHandler(u.Host)
+	h.Init()
+	tunnelServer := &Server{
+		Listener: ln,
+		Handler:  h,
+	}
+	go tunnelServer.Run()
+	defer tunnelServer.Close()
+
+	// wait for the tunnel registration.
+	for i := 0; i < 10; i++ {
+		if tunnels.check(host, false) == ErrTunnelExists {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", vhostServer.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return vhostRoundtrip(conn, host, data)
+}
+
+var tunnelRoundtripTests = []struct {
+	services []TunnelService
+	name     string
+	token    string
+	host     string
+	pass     bool
+}{
+	{nil, "app1", "", "app1.example.com", true},
+	{nil, "app1", "", "app2.example.com", false},
+	{[]TunnelService{{Name: "web", Token: "123456"}}, "web", "123456", "web.example.com", true},
+	{[]TunnelService{{Name: "web", Token: "123456"}}, "web", "654321", "web.example.com", false},
+	{[]TunnelService{{Name: "web", Token: "123456"}}, "app1", "123456", "app1.example.com", false},
+	{[]TunnelService{{Name: "web", Token: "123456", Expose: "www.example.org"}}, "web", "123456", "www.example.org", true},
+	{[]TunnelService{{Name: "web", Token: "123456", Expose: "www.example.org"}}, "web", "123456", "web.example.com", false},
+}
+
+func TestTunnelRoundtrip(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for i, tc := range tunnelRoundtripTests {
+		tunnels := NewTunnels("example.com", tc.services...)
+		err := tunnelRoundtrip(tunnels, httpSrv.URL, tc.name, tc.token, tc.host, sendData)
+		if err == nil {
+			if !tc.pass {
+				t.Errorf("#%d should failed", i)
+			}
+		} else {
+			if tc.pass {
+				t.Errorf("#%d got error: %v", i, err)
+			}
+		}
+	}
+}
+
+var tunnelsAuthorizeTests = []struct {
+	name   string
+	token  string
+	expose string
+	err    error
+}{
+	{"web", "123456", "web.example.com", nil},
+	{"web", "", "", ErrTunnelUnauthorized},
+	{"web", "12345", "", ErrTunnelUnauthorized},
+	{"api", "123456", "api.example.org", nil},
+	{"app", "123456", "app1.example.com", nil},
+	{"ssh", "123456", ":2222", nil},
+	{"unknown", "123456", "", ErrTunnelUnauthorized},
+}
+
+func TestTunnelsAuthorize(t *testing.T) {
+	tunnels := NewTunnels("")
+	if tunnels.Restricted() {
+		t.Error("tunnels without services should not be restricted")
+	}
+
+	data := `
+domain example.com
+reload 10s
+web 123456
+api 123456 api.example.org
+app 123456 app1  # comment
+ssh 123456 :2222
+`
+	if err := tunnels.Reload(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !tunnels.Restricted() {
+		t.Error("tunnels with services should be restricted")
+	}
+	if tunnels.Domain() != "example.com" {
+		t.Errorf("domain should be example.com, got %s", tunnels.Domain())
+	}
+	if tunnels.Period() != 10*time.Second {
+		t.Errorf("period should be %v, got %v", 10*time.Second, tunnels.Period())
+	}
+
+	for i, tc := range tunnelsAuthorizeTests {
+		expose, err := tunnels.Authorize(tc.name, tc.token)
+		if err != tc.err {
+			t.Errorf("#%d got error %v, want %v", i, err, tc.err)
+		}
+		if expose != tc.expose {
+			t.Errorf("#%d expose should be %s, got %s", i, tc.expose, expose)
+		}
+	}
+
+	tunnels.Stop()
+	if tunnels.Period() >= 0 {
+		t.Errorf("period of the stopped reloader should be minus value")
+	}
+}
+
+// directConnHandler reports whether the connections of the secret tunnel provider are the direct P2P connections.
+type directConnHandler struct {
+	Handler
+	direct chan bool
+}
+
+func (h *directConnHandler) Handle(conn net.Conn) {
+	_, ok := conn.(*p2pConn)
+	select {
+	case h.direct <- ok:
+	default:
+	}
+	h.Handler.Handle(conn)
+}
+
+func secretTunnelRoundtrip(targetURL, providerSecret, visitorSecret string, p2p bool, data []byte) error {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+	tunnels := NewTunnels("example.com")
+
+	var rendezvous string
+	if p2p {
+		ln, err := UDPDirectForwardListener("127.0.0.1:0", 0)
+		if err != nil {
+			return err
+		}
+		server := &Server{
+			Listener: ln,
+			Handler:  RendezvousHandler(),
+		}
+		go server.Run()
+		defer server.Close()
+		rendezvous = server.Addr().String()
+	}
+
+	ln, err := TCPListener("")
+	if err != nil {
+		return err
+	}
+	socksServer := &Server{
+		Listener: ln,
+		Handler:  SOCKS5Handler(TunnelsHandlerOption(tunnels)),
+	}
+	go socksServer.Run()
+	defer socksServer.Close()
+
+	chain := NewChain(Node{
+		Protocol: "socks5",
+		Addr:     socksServer.Addr().String(),
+		Client: &Client{
+			Connector:   SOCKS5Connector(nil),
+			Transporter: TCPTransporter(),
+		},
+	})
+
+	ln, err = TCPRemoteSecretListener("db", "", &SecretTunnelConfig{Secret: providerSecret, P2P: rendezvous}, chain)
+	if err != nil {
+		return err
+	}
+	h := &directConnHandler{
+		Handler: TCPRemoteForwardHandler(u.Host),
+		direct:  make(chan bool, 1),
+	}
+	h.Init()
+	providerServer := &Server{
+		Listener: ln,
+		Handler:  h,
+	}
+	go providerServer.Run()
+	defer providerServer.Close()
+
+	ln, err = TCPListener("")
+	if err != nil {
+		return err
+	}
+	visitorServer := &Server{
+		Listener: ln,
+		Handler:  SecretTunnelHandler("db", &SecretTunnelConfig{Secret: visitorSecret, P2P: rendezvous}, ChainHandlerOption(chain)),
+	}
+	go visitorServer.Run()
+	defer visitorServer.Close()
+
+	// wait for the tunnel registration.
+	for i := 0; i < 10; i++ {
+		if tunnels.check("db", true) == ErrTunnelExists {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := tunnels.Dial("db"); err != ErrTunnelNotFound {
+		return errors.New("secret tunnel should not be exposed publicly")
+	}
+
+	conn, err := net.Dial("tcp", visitorServer.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := httpRoundtrip(conn, targetURL, data); err != nil {
+		return err
+	}
+	// the P2P connection must not fall back to the relay silently.
+	if direct := <-h.direct; direct != p2p {
+		return fmt.Errorf("the connection should be direct %v, got %v", p2p, direct)
+	}
+	return nil
+}
+
+func TestSecretTunnelRoundtrip(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	if err := secretTunnelRoundtrip(httpSrv.URL, "123456", "123456", false, sendData); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	if err := secretTunnelRoundtrip(httpSrv.URL, "123456", "654321", false, sendData); err == nil {
+		t.Errorf("secret tunnel with different secret should failed")
+	}
+	if err := secretTunnelRoundtrip(httpSrv.URL, "123456", "123456", true, sendData); err != nil {
+		t.Errorf("p2p got error: %v", err)
+	}
+}
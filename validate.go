@@ -0,0 +1,122 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// The protocol deviations detected by the Validator.
+const (
+	DeviationReserved = "rsv"      // non-zero reserved field
+	DeviationTrailing = "trailing" // trailing bytes after the message
+	DeviationLength   = "length"   // bad length field
+)
+
+var errProtocolDeviation = errors.New("protocol deviation")
+
+// Validator is the protocol validation mode of a service.
+// In strict mode, the messages deviating from the RFC are rejected,
+// otherwise the deviations are tolerated for the known broken clients, and counted.
+type Validator struct {
+	strict bool
+	counts map[string]uint64
+	mux    sync.Mutex
+}
+
+// NewValidator creates a Validator, it rejects the deviations if strict is true.
+func NewValidator(strict bool) *Validator {
+	return &Validator{
+		strict: strict,
+		counts: make(map[string]uint64),
+	}
+}
+
+// Strict reports whether the validator is in strict mode.
+func (v *Validator) Strict() bool {
+	return v != nil && v.strict
+}
+
+// Tolerate records the deviation, and reports whether it is tolerated.
+// The nil Validator tolerates all deviations without counting.
+func (v *Validator) Tolerate(deviation string) bool {
+	if v == nil {
+		return true
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if v.strict {
+		return false
+	}
+	v.counts[deviation]++
+	return true
+}
+
+// Counts returns the number of the tolerated deviations by the name.
+func (v *Validator) Counts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	if v == nil {
+		return counts
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	for k, n := range v.counts {
+		counts[k] = n
+	}
+	return counts
+}
+
+type recordReader struct {
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.buf.Write(b[:n])
+	return n, err
+}
+
+// readSOCKS5Request reads the SOCKS5 request from conn and validates it by the validator v.
+// The trailing bytes read along with the request are kept in the returned connection if tolerated.
+func readSOCKS5Request(conn net.Conn, v *Validator) (*gosocks5.Request, net.Conn, []string, error) {
+	rr := &recordReader{r: conn}
+	req, err := gosocks5.ReadRequest(rr)
+	if err != nil {
+		return nil, conn, nil, err
+	}
+
+	var deviations []string
+	raw := rr.buf.Bytes()
+	length := req.Addr.Length() // the length of the request
+	if raw[2] != 0 {
+		deviations = append(deviations, DeviationReserved)
+	}
+	if req.Addr.Type == gosocks5.AddrDomain && raw[4] == 0 {
+		deviations = append(deviations, DeviationLength)
+	}
+	if len(raw) > length {
+		deviations = append(deviations, DeviationTrailing)
+	}
+	for _, d := range deviations {
+		if !v.Tolerate(d) {
+			return nil, conn, deviations, errProtocolDeviation
+		}
+	}
+
+	if len(raw) > length {
+		br := bufio.NewReader(io.MultiReader(bytes.NewReader(raw[length:]), conn))
+		br.Peek(len(raw) - length) // buffer the trailing data, so the relay never reads around it.
+		conn = &bufferdConn{Conn: conn, br: br}
+	}
+	return req, conn, deviations, nil
+}
@@ -0,0 +1,70 @@
+package gost
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+var socks5RequestValidateTests = []struct {
+	req        []byte
+	deviations int
+}{
+	{[]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}, 0},
+	{[]byte{5, 1, 1, 1, 127, 0, 0, 1, 0, 80}, 1},
+	{[]byte{5, 1, 0, 3, 0, 0, 80}, 1},
+	{[]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80, 'G', 'E', 'T'}, 1},
+	{[]byte{5, 1, 1, 3, 0, 0, 80, 'G', 'E', 'T'}, 3},
+}
+
+func TestValidateSOCKS5Request(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		v := NewValidator(strict)
+		var total uint64
+		for i, tc := range socks5RequestValidateTests {
+			c1, c2 := net.Pipe()
+			go c2.Write(tc.req)
+
+			req, conn, deviations, err := readSOCKS5Request(c1, v)
+			if len(deviations) != tc.deviations {
+				t.Errorf("#%d should have %d deviations, got %v", i, tc.deviations, deviations)
+			}
+			if strict && tc.deviations > 0 {
+				if err == nil {
+					t.Errorf("#%d the deviation should be rejected in strict mode", i)
+				}
+				c1.Close()
+				c2.Close()
+				continue
+			}
+			if err != nil {
+				t.Fatalf("#%d %v", i, err)
+			}
+			total += uint64(tc.deviations)
+
+			// the trailing bytes are kept.
+			if n := len(tc.req) - req.Addr.Length(); n > 0 {
+				b := make([]byte, n)
+				if _, err := io.ReadFull(conn, b); err != nil || !bytes.Equal(b, tc.req[len(tc.req)-n:]) {
+					t.Errorf("#%d the trailing bytes should be kept, got %q, %v", i, b, err)
+				}
+			}
+			c1.Close()
+			c2.Close()
+		}
+
+		var n uint64
+		for _, count := range v.Counts() {
+			n += count
+		}
+		if n != total {
+			t.Errorf("strict=%v should count %d deviations, got %d", strict, total, n)
+		}
+	}
+
+	var v *Validator
+	if !v.Tolerate(DeviationReserved) || v.Strict() {
+		t.Error("nil validator should tolerate the deviations")
+	}
+}
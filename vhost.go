@@ -0,0 +1,367 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	dissector "github.com/ginuerzh/tls-dissector"
+)
+
+// VirtualHost is a backend service bound to a hostname pattern, used by the reverse proxy.
+type VirtualHost struct {
+	// Host is the hostname pattern, such as 'www.example.com', '*.example.com' or '.example.com'.
+	Host string
+	// Backend is the address of the backend service.
+	Backend string
+	// Chain is the chain used to reach the backend, the chain of the handler will be used if it is nil.
+	Chain *Chain
+	// Certificate is used to terminate the TLS connection for this host,
+	// if it is nil, the TLS connection will be passed through to the backend by SNI.
+	Certificate *tls.Certificate
+	matcher     Matcher
+}
+
+// VirtualHosts is a routing table that maps the hostnames to the backend services.
+// For each virtual host a single line should be present with the following information:
+// hostname backend [chain=name] [cert=file key=file]
+// Text from a "#" character until the end of the line is a comment, and is ignored.
+type VirtualHosts struct {
+	hosts   []VirtualHost
+	chains  map[string]*Chain
+	period  time.Duration
+	stopped chan struct{}
+	mux     sync.RWMutex
+}
+
+// NewVirtualHosts creates a VirtualHosts with optional list of virtual hosts.
+// The chains are the named chains that can be referenced by the chain option in the config.
+func NewVirtualHosts(chains map[string]*Chain, hosts ...VirtualHost) *VirtualHosts {
+	vh := &VirtualHosts{
+		chains:  chains,
+		stopped: make(chan struct{}),
+	}
+	vh.AddVirtualHost(hosts...)
+	return vh
+}
+
+// AddVirtualHost adds virtual host(s) to the routing table.
+func (vh *VirtualHosts) AddVirtualHost(hosts ...VirtualHost) {
+	vh.mux.Lock()
+	defer vh.mux.Unlock()
+
+	for _, host := range hosts {
+		host.matcher = DomainMatcher(host.Host)
+		vh.hosts = append(vh.hosts, host)
+	}
+}
+
+// Lookup searches the virtual host for the hostname host, the port of host is ignored.
+// The first matched virtual host is returned.
+func (vh *VirtualHosts) Lookup(host string) *VirtualHost {
+	if vh == nil || host == "" {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	vh.mux.RLock()
+	defer vh.mux.RUnlock()
+
+	for i := range vh.hosts {
+		if vh.hosts[i].matcher.Match(host) {
+			v := vh.hosts[i]
+			return &v
+		}
+	}
+	return nil
+}
+
+// Reload parses config from r, then live reloads the virtual hosts.
+func (vh *VirtualHosts) Reload(r io.Reader) error {
+	var period time.Duration
+	var hosts []VirtualHost
+
+	if r == nil || vh.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		ss := splitLine(line)
+		if len(ss) < 2 {
+			continue // invalid lines are ignored
+		}
+
+		switch ss[0] {
+		case "reload": // reload option
+			period, _ = time.ParseDuration(ss[1])
+		default:
+			host := VirtualHost{
+				Host:    ss[0],
+				Backend: ss[1],
+				matcher: DomainMatcher(ss[0]),
+			}
+			var certFile, keyFile string
+			for _, s := range ss[2:] {
+				kv := strings.SplitN(s, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				switch kv[0] {
+				case "chain":
+					chain, ok := vh.chains[kv[1]]
+					if !ok {
+						return fmt.Errorf("vhost %s: chain %s not found", host.Host, kv[1])
+					}
+					host.Chain = chain
+				case "cert":
+					certFile = kv[1]
+				case "key":
+					keyFile = kv[1]
+				}
+			}
+			if certFile != "" && keyFile != "" {
+				cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+				if err != nil {
+					return fmt.Errorf("vhost %s: %v", host.Host, err)
+				}
+				host.Certificate = &cert
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	vh.mux.Lock()
+	vh.period = period
+	vh.hosts = hosts
+	vh.mux.Unlock()
+
+	return nil
+}
+
+// Period returns the reload period.
+func (vh *VirtualHosts) Period() time.Duration {
+	if vh.Stopped() {
+		return -1
+	}
+
+	vh.mux.RLock()
+	defer vh.mux.RUnlock()
+
+	return vh.period
+}
+
+// Stop stops reloading.
+func (vh *VirtualHosts) Stop() {
+	select {
+	case <-vh.stopped:
+	default:
+		close(vh.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (vh *VirtualHosts) Stopped() bool {
+	select {
+	case <-vh.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+var errVHostNotFound = errors.New("unknown host")
+
+type vhostHandler struct {
+	options *HandlerOptions
+}
+
+// VHostHandler creates a server Handler for the reverse proxy server,
+// it routes the inbound HTTP requests and TLS connections to the backends by the Host header or SNI.
+// The hosts not found in the virtual hosts are routed to the public subdomain tunnels, if any.
+func VHostHandler(opts ...HandlerOption) Handler {
+	h := &vhostHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *vhostHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *vhostHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReaderSize(conn, dissector.RecordHeaderLen+0xFFFF)
+	hdr, err := br.Peek(dissector.RecordHeaderLen)
+	if err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s",
+			conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	conn = &bufferdConn{br: br, Conn: conn}
+
+	if hdr[0] != dissector.Handshake {
+		h.handleHTTP(conn, "http")
+		return
+	}
+
+	// peek the whole ClientHello record to get the server name.
+	n := int(binary.BigEndian.Uint16(hdr[3:5]))
+	b, err := br.Peek(dissector.RecordHeaderLen + n)
+	if err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s",
+			conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	_, host, err := readClientHelloRecord(bytes.NewReader(b), "", false)
+	if err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s",
+			conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+
+	if vhost := h.options.VirtualHosts.Lookup(host); vhost != nil && vhost.Certificate != nil {
+		tlsConn := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{*vhost.Certificate},
+		})
+		h.handleHTTP(tlsConn, "https")
+		return
+	}
+
+	cc, backend, err := h.dial(host)
+	if err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s (%s)",
+			conn.RemoteAddr(), conn.LocalAddr(), err, host)
+		return
+	}
+	defer cc.Close()
+
+	h.options.Logger.Logf("[vhost] %s -> %s -> %s (%s)",
+		conn.RemoteAddr(), h.options.Node.String(), backend, host)
+
+	h.options.Logger.Logf("[vhost] %s <-> %s", conn.RemoteAddr(), backend)
+	transport(conn, cc)
+	h.options.Logger.Logf("[vhost] %s >-< %s", conn.RemoteAddr(), backend)
+}
+
+func (h *vhostHandler) handleHTTP(conn net.Conn, scheme string) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s",
+			conn.RemoteAddr(), conn.LocalAddr(), err)
+		return
+	}
+	defer req.Body.Close()
+
+	if h.options.Logger.Debug() {
+		dump, _ := httputil.DumpRequest(req, false)
+		h.options.Logger.Logf("[vhost] %s -> %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+	}
+
+	cc, backend, err := h.dial(req.Host)
+	if err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s (%s)",
+			conn.RemoteAddr(), conn.LocalAddr(), err, req.Host)
+		if err == errVHostNotFound {
+			h.writeStatus(conn, http.StatusNotFound)
+		} else {
+			h.writeStatus(conn, http.StatusBadGateway)
+		}
+		return
+	}
+	defer cc.Close()
+
+	h.options.Logger.Logf("[vhost] %s -> %s -> %s (%s)",
+		conn.RemoteAddr(), h.options.Node.String(), backend, req.Host)
+
+	if ip, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		if v := req.Header.Get("X-Forwarded-For"); v != "" {
+			ip = v + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	req.Header.Set("X-Forwarded-Proto", scheme)
+	// the connection is relayed to the backend of this request, the next requests on it may be for the other hosts,
+	// so it is not kept alive, except for the protocol upgrade such as websocket which takes over the connection.
+	if req.Header.Get("Upgrade") == "" {
+		req.Header.Del("Connection")
+		req.Close = true
+	}
+
+	if err := req.Write(cc); err != nil {
+		h.options.Logger.Logf("[vhost] %s -> %s : %s",
+			conn.RemoteAddr(), backend, err)
+		return
+	}
+
+	h.options.Logger.Logf("[vhost] %s <-> %s", conn.RemoteAddr(), backend)
+	transport(&bufferdConn{Conn: conn, br: br}, cc)
+	h.options.Logger.Logf("[vhost] %s >-< %s", conn.RemoteAddr(), backend)
+}
+
+// dial connects to the backend of the host, the virtual hosts take precedence over the tunnels.
+func (h *vhostHandler) dial(host string) (net.Conn, string, error) {
+	if vhost := h.options.VirtualHosts.Lookup(host); vhost != nil {
+		chain := vhost.Chain
+		if chain == nil {
+			chain = h.options.Chain
+		}
+		cc, err := chain.Dial(vhost.Backend,
+			RetryChainOption(h.options.Retries),
+			TimeoutChainOption(h.options.Timeout),
+			HostsChainOption(h.options.Hosts),
+			ResolverChainOption(h.options.Resolver),
+			DNSPolicyChainOption(h.options.DNSPolicy),
+		)
+		return cc, vhost.Backend, err
+	}
+
+	cc, err := h.options.Tunnels.Dial(host)
+	if err == ErrTunnelNotFound {
+		err = errVHostNotFound
+	}
+	return cc, "tunnel", err
+}
+
+func (h *vhostHandler) writeStatus(conn net.Conn, code int) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	resp.Header.Set("Server", "gost/"+Version)
+	resp.Header.Set("Connection", "close")
+
+	if h.options.Logger.Debug() {
+		dump, _ := httputil.DumpResponse(resp, false)
+		h.options.Logger.Logf("[vhost] %s <- %s\n%s", conn.RemoteAddr(), conn.LocalAddr(), string(dump))
+	}
+	resp.Write(conn)
+}
@@ -0,0 +1,289 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var vhostsLookupTests = []struct {
+	hosts   []VirtualHost
+	host    string
+	backend string
+}{
+	{nil, "", ""},
+	{nil, "example.com", ""},
+	{[]VirtualHost{{Host: "example.com", Backend: "127.0.0.1:80"}}, "", ""},
+	{[]VirtualHost{{Host: "example.com", Backend: "127.0.0.1:80"}}, "example.com", "127.0.0.1:80"},
+	{[]VirtualHost{{Host: "example.com", Backend: "127.0.0.1:80"}}, "example.com:8080", "127.0.0.1:80"},
+	{[]VirtualHost{{Host: "example.com", Backend: "127.0.0.1:80"}}, "EXAMPLE.com.", "127.0.0.1:80"},
+	{[]VirtualHost{{Host: "example.com", Backend: "127.0.0.1:80"}}, "www.example.com", ""},
+	{[]VirtualHost{{Host: "*.example.com", Backend: "127.0.0.1:80"}}, "www.example.com", "127.0.0.1:80"},
+	{[]VirtualHost{{Host: "*.example.com", Backend: "127.0.0.1:80"}}, "example.com", ""},
+	{[]VirtualHost{{Host: ".example.com", Backend: "127.0.0.1:80"}}, "example.com", "127.0.0.1:80"},
+	{[]VirtualHost{{Host: ".example.com", Backend: "127.0.0.1:80"}}, "www.example.com", "127.0.0.1:80"},
+	{[]VirtualHost{
+		{Host: "www.example.com", Backend: "127.0.0.1:80"},
+		{Host: ".example.com", Backend: "127.0.0.1:8080"},
+	}, "api.example.com", "127.0.0.1:8080"},
+	{[]VirtualHost{
+		{Host: "www.example.com", Backend: "127.0.0.1:80"},
+		{Host: ".example.com", Backend: "127.0.0.1:8080"},
+	}, "www.example.com", "127.0.0.1:80"},
+}
+
+func TestVirtualHostsLookup(t *testing.T) {
+	for i, tc := range vhostsLookupTests {
+		vhosts := NewVirtualHosts(nil, tc.hosts...)
+		var backend string
+		if vh := vhosts.Lookup(tc.host); vh != nil {
+			backend = vh.Backend
+		}
+		if backend != tc.backend {
+			t.Errorf("#%d test failed: lookup should be %s, got %s", i, tc.backend, backend)
+		}
+	}
+}
+
+func TestVirtualHostsReload(t *testing.T) {
+	chain := NewChain()
+	vhosts := NewVirtualHosts(map[string]*Chain{"internal": chain})
+
+	data := `
+reload 10s
+www.example.com   127.0.0.1:80
+.example.org      127.0.0.1:8080 chain=internal  # comment
+`
+	if err := vhosts.Reload(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+	if vhosts.Period() != 10*time.Second {
+		t.Errorf("period should be %v, got %v", 10*time.Second, vhosts.Period())
+	}
+	if vh := vhosts.Lookup("www.example.com"); vh == nil || vh.Backend != "127.0.0.1:80" || vh.Chain != nil {
+		t.Errorf("unexpected lookup result for www.example.com: %+v", vh)
+	}
+	if vh := vhosts.Lookup("api.example.org"); vh == nil || vh.Backend != "127.0.0.1:8080" || vh.Chain != chain {
+		t.Errorf("unexpected lookup result for api.example.org: %+v", vh)
+	}
+
+	if err := vhosts.Reload(bytes.NewBufferString("www.example.com 127.0.0.1:80 chain=notfound")); err == nil {
+		t.Errorf("reload with unknown chain should failed")
+	}
+	if vh := vhosts.Lookup("api.example.org"); vh == nil {
+		t.Errorf("failed reload should keep the previous virtual hosts")
+	}
+
+	vhosts.Stop()
+	if vhosts.Period() >= 0 {
+		t.Errorf("period of the stopped reloader should be minus value")
+	}
+}
+
+func vhostRoundtrip(conn net.Conn, host string, data []byte) error {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err = req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	recv, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, recv) {
+		return fmt.Errorf("data not equal")
+	}
+	return nil
+}
+
+func vhostServer(hosts ...VirtualHost) (*Server, error) {
+	ln, err := TCPListener("")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{
+		Listener: ln,
+		Handler: VHostHandler(
+			VirtualHostsHandlerOption(NewVirtualHosts(nil, hosts...)),
+		),
+	}
+	go server.Run()
+	return server, nil
+}
+
+func TestVHostHTTP(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+	u, _ := url.Parse(httpSrv.URL)
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	server, err := vhostServer(VirtualHost{Host: "www.example.com", Backend: u.Host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for i, tc := range []struct {
+		host   string
+		errStr string
+	}{
+		{"www.example.com", ""},
+		{"www.example.com:8080", ""},
+		{"api.example.com", "404 Not Found"},
+	} {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = vhostRoundtrip(conn, tc.host, sendData)
+		conn.Close()
+		if tc.errStr == "" && err != nil {
+			t.Errorf("#%d got error: %v", i, err)
+		}
+		if tc.errStr != "" && (err == nil || err.Error() != tc.errStr) {
+			t.Errorf("#%d got error %v, want %v", i, err, tc.errStr)
+		}
+	}
+}
+
+func TestVHostHTTPKeepAlive(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	srv1, srv2 := backend("www"), backend("api")
+	defer srv1.Close()
+	defer srv2.Close()
+	u1, _ := url.Parse(srv1.URL)
+	u2, _ := url.Parse(srv2.URL)
+
+	server, err := vhostServer(
+		VirtualHost{Host: "www.example.com", Backend: u1.Host},
+		VirtualHost{Host: "api.example.com", Backend: u2.Host},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	br := bufio.NewReader(conn)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("Connection", "keep-alive")
+	req.Write(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "www" || !resp.Close {
+		t.Fatalf("the response should be of the host www and close the connection, got %q, close %v", body, resp.Close)
+	}
+
+	// the request for the other host is not relayed to the backend of the first one.
+	req, _ = http.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	req.Write(conn)
+	if resp, err = http.ReadResponse(br, req); err == nil {
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Errorf("the connection should be closed, got %q", body)
+	}
+}
+
+func TestVHostTLSTermination(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+	u, _ := url.Parse(httpSrv.URL)
+
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	server, err := vhostServer(VirtualHost{Host: "www.example.com", Backend: u.Host, Certificate: &cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn = tls.Client(conn, &tls.Config{
+		ServerName:         "www.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err := vhostRoundtrip(conn, "www.example.com", sendData); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVHostTLSPassthrough(t *testing.T) {
+	httpSrv := httptest.NewTLSServer(httpTestHandler)
+	defer httpSrv.Close()
+	u, _ := url.Parse(httpSrv.URL)
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	server, err := vhostServer(VirtualHost{Host: "www.example.com", Backend: u.Host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn = tls.Client(conn, &tls.Config{
+		ServerName:         "www.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err := vhostRoundtrip(conn, "www.example.com", sendData); err != nil {
+		t.Error(err)
+	}
+}
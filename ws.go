@@ -95,24 +95,27 @@ func (tr *mwsTransporter) Dial(addr string, options ...DialOption) (conn net.Con
 		delete(tr.sessions, addr)
 		ok = false
 	}
+	if ok && !session.reserve(opts.MaxStreams) {
+		if session.session != nil {
+			session.retire() // the pending session is retired by its Handshake
+		}
+		delete(tr.sessions, addr)
+		ok = false // session is full
+	}
 	if !ok {
 		timeout := opts.Timeout
 		if timeout <= 0 {
 			timeout = DialTimeout
 		}
 
-		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
-		} else {
-			conn, err = opts.Chain.Dial(addr)
-		}
+		conn, err = opts.dial(addr, timeout)
 		if err != nil {
 			return
 		}
-		session = &muxSession{conn: conn}
+		session = &muxSession{conn: conn, pending: 1} // the stream being dialed
 		tr.sessions[addr] = session
 	}
-	return session.conn, nil
+	return newMuxDialConn(session, &tr.sessionMutex), nil
 }
 
 func (tr *mwsTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
@@ -133,6 +136,10 @@ func (tr *mwsTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (
 	defer conn.SetDeadline(time.Time{})
 
 	session, ok := tr.sessions[opts.Addr]
+	if dc, dialed := conn.(*muxDialConn); dialed {
+		conn, session = dc.handshake() // the session on which Dial reserved the stream
+		ok = true
+	}
 	if !ok || session.session == nil {
 		s, err := tr.initSession(opts.Addr, conn, opts)
 		if err != nil {
@@ -140,8 +147,15 @@ func (tr *mwsTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (
 			delete(tr.sessions, opts.Addr)
 			return nil, err
 		}
-		session = s
-		tr.sessions[opts.Addr] = session
+		if !ok {
+			session = s
+			tr.sessions[opts.Addr] = session
+		} else {
+			session.conn, session.session = s.conn, s.session
+			if tr.sessions[opts.Addr] != session {
+				session.retire() // the session is replaced after Dial
+			}
+		}
 	}
 
 	cc, err := session.GetConn()
@@ -175,8 +189,7 @@ func (tr *mwsTransporter) initSession(addr string, conn net.Conn, opts *Handshak
 		return nil, err
 	}
 	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
-	session, err := smux.Client(conn, smuxConfig)
+	session, err := smux.Client(conn, muxConfig(opts.Interval))
 	if err != nil {
 		return nil, err
 	}
@@ -252,24 +265,27 @@ func (tr *mwssTransporter) Dial(addr string, options ...DialOption) (conn net.Co
 		delete(tr.sessions, addr)
 		ok = false
 	}
+	if ok && !session.reserve(opts.MaxStreams) {
+		if session.session != nil {
+			session.retire() // the pending session is retired by its Handshake
+		}
+		delete(tr.sessions, addr)
+		ok = false // session is full
+	}
 	if !ok {
 		timeout := opts.Timeout
 		if timeout <= 0 {
 			timeout = DialTimeout
 		}
 
-		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
-		} else {
-			conn, err = opts.Chain.Dial(addr)
-		}
+		conn, err = opts.dial(addr, timeout)
 		if err != nil {
 			return
 		}
-		session = &muxSession{conn: conn}
+		session = &muxSession{conn: conn, pending: 1} // the stream being dialed
 		tr.sessions[addr] = session
 	}
-	return session.conn, nil
+	return newMuxDialConn(session, &tr.sessionMutex), nil
 }
 
 func (tr *mwssTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
@@ -290,6 +306,10 @@ func (tr *mwssTransporter) Handshake(conn net.Conn, options ...HandshakeOption)
 	defer conn.SetDeadline(time.Time{})
 
 	session, ok := tr.sessions[opts.Addr]
+	if dc, dialed := conn.(*muxDialConn); dialed {
+		conn, session = dc.handshake() // the session on which Dial reserved the stream
+		ok = true
+	}
 	if !ok || session.session == nil {
 		s, err := tr.initSession(opts.Addr, conn, opts)
 		if err != nil {
@@ -297,8 +317,15 @@ func (tr *mwssTransporter) Handshake(conn net.Conn, options ...HandshakeOption)
 			delete(tr.sessions, opts.Addr)
 			return nil, err
 		}
-		session = s
-		tr.sessions[opts.Addr] = session
+		if !ok {
+			session = s
+			tr.sessions[opts.Addr] = session
+		} else {
+			session.conn, session.session = s.conn, s.session
+			if tr.sessions[opts.Addr] != session {
+				session.retire() // the session is replaced after Dial
+			}
+		}
 	}
 	cc, err := session.GetConn()
 	if err != nil {
@@ -335,8 +362,7 @@ func (tr *mwssTransporter) initSession(addr string, conn net.Conn, opts *Handsha
 		return nil, err
 	}
 	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
-	session, err := smux.Client(conn, smuxConfig)
+	session, err := smux.Client(conn, muxConfig(opts.Interval))
 	if err != nil {
 		return nil, err
 	}
@@ -523,8 +549,7 @@ func (l *mwsListener) upgrade(w http.ResponseWriter, r *http.Request) {
 }
 
 func (l *mwsListener) mux(conn net.Conn) {
-	smuxConfig := smux.DefaultConfig()
-	mux, err := smux.Server(conn, smuxConfig)
+	mux, err := smux.Server(conn, muxServerConfig(0))
 	if err != nil {
 		log.Logf("[mws] %s - %s : %s", conn.RemoteAddr(), l.Addr(), err)
 		return